@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/order_load"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// ChargebackRequest is a chargeback received by the API, with the fields of the CSV files
+// Without an amount what is left of the order is charged back
+type ChargebackRequest struct {
+	ID        string  `json:"id"`
+	OrderID   string  `json:"order_id"`
+	Amount    float64 `json:"amount,omitempty"`
+	CreatedAt string  `json:"created_at"`
+	Reason    string  `json:"reason,omitempty"`
+}
+
+// ChargebackResult is the outcome of a chargeback received
+// A duplicate chargeback reports the amounts of the chargeback already imported
+type ChargebackResult struct {
+	ID     string  `json:"id"`
+	Status string  `json:"status"`
+	Amount float64 `json:"amount,omitempty"`
+	Fee    float64 `json:"fee,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// ChargebackBatchResult is the outcome of a batch of chargebacks, in the order they were received
+type ChargebackBatchResult struct {
+	Results    []ChargebackResult `json:"results"`
+	Created    int                `json:"created"`
+	Duplicates int                `json:"duplicates"`
+	Rejected   int                `json:"rejected"`
+}
+
+// importChargebacks imports a chargeback or a list of chargebacks, returning the status code and body of the response
+func (s *Server) importChargebacks(ctx context.Context, body []byte) (int, any, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return 0, nil, badRequest("missing chargebacks")
+	}
+
+	switch body[0] {
+	case '{':
+		var request ChargebackRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			return 0, nil, badRequest("invalid chargeback: %v", err)
+		}
+
+		result, err := s.importChargeback(ctx, request)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch result.Status {
+		case OrderCreated:
+			return http.StatusCreated, result, nil
+		case OrderRejected:
+			return http.StatusUnprocessableEntity, result, nil
+		default:
+			return http.StatusOK, result, nil
+		}
+
+	case '[':
+		var requests []ChargebackRequest
+		if err := json.Unmarshal(body, &requests); err != nil {
+			return 0, nil, badRequest("invalid chargebacks: %v", err)
+		}
+		if len(requests) == 0 {
+			return 0, nil, badRequest("missing chargebacks")
+		}
+		if len(requests) > MaxOrdersBatch {
+			return 0, nil, badRequest("%d chargebacks, expected %d at most", len(requests), MaxOrdersBatch)
+		}
+
+		batch := ChargebackBatchResult{Results: make([]ChargebackResult, 0, len(requests))}
+		for _, request := range requests {
+			result, err := s.importChargeback(ctx, request)
+			if err != nil {
+				return 0, nil, err
+			}
+
+			batch.Results = append(batch.Results, result)
+			switch result.Status {
+			case OrderCreated:
+				batch.Created++
+			case OrderDuplicate:
+				batch.Duplicates++
+			case OrderRejected:
+				batch.Rejected++
+			}
+		}
+		return http.StatusOK, batch, nil
+
+	default:
+		return 0, nil, badRequest("expected a chargeback or a list of chargebacks")
+	}
+}
+
+// importChargeback validates a chargeback like the CSV loader does, and inserts it unless it already exists
+// Invalid chargebacks are rejected, only the errors of the database fail the request
+func (s *Server) importChargeback(ctx context.Context, request ChargebackRequest) (ChargebackResult, error) {
+	result := ChargebackResult{ID: request.ID}
+	logger := s.logger.With(system.LogChargebackIDKey, request.ID, system.LogOrderIDKey, request.OrderID)
+
+	// A known chargeback is a duplicate, even if building it again would exceed its order
+	if request.ID != "" {
+		existingChargeback, err := s.querier.SelectChargeback(ctx, request.ID)
+		if err != nil {
+			return result, fmt.Errorf("error checking if chargeback exists: %w", err)
+		}
+		if existingChargeback != nil {
+			logger.Info("chargeback already exists", system.LogMerchantIDKey, existingChargeback.MerchantID)
+			metrics.ChargebacksReceived.WithLabelValues(metrics.ResultDuplicate).Inc()
+
+			result.Status = OrderDuplicate
+			result.Amount = round(existingChargeback.Amount)
+			result.Fee = round(existingChargeback.Fee)
+			return result, nil
+		}
+	}
+
+	chargeback, err := s.chargebacks.Build(ctx, order_load.NewChargeback{
+		ID:        request.ID,
+		OrderID:   request.OrderID,
+		Amount:    request.Amount,
+		CreatedAt: request.CreatedAt,
+		Reason:    request.Reason,
+	})
+	if errors.Is(err, order_load.ErrorInvalidChargeback) {
+		logger.Info("chargeback rejected", system.LogErrorKey, err)
+		metrics.ChargebacksReceived.WithLabelValues(metrics.ResultRejected).Inc()
+
+		result.Status = OrderRejected
+		result.Error = err.Error()
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	// Another refund or chargeback of the order could have been imported since the chargeback was built
+	err = s.querier.InsertChargeback(ctx, *chargeback)
+	if errors.Is(err, database.ErrorOrderAmountExceeded) {
+		logger.Info("chargeback rejected", system.LogErrorKey, err)
+		metrics.ChargebacksReceived.WithLabelValues(metrics.ResultRejected).Inc()
+
+		result.Status = OrderRejected
+		result.Error = fmt.Errorf("%w: %v", order_load.ErrorInvalidChargeback, err).Error()
+		return result, nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("error inserting chargeback: %w", err)
+	}
+	logger.Info("chargeback imported", system.LogMerchantIDKey, chargeback.MerchantID)
+	metrics.ChargebacksReceived.WithLabelValues(metrics.ResultImported).Inc()
+
+	result.Status = OrderCreated
+	result.Amount = round(chargeback.Amount)
+	result.Fee = round(chargeback.Fee)
+	return result, nil
+}
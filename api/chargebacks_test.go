@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// expectChargebacks mocks a refunded order and an existing chargeback of it, every other chargeback is new
+func expectChargebacks(mockQuerier *mock.Mock, merchant entities.Merchant) {
+	order := entities.Order{ID: "e653f3e14bc4", MerchantID: merchant.ID, Amount: 100, FeeAmount: 0.95, CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)}
+	refund := entities.Refund{ID: "r-0", OrderID: order.ID, MerchantID: merchant.ID, Amount: 20, FeeReversal: 0.19, CreatedAt: order.CreatedAt}
+	existing := entities.Chargeback{ID: "existing", OrderID: order.ID, MerchantID: merchant.ID, Amount: 30, Fee: 15, CreatedAt: order.CreatedAt}
+
+	mockQuerier.On("SelectOrder", mock.Anything, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectOrder", mock.Anything, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectChargeback", mock.Anything, existing.ID).Return(&existing, nil)
+	mockQuerier.On("SelectChargeback", mock.Anything, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectOrderRefunds", mock.Anything, order.ID).Return([]entities.Refund{refund}, nil)
+	mockQuerier.On("SelectOrderChargebacks", mock.Anything, order.ID).Return([]entities.Chargeback{existing}, nil)
+	mockQuerier.On("InsertChargeback", mock.Anything, mock.Anything).Return(nil)
+}
+
+func TestPostChargeback(t *testing.T) {
+	merchant := testMerchant()
+	mockQuerier := test_helpers.NewMockQuerier()
+	expectChargebacks(&mockQuerier.Mock, merchant)
+	server := NewServer(mockQuerier)
+
+	var result ChargebackResult
+	recorder := postTo(t, server, "/chargebacks", `{"id":"cb-1","order_id":"e653f3e14bc4","amount":20,"created_at":"2023-02-10","reason":"fraud"}`, "")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, ChargebackResult{ID: "cb-1", Status: OrderCreated, Amount: 20, Fee: system.DefaultChargebackFee}, result)
+
+	mockQuerier.AssertCalled(t, "InsertChargeback", mock.Anything, mock.MatchedBy(func(chargeback entities.Chargeback) bool {
+		return chargeback.ID == "cb-1" && chargeback.MerchantID == merchant.ID && chargeback.Amount == 20 && chargeback.Reason == "fraud"
+	}))
+
+	// Without an amount, what is left once refunded and charged back is charged back
+	recorder = postTo(t, server, "/chargebacks", `{"id":"cb-2","order_id":"e653f3e14bc4","created_at":"2023-02-10"}`, "")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, 50.0, result.Amount)
+
+	// A duplicate is not built again
+	recorder = postTo(t, server, "/chargebacks", `{"id":"existing","order_id":"e653f3e14bc4","amount":30,"created_at":"2023-02-01"}`, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, ChargebackResult{ID: "existing", Status: OrderDuplicate, Amount: 30, Fee: 15}, result)
+
+	recorder = postTo(t, server, "/chargebacks", `[
+		{"id":"cb-3","order_id":"e653f3e14bc4","amount":60,"created_at":"2023-02-10"},
+		{"id":"cb-4","order_id":"unknown","amount":10,"created_at":"2023-02-10"}
+	]`, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var batch ChargebackBatchResult
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Equal(t, 2, batch.Rejected)
+	require.Contains(t, batch.Results[0].Error, "exceeds the 50.00 left to charge back")
+	require.Contains(t, batch.Results[1].Error, `unknown order "unknown"`)
+
+	mockQuerier.AssertNumberOfCalls(t, "InsertChargeback", 2)
+}
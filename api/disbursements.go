@@ -0,0 +1,420 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/disbursement_status"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// Disbursement is a disbursement as returned by the API
+type Disbursement struct {
+	Reference               string    `json:"reference"`
+	Merchant                string    `json:"merchant"`
+	Currency                string    `json:"currency"`
+	Frequency               string    `json:"frequency"`
+	OrdersStartAt           string    `json:"orders_start_at"`
+	OrdersEndAt             string    `json:"orders_end_at"`
+	OrdersTotalEntries      int       `json:"orders_total_entries"`
+	OrdersSumAmount         float64   `json:"orders_sum_amount"`
+	FeeAmount               float64   `json:"fee_amount"`
+	FeeAmountCorrection     float64   `json:"fee_amount_correction"`
+	RefundsTotalEntries     int       `json:"refunds_total_entries"`
+	RefundsAmount           float64   `json:"refunds_amount"`
+	FeeReversalAmount       float64   `json:"fee_reversal_amount"`
+	ChargebacksTotalEntries int       `json:"chargebacks_total_entries"`
+	ChargebacksAmount       float64   `json:"chargebacks_amount"`
+	ChargebackFeeAmount     float64   `json:"chargeback_fee_amount"`
+	CarriedAmount           float64   `json:"carried_amount"`       // Debt of the merchant deducted
+	CarryForwardAmount      float64   `json:"carry_forward_amount"` // Still owed by the merchant, deducted from its next disbursement
+	NetAmount               float64   `json:"net_amount"`
+	Status                  string    `json:"status"`
+	StatusChangedAt         time.Time `json:"status_changed_at"`
+	CreatedAt               time.Time `json:"created_at"`
+}
+
+// DisbursementPage is a page of a disbursements list
+type DisbursementPage struct {
+	Data     []Disbursement `json:"data"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"page_size"`
+	Total    int64          `json:"total"`
+}
+
+// DisbursementDetail is a disbursement with the orders, refunds and chargebacks it covers, its fees and its status history
+type DisbursementDetail struct {
+	Disbursement
+	Fees          Fees           `json:"fees"`
+	Orders        []Order        `json:"orders"`
+	Refunds       []Refund       `json:"refunds"`
+	Chargebacks   []Chargeback   `json:"chargebacks"`
+	StatusHistory []StatusChange `json:"status_history"`
+}
+
+// StatusChange is a change of the payout status of a disbursement
+type StatusChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Fees details what is charged to the merchant in a disbursement
+type Fees struct {
+	OrdersFeeAmount   float64 `json:"orders_fee_amount"`
+	MonthlyCorrection float64 `json:"minimum_monthly_fee_correction"`
+	RefundsReversal   float64 `json:"refunds_fee_reversal"` // Given back for the refunded orders
+	Chargebacks       float64 `json:"chargeback_fees"`
+	Total             float64 `json:"total"`
+}
+
+// Order is an order included in a disbursement
+type Order struct {
+	ID        string  `json:"id"`
+	Amount    float64 `json:"amount"`
+	FeeAmount float64 `json:"fee_amount"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// Refund is a refund deducted in a disbursement
+type Refund struct {
+	ID          string  `json:"id"`
+	OrderID     string  `json:"order_id"`
+	Amount      float64 `json:"amount"`
+	FeeReversal float64 `json:"fee_reversal"`
+	CreatedAt   string  `json:"created_at"`
+	DeductedOn  string  `json:"deducted_on"`
+}
+
+// Chargeback is a chargeback deducted in a disbursement
+type Chargeback struct {
+	ID         string  `json:"id"`
+	OrderID    string  `json:"order_id"`
+	Amount     float64 `json:"amount"`
+	Fee        float64 `json:"fee"`
+	Reason     string  `json:"reason,omitempty"`
+	CreatedAt  string  `json:"created_at"`
+	DeductedOn string  `json:"deducted_on"`
+}
+
+// Error is the body of the error responses
+type Error struct {
+	Error string `json:"error"`
+}
+
+// listDisbursements handles GET /disbursements
+// Parameters: merchant, frequency, status, from, to, page and page_size
+func (s *Server) listDisbursements(r *http.Request) (any, error) {
+	query := r.URL.Query()
+
+	filter, page, err := parseListParameters(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if reference := query.Get("merchant"); reference != "" {
+		merchant, err := s.querier.SelectMerchantByReference(r.Context(), reference)
+		if err != nil {
+			return nil, err
+		}
+		if merchant == nil {
+			return nil, badRequest("unknown merchant %q", reference)
+		}
+		filter.MerchantID = merchant.ID
+	}
+
+	return s.disbursementPage(r.Context(), filter, page)
+}
+
+// listMerchantDisbursements handles GET /merchants/{reference}/disbursements
+func (s *Server) listMerchantDisbursements(r *http.Request) (any, error) {
+	reference := pathParameter(r.URL.Path, "/merchants/", "/disbursements")
+	if reference == "" {
+		return nil, ErrorNotFound
+	}
+
+	filter, page, err := parseListParameters(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	merchant, err := s.querier.SelectMerchantByReference(r.Context(), reference)
+	if err != nil {
+		return nil, err
+	}
+	if merchant == nil {
+		return nil, fmt.Errorf("merchant %q %w", reference, ErrorNotFound)
+	}
+	filter.MerchantID = merchant.ID
+
+	return s.disbursementPage(r.Context(), filter, page)
+}
+
+func (s *Server) disbursementPage(ctx context.Context, filter entities.DisbursementFilter, page int) (*DisbursementPage, error) {
+	disbursements, err := s.querier.SelectDisbursements(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := s.querier.CountDisbursements(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	merchants, err := s.merchantReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DisbursementPage{
+		Data:     make([]Disbursement, 0, len(disbursements)),
+		Page:     page,
+		PageSize: filter.Limit,
+		Total:    total,
+	}
+	for _, disbursement := range disbursements {
+		result.Data = append(result.Data, newDisbursement(disbursement, merchants[disbursement.MerchantID]))
+	}
+
+	return result, nil
+}
+
+// showDisbursement handles GET /disbursements/{reference}
+// The orders of a disbursement are the disbursed orders of the merchant in its period
+func (s *Server) showDisbursement(r *http.Request) (any, error) {
+	reference := pathParameter(r.URL.Path, "/disbursements/", "")
+	if reference == "" {
+		return nil, ErrorNotFound
+	}
+
+	disbursement, err := s.querier.SelectDisbursementByReference(r.Context(), reference)
+	if err != nil {
+		return nil, err
+	}
+	if disbursement == nil {
+		return nil, fmt.Errorf("disbursement %q %w", reference, ErrorNotFound)
+	}
+
+	merchant, err := s.querier.SelectMerchant(r.Context(), disbursement.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	merchantReference := ""
+	if merchant != nil {
+		merchantReference = merchant.Reference
+	}
+
+	orders, err := s.querier.SelectDisbursedOrders(r.Context(), disbursement.MerchantID, disbursement.OrdersStartAt, disbursement.OrdersEndAt)
+	if err != nil {
+		return nil, err
+	}
+
+	refunds, err := s.querier.SelectDeductedRefunds(r.Context(), disbursement.MerchantID, disbursement.OrdersStartAt, disbursement.OrdersEndAt)
+	if err != nil {
+		return nil, err
+	}
+
+	chargebacks, err := s.querier.SelectDeductedChargebacks(r.Context(), disbursement.MerchantID, disbursement.OrdersStartAt, disbursement.OrdersEndAt)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := s.querier.SelectDisbursementStatusChanges(r.Context(), disbursement.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &DisbursementDetail{
+		Disbursement: newDisbursement(*disbursement, merchantReference),
+		Fees: Fees{
+			OrdersFeeAmount:   round(disbursement.FeeAmount),
+			MonthlyCorrection: round(disbursement.FeeAmountCorrection),
+			RefundsReversal:   round(disbursement.FeeReversalAmount),
+			Chargebacks:       round(disbursement.ChargebackFeeAmount),
+			Total: round(disbursement.FeeAmount + disbursement.FeeAmountCorrection - disbursement.FeeReversalAmount +
+				disbursement.ChargebackFeeAmount),
+		},
+		Orders:        make([]Order, 0, len(orders)),
+		Refunds:       make([]Refund, 0, len(refunds)),
+		Chargebacks:   make([]Chargeback, 0, len(chargebacks)),
+		StatusHistory: make([]StatusChange, 0, len(changes)),
+	}
+	for _, order := range orders {
+		detail.Orders = append(detail.Orders, Order{
+			ID:        order.ID,
+			Amount:    round(order.Amount),
+			FeeAmount: round(order.FeeAmount),
+			CreatedAt: order.CreatedAt.Format(time.DateOnly),
+		})
+	}
+	for _, refund := range refunds {
+		deductedOn := ""
+		if refund.DeductedOn != nil {
+			deductedOn = refund.DeductedOn.Format(time.DateOnly)
+		}
+		detail.Refunds = append(detail.Refunds, Refund{
+			ID:          refund.ID,
+			OrderID:     refund.OrderID,
+			Amount:      round(refund.Amount),
+			FeeReversal: round(refund.FeeReversal),
+			CreatedAt:   refund.CreatedAt.Format(time.DateOnly),
+			DeductedOn:  deductedOn,
+		})
+	}
+	for _, chargeback := range chargebacks {
+		deductedOn := ""
+		if chargeback.DeductedOn != nil {
+			deductedOn = chargeback.DeductedOn.Format(time.DateOnly)
+		}
+		detail.Chargebacks = append(detail.Chargebacks, Chargeback{
+			ID:         chargeback.ID,
+			OrderID:    chargeback.OrderID,
+			Amount:     round(chargeback.Amount),
+			Fee:        round(chargeback.Fee),
+			Reason:     chargeback.Reason,
+			CreatedAt:  chargeback.CreatedAt.Format(time.DateOnly),
+			DeductedOn: deductedOn,
+		})
+	}
+
+	for _, change := range changes {
+		detail.StatusHistory = append(detail.StatusHistory, StatusChange{
+			From:      string(change.FromStatus),
+			To:        string(change.ToStatus),
+			Reason:    change.Reason,
+			ChangedAt: change.ChangedAt,
+		})
+	}
+
+	return detail, nil
+}
+
+// merchantReferences maps the merchant IDs to their references
+func (s *Server) merchantReferences(ctx context.Context) (map[uuid.UUID]string, error) {
+	merchants, err := s.querier.SelectMerchants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	references := make(map[uuid.UUID]string, len(merchants))
+	for _, merchant := range merchants {
+		references[merchant.ID] = merchant.Reference
+	}
+	return references, nil
+}
+
+// parseListParameters parses the filters and paging of the disbursements lists
+func parseListParameters(query url.Values) (entities.DisbursementFilter, int, error) {
+	var filter entities.DisbursementFilter
+
+	switch frequency := entities.DisbursementFrequencies(query.Get("frequency")); frequency {
+	case "":
+	case entities.DailyDisbursementFrequency, entities.WeeklyDisbursementFrequency, entities.MonthlyDisbursementFrequency:
+		filter.Frequency = frequency
+	default:
+		return filter, 0, badRequest("invalid frequency %q, expected daily, weekly or monthly", frequency)
+	}
+
+	if status := query.Get("status"); status != "" {
+		var err error
+		filter.Status, err = disbursement_status.ParseStatus(status)
+		if err != nil {
+			return filter, 0, badRequest("invalid status: %s", err)
+		}
+	}
+
+	var err error
+	filter.From, err = parseDate(query, "from")
+	if err != nil {
+		return filter, 0, err
+	}
+	filter.To, err = parseDate(query, "to")
+	if err != nil {
+		return filter, 0, err
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.To.Before(filter.From) {
+		return filter, 0, badRequest("to %s is before from %s", filter.To.Format(time.DateOnly), filter.From.Format(time.DateOnly))
+	}
+
+	page, err := parsePositive(query, "page", 1, math.MaxInt32)
+	if err != nil {
+		return filter, 0, err
+	}
+	filter.Limit, err = parsePositive(query, "page_size", DefaultPageSize, MaxPageSize)
+	if err != nil {
+		return filter, 0, err
+	}
+	filter.Offset = (page - 1) * filter.Limit
+
+	return filter, page, nil
+}
+
+func parseDate(query url.Values, name string) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, badRequest("invalid %s %q, expected a date like 2023-01-31", name, value)
+	}
+	return date, nil
+}
+
+func parsePositive(query url.Values, name string, defaultValue, maxValue int) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 || number > maxValue {
+		return 0, badRequest("invalid %s %q, expected a number from 1 to %d", name, value, maxValue)
+	}
+	return number, nil
+}
+
+func newDisbursement(disbursement entities.MerchantDisbursement, merchant string) Disbursement {
+	return Disbursement{
+		Reference:               disbursement.Reference,
+		Merchant:                merchant,
+		Currency:                disbursement.Currency,
+		Frequency:               string(disbursement.DisbursementFrequency),
+		OrdersStartAt:           disbursement.OrdersStartAt.Format(time.DateOnly),
+		OrdersEndAt:             disbursement.OrdersEndAt.Format(time.DateOnly),
+		OrdersTotalEntries:      disbursement.OrdersTotalEntries,
+		OrdersSumAmount:         round(disbursement.OrdersSumAmount),
+		FeeAmount:               round(disbursement.FeeAmount),
+		FeeAmountCorrection:     round(disbursement.FeeAmountCorrection),
+		RefundsTotalEntries:     disbursement.RefundsTotalEntries,
+		RefundsAmount:           round(disbursement.RefundsAmount),
+		FeeReversalAmount:       round(disbursement.FeeReversalAmount),
+		ChargebacksTotalEntries: disbursement.ChargebacksTotalEntries,
+		ChargebacksAmount:       round(disbursement.ChargebacksAmount),
+		ChargebackFeeAmount:     round(disbursement.ChargebackFeeAmount),
+		CarriedAmount:           round(disbursement.CarriedAmount),
+		CarryForwardAmount:      round(disbursement.CarryForwardAmount),
+		NetAmount:               round(disbursement.NetAmount),
+		Status:                  string(disbursement.Status),
+		StatusChangedAt:         disbursement.StatusChangedAt(),
+		CreatedAt:               disbursement.CreatedAt,
+	}
+}
+
+// round rounds an amount to cents
+func round(amount float64) float64 {
+	return entities.RoundAmount(amount)
+}
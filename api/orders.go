@@ -0,0 +1,300 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/order_load"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+const (
+	// MaxOrdersBatch is the maximum number of orders, refunds or chargebacks, of a batch
+	MaxOrdersBatch = 1000
+
+	// IdempotencyKeyHeader identifies a request, so it can be retried safely
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader is set on the responses replayed for a known idempotency key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+	maxOrdersBodyBytes      = 1 << 20
+)
+
+// Status of the orders, refunds and chargebacks received
+const (
+	OrderCreated   = "created"
+	OrderDuplicate = "duplicate"
+	OrderRejected  = "rejected"
+)
+
+// OrderRequest is an order received by the API, with the fields of the CSV files
+type OrderRequest struct {
+	ID                string  `json:"id"`
+	MerchantReference string  `json:"merchant_reference"`
+	Amount            float64 `json:"amount"`
+	CreatedAt         string  `json:"created_at"`
+	Currency          string  `json:"currency,omitempty"` // In euros when not given
+}
+
+// OrderResult is the outcome of an order received
+// A duplicate order reports the fee of the order already imported
+type OrderResult struct {
+	ID        string  `json:"id"`
+	Status    string  `json:"status"`
+	FeeAmount float64 `json:"fee_amount,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// OrderBatchResult is the outcome of a batch of orders, in the order they were received
+type OrderBatchResult struct {
+	Results    []OrderResult `json:"results"`
+	Created    int           `json:"created"`
+	Duplicates int           `json:"duplicates"`
+	Rejected   int           `json:"rejected"`
+}
+
+// importFunc imports the body of a request, returning the status code and body of the response
+type importFunc func(ctx context.Context, body []byte) (int, any, error)
+
+// postImport handles the POST of the orders, refunds and chargebacks, with one or a list of them
+// One responds 201 when created, 200 when it already exists and 422 when rejected
+// A list responds 200 with the result of each
+// Requests with an Idempotency-Key are answered once, and their response is replayed on retries
+// The key is reserved before the request is processed, so concurrent retries are not processed twice
+func (s *Server) postImport(importer importFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSON(w, http.StatusMethodNotAllowed, Error{Error: "method not allowed"})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOrdersBodyBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeJSON(w, http.StatusRequestEntityTooLarge, Error{Error: fmt.Sprintf("body larger than %d bytes", maxOrdersBodyBytes)})
+				return
+			}
+			s.writeError(w, r, badRequest("error reading body: %v", err))
+			return
+		}
+
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if len(key) > maxIdempotencyKeyLength {
+			s.writeError(w, r, badRequest("%s longer than %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+		hash := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(hash[:])
+
+		if key != "" {
+			reserved, err := s.querier.ReserveIdempotencyKey(r.Context(), key, requestHash)
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+			if !reserved {
+				stored, err := s.querier.SelectIdempotencyKey(r.Context(), key)
+				if err != nil {
+					s.writeError(w, r, err)
+					return
+				}
+				s.replay(w, key, stored, requestHash)
+				return
+			}
+		}
+
+		code, response, err := importer(r.Context(), body)
+		var encoded []byte
+		if err == nil {
+			encoded, err = json.Marshal(response)
+		}
+		if err != nil {
+			s.release(key)
+			s.writeError(w, r, err)
+			return
+		}
+		encoded = append(encoded, '\n')
+
+		if key != "" {
+			err = s.querier.CompleteIdempotencyKey(r.Context(), entities.IdempotencyKey{
+				Key:         key,
+				RequestHash: requestHash,
+				StatusCode:  code,
+				Response:    encoded,
+			})
+			// The orders, refunds or chargebacks are imported, a retry finds them as duplicates once the key is released
+			if err != nil {
+				s.logger.Error("error storing idempotency key", "key", key, system.LogErrorKey, err)
+				s.release(key)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_, _ = w.Write(encoded)
+	}
+}
+
+// replay writes the response stored for an idempotency key
+// A key cannot be reused for a different request, nor replayed while its request is being processed
+func (s *Server) replay(w http.ResponseWriter, key string, stored *entities.IdempotencyKey, requestHash string) {
+	if stored != nil && stored.RequestHash != requestHash {
+		writeJSON(w, http.StatusUnprocessableEntity, Error{
+			Error: fmt.Sprintf("%s %q was used for a different request", IdempotencyKeyHeader, key),
+		})
+		return
+	}
+	// Still pending, or released meanwhile as its request failed
+	if stored == nil || stored.Status == entities.PendingIdempotencyKeyStatus {
+		writeJSON(w, http.StatusConflict, Error{
+			Error: fmt.Sprintf("the request with %s %q is being processed, retry later", IdempotencyKeyHeader, key),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(stored.StatusCode)
+	_, _ = w.Write(stored.Response)
+}
+
+// release frees the idempotency key of a request which failed, so it can be retried
+func (s *Server) release(key string) {
+	if key == "" {
+		return
+	}
+	// The request context may be done, the key is freed anyway
+	err := s.querier.ReleaseIdempotencyKey(context.Background(), key)
+	if err != nil {
+		s.logger.Error("error releasing idempotency key", "key", key, system.LogErrorKey, err)
+	}
+}
+
+// importOrders imports an order or a list of orders, returning the status code and body of the response
+func (s *Server) importOrders(ctx context.Context, body []byte) (int, any, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return 0, nil, badRequest("missing orders")
+	}
+
+	switch body[0] {
+	case '{':
+		var request OrderRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			return 0, nil, badRequest("invalid order: %v", err)
+		}
+
+		result, err := s.importOrder(ctx, request)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch result.Status {
+		case OrderCreated:
+			return http.StatusCreated, result, nil
+		case OrderRejected:
+			return http.StatusUnprocessableEntity, result, nil
+		default:
+			return http.StatusOK, result, nil
+		}
+
+	case '[':
+		var requests []OrderRequest
+		if err := json.Unmarshal(body, &requests); err != nil {
+			return 0, nil, badRequest("invalid orders: %v", err)
+		}
+		if len(requests) == 0 {
+			return 0, nil, badRequest("missing orders")
+		}
+		if len(requests) > MaxOrdersBatch {
+			return 0, nil, badRequest("%d orders, expected %d at most", len(requests), MaxOrdersBatch)
+		}
+
+		batch := OrderBatchResult{Results: make([]OrderResult, 0, len(requests))}
+		for _, request := range requests {
+			result, err := s.importOrder(ctx, request)
+			if err != nil {
+				return 0, nil, err
+			}
+
+			batch.Results = append(batch.Results, result)
+			switch result.Status {
+			case OrderCreated:
+				batch.Created++
+			case OrderDuplicate:
+				batch.Duplicates++
+			case OrderRejected:
+				batch.Rejected++
+			}
+		}
+		return http.StatusOK, batch, nil
+
+	default:
+		return 0, nil, badRequest("expected an order or a list of orders")
+	}
+}
+
+// importOrder validates an order like the CSV loader does, and inserts it unless it already exists
+// Invalid orders are rejected, only the errors of the database fail the request
+func (s *Server) importOrder(ctx context.Context, request OrderRequest) (OrderResult, error) {
+	result := OrderResult{ID: request.ID}
+	logger := s.logger.With(system.LogOrderIDKey, request.ID)
+
+	order, err := s.builder.Build(ctx, order_load.NewOrder{
+		ID:                request.ID,
+		MerchantReference: request.MerchantReference,
+		Amount:            request.Amount,
+		CreatedAt:         request.CreatedAt,
+		Currency:          request.Currency,
+	})
+	if errors.Is(err, order_load.ErrorInvalidOrder) {
+		logger.Info("order rejected", system.LogErrorKey, err)
+		metrics.OrdersReceived.WithLabelValues(metrics.ResultRejected).Inc()
+
+		result.Status = OrderRejected
+		result.Error = err.Error()
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	existingOrder, err := s.querier.SelectOrder(ctx, order.ID)
+	if err != nil {
+		return result, fmt.Errorf("error checking if order exists: %w", err)
+	}
+
+	// Skip if the order already exists
+	if existingOrder != nil {
+		logger.Info("order already exists", system.LogMerchantIDKey, existingOrder.MerchantID)
+		metrics.OrdersReceived.WithLabelValues(metrics.ResultDuplicate).Inc()
+
+		result.Status = OrderDuplicate
+		result.FeeAmount = round(existingOrder.FeeAmount)
+		return result, nil
+	}
+
+	err = s.querier.InsertOrder(ctx, *order)
+	if err != nil {
+		return result, fmt.Errorf("error inserting order: %w", err)
+	}
+	logger.Info("order imported", system.LogMerchantIDKey, order.MerchantID)
+	metrics.OrdersReceived.WithLabelValues(metrics.ResultImported).Inc()
+
+	result.Status = OrderCreated
+	result.FeeAmount = round(order.FeeAmount)
+	return result, nil
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func post(t *testing.T, server *Server, body, key string) *httptest.ResponseRecorder {
+	return postTo(t, server, "/orders", body, key)
+}
+
+func postTo(t *testing.T, server *Server, path, body, key string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if key != "" {
+		request.Header.Set(IdempotencyKeyHeader, key)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	return recorder
+}
+
+// expectOrders mocks a merchant and an existing order, every other order is new
+func expectOrders(mockQuerier *mock.Mock, merchant entities.Merchant) {
+	mockQuerier.On("SelectMerchantByReference", mock.Anything, merchant.Reference).Return(&merchant, nil)
+	mockQuerier.On("SelectMerchantByReference", mock.Anything, "unknown").Return(nil, nil)
+	mockQuerier.On("SelectOrder", mock.Anything, "existing").Return(&entities.Order{ID: "existing", MerchantID: merchant.ID, FeeAmount: 0.95}, nil)
+	mockQuerier.On("SelectOrder", mock.Anything, mock.Anything).Return(nil, nil)
+	mockQuerier.On("InsertOrder", mock.Anything, mock.Anything).Return(nil)
+}
+
+func TestPostOrder(t *testing.T) {
+	merchant := testMerchant()
+	mockQuerier := test_helpers.NewMockQuerier()
+	expectOrders(&mockQuerier.Mock, merchant)
+	server := NewServer(mockQuerier)
+
+	var result OrderResult
+	recorder := post(t, server, `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":102.29,"created_at":"2023-02-01"}`, "")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, OrderResult{ID: "e653f3e14bc4", Status: OrderCreated, FeeAmount: 0.97}, result)
+
+	mockQuerier.AssertCalled(t, "InsertOrder", mock.Anything, mock.MatchedBy(func(order entities.Order) bool {
+		return order.ID == "e653f3e14bc4" && order.MerchantID == merchant.ID && order.Amount == 102.29 && order.Currency == "EUR"
+	}))
+
+	recorder = post(t, server, `{"id":"existing","merchant_reference":"padberg_group","amount":100,"created_at":"2023-02-01"}`, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, OrderResult{ID: "existing", Status: OrderDuplicate, FeeAmount: 0.95}, result)
+
+	recorder = post(t, server, `{"id":"1","merchant_reference":"unknown","amount":100,"created_at":"2023-02-01"}`, "")
+	require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, OrderRejected, result.Status)
+	require.Contains(t, result.Error, `unknown merchant "unknown"`)
+
+	recorder = post(t, server, `{"id":"4","merchant_reference":"padberg_group","amount":100,"created_at":"2023-02-01","currency":"GBP"}`, "")
+	require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Contains(t, result.Error, "currency GBP does not match the settlement currency EUR")
+}
+
+func TestPostOrdersBatch(t *testing.T) {
+	merchant := testMerchant()
+	mockQuerier := test_helpers.NewMockQuerier()
+	expectOrders(&mockQuerier.Mock, merchant)
+	server := NewServer(mockQuerier)
+
+	recorder := post(t, server, `[
+		{"id":"1","merchant_reference":"padberg_group","amount":40,"created_at":"2023-02-01"},
+		{"id":"existing","merchant_reference":"padberg_group","amount":100,"created_at":"2023-02-01"},
+		{"id":"2","merchant_reference":"padberg_group","amount":-1,"created_at":"2023-02-01"},
+		{"id":"3","merchant_reference":"padberg_group","amount":300,"created_at":"2023-02-30"}
+	]`, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var batch OrderBatchResult
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Equal(t, 1, batch.Created)
+	require.Equal(t, 1, batch.Duplicates)
+	require.Equal(t, 2, batch.Rejected)
+	require.Len(t, batch.Results, 4)
+	require.Equal(t, OrderResult{ID: "1", Status: OrderCreated, FeeAmount: 0.4}, batch.Results[0])
+	require.Equal(t, OrderDuplicate, batch.Results[1].Status)
+	require.Contains(t, batch.Results[2].Error, "amount must be positive")
+	require.Contains(t, batch.Results[3].Error, "error parsing created_at")
+
+	mockQuerier.AssertNumberOfCalls(t, "InsertOrder", 1)
+}
+
+func TestPostOrdersInvalidRequests(t *testing.T) {
+	mockQuerier := test_helpers.NewMockQuerier()
+	expectOrders(&mockQuerier.Mock, testMerchant())
+	server := NewServer(mockQuerier)
+
+	tooMany := "[" + strings.Repeat(`{"id":"1"},`, MaxOrdersBatch) + `{"id":"1"}]`
+	for body, expected := range map[string]string{
+		"":                   "missing orders",
+		"[]":                 "missing orders",
+		`"order"`:            "expected an order or a list of orders",
+		`{"id":`:             "invalid order",
+		`[{"amount":"ten"}]`: "invalid orders",
+		tooMany:              "1001 orders, expected 1000 at most",
+	} {
+		var response Error
+		recorder := post(t, server, body, "")
+		require.Equal(t, http.StatusBadRequest, recorder.Code, body)
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		require.Contains(t, response.Error, expected, body)
+	}
+
+	recorder := post(t, server, `{}`, strings.Repeat("k", 256))
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/orders", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	require.Equal(t, "POST", recorder.Header().Get("Allow"))
+}
+
+func TestPostOrdersIdempotencyKey(t *testing.T) {
+	merchant := testMerchant()
+	body := `{"id":"e653f3e14bc4","merchant_reference":"padberg_group","amount":102.29,"created_at":"2023-02-01"}`
+
+	t.Run("StoresResponse", func(t *testing.T) {
+		mockQuerier := test_helpers.NewMockQuerier()
+		expectOrders(&mockQuerier.Mock, merchant)
+		mockQuerier.On("ReserveIdempotencyKey", mock.Anything, "key-1", mock.Anything).Return(true, nil)
+		mockQuerier.On("CompleteIdempotencyKey", mock.Anything, mock.Anything).Return(nil)
+
+		recorder := post(t, NewServer(mockQuerier), body, "key-1")
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		require.Empty(t, recorder.Header().Get(IdempotentReplayedHeader))
+
+		mockQuerier.AssertCalled(t, "CompleteIdempotencyKey", mock.Anything, mock.MatchedBy(func(key entities.IdempotencyKey) bool {
+			return key.Key == "key-1" && key.StatusCode == http.StatusCreated &&
+				len(key.RequestHash) == 64 && string(key.Response) == recorder.Body.String()
+		}))
+	})
+
+	t.Run("ReplaysResponse", func(t *testing.T) {
+		mockQuerier := test_helpers.NewMockQuerier()
+		expectOrders(&mockQuerier.Mock, merchant)
+		mockQuerier.On("ReserveIdempotencyKey", mock.Anything, "key-1", mock.Anything).Return(true, nil).Once()
+		mockQuerier.On("ReserveIdempotencyKey", mock.Anything, "key-1", mock.Anything).Return(false, nil)
+		mockQuerier.On("CompleteIdempotencyKey", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+			stored := args.Get(1).(entities.IdempotencyKey)
+			stored.Status = entities.CompletedIdempotencyKeyStatus
+			mockQuerier.On("SelectIdempotencyKey", mock.Anything, "key-1").Return(&stored, nil)
+		})
+		server := NewServer(mockQuerier)
+
+		first := post(t, server, body, "key-1")
+		replayed := post(t, server, body, "key-1")
+		require.Equal(t, first.Code, replayed.Code)
+		require.Equal(t, first.Body.String(), replayed.Body.String())
+		require.Equal(t, "true", replayed.Header().Get(IdempotentReplayedHeader))
+		mockQuerier.AssertNumberOfCalls(t, "InsertOrder", 1)
+
+		// The key cannot be reused for another request
+		recorder := post(t, server, strings.Replace(body, "102.29", "100", 1), "key-1")
+		require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+		require.Contains(t, recorder.Body.String(), `Idempotency-Key \"key-1\" was used for a different request`)
+	})
+
+	t.Run("BeingProcessed", func(t *testing.T) {
+		mockQuerier := test_helpers.NewMockQuerier()
+		expectOrders(&mockQuerier.Mock, merchant)
+		mockQuerier.On("ReserveIdempotencyKey", mock.Anything, "key-1", mock.Anything).Return(false, nil)
+		mockQuerier.On("SelectIdempotencyKey", mock.Anything, "key-1").Return(nil, nil).Once()
+		server := NewServer(mockQuerier)
+
+		// Released by a failed request
+		recorder := post(t, server, body, "key-1")
+		require.Equal(t, http.StatusConflict, recorder.Code)
+
+		stored := &entities.IdempotencyKey{Key: "key-1", Status: entities.PendingIdempotencyKeyStatus}
+		stored.RequestHash = requestHash(body)
+		mockQuerier.On("SelectIdempotencyKey", mock.Anything, "key-1").Return(stored, nil)
+
+		recorder = post(t, server, body, "key-1")
+		require.Equal(t, http.StatusConflict, recorder.Code)
+		require.Contains(t, recorder.Body.String(), `the request with Idempotency-Key \"key-1\" is being processed`)
+		mockQuerier.AssertNotCalled(t, "InsertOrder", mock.Anything, mock.Anything)
+	})
+
+	t.Run("ReleasedOnError", func(t *testing.T) {
+		mockQuerier := test_helpers.NewMockQuerier()
+		expectOrders(&mockQuerier.Mock, merchant)
+		mockQuerier.On("ReserveIdempotencyKey", mock.Anything, "key-1", mock.Anything).Return(true, nil)
+		mockQuerier.On("ReleaseIdempotencyKey", mock.Anything, "key-1").Return(nil)
+
+		recorder := post(t, NewServer(mockQuerier), `{"id":`, "key-1")
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		mockQuerier.AssertCalled(t, "ReleaseIdempotencyKey", mock.Anything, "key-1")
+		mockQuerier.AssertNotCalled(t, "CompleteIdempotencyKey", mock.Anything, mock.Anything)
+	})
+
+	t.Run("DatabaseError", func(t *testing.T) {
+		mockQuerier := test_helpers.NewMockQuerier()
+		expectOrders(&mockQuerier.Mock, merchant)
+		mockQuerier.On("ReserveIdempotencyKey", mock.Anything, "key-1", mock.Anything).Return(false, errors.New("connection refused"))
+
+		recorder := post(t, NewServer(mockQuerier), body, "key-1")
+		require.Equal(t, http.StatusInternalServerError, recorder.Code)
+		mockQuerier.AssertNotCalled(t, "InsertOrder", mock.Anything, mock.Anything)
+	})
+}
+
+// requestHash is the hash of a request body, as stored with its idempotency key
+func requestHash(body string) string {
+	hash := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(hash[:])
+}
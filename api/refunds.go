@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/order_load"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// RefundRequest is a refund received by the API, with the fields of the CSV files
+// Without an amount the order is cancelled, refunding what is left of it
+type RefundRequest struct {
+	ID        string  `json:"id"`
+	OrderID   string  `json:"order_id"`
+	Amount    float64 `json:"amount,omitempty"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// RefundResult is the outcome of a refund received
+// A duplicate refund reports the amounts of the refund already imported
+type RefundResult struct {
+	ID          string  `json:"id"`
+	Status      string  `json:"status"`
+	Amount      float64 `json:"amount,omitempty"`
+	FeeReversal float64 `json:"fee_reversal,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// RefundBatchResult is the outcome of a batch of refunds, in the order they were received
+type RefundBatchResult struct {
+	Results    []RefundResult `json:"results"`
+	Created    int            `json:"created"`
+	Duplicates int            `json:"duplicates"`
+	Rejected   int            `json:"rejected"`
+}
+
+// importRefunds imports a refund or a list of refunds, returning the status code and body of the response
+func (s *Server) importRefunds(ctx context.Context, body []byte) (int, any, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return 0, nil, badRequest("missing refunds")
+	}
+
+	switch body[0] {
+	case '{':
+		var request RefundRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			return 0, nil, badRequest("invalid refund: %v", err)
+		}
+
+		result, err := s.importRefund(ctx, request)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch result.Status {
+		case OrderCreated:
+			return http.StatusCreated, result, nil
+		case OrderRejected:
+			return http.StatusUnprocessableEntity, result, nil
+		default:
+			return http.StatusOK, result, nil
+		}
+
+	case '[':
+		var requests []RefundRequest
+		if err := json.Unmarshal(body, &requests); err != nil {
+			return 0, nil, badRequest("invalid refunds: %v", err)
+		}
+		if len(requests) == 0 {
+			return 0, nil, badRequest("missing refunds")
+		}
+		if len(requests) > MaxOrdersBatch {
+			return 0, nil, badRequest("%d refunds, expected %d at most", len(requests), MaxOrdersBatch)
+		}
+
+		batch := RefundBatchResult{Results: make([]RefundResult, 0, len(requests))}
+		for _, request := range requests {
+			result, err := s.importRefund(ctx, request)
+			if err != nil {
+				return 0, nil, err
+			}
+
+			batch.Results = append(batch.Results, result)
+			switch result.Status {
+			case OrderCreated:
+				batch.Created++
+			case OrderDuplicate:
+				batch.Duplicates++
+			case OrderRejected:
+				batch.Rejected++
+			}
+		}
+		return http.StatusOK, batch, nil
+
+	default:
+		return 0, nil, badRequest("expected a refund or a list of refunds")
+	}
+}
+
+// importRefund validates a refund like the CSV loader does, and inserts it unless it already exists
+// Invalid refunds are rejected, only the errors of the database fail the request
+func (s *Server) importRefund(ctx context.Context, request RefundRequest) (RefundResult, error) {
+	result := RefundResult{ID: request.ID}
+	logger := s.logger.With(system.LogRefundIDKey, request.ID, system.LogOrderIDKey, request.OrderID)
+
+	// A known refund is a duplicate, even if building it again would exceed its order
+	if request.ID != "" {
+		existingRefund, err := s.querier.SelectRefund(ctx, request.ID)
+		if err != nil {
+			return result, fmt.Errorf("error checking if refund exists: %w", err)
+		}
+		if existingRefund != nil {
+			logger.Info("refund already exists", system.LogMerchantIDKey, existingRefund.MerchantID)
+			metrics.RefundsReceived.WithLabelValues(metrics.ResultDuplicate).Inc()
+
+			result.Status = OrderDuplicate
+			result.Amount = round(existingRefund.Amount)
+			result.FeeReversal = round(existingRefund.FeeReversal)
+			return result, nil
+		}
+	}
+
+	refund, err := s.refunds.Build(ctx, order_load.NewRefund{
+		ID:        request.ID,
+		OrderID:   request.OrderID,
+		Amount:    request.Amount,
+		CreatedAt: request.CreatedAt,
+	})
+	if errors.Is(err, order_load.ErrorInvalidRefund) {
+		logger.Info("refund rejected", system.LogErrorKey, err)
+		metrics.RefundsReceived.WithLabelValues(metrics.ResultRejected).Inc()
+
+		result.Status = OrderRejected
+		result.Error = err.Error()
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	// Another refund or chargeback of the order could have been imported since the refund was built
+	err = s.querier.InsertRefund(ctx, *refund)
+	if errors.Is(err, database.ErrorOrderAmountExceeded) {
+		logger.Info("refund rejected", system.LogErrorKey, err)
+		metrics.RefundsReceived.WithLabelValues(metrics.ResultRejected).Inc()
+
+		result.Status = OrderRejected
+		result.Error = fmt.Errorf("%w: %v", order_load.ErrorInvalidRefund, err).Error()
+		return result, nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("error inserting refund: %w", err)
+	}
+	logger.Info("refund imported", system.LogMerchantIDKey, refund.MerchantID)
+	metrics.RefundsReceived.WithLabelValues(metrics.ResultImported).Inc()
+
+	result.Status = OrderCreated
+	result.Amount = round(refund.Amount)
+	result.FeeReversal = round(refund.FeeReversal)
+	return result, nil
+}
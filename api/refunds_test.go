@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// expectRefunds mocks an order and an existing refund of it, every other refund is new
+func expectRefunds(mockQuerier *mock.Mock, merchant entities.Merchant) {
+	order := entities.Order{ID: "e653f3e14bc4", MerchantID: merchant.ID, Amount: 100, FeeAmount: 0.95, CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)}
+	existing := entities.Refund{ID: "existing", OrderID: order.ID, MerchantID: merchant.ID, Amount: 60, FeeReversal: 0.57, CreatedAt: order.CreatedAt}
+
+	mockQuerier.On("SelectOrder", mock.Anything, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectOrder", mock.Anything, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectRefund", mock.Anything, existing.ID).Return(&existing, nil)
+	mockQuerier.On("SelectRefund", mock.Anything, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectOrderRefunds", mock.Anything, order.ID).Return([]entities.Refund{existing}, nil)
+	mockQuerier.On("SelectOrderChargebacks", mock.Anything, order.ID).Return(nil, nil)
+	mockQuerier.On("InsertRefund", mock.Anything, mock.Anything).Return(nil)
+}
+
+func TestPostRefund(t *testing.T) {
+	merchant := testMerchant()
+	mockQuerier := test_helpers.NewMockQuerier()
+	expectRefunds(&mockQuerier.Mock, merchant)
+	server := NewServer(mockQuerier)
+
+	var result RefundResult
+	recorder := postTo(t, server, "/refunds", `{"id":"r-1","order_id":"e653f3e14bc4","amount":20,"created_at":"2023-02-03"}`, "")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, RefundResult{ID: "r-1", Status: OrderCreated, Amount: 20, FeeReversal: 0.19}, result)
+
+	mockQuerier.AssertCalled(t, "InsertRefund", mock.Anything, mock.MatchedBy(func(refund entities.Refund) bool {
+		return refund.ID == "r-1" && refund.OrderID == "e653f3e14bc4" && refund.MerchantID == merchant.ID && refund.Amount == 20
+	}))
+
+	// Without an amount, the order is cancelled
+	recorder = postTo(t, server, "/refunds", `{"id":"r-2","order_id":"e653f3e14bc4","created_at":"2023-02-03"}`, "")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, RefundResult{ID: "r-2", Status: OrderCreated, Amount: 40, FeeReversal: 0.38}, result)
+
+	// A duplicate is not built again, its order being already refunded
+	recorder = postTo(t, server, "/refunds", `{"id":"existing","order_id":"e653f3e14bc4","amount":60,"created_at":"2023-02-01"}`, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, RefundResult{ID: "existing", Status: OrderDuplicate, Amount: 60, FeeReversal: 0.57}, result)
+
+	recorder = postTo(t, server, "/refunds", `{"id":"r-3","order_id":"e653f3e14bc4","amount":50,"created_at":"2023-02-03"}`, "")
+	require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, OrderRejected, result.Status)
+	require.Contains(t, result.Error, "exceeds the 40.00 left to refund")
+}
+
+func TestPostRefundExceededOnInsert(t *testing.T) {
+	merchant := testMerchant()
+	order := entities.Order{ID: "e653f3e14bc4", MerchantID: merchant.ID, Amount: 100, FeeAmount: 0.95, CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)}
+
+	// Another refund of the order was inserted since this one was built
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectOrder", mock.Anything, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectRefund", mock.Anything, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectOrderRefunds", mock.Anything, order.ID).Return(nil, nil)
+	mockQuerier.On("SelectOrderChargebacks", mock.Anything, order.ID).Return(nil, nil)
+	mockQuerier.On("InsertRefund", mock.Anything, mock.Anything).Return(database.ErrorOrderAmountExceeded)
+	server := NewServer(mockQuerier)
+
+	var result RefundResult
+	recorder := postTo(t, server, "/refunds", `{"id":"r-1","order_id":"e653f3e14bc4","amount":80,"created_at":"2023-02-03"}`, "")
+	require.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+	require.Equal(t, OrderRejected, result.Status)
+	require.Contains(t, result.Error, "invalid refund: amount exceeds what is left of the order")
+}
+
+func TestPostRefundsBatch(t *testing.T) {
+	mockQuerier := test_helpers.NewMockQuerier()
+	expectRefunds(&mockQuerier.Mock, testMerchant())
+	server := NewServer(mockQuerier)
+
+	recorder := postTo(t, server, "/refunds", `[
+		{"id":"r-1","order_id":"e653f3e14bc4","amount":10,"created_at":"2023-02-03"},
+		{"id":"existing","order_id":"e653f3e14bc4","amount":60,"created_at":"2023-02-01"},
+		{"id":"r-2","order_id":"unknown","amount":10,"created_at":"2023-02-03"}
+	]`, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var batch RefundBatchResult
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Equal(t, 1, batch.Created)
+	require.Equal(t, 1, batch.Duplicates)
+	require.Equal(t, 1, batch.Rejected)
+	require.Len(t, batch.Results, 3)
+	require.Contains(t, batch.Results[2].Error, `unknown order "unknown"`)
+
+	mockQuerier.AssertNumberOfCalls(t, "InsertRefund", 1)
+
+	var response Error
+	recorder = postTo(t, server, "/refunds", `"refund"`, "")
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Equal(t, "expected a refund or a list of refunds", response.Error)
+}
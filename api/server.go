@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+	"github.com/ildomm/cc_sq_disbursement/order_load"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// Server serves the REST API of the disbursements, and receives new orders, refunds and chargebacks
+//
+//	GET  /disbursements                             list, filtered by merchant, frequency and dates, paged
+//	GET  /disbursements/{reference}                 a disbursement with its orders and fees
+//	GET  /disbursements/{reference}/statement       statement of a disbursement, as CSV or PDF
+//	GET  /merchants/{reference}/disbursements       list of a merchant, with the same filters and paging
+//	GET  /merchants/{reference}/statements/{month}  statement of a merchant for a month, as CSV or PDF
+//	POST /orders                                    import an order or a list of orders
+//	POST /refunds                                   import a refund or a list of refunds
+//	POST /chargebacks                               import a chargeback or a list of chargebacks
+type Server struct {
+	querier     database.Querier
+	builder     *order_load.OrderBuilder
+	refunds     *order_load.RefundBuilder
+	chargebacks *order_load.ChargebackBuilder
+	logger      *slog.Logger
+	mux         *http.ServeMux
+}
+
+func NewServer(querier database.Querier) *Server {
+	return NewServerWithConfig(context.Background(), querier, system.DefaultConfig())
+}
+
+// NewServerWithConfig creates a server calculating the fees of the new orders, refunds and chargebacks with the fees of the config
+func NewServerWithConfig(ctx context.Context, querier database.Querier, cfg system.Config) *Server {
+	feeCalc := fee_calculator.NewFeeCalculatorWithConfig(ctx, querier, cfg.Fees)
+	s := &Server{
+		querier:     querier,
+		builder:     order_load.NewOrderBuilder(querier, feeCalc),
+		refunds:     order_load.NewRefundBuilder(querier, feeCalc),
+		chargebacks: order_load.NewChargebackBuilder(querier, feeCalc),
+		logger:      system.ComponentLogger("api"),
+		mux:         http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/disbursements", s.get(s.listDisbursements))
+	s.mux.HandleFunc("/disbursements/", s.disbursementRoutes)
+	s.mux.HandleFunc("/merchants/", s.merchantRoutes)
+	s.mux.HandleFunc("/orders", s.postImport(s.importOrders))
+	s.mux.HandleFunc("/refunds", s.postImport(s.importRefunds))
+	s.mux.HandleFunc("/chargebacks", s.postImport(s.importChargebacks))
+
+	return s
+}
+
+// Register adds the API routes to a mux, next to other endpoints like /metrics
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.Handle("/disbursements", s)
+	mux.Handle("/disbursements/", s)
+	mux.Handle("/merchants/", s)
+	mux.Handle("/orders", s)
+	mux.Handle("/refunds", s)
+	mux.Handle("/chargebacks", s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ErrorNotFound is returned by the handlers when the resource does not exist
+var ErrorNotFound = errors.New("not found")
+
+// errorBadRequest wraps the errors caused by invalid parameters
+type errorBadRequest struct {
+	err error
+}
+
+func (e errorBadRequest) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...any) error {
+	return errorBadRequest{fmt.Errorf(format, args...)}
+}
+
+// handlerFunc is an API handler, returning the response body or an error
+type handlerFunc func(r *http.Request) (any, error)
+
+// get adapts a handler for GET requests, writing its result as JSON
+func (s *Server) get(handler handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSON(w, http.StatusMethodNotAllowed, Error{Error: "method not allowed"})
+			return
+		}
+
+		body, err := handler(r)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var badRequestErr errorBadRequest
+	switch {
+	case errors.As(err, &badRequestErr):
+		writeJSON(w, http.StatusBadRequest, Error{Error: err.Error()})
+	case errors.Is(err, ErrorNotFound):
+		writeJSON(w, http.StatusNotFound, Error{Error: err.Error()})
+	default:
+		s.logger.Error("error serving request", "path", r.URL.Path, system.LogErrorKey, err)
+		writeJSON(w, http.StatusInternalServerError, Error{Error: "internal error"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// pathParameter returns the part of the path after the prefix and before the suffix
+// It is empty when the path does not match or the parameter has a slash
+func pathParameter(path, prefix, suffix string) string {
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return ""
+	}
+	parameter := strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix)
+	if strings.Contains(parameter, "/") {
+		return ""
+	}
+	return parameter
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, server *Server, path string, body any) int {
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	if body != nil {
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), body))
+	}
+	return recorder.Code
+}
+
+func testMerchant() entities.Merchant {
+	return entities.Merchant{
+		ID:                    uuid.New(),
+		Reference:             "padberg_group",
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		Currency:              entities.DefaultCurrency,
+	}
+}
+
+func testDisbursement(merchant entities.Merchant) entities.MerchantDisbursement {
+	day := time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)
+	sentAt := day.AddDate(0, 0, 1)
+	return entities.MerchantDisbursement{
+		ID:                    uuid.New(),
+		Reference:             "DSB-20230115-1A2B3C4D",
+		MerchantID:            merchant.ID,
+		Currency:              merchant.Currency,
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day,
+		OrdersEndAt:           day,
+		FeeAmount:             1.4249999,
+		FeeAmountCorrection:   3.5,
+		OrdersSumAmount:       150.005,
+		OrdersTotalEntries:    2,
+		NetAmount:             145.08,
+		Status:                entities.SentDisbursementStatus,
+		SentAt:                &sentAt,
+		CreatedAt:             day.Add(8 * time.Hour),
+	}
+}
+
+func TestListDisbursements(t *testing.T) {
+	merchant := testMerchant()
+	disbursement := testDisbursement(merchant)
+
+	expectedFilter := entities.DisbursementFilter{
+		MerchantID: merchant.ID,
+		Frequency:  entities.DailyDisbursementFrequency,
+		Status:     entities.SentDisbursementStatus,
+		From:       time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:         time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC),
+		Limit:      10,
+		Offset:     10,
+	}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchantByReference", mock.Anything, merchant.Reference).Return(&merchant, nil)
+	mockQuerier.On("SelectMerchants", mock.Anything).Return([]entities.Merchant{merchant}, nil)
+	mockQuerier.On("SelectDisbursements", mock.Anything, expectedFilter).Return([]entities.MerchantDisbursement{disbursement}, nil)
+	mockQuerier.On("CountDisbursements", mock.Anything, expectedFilter).Return(int64(11), nil)
+
+	var page DisbursementPage
+	code := get(t, NewServer(mockQuerier),
+		"/disbursements?merchant=padberg_group&frequency=daily&status=sent&from=2023-01-01&to=2023-01-31&page=2&page_size=10", &page)
+	require.Equal(t, http.StatusOK, code)
+
+	require.Equal(t, 2, page.Page)
+	require.Equal(t, 10, page.PageSize)
+	require.Equal(t, int64(11), page.Total)
+	require.Len(t, page.Data, 1)
+	require.Equal(t, Disbursement{
+		Reference:           "DSB-20230115-1A2B3C4D",
+		Merchant:            "padberg_group",
+		Currency:            "EUR",
+		Frequency:           "daily",
+		OrdersStartAt:       "2023-01-15",
+		OrdersEndAt:         "2023-01-15",
+		OrdersTotalEntries:  2,
+		OrdersSumAmount:     150.01,
+		FeeAmount:           1.42,
+		FeeAmountCorrection: 3.5,
+		NetAmount:           145.08,
+		Status:              "sent",
+		StatusChangedAt:     *disbursement.SentAt,
+		CreatedAt:           disbursement.CreatedAt,
+	}, page.Data[0])
+}
+
+func TestListDisbursementsDefaults(t *testing.T) {
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchants", mock.Anything).Return([]entities.Merchant{}, nil)
+	mockQuerier.On("SelectDisbursements", mock.Anything, entities.DisbursementFilter{Limit: DefaultPageSize}).Return(nil, nil)
+	mockQuerier.On("CountDisbursements", mock.Anything, entities.DisbursementFilter{Limit: DefaultPageSize}).Return(int64(0), nil)
+
+	var page DisbursementPage
+	code := get(t, NewServer(mockQuerier), "/disbursements", &page)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 1, page.Page)
+	require.Equal(t, DefaultPageSize, page.PageSize)
+	require.NotNil(t, page.Data)
+	require.Empty(t, page.Data)
+}
+
+func TestListDisbursementsInvalidParameters(t *testing.T) {
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchantByReference", mock.Anything, "unknown").Return(nil, nil)
+	server := NewServer(mockQuerier)
+
+	for path, expected := range map[string]string{
+		"/disbursements?frequency=yearly":                 `invalid frequency "yearly"`,
+		"/disbursements?status=paid":                      `invalid status: unknown disbursement status "paid"`,
+		"/disbursements?from=15/01/2023":                  `invalid from "15/01/2023"`,
+		"/disbursements?to=2023-02-30":                    `invalid to "2023-02-30"`,
+		"/disbursements?from=2023-02-01&to=2023-01-01":    "to 2023-01-01 is before from 2023-02-01",
+		"/disbursements?page=0":                           `invalid page "0"`,
+		"/disbursements?page_size=501":                    `invalid page_size "501", expected a number from 1 to 500`,
+		"/disbursements?page_size=ten":                    `invalid page_size "ten"`,
+		"/disbursements?merchant=unknown":                 `unknown merchant "unknown"`,
+		"/merchants/unknown/disbursements?frequency=none": `invalid frequency "none"`,
+	} {
+		var body Error
+		code := get(t, server, path, &body)
+		require.Equal(t, http.StatusBadRequest, code, path)
+		require.Contains(t, body.Error, expected, path)
+	}
+}
+
+func TestListMerchantDisbursements(t *testing.T) {
+	merchant := testMerchant()
+	disbursement := testDisbursement(merchant)
+	expectedFilter := entities.DisbursementFilter{MerchantID: merchant.ID, Limit: DefaultPageSize}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchantByReference", mock.Anything, merchant.Reference).Return(&merchant, nil)
+	mockQuerier.On("SelectMerchantByReference", mock.Anything, "unknown").Return(nil, nil)
+	mockQuerier.On("SelectMerchants", mock.Anything).Return([]entities.Merchant{merchant}, nil)
+	mockQuerier.On("SelectDisbursements", mock.Anything, expectedFilter).Return([]entities.MerchantDisbursement{disbursement}, nil)
+	mockQuerier.On("CountDisbursements", mock.Anything, expectedFilter).Return(int64(1), nil)
+	server := NewServer(mockQuerier)
+
+	var page DisbursementPage
+	code := get(t, server, "/merchants/padberg_group/disbursements", &page)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Data, 1)
+	require.Equal(t, "padberg_group", page.Data[0].Merchant)
+
+	var body Error
+	code = get(t, server, "/merchants/unknown/disbursements", &body)
+	require.Equal(t, http.StatusNotFound, code)
+	require.Equal(t, `merchant "unknown" not found`, body.Error)
+
+	for _, path := range []string{"/merchants/", "/merchants/padberg_group", "/merchants/padberg_group/orders"} {
+		code = get(t, server, path, nil)
+		require.Equal(t, http.StatusNotFound, code, path)
+	}
+}
+
+func TestShowDisbursement(t *testing.T) {
+	merchant := testMerchant()
+	disbursement := testDisbursement(merchant)
+	disbursement.ChargebacksTotalEntries = 1
+	disbursement.ChargebacksAmount = 30
+	disbursement.ChargebackFeeAmount = 15
+	orders := []entities.Order{
+		{ID: "e653f3e14bc4", MerchantID: merchant.ID, Amount: 100.005, FeeAmount: 0.95, CreatedAt: disbursement.OrdersStartAt, Disbursed: true},
+		{ID: "20b674c93ea6", MerchantID: merchant.ID, Amount: 50, FeeAmount: 0.475, CreatedAt: disbursement.OrdersStartAt, Disbursed: true},
+	}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDisbursementByReference", mock.Anything, disbursement.Reference).Return(&disbursement, nil)
+	mockQuerier.On("SelectDisbursementByReference", mock.Anything, "DSB-MISSING").Return(nil, nil)
+	mockQuerier.On("SelectMerchant", mock.Anything, merchant.ID).Return(&merchant, nil)
+	mockQuerier.On("SelectDisbursedOrders", mock.Anything, merchant.ID, disbursement.OrdersStartAt, disbursement.OrdersEndAt).Return(orders, nil)
+	mockQuerier.On("SelectDeductedRefunds", mock.Anything, merchant.ID, disbursement.OrdersStartAt, disbursement.OrdersEndAt).Return([]entities.Refund{
+		{ID: "r-1", OrderID: "0a1b2c3d4e5f", MerchantID: merchant.ID, Amount: 20, FeeReversal: 0.19, CreatedAt: disbursement.OrdersStartAt, DeductedOn: &disbursement.OrdersEndAt},
+	}, nil)
+	mockQuerier.On("SelectDeductedChargebacks", mock.Anything, merchant.ID, disbursement.OrdersStartAt, disbursement.OrdersEndAt).Return([]entities.Chargeback{
+		{ID: "cb-1", OrderID: "20b674c93ea6", MerchantID: merchant.ID, Amount: 30, Fee: 15, Reason: "fraud", CreatedAt: disbursement.OrdersStartAt, DeductedOn: &disbursement.OrdersEndAt},
+	}, nil)
+	mockQuerier.On("SelectDisbursementStatusChanges", mock.Anything, disbursement.ID).Return([]entities.DisbursementStatusChange{
+		{FromStatus: entities.CalculatedDisbursementStatus, ToStatus: entities.ApprovedDisbursementStatus, ChangedAt: disbursement.CreatedAt},
+		{FromStatus: entities.ApprovedDisbursementStatus, ToStatus: entities.SentDisbursementStatus, Reason: "payout batch PAY-20230116-1A2B3C4D", ChangedAt: *disbursement.SentAt},
+	}, nil)
+	server := NewServer(mockQuerier)
+
+	var detail DisbursementDetail
+	code := get(t, server, "/disbursements/"+disbursement.Reference, &detail)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, disbursement.Reference, detail.Reference)
+	require.Equal(t, "padberg_group", detail.Merchant)
+	require.Equal(t, Fees{OrdersFeeAmount: 1.42, MonthlyCorrection: 3.5, Chargebacks: 15, Total: 19.92}, detail.Fees)
+	require.Equal(t, 30.0, detail.ChargebacksAmount)
+	require.Equal(t, []Order{
+		{ID: "e653f3e14bc4", Amount: 100.01, FeeAmount: 0.95, CreatedAt: "2023-01-15"},
+		{ID: "20b674c93ea6", Amount: 50, FeeAmount: 0.48, CreatedAt: "2023-01-15"},
+	}, detail.Orders)
+	require.Equal(t, []Refund{
+		{ID: "r-1", OrderID: "0a1b2c3d4e5f", Amount: 20, FeeReversal: 0.19, CreatedAt: "2023-01-15", DeductedOn: "2023-01-15"},
+	}, detail.Refunds)
+	require.Equal(t, []Chargeback{
+		{ID: "cb-1", OrderID: "20b674c93ea6", Amount: 30, Fee: 15, Reason: "fraud", CreatedAt: "2023-01-15", DeductedOn: "2023-01-15"},
+	}, detail.Chargebacks)
+	require.Equal(t, "sent", detail.Status)
+	require.Equal(t, []StatusChange{
+		{From: "calculated", To: "approved", ChangedAt: disbursement.CreatedAt},
+		{From: "approved", To: "sent", Reason: "payout batch PAY-20230116-1A2B3C4D", ChangedAt: *disbursement.SentAt},
+	}, detail.StatusHistory)
+
+	var body Error
+	code = get(t, server, "/disbursements/DSB-MISSING", &body)
+	require.Equal(t, http.StatusNotFound, code)
+	require.Equal(t, `disbursement "DSB-MISSING" not found`, body.Error)
+
+	code = get(t, server, "/disbursements/DSB-MISSING/orders", nil)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestServerErrors(t *testing.T) {
+	// Mock logger to capture log output, the server logger is set up on creation
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDisbursementByReference", mock.Anything, "DSB-1").Return(nil, errors.New("connection refused"))
+	server := NewServer(mockQuerier)
+
+	var body Error
+	code := get(t, server, "/disbursements/DSB-1", &body)
+	require.Equal(t, http.StatusInternalServerError, code)
+	require.Equal(t, "internal error", body.Error)
+	mockLog.AssertRecord(t, "error serving request", map[string]any{"path": "/disbursements/DSB-1", "error": "connection refused"})
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/disbursements", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	require.Equal(t, "GET, HEAD", recorder.Header().Get("Allow"))
+}
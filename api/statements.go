@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/statement"
+)
+
+// disbursementRoutes serves the paths under /disbursements/
+func (s *Server) disbursementRoutes(w http.ResponseWriter, r *http.Request) {
+	if reference := pathParameter(r.URL.Path, "/disbursements/", "/statement"); reference != "" {
+		s.writeStatement(w, r, func() (*statement.Statement, error) {
+			return statement.ForDisbursement(r.Context(), s.querier, reference)
+		})
+		return
+	}
+	s.get(s.showDisbursement)(w, r)
+}
+
+// merchantRoutes serves the paths under /merchants/
+func (s *Server) merchantRoutes(w http.ResponseWriter, r *http.Request) {
+	// /merchants/{reference}/statements/{month}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/merchants/"), "/")
+	if len(parts) == 3 && parts[0] != "" && parts[1] == "statements" {
+		s.writeStatement(w, r, func() (*statement.Statement, error) {
+			month, err := time.Parse(statement.MonthLayout, parts[2])
+			if err != nil {
+				return nil, badRequest("invalid month %q, expected a month like 2023-01", parts[2])
+			}
+			return statement.ForMonth(r.Context(), s.querier, parts[0], month)
+		})
+		return
+	}
+	s.get(s.listMerchantDisbursements)(w, r)
+}
+
+// writeStatement exports a statement as a file, in the format of the format parameter, csv by default
+func (s *Server) writeStatement(w http.ResponseWriter, r *http.Request, build func() (*statement.Statement, error)) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, Error{Error: "method not allowed"})
+		return
+	}
+
+	format := statement.CSVFormat
+	if value := r.URL.Query().Get("format"); value != "" {
+		var err error
+		format, err = statement.ParseFormat(value)
+		if err != nil {
+			s.writeError(w, r, badRequest("%s", err))
+			return
+		}
+	}
+
+	merchantStatement, err := build()
+	if errors.Is(err, statement.ErrorDisbursementNotFound) || errors.Is(err, statement.ErrorMerchantNotFound) {
+		writeJSON(w, http.StatusNotFound, Error{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	// Export before writing the headers, so a failure still responds with an error
+	var body bytes.Buffer
+	err = statement.Write(&body, format, merchantStatement)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", merchantStatement.Filename(format)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body.Bytes())
+}
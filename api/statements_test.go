@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatements(t *testing.T) {
+	merchant := testMerchant()
+	disbursement := testDisbursement(merchant)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDisbursementByReference", mock.Anything, disbursement.Reference).Return(&disbursement, nil)
+	mockQuerier.On("SelectDisbursementByReference", mock.Anything, "DSB-MISSING").Return(nil, nil)
+	mockQuerier.On("SelectMerchant", mock.Anything, merchant.ID).Return(&merchant, nil)
+	mockQuerier.On("SelectMerchantByReference", mock.Anything, merchant.Reference).Return(&merchant, nil)
+	mockQuerier.On("SelectMerchantByReference", mock.Anything, "unknown").Return(nil, nil)
+	mockQuerier.On("SelectDisbursedOrders", mock.Anything, merchant.ID, mock.Anything, mock.Anything).Return([]entities.Order{
+		{ID: "e653f3e14bc4", Amount: 100, FeeAmount: 0.95, CreatedAt: disbursement.OrdersStartAt},
+	}, nil)
+	mockQuerier.On("SelectDisbursements", mock.Anything, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectDeductedRefunds", mock.Anything, merchant.ID, mock.Anything, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectDeductedChargebacks", mock.Anything, merchant.ID, mock.Anything, mock.Anything).Return(nil, nil)
+	server := NewServer(mockQuerier)
+
+	request := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	recorder := request("/disbursements/" + disbursement.Reference + "/statement")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+	require.Equal(t, `attachment; filename="statement-DSB-20230115-1A2B3C4D.csv"`, recorder.Header().Get("Content-Disposition"))
+	require.Contains(t, recorder.Body.String(), "e653f3e14bc4,2023-01-15,100.00,0.95\n")
+
+	recorder = request("/merchants/padberg_group/statements/2023-01?format=pdf")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "application/pdf", recorder.Header().Get("Content-Type"))
+	require.Equal(t, `attachment; filename="statement-padberg_group-2023-01.pdf"`, recorder.Header().Get("Content-Disposition"))
+	require.True(t, strings.HasPrefix(recorder.Body.String(), "%PDF-"))
+	mockQuerier.AssertCalled(t, "SelectDisbursedOrders", mock.Anything, merchant.ID,
+		time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC))
+
+	for path, expectedCode := range map[string]int{
+		"/disbursements/DSB-MISSING/statement":                    http.StatusNotFound,
+		"/merchants/unknown/statements/2023-01":                   http.StatusNotFound,
+		"/merchants/padberg_group/statements/2023-13":             http.StatusBadRequest,
+		"/merchants/padberg_group/statements/2023-01?format=xlsx": http.StatusBadRequest,
+	} {
+		recorder = request(path)
+		require.Equal(t, expectedCode, recorder.Code, path)
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"), path)
+	}
+}
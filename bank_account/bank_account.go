@@ -0,0 +1,230 @@
+package bank_account
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+const maxHolderNameLength = 70
+
+var (
+	ErrorInvalidAccount    = errors.New("invalid bank account")
+	ErrorAccountNotFound   = errors.New("bank account not found")
+	ErrorMerchantNotFound  = errors.New("merchant not found")
+	ErrorInvalidTransition = errors.New("invalid bank account change")
+)
+
+// transitions lists the statuses each status can change to
+// Pending accounts are verified or rejected, and a verified account can be rejected, e.g. when a payout is returned
+var transitions = map[entities.BankAccountStatuses][]entities.BankAccountStatuses{
+	entities.PendingBankAccountStatus:  {entities.VerifiedBankAccountStatus, entities.RejectedBankAccountStatus},
+	entities.VerifiedBankAccountStatus: {entities.RejectedBankAccountStatus},
+}
+
+// NewAccount is a bank account given for a merchant
+type NewAccount struct {
+	IBAN       string
+	BIC        string // Optional
+	HolderName string
+	ValidFrom  time.Time // Defaults to today
+}
+
+// Service manages the bank accounts of the merchants, recording every change in their history
+type Service struct {
+	querier database.Querier
+	logger  *slog.Logger
+	now     func() time.Time
+}
+
+func NewService(querier database.Querier) *Service {
+	return &Service{
+		querier: querier,
+		logger:  system.ComponentLogger("bank_account"),
+		now:     time.Now,
+	}
+}
+
+// Add validates and stores a bank account for a merchant, pending verification
+func (s *Service) Add(ctx context.Context, merchantReference string, newAccount NewAccount) (*entities.MerchantBankAccount, error) {
+	merchant, err := s.querier.SelectMerchantByReference(ctx, merchantReference)
+	if err != nil {
+		return nil, err
+	}
+	if merchant == nil {
+		return nil, fmt.Errorf("%w: %q", ErrorMerchantNotFound, merchantReference)
+	}
+
+	account := &entities.MerchantBankAccount{
+		MerchantID: merchant.ID,
+		IBAN:       Normalize(newAccount.IBAN),
+		BIC:        Normalize(newAccount.BIC),
+		HolderName: newAccount.HolderName,
+		ValidFrom:  system.StartOfDay(newAccount.ValidFrom),
+		Status:     entities.PendingBankAccountStatus,
+	}
+	if newAccount.ValidFrom.IsZero() {
+		account.ValidFrom = system.StartOfDay(s.now())
+	}
+
+	err = validate(account)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.querier.InsertBankAccount(ctx, account)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting bank account: %w", err)
+	}
+	s.logger.Info("bank account added", system.LogMerchantIDKey, merchant.ID, "bank_account_id", account.ID)
+
+	return account, nil
+}
+
+// validate checks the account details, all the problems found are reported
+func validate(account *entities.MerchantBankAccount) error {
+	var errs []error
+	if err := ValidateIBAN(account.IBAN); err != nil {
+		errs = append(errs, err)
+	}
+	if account.BIC != "" {
+		if err := ValidateBIC(account.BIC); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if account.HolderName == "" || len(account.HolderName) > maxHolderNameLength {
+		errs = append(errs, fmt.Errorf("the holder name must have from 1 to %d characters", maxHolderNameLength))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrorInvalidAccount, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Verify marks a pending account as verified, so the merchant disbursements are paid to it from its first valid day
+// The verified account valid before it is closed the day before, as a merchant is paid to one account at a time
+func (s *Service) Verify(ctx context.Context, id uuid.UUID) (*entities.MerchantBankAccount, error) {
+	account, err := s.account(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTransition(account, entities.VerifiedBankAccountStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := s.querier.SelectBankAccounts(ctx, account.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+
+	lastDay := account.ValidFrom.AddDate(0, 0, -1)
+	var superseded []entities.MerchantBankAccount
+	for _, other := range accounts {
+		if other.ID == account.ID || other.Status != entities.VerifiedBankAccountStatus {
+			continue
+		}
+		if other.ValidTo != nil && other.ValidTo.Before(account.ValidFrom) {
+			continue
+		}
+		if !other.ValidFrom.Before(account.ValidFrom) {
+			return nil, fmt.Errorf("%w: the verified account %s is valid from %s, after %s",
+				ErrorInvalidTransition, other.ID, other.ValidFrom.Format(time.DateOnly), account.ValidFrom.Format(time.DateOnly))
+		}
+		other.ValidTo = &lastDay
+		superseded = append(superseded, other)
+	}
+
+	// Close the previous accounts first: if verifying fails the merchant has no account, rather than two
+	for i := range superseded {
+		err = s.querier.UpdateBankAccount(ctx, &superseded[i], entities.BankAccountClosed)
+		if err != nil {
+			return nil, fmt.Errorf("error closing bank account: %w", err)
+		}
+		s.logger.Info("bank account closed", system.LogMerchantIDKey, account.MerchantID, "bank_account_id", superseded[i].ID)
+	}
+
+	account.Status = entities.VerifiedBankAccountStatus
+	err = s.querier.UpdateBankAccount(ctx, account, entities.BankAccountVerified)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying bank account: %w", err)
+	}
+	s.logger.Info("bank account verified", system.LogMerchantIDKey, account.MerchantID, "bank_account_id", account.ID)
+
+	return account, nil
+}
+
+// Reject marks an account as rejected, its disbursements not paid yet are not paid to it
+func (s *Service) Reject(ctx context.Context, id uuid.UUID) (*entities.MerchantBankAccount, error) {
+	account, err := s.account(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTransition(account, entities.RejectedBankAccountStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	account.Status = entities.RejectedBankAccountStatus
+	err = s.querier.UpdateBankAccount(ctx, account, entities.BankAccountRejected)
+	if err != nil {
+		return nil, fmt.Errorf("error rejecting bank account: %w", err)
+	}
+	s.logger.Info("bank account rejected", system.LogMerchantIDKey, account.MerchantID, "bank_account_id", account.ID)
+
+	return account, nil
+}
+
+// Close ends the validity period of an account on its last day
+func (s *Service) Close(ctx context.Context, id uuid.UUID, lastDay time.Time) (*entities.MerchantBankAccount, error) {
+	account, err := s.account(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	lastDay = system.StartOfDay(lastDay)
+	if account.Status == entities.RejectedBankAccountStatus {
+		return nil, fmt.Errorf("%w: the account is rejected", ErrorInvalidTransition)
+	}
+	if lastDay.Before(account.ValidFrom) {
+		return nil, fmt.Errorf("%w: the last day %s is before the first one %s",
+			ErrorInvalidTransition, lastDay.Format(time.DateOnly), account.ValidFrom.Format(time.DateOnly))
+	}
+
+	account.ValidTo = &lastDay
+	err = s.querier.UpdateBankAccount(ctx, account, entities.BankAccountClosed)
+	if err != nil {
+		return nil, fmt.Errorf("error closing bank account: %w", err)
+	}
+	s.logger.Info("bank account closed", system.LogMerchantIDKey, account.MerchantID, "bank_account_id", account.ID)
+
+	return account, nil
+}
+
+func (s *Service) account(ctx context.Context, id uuid.UUID) (*entities.MerchantBankAccount, error) {
+	account, err := s.querier.SelectBankAccount(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, fmt.Errorf("%w: %s", ErrorAccountNotFound, id)
+	}
+	return account, nil
+}
+
+func checkTransition(account *entities.MerchantBankAccount, to entities.BankAccountStatuses) error {
+	for _, allowed := range transitions[account.Status] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: a %s account cannot be %s", ErrorInvalidTransition, account.Status, to)
+}
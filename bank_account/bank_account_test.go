@@ -0,0 +1,246 @@
+package bank_account
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestValidateIBAN(t *testing.T) {
+	for _, iban := range []string{
+		"DE89370400440532013000",
+		"ES9121000418450200051332",
+		"NL91ABNA0417164300",
+		"GB82WEST12345698765432",
+		"FR1420041010050500013M02606",
+	} {
+		require.NoError(t, ValidateIBAN(iban), iban)
+	}
+
+	for iban, expected := range map[string]string{
+		"":                           "expected a country code",
+		"1234":                       "expected a country code",
+		"DE89 3704 0044 0532 0130":   "expected a country code",
+		"ZZ89370400440532013000":     "unknown country ZZ",
+		"DE8937040044053201300":      "DE IBANs have 22 characters",
+		"DE88370400440532013000":     "wrong check digits",
+		"ES9121000418450200051333":   "wrong check digits",
+		"NL91ABNA0417164301":         "wrong check digits",
+		"de89370400440532013000":     "expected a country code",
+		"GB82WEST1234569876543X":     "wrong check digits",
+		"FR1420041010050500013M0260": "FR IBANs have 27 characters",
+	} {
+		require.ErrorContains(t, ValidateIBAN(iban), expected, iban)
+	}
+}
+
+func TestValidateBIC(t *testing.T) {
+	require.NoError(t, ValidateBIC("COBADEFF"))
+	require.NoError(t, ValidateBIC("COBADEFFXXX"))
+	require.ErrorContains(t, ValidateBIC("COBA"), `invalid BIC "COBA"`)
+	require.ErrorContains(t, ValidateBIC("COBADEFFXX"), `invalid BIC "COBADEFFXX"`)
+}
+
+func TestNormalize(t *testing.T) {
+	require.Equal(t, "DE89370400440532013000", Normalize(" de89 3704 0044 0532 0130 00"))
+	require.Equal(t, "", Normalize(""))
+}
+
+func TestAdd(t *testing.T) {
+	ctx := context.Background()
+	merchant := &entities.Merchant{ID: uuid.New(), Reference: "padberg_group"}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchantByReference", ctx, "padberg_group").Return(merchant, nil)
+	mockQuerier.On("SelectMerchantByReference", ctx, "unknown").Return(nil, nil)
+	mockQuerier.On("InsertBankAccount", ctx, mock.Anything).Return(nil)
+
+	service := NewService(mockQuerier)
+	service.now = func() time.Time { return time.Date(2023, 2, 1, 15, 30, 0, 0, time.UTC) }
+
+	// The account is normalized and pending verification from today
+	account, err := service.Add(ctx, "padberg_group", NewAccount{
+		IBAN:       "de89 3704 0044 0532 0130 00",
+		BIC:        "cobadeffxxx",
+		HolderName: "Padberg Group GmbH",
+	})
+	require.NoError(t, err)
+	require.Equal(t, merchant.ID, account.MerchantID)
+	require.Equal(t, "DE89370400440532013000", account.IBAN)
+	require.Equal(t, "COBADEFFXXX", account.BIC)
+	require.Equal(t, entities.PendingBankAccountStatus, account.Status)
+	require.Equal(t, day(2023, 2, 1), account.ValidFrom)
+	require.Nil(t, account.ValidTo)
+	mockQuerier.AssertCalled(t, "InsertBankAccount", ctx, account)
+
+	// Every problem is reported
+	_, err = service.Add(ctx, "padberg_group", NewAccount{IBAN: "DE88370400440532013000", BIC: "COBA"})
+	require.ErrorIs(t, err, ErrorInvalidAccount)
+	require.ErrorContains(t, err, "wrong check digits")
+	require.ErrorContains(t, err, `invalid BIC "COBA"`)
+	require.ErrorContains(t, err, "the holder name must have from 1 to 70 characters")
+
+	_, err = service.Add(ctx, "unknown", NewAccount{IBAN: "DE89370400440532013000", HolderName: "Unknown"})
+	require.ErrorIs(t, err, ErrorMerchantNotFound)
+
+	mockQuerier.AssertNumberOfCalls(t, "InsertBankAccount", 1)
+}
+
+func TestVerifyClosesPreviousAccount(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+
+	previous := entities.MerchantBankAccount{
+		ID:         uuid.New(),
+		MerchantID: merchantID,
+		ValidFrom:  day(2023, 1, 1),
+		Status:     entities.VerifiedBankAccountStatus,
+	}
+	closedBefore := day(2023, 1, 31)
+	expired := entities.MerchantBankAccount{
+		ID:         uuid.New(),
+		MerchantID: merchantID,
+		ValidFrom:  day(2022, 1, 1),
+		ValidTo:    &closedBefore,
+		Status:     entities.VerifiedBankAccountStatus,
+	}
+	rejected := entities.MerchantBankAccount{
+		ID:         uuid.New(),
+		MerchantID: merchantID,
+		ValidFrom:  day(2023, 1, 1),
+		Status:     entities.RejectedBankAccountStatus,
+	}
+	pending := &entities.MerchantBankAccount{
+		ID:         uuid.New(),
+		MerchantID: merchantID,
+		ValidFrom:  day(2023, 3, 1),
+		Status:     entities.PendingBankAccountStatus,
+	}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectBankAccount", ctx, pending.ID).Return(pending, nil)
+	mockQuerier.On("SelectBankAccounts", ctx, merchantID).Return(
+		[]entities.MerchantBankAccount{previous, expired, rejected, *pending}, nil)
+	mockQuerier.On("UpdateBankAccount", ctx, mock.Anything, mock.Anything).Return(nil)
+
+	account, err := NewService(mockQuerier).Verify(ctx, pending.ID)
+	require.NoError(t, err)
+	require.Equal(t, entities.VerifiedBankAccountStatus, account.Status)
+
+	// Only the open verified account is closed, the day before the new one is valid
+	mockQuerier.AssertCalled(t, "UpdateBankAccount", ctx, mock.MatchedBy(func(a *entities.MerchantBankAccount) bool {
+		return a.ID == previous.ID && a.ValidTo != nil && a.ValidTo.Equal(day(2023, 2, 28))
+	}), entities.BankAccountClosed)
+	mockQuerier.AssertCalled(t, "UpdateBankAccount", ctx, pending, entities.BankAccountVerified)
+	mockQuerier.AssertNumberOfCalls(t, "UpdateBankAccount", 2)
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+
+	later := entities.MerchantBankAccount{
+		ID:         uuid.New(),
+		MerchantID: merchantID,
+		ValidFrom:  day(2023, 3, 1),
+		Status:     entities.VerifiedBankAccountStatus,
+	}
+	pending := &entities.MerchantBankAccount{
+		ID:         uuid.New(),
+		MerchantID: merchantID,
+		ValidFrom:  day(2023, 2, 1),
+		Status:     entities.PendingBankAccountStatus,
+	}
+	rejected := &entities.MerchantBankAccount{
+		ID:     uuid.New(),
+		Status: entities.RejectedBankAccountStatus,
+	}
+	missing := uuid.New()
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectBankAccount", ctx, pending.ID).Return(pending, nil)
+	mockQuerier.On("SelectBankAccount", ctx, rejected.ID).Return(rejected, nil)
+	mockQuerier.On("SelectBankAccount", ctx, missing).Return(nil, nil)
+	mockQuerier.On("SelectBankAccounts", ctx, merchantID).Return([]entities.MerchantBankAccount{later, *pending}, nil)
+
+	service := NewService(mockQuerier)
+
+	// A verified account valid from a later day is not closed before it starts
+	_, err := service.Verify(ctx, pending.ID)
+	require.ErrorIs(t, err, ErrorInvalidTransition)
+	require.ErrorContains(t, err, "is valid from 2023-03-01, after 2023-02-01")
+
+	_, err = service.Verify(ctx, rejected.ID)
+	require.ErrorIs(t, err, ErrorInvalidTransition)
+	require.ErrorContains(t, err, "a rejected account cannot be verified")
+
+	_, err = service.Verify(ctx, missing)
+	require.ErrorIs(t, err, ErrorAccountNotFound)
+
+	mockQuerier.AssertNotCalled(t, "UpdateBankAccount", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRejectAndClose(t *testing.T) {
+	ctx := context.Background()
+	verified := &entities.MerchantBankAccount{
+		ID:        uuid.New(),
+		ValidFrom: day(2023, 1, 1),
+		Status:    entities.VerifiedBankAccountStatus,
+	}
+	rejected := &entities.MerchantBankAccount{
+		ID:        uuid.New(),
+		ValidFrom: day(2023, 1, 1),
+		Status:    entities.RejectedBankAccountStatus,
+	}
+	failing := &entities.MerchantBankAccount{
+		ID:        uuid.New(),
+		ValidFrom: day(2023, 1, 1),
+		Status:    entities.PendingBankAccountStatus,
+	}
+	dbError := errors.New("database error")
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectBankAccount", ctx, verified.ID).Return(verified, nil)
+	mockQuerier.On("SelectBankAccount", ctx, rejected.ID).Return(rejected, nil)
+	mockQuerier.On("SelectBankAccount", ctx, failing.ID).Return(failing, nil)
+	mockQuerier.On("UpdateBankAccount", ctx, verified, mock.Anything).Return(nil)
+	mockQuerier.On("UpdateBankAccount", ctx, failing, mock.Anything).Return(dbError)
+
+	service := NewService(mockQuerier)
+
+	// Closing keeps the status, the account is valid until its last day
+	account, err := service.Close(ctx, verified.ID, time.Date(2023, 1, 31, 18, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, entities.VerifiedBankAccountStatus, account.Status)
+	require.Equal(t, day(2023, 1, 31), *account.ValidTo)
+	require.True(t, account.ValidOn(day(2023, 1, 31)))
+	require.False(t, account.ValidOn(day(2023, 2, 1)))
+
+	_, err = service.Close(ctx, verified.ID, day(2022, 12, 31))
+	require.ErrorIs(t, err, ErrorInvalidTransition)
+
+	_, err = service.Close(ctx, rejected.ID, day(2023, 1, 31))
+	require.ErrorIs(t, err, ErrorInvalidTransition)
+
+	account, err = service.Reject(ctx, verified.ID)
+	require.NoError(t, err)
+	require.Equal(t, entities.RejectedBankAccountStatus, account.Status)
+	mockQuerier.AssertCalled(t, "UpdateBankAccount", ctx, verified, entities.BankAccountRejected)
+
+	_, err = service.Reject(ctx, rejected.ID)
+	require.ErrorIs(t, err, ErrorInvalidTransition)
+
+	_, err = service.Reject(ctx, failing.ID)
+	require.ErrorIs(t, err, dbError)
+}
@@ -0,0 +1,72 @@
+package bank_account
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ibanLengths is the length of the IBANs of each country, from the IBAN registry
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22, "BH": 22, "BR": 29,
+	"BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22, "DK": 18, "DO": 28, "EE": 20, "EG": 29,
+	"ES": 24, "FI": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28,
+	"HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20,
+	"LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24, "ME": 22, "MK": 19,
+	"MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24, "PL": 28, "PS": 29, "PT": 25, "QA": 29,
+	"RO": 24, "RS": 22, "SA": 24, "SC": 31, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28,
+	"TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+var (
+	ibanPattern = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{1,30}$`)
+	bicPattern  = regexp.MustCompile(`^[A-Z]{6}[A-Z2-9][A-NP-Z0-9]([A-Z0-9]{3})?$`)
+)
+
+// Normalize removes the spaces of an IBAN or a BIC, as they are usually written, and uppercases it
+func Normalize(code string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+}
+
+// ValidateIBAN checks a normalized IBAN: its format, the length for its country and its mod-97 check digits
+func ValidateIBAN(iban string) error {
+	if !ibanPattern.MatchString(iban) {
+		return fmt.Errorf("invalid IBAN %q, expected a country code, 2 check digits and the account number", iban)
+	}
+
+	length, known := ibanLengths[iban[:2]]
+	if !known {
+		return fmt.Errorf("invalid IBAN %q, unknown country %s", iban, iban[:2])
+	}
+	if len(iban) != length {
+		return fmt.Errorf("invalid IBAN %q, %s IBANs have %d characters", iban, iban[:2], length)
+	}
+
+	if ibanRemainder(iban) != 1 {
+		return fmt.Errorf("invalid IBAN %q, wrong check digits", iban)
+	}
+	return nil
+}
+
+// ibanRemainder computes the ISO 7064 mod 97-10 remainder of an IBAN,
+// with the country code and the check digits moved to the end and the letters converted to numbers, A being 10
+func ibanRemainder(iban string) int {
+	remainder := 0
+	for _, r := range iban[4:] + iban[:4] {
+		if r >= 'A' && r <= 'Z' {
+			value := int(r-'A') + 10
+			remainder = (remainder*100 + value) % 97
+		} else {
+			remainder = (remainder*10 + int(r-'0')) % 97
+		}
+	}
+	return remainder
+}
+
+// ValidateBIC checks a normalized BIC, of 8 or 11 characters
+func ValidateBIC(bic string) error {
+	if !bicPattern.MatchString(bic) {
+		return fmt.Errorf("invalid BIC %q, expected 8 or 11 letters and digits", bic)
+	}
+	return nil
+}
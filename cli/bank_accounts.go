@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/bank_account"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/report"
+)
+
+func bankAccountsCommand() *command {
+	return &command{
+		name:    "bank-accounts",
+		summary: "Manage the bank accounts the merchant disbursements are paid to",
+		usage: "bank-accounts list -merchant reference [-history] [-format table|csv|json]" +
+			" | bank-accounts add -merchant reference -iban iban -holder name [-bic bic] [-valid-from yyyy-mm-dd]" +
+			" | bank-accounts verify|reject -id id | bank-accounts close -id id -last-day yyyy-mm-dd",
+		run: runBankAccounts,
+	}
+}
+
+func runBankAccounts(ctx context.Context, globals *Globals, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing bank-accounts action, expected list, add, verify, reject or close", ErrorUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		return listBankAccounts(ctx, globals, args[1:])
+	case "add":
+		return addBankAccount(ctx, globals, args[1:])
+	case "verify", "reject", "close":
+		return changeBankAccount(ctx, globals, args[0], args[1:])
+	}
+	return fmt.Errorf("%w: unknown bank-accounts action %q, expected list, add, verify, reject or close", ErrorUsage, args[0])
+}
+
+func listBankAccounts(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(bankAccountsCommand())
+	reference := fs.String("merchant", "", "Reference of the merchant")
+	history := fs.Bool("history", false, "List the changes of the accounts instead. Defaults to false")
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+
+	err := parseAction(globals, fs, "bank-accounts list", args)
+	if err != nil {
+		return err
+	}
+	if *reference == "" {
+		return fmt.Errorf("%w: bank-accounts list requires -merchant", ErrorUsage)
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	merchant, err := querier.SelectMerchantByReference(ctx, *reference)
+	if err != nil {
+		return err
+	}
+	if merchant == nil {
+		return fmt.Errorf("%w: %q", bank_account.ErrorMerchantNotFound, *reference)
+	}
+
+	if *history {
+		changes, err := querier.SelectBankAccountChanges(ctx, merchant.ID)
+		if err != nil {
+			return err
+		}
+
+		table := report.NewTable("changed_at", "bank_account_id", "change", "status", "valid_from", "valid_to")
+		for _, change := range changes {
+			table.AddRow(
+				change.ChangedAt.Format(time.RFC3339),
+				change.BankAccountID,
+				change.Change,
+				string(change.Status),
+				change.ValidFrom,
+				optionalDay(change.ValidTo))
+		}
+		return report.Write(globals.Stdout, outputFormat, table)
+	}
+
+	accounts, err := querier.SelectBankAccounts(ctx, merchant.ID)
+	if err != nil {
+		return err
+	}
+
+	table := report.NewTable("id", "iban", "bic", "holder_name", "valid_from", "valid_to", "status")
+	for _, account := range accounts {
+		table.AddRow(
+			account.ID,
+			account.IBAN,
+			account.BIC,
+			account.HolderName,
+			account.ValidFrom,
+			optionalDay(account.ValidTo),
+			string(account.Status))
+	}
+	return report.Write(globals.Stdout, outputFormat, table)
+}
+
+// addBankAccount adds an account to a merchant, pending verification
+func addBankAccount(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(bankAccountsCommand())
+	reference := fs.String("merchant", "", "Reference of the merchant")
+	iban := fs.String("iban", "", "IBAN of the account, spaces are ignored")
+	bic := fs.String("bic", "", "BIC of the bank of the account. Optional")
+	holder := fs.String("holder", "", "Name of the account holder")
+	validFrom := fs.String("valid-from", "", "First day the disbursements are paid to the account, yyyy-mm-dd. Defaults to today")
+
+	err := parseAction(globals, fs, "bank-accounts add", args)
+	if err != nil {
+		return err
+	}
+	if *reference == "" || *iban == "" || *holder == "" {
+		return fmt.Errorf("%w: bank-accounts add requires -merchant, -iban and -holder", ErrorUsage)
+	}
+
+	newAccount := bank_account.NewAccount{
+		IBAN:       *iban,
+		BIC:        *bic,
+		HolderName: *holder,
+	}
+	if *validFrom != "" {
+		newAccount.ValidFrom, err = parseDay("valid-from", *validFrom)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Check the account details before connecting
+	err = bank_account.ValidateIBAN(bank_account.Normalize(*iban))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+	if *bic != "" {
+		err = bank_account.ValidateBIC(bank_account.Normalize(*bic))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrorUsage, err)
+		}
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	account, err := bank_account.NewService(querier).Add(ctx, *reference, newAccount)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(globals.Stdout, "bank account %s of %s added, pending verification\n", account.ID, *reference)
+	return nil
+}
+
+// changeBankAccount verifies, rejects or closes an account
+func changeBankAccount(ctx context.Context, globals *Globals, action string, args []string) error {
+	fs := globals.newFlagSet(bankAccountsCommand())
+	id := fs.String("id", "", "ID of the bank account")
+	var lastDay *string
+	if action == "close" {
+		lastDay = fs.String("last-day", "", "Last day the disbursements are paid to the account, yyyy-mm-dd")
+	}
+
+	err := parseAction(globals, fs, "bank-accounts "+action, args)
+	if err != nil {
+		return err
+	}
+	if *id == "" {
+		return fmt.Errorf("%w: bank-accounts %s requires -id", ErrorUsage, action)
+	}
+	accountID, err := uuid.Parse(*id)
+	if err != nil {
+		return fmt.Errorf("%w: invalid bank account id %q", ErrorUsage, *id)
+	}
+
+	var last time.Time
+	if action == "close" {
+		if *lastDay == "" {
+			return fmt.Errorf("%w: bank-accounts close requires -last-day", ErrorUsage)
+		}
+		last, err = parseDay("last-day", *lastDay)
+		if err != nil {
+			return err
+		}
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	service := bank_account.NewService(querier)
+	var account *entities.MerchantBankAccount
+	switch action {
+	case "verify":
+		account, err = service.Verify(ctx, accountID)
+	case "reject":
+		account, err = service.Reject(ctx, accountID)
+	case "close":
+		account, err = service.Close(ctx, accountID, last)
+	}
+	if err != nil {
+		return err
+	}
+
+	validTo := "open"
+	if account.ValidTo != nil {
+		validTo = account.ValidTo.Format(time.DateOnly)
+	}
+	fmt.Fprintf(globals.Stdout, "bank account %s: %s, valid from %s to %s\n",
+		account.ID,
+		account.Status,
+		account.ValidFrom.Format(time.DateOnly),
+		validTo)
+	return nil
+}
+
+// parseAction parses the flags of a command action, like "bank-accounts list", which takes no arguments
+func parseAction(globals *Globals, fs *flag.FlagSet, action string, args []string) error {
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%w: %s does not take arguments", ErrorUsage, action)
+	}
+	return nil
+}
+
+func parseDay(name, value string) (time.Time, error) {
+	day, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid %s %q, expected a date like 2023-01-31", ErrorUsage, name, value)
+	}
+	return day, nil
+}
+
+// optionalDay is the day to report, nil when the account has no last day
+func optionalDay(day *time.Time) any {
+	if day == nil {
+		return nil
+	}
+	return *day
+}
@@ -0,0 +1,300 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+const (
+	// Name is the name of the unified binary
+	Name = "disbursement"
+
+	ExitSuccess = 0
+	ExitFailure = 1
+	ExitUsage   = 2
+)
+
+// ErrorUsage is returned by commands when the command line is not valid
+var ErrorUsage = errors.New("invalid usage")
+
+// Globals holds the options shared by every command
+// They can be given before the command name or among the command options
+type Globals struct {
+	ConfigFile string
+	Config     system.Config // Resolved once the command options are parsed
+	Version    string
+	Stdout     io.Writer
+	Stderr     io.Writer
+
+	overrides []func(*system.Config) // Options given as flags, which take precedence over the config
+}
+
+// command is a subcommand of the unified binary
+type command struct {
+	name    string
+	summary string
+	usage   string
+	run     func(ctx context.Context, globals *Globals, args []string) error
+}
+
+// commands lists the available subcommands, in the order shown in the help
+func commands() []*command {
+	return []*command{
+		loadCommand(),
+		processCommand(),
+		disbursementsCommand(),
+		merchantsCommand(),
+		bankAccountsCommand(),
+		reportCommand(),
+		statementCommand(),
+		payoutCommand(),
+		reconcileCommand(),
+		ledgerCommand(),
+		webhooksCommand(),
+		serveCommand(),
+		migrateCommand(),
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// Main runs the command line with the process standard streams and returns the exit code
+// It is the entry point of the unified binary and the compatibility wrappers
+func Main(version string, args []string) int {
+	// Create an overarching context which we can use to safely cancel
+	// all goroutines when we receive a signal to terminate.
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+
+	// Set the timezone to UTC
+	system.SetGlobalTimezoneUTC() //nolint:all
+
+	return Run(ctx, version, args, os.Stdout, os.Stderr)
+}
+
+// Run parses the global options, then runs the command named in args
+func Run(ctx context.Context, version string, args []string, stdout, stderr io.Writer) int {
+	globals := &Globals{
+		ConfigFile: os.Getenv("CONFIG_FILE"),
+		Version:    version,
+		Stdout:     stdout,
+		Stderr:     stderr,
+	}
+
+	fs := flag.NewFlagSet(Name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	globals.register(fs)
+	fs.Usage = func() { printUsage(stderr) }
+
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return ExitSuccess
+	}
+	if err != nil {
+		return ExitUsage
+	}
+
+	if fs.NArg() == 0 {
+		printUsage(stderr)
+		return ExitUsage
+	}
+
+	name := fs.Arg(0)
+	if name == "help" {
+		return help(stdout, stderr, fs.Args()[1:])
+	}
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", name)
+		printUsage(stderr)
+		return ExitUsage
+	}
+
+	err = cmd.run(ctx, globals, fs.Args()[1:])
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return ExitSuccess
+	case errors.Is(err, ErrorUsage):
+		fmt.Fprintf(stderr, "%s\n", err)
+		return ExitUsage
+	default:
+		fmt.Fprintf(stderr, "%s: %s\n", cmd.name, err)
+		return ExitFailure
+	}
+}
+
+// register adds the global options to a flag set
+func (g *Globals) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.ConfigFile, "config", g.ConfigFile, configUsage)
+	fs.Func("db", system.DBConnURLUsage, func(value string) error {
+		g.override(func(cfg *system.Config) { cfg.Database.URL = value })
+		return nil
+	})
+	g.boolFlag(fs, "auto-migrate", autoMigrateUsage, func(cfg *system.Config, value bool) {
+		cfg.Database.AutoMigrate = value
+	})
+	fs.Func("log-level", logLevelUsage, func(value string) error {
+		g.override(func(cfg *system.Config) { cfg.Log.Level = value })
+		return nil
+	})
+	fs.Func("http-addr", httpAddrUsage, func(value string) error {
+		g.override(func(cfg *system.Config) { cfg.HTTP.Addr = value })
+		return nil
+	})
+}
+
+const (
+	configUsage      = "YAML config file, see config.example.yaml. Defaults to CONFIG_FILE"
+	autoMigrateUsage = "Run the database migrations on start. When false the schema version is only verified. Defaults to AUTO_MIGRATE, or true"
+	httpAddrUsage    = "Serve /metrics and, for the loader, /healthz and /readyz on the `address`, eg: :9090. Defaults to HTTP_ADDR, or disabled"
+	logLevelUsage    = "Minimum `level` of the JSON logs written to stderr: debug, info, warn or error. Defaults to LOG_LEVEL, or info"
+)
+
+// override records an option given as a flag, applied on top of the config file and environment
+func (g *Globals) override(apply func(*system.Config)) {
+	g.overrides = append(g.overrides, apply)
+}
+
+// boolFlag registers a boolean flag overriding a config value
+func (g *Globals) boolFlag(fs *flag.FlagSet, name, usage string, apply func(*system.Config, bool)) {
+	fs.BoolFunc(name, usage, func(value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		g.override(func(cfg *system.Config) { apply(cfg, parsed) })
+		return nil
+	})
+}
+
+// loadConfig resolves the config from the defaults, the config file, the environment and the flags
+// Once resolved, the logs are written to stderr as JSON with the configured level
+func (g *Globals) loadConfig() error {
+	cfg, err := system.LoadConfig(g.ConfigFile, os.LookupEnv)
+	if err != nil {
+		return err
+	}
+
+	for _, apply := range g.overrides {
+		apply(cfg)
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	level, err := system.ParseLogLevel(cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(system.NewLogger(g.Stderr, level))
+
+	g.Config = *cfg
+	return nil
+}
+
+// newFlagSet creates the flag set of a command, including the global options
+func (g *Globals) newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(g.Stderr)
+	g.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(g.Stderr, "Usage: %s %s\n\n%s\n\nOptions:\n", Name, cmd.usage, cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the command options and resolves the config, errors are reported as usage errors
+func (g *Globals) parse(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	err = g.loadConfig()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+	return nil
+}
+
+// connect opens the database connection and runs the migrations, unless disabled
+func (g *Globals) connect(ctx context.Context) (*database.PostgresQuerier, error) {
+	dBConnURL, err := system.ValidateDBConnURL(g.Config.Database.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	var opts []database.Option
+	if !g.Config.Database.AutoMigrate {
+		opts = append(opts, database.WithoutMigrations())
+	}
+
+	// Set up the database connection and run migrations
+	slog.Debug("connecting to database")
+	querier, err := database.NewPostgresQuerier(ctx, dBConnURL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the database: %w", err)
+	}
+
+	return querier, nil
+}
+
+func help(stdout, stderr io.Writer, args []string) int {
+	if len(args) == 0 {
+		printUsage(stdout)
+		return ExitSuccess
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return ExitUsage
+	}
+
+	globals := &Globals{Stderr: stdout}
+	globals.newFlagSet(cmd).Usage()
+	return ExitSuccess
+}
+
+func printUsage(w io.Writer) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Usage: %s [global options] <command> [options]\n\n", Name)
+	fmt.Fprintf(&b, "Commands:\n")
+	for _, cmd := range commands() {
+		fmt.Fprintf(&b, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(&b, "\nGlobal options:\n")
+	fs := flag.NewFlagSet(Name, flag.ContinueOnError)
+	fs.SetOutput(&b)
+	(&Globals{}).register(fs)
+	fs.PrintDefaults()
+	fmt.Fprintf(&b, "\nRun '%s help <command>' for the options of a command.\n", Name)
+
+	fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,340 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func runCLI(t *testing.T, args ...string) (int, string, string) {
+	t.Setenv("DATABASE_URL", "")
+
+	var stdout, stderr bytes.Buffer
+	code := Run(context.Background(), "test", args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunWithoutCommand(t *testing.T) {
+	code, _, stderr := runCLI(t)
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, "Usage: disbursement [global options] <command> [options]")
+	require.Contains(t, stderr, "load")
+	require.Contains(t, stderr, "process")
+	require.Contains(t, stderr, "merchants")
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	code, _, stderr := runCLI(t, "unknown")
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, `unknown command "unknown"`)
+}
+
+func TestRunHelp(t *testing.T) {
+	code, stdout, _ := runCLI(t, "help")
+	require.Equal(t, ExitSuccess, code)
+	require.Contains(t, stdout, "Global options:")
+	require.Contains(t, stdout, "-db url")
+
+	code, stdout, _ = runCLI(t, "help", "process")
+	require.Equal(t, ExitSuccess, code)
+	require.Contains(t, stdout, "Usage: disbursement process")
+	require.Contains(t, stdout, "-dry-run")
+	require.Contains(t, stdout, "-db url")
+
+	code, _, stderr := runCLI(t, "help", "unknown")
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, `unknown command "unknown"`)
+
+	code, _, stderr = runCLI(t, "process", "-h")
+	require.Equal(t, ExitSuccess, code)
+	require.Contains(t, stderr, "Usage: disbursement process")
+}
+
+func TestRunMissingDatabase(t *testing.T) {
+	for _, command := range []string{"process", "merchants"} {
+		code, _, stderr := runCLI(t, command)
+		require.Equal(t, ExitUsage, code, command)
+		require.Contains(t, stderr, "missing -db or DATABASE_URL", command)
+	}
+}
+
+func TestRunInvalidOptions(t *testing.T) {
+	tests := []struct {
+		args        []string
+		expectedErr string
+	}{
+		{[]string{"process", "-unknown"}, "flag provided but not defined: -unknown"},
+		{[]string{"process", "-from", "2023-01-31", "-to", "2023-01-01"}, "the range end 2023-01-01 is before its start 2023-01-31"},
+		{[]string{"process", "-from", "2023-01-01"}, "missing -to"},
+		{[]string{"process", "-dry-run", "-format", "xml"}, "unknown report format"},
+		{[]string{"merchants", "-format", "xml"}, "unknown report format"},
+		{[]string{"merchants", "remove"}, `unknown merchants action "remove"`},
+		{[]string{"merchants", "set-currency", "-currency", "GBP"}, "merchants set-currency requires -merchant"},
+		{[]string{"merchants", "set-currency", "-merchant", "padberg_group", "-currency", "pounds"}, `invalid currency "pounds"`},
+		{[]string{"merchants", "set-currency", "-merchant", "padberg_group", "-currency", "GBP"}, "missing -db or DATABASE_URL"},
+		{[]string{"-unknown", "process"}, "flag provided but not defined: -unknown"},
+		{[]string{"-log-level", "verbose", "process"}, `invalid log level "verbose"`},
+	}
+
+	for _, test := range tests {
+		code, _, stderr := runCLI(t, test.args...)
+		require.Equal(t, ExitUsage, code, test.args)
+		require.Contains(t, stderr, test.expectedErr, test.args)
+	}
+}
+
+func TestRunLogsAsJSON(t *testing.T) {
+	t.Setenv("DATABASE_URL", "")
+
+	code, _, stderr := runCLI(t, "process", "-log-level", "warn")
+	require.Equal(t, ExitUsage, code)
+	require.NotContains(t, stderr, "starting job")
+
+	code, _, stderr = runCLI(t, "process", "-log-level", "info")
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, `"msg":"starting job"`)
+	require.Contains(t, stderr, `"component":"processor"`)
+	require.Contains(t, stderr, `"version":"test"`)
+}
+
+func TestGlobalOptionsPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte("database:\n  url: postgres://file\n  auto_migrate: false\nprocessor:\n  wait_for_lock: true\n"), 0o600)
+	require.NoError(t, err)
+
+	t.Setenv("DATABASE_URL", "postgres://env")
+
+	var stdout, stderr bytes.Buffer
+
+	// The environment takes precedence over the config file
+	globals := &Globals{ConfigFile: configFile, Stdout: &stdout, Stderr: &stderr}
+	fs := globals.newFlagSet(processCommand())
+	err = globals.parse(fs, []string{})
+	require.NoError(t, err)
+	require.Equal(t, "postgres://env", globals.Config.Database.URL)
+	require.False(t, globals.Config.Database.AutoMigrate)
+	require.True(t, globals.Config.Processor.WaitForLock)
+
+	// Flags take precedence over everything, given before or after the command name
+	globals = &Globals{ConfigFile: configFile, Stdout: &stdout, Stderr: &stderr}
+	fs = globals.newFlagSet(migrateCommand())
+	err = fs.Parse([]string{"-auto-migrate"})
+	require.NoError(t, err)
+
+	fs = globals.newFlagSet(processCommand())
+	err = globals.parse(fs, []string{"-db", "postgres://flag"})
+	require.NoError(t, err)
+	require.Equal(t, "postgres://flag", globals.Config.Database.URL)
+	require.True(t, globals.Config.Database.AutoMigrate)
+	require.True(t, globals.Config.Processor.WaitForLock)
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte("loader:\n  job_pause: -1s\n"), 0o600)
+	require.NoError(t, err)
+
+	code, _, stderr := runCLI(t, "-config", configFile, "process")
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, "invalid config: loader job_pause must be positive")
+
+	code, _, stderr = runCLI(t, "-config", "missing.yaml", "process")
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, "error reading config file")
+}
+
+func TestParseMigrateAction(t *testing.T) {
+	tests := []struct {
+		args            []string
+		expectedAction  string
+		expectedVersion int
+	}{
+		{[]string{"up"}, "up", 0},
+		{[]string{"down"}, "down", 0},
+		{[]string{"status"}, "status", 0},
+		{[]string{"to", "5"}, "to", 5},
+		{[]string{"to", "0"}, "to", 0},
+		{[]string{"force", "8"}, "force", 8},
+		{[]string{"force", "-1"}, "force", -1},
+	}
+
+	for _, test := range tests {
+		action, version, err := parseMigrateAction(test.args)
+		require.NoError(t, err, test.args)
+		require.Equal(t, test.expectedAction, action)
+		require.Equal(t, test.expectedVersion, version)
+	}
+
+	for _, args := range [][]string{{}, {"sideways"}, {"up", "1"}, {"to"}, {"to", "x"}, {"to", "-1"}, {"force", "-2"}} {
+		_, _, err := parseMigrateAction(args)
+		require.ErrorIs(t, err, ErrorUsage, args)
+	}
+}
+
+func TestRunMigrateInvalidAction(t *testing.T) {
+	code, _, stderr := runCLI(t, "migrate", "sideways")
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, `unknown migrate action "sideways"`)
+}
+
+func TestRunServeRequiresAddr(t *testing.T) {
+	code, _, stderr := runCLI(t, "serve")
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, "the API requires an HTTP address")
+}
+
+func TestRunReportInvalidUsage(t *testing.T) {
+	for args, expected := range map[string]string{
+		"report":                     "missing report, expected yearly or debts",
+		"report monthly":             `unknown report "monthly", expected yearly or debts`,
+		"report yearly extra":        "report yearly does not take arguments",
+		"report yearly -year -1":     "invalid year -1",
+		"report yearly -format md":   `unknown report format "md"`,
+		"report debts extra":         "report debts does not take arguments",
+		"report debts -format md":    `unknown report format "md"`,
+		"ledger":                     "missing ledger action, expected check or balances",
+		"ledger verify":              `unknown ledger action "verify", expected check or balances`,
+		"ledger check extra":         "ledger check does not take arguments",
+		"ledger balances -format md": `unknown report format "md"`,
+	} {
+		code, _, stderr := runCLI(t, strings.Fields(args)...)
+		require.Equal(t, ExitUsage, code, args)
+		require.Contains(t, stderr, expected, args)
+	}
+}
+
+func TestRunStatementInvalidUsage(t *testing.T) {
+	for args, expected := range map[string]string{
+		"statement":                                        "expected -disbursement, or -merchant and -month",
+		"statement -merchant padberg_group":                "expected -disbursement, or -merchant and -month",
+		"statement -disbursement DSB-1 -month 2023-01":     "-disbursement cannot be given with -merchant and -month",
+		"statement -merchant padberg_group -month 2023/01": `invalid month "2023/01"`,
+		"statement -disbursement DSB-1 -format xlsx":       `unknown statement format "xlsx"`,
+		"statement -disbursement DSB-1 extra":              "statement does not take arguments",
+	} {
+		code, _, stderr := runCLI(t, strings.Fields(args)...)
+		require.Equal(t, ExitUsage, code, args)
+		require.Contains(t, stderr, expected, args)
+	}
+}
+
+func TestRunPayoutInvalidUsage(t *testing.T) {
+	t.Setenv("PAYOUT_DEBTOR_NAME", "Sequra Payouts")
+	t.Setenv("PAYOUT_DEBTOR_IBAN", "ES9121000418450200051332")
+
+	for args, expected := range map[string]string{
+		"payout":                          "missing -output",
+		"payout -output payout.xml extra": "payout does not take arguments",
+		"payout -output payout.xml -day 2023-13-01":            `invalid date "2023-13-01"`,
+		"payout -output payout.xml -execution-date 16/01/2023": `invalid execution date "16/01/2023"`,
+		"payout -output payout.xml -execution-date 2023-01-16": "the execution date 2023-01-16 is in the past",
+		"payout -dry-run": "missing -db or DATABASE_URL",
+	} {
+		code, _, stderr := runCLI(t, strings.Fields(args)...)
+		require.Equal(t, ExitUsage, code, args)
+		require.Contains(t, stderr, expected, args)
+	}
+}
+
+func TestRunPayoutRequiresDebtor(t *testing.T) {
+	t.Setenv("PAYOUT_DEBTOR_IBAN", "ES91 2100")
+
+	code, _, stderr := runCLI(t, "payout", "-dry-run")
+	require.Equal(t, ExitUsage, code)
+	require.Contains(t, stderr, "payout debtor_name is required")
+	require.Contains(t, stderr, `invalid IBAN "ES91 2100"`)
+}
+
+func TestRunDisbursementsInvalidUsage(t *testing.T) {
+	for args, expected := range map[string]string{
+		"disbursements":                                             "missing disbursements action",
+		"disbursements pay":                                         `unknown disbursements action "pay"`,
+		"disbursements list -status paid":                           `unknown disbursement status "paid"`,
+		"disbursements list extra":                                  "disbursements list does not take arguments",
+		"disbursements approve":                                     "requires either -reference or -day",
+		"disbursements approve -reference DSB-1 -day yesterday":     "requires either -reference or -day",
+		"disbursements approve -day 2999-01-01":                     "in the future",
+		"disbursements set-status -reference DSB-1":                 "requires -reference and -status",
+		"disbursements set-status -reference DSB-1 -status paid":    `unknown disbursement status "paid"`,
+		"disbursements history":                                     "requires -reference",
+		"disbursements history -reference DSB-1 -format xml":        `unknown report format "xml"`,
+		"disbursements set-status -reference DSB-1 -status settled": "missing -db or DATABASE_URL",
+		"disbursements approve -day yesterday":                      "missing -db or DATABASE_URL",
+	} {
+		code, _, stderr := runCLI(t, strings.Fields(args)...)
+		require.Equal(t, ExitUsage, code, args)
+		require.Contains(t, stderr, expected, args)
+	}
+}
+
+func TestRunReconcileInvalidUsage(t *testing.T) {
+	for args, expected := range map[string]string{
+		"reconcile":                             "missing reconcile action",
+		"reconcile match":                       `unknown reconcile action "match"`,
+		"reconcile import -watch statement.xml": "it does not take files",
+		"reconcile report extra":                "reconcile report does not take arguments",
+		"reconcile report -from 2023-01-01":     "both -from and -to are required",
+		"reconcile report -day 2999-01-01":      "in the future",
+		"reconcile report -format xml":          `unknown report format "xml"`,
+		"reconcile import statement.xml":        "missing -db or DATABASE_URL",
+		"reconcile report -day yesterday -all":  "missing -db or DATABASE_URL",
+	} {
+		code, _, stderr := runCLI(t, strings.Fields(args)...)
+		require.Equal(t, ExitUsage, code, args)
+		require.Contains(t, stderr, expected, args)
+	}
+}
+
+func TestRunWebhooksInvalidUsage(t *testing.T) {
+	for args, expected := range map[string]string{
+		"webhooks":      "missing webhooks action",
+		"webhooks send": `unknown webhooks action "send"`,
+		"webhooks set -url https://merchant.example":    "webhooks set requires -merchant",
+		"webhooks set -merchant padberg_group":          "webhooks set requires -url",
+		"webhooks set -merchant padberg_group -url ftp": "invalid webhook url",
+		"webhooks remove":            "webhooks remove requires -merchant",
+		"webhooks list -status lost": `unknown status "lost"`,
+		"webhooks list -limit 0":     "-limit must be at least 1",
+		"webhooks list -format xml":  `unknown report format "xml"`,
+		"webhooks retry":             "webhooks retry requires -id",
+		"webhooks retry -id 42":      `invalid event id "42"`,
+		"webhooks dispatch extra":    "webhooks dispatch does not take arguments",
+		"webhooks listen":            "webhooks listen requires -secret",
+		"webhooks set -merchant padberg_group -url https://merchant.example/hooks": "missing -db or DATABASE_URL",
+		"webhooks list -status dead -merchant padberg_group":                       "missing -db or DATABASE_URL",
+		"webhooks dispatch": "missing -db or DATABASE_URL",
+	} {
+		code, _, stderr := runCLI(t, strings.Fields(args)...)
+		require.Equal(t, ExitUsage, code, args)
+		require.Contains(t, stderr, expected, args)
+	}
+}
+
+func TestRunBankAccountsInvalidUsage(t *testing.T) {
+	for args, expected := range map[string]string{
+		"bank-accounts":                              "missing bank-accounts action",
+		"bank-accounts remove":                       `unknown bank-accounts action "remove"`,
+		"bank-accounts list":                         "requires -merchant",
+		"bank-accounts list -merchant a b":           "does not take arguments",
+		"bank-accounts list -merchant a -format xml": `unknown report format "xml"`,
+		"bank-accounts add -merchant padberg_group -iban DE89370400440532013000":                                        "requires -merchant, -iban and -holder",
+		"bank-accounts add -merchant padberg_group -iban 1234 -holder Padberg":                                          `invalid IBAN "1234"`,
+		"bank-accounts add -merchant padberg_group -iban DE89370400440532013001 -holder Padberg":                        "wrong check digits",
+		"bank-accounts add -merchant padberg_group -iban DE89370400440532013000 -holder Padberg -bic COBA":              `invalid BIC "COBA"`,
+		"bank-accounts add -merchant padberg_group -iban DE89370400440532013000 -holder Padberg -valid-from 2023-13-01": "invalid valid-from",
+		"bank-accounts add -merchant padberg_group -iban de89370400440532013000 -holder Padberg":                        "missing -db or DATABASE_URL",
+		"bank-accounts verify":                                          "requires -id",
+		"bank-accounts reject -id 42":                                   `invalid bank account id "42"`,
+		"bank-accounts close -id 9b2f7c4e-1d9a-4a51-8f3c-2b6f0e0a7d11":  "requires -last-day",
+		"bank-accounts verify -id 9b2f7c4e-1d9a-4a51-8f3c-2b6f0e0a7d11": "missing -db or DATABASE_URL",
+	} {
+		code, _, stderr := runCLI(t, strings.Fields(args)...)
+		require.Equal(t, ExitUsage, code, args)
+		require.Contains(t, stderr, expected, args)
+	}
+}
@@ -0,0 +1,235 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/disbursement_status"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/report"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+func disbursementsCommand() *command {
+	return &command{
+		name:    "disbursements",
+		summary: "Follow and change the payout status of the disbursements",
+		usage: "disbursements list [-status status] [-merchant reference] [-format table|csv|json]" +
+			" | disbursements approve -reference reference | -day date [-reason text]" +
+			" | disbursements set-status -reference reference -status status [-reason text]" +
+			" | disbursements history -reference reference [-format table|csv|json]",
+		run: runDisbursements,
+	}
+}
+
+func runDisbursements(ctx context.Context, globals *Globals, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing disbursements action, expected list, approve, set-status or history", ErrorUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		return listDisbursements(ctx, globals, args[1:])
+	case "approve":
+		return approveDisbursements(ctx, globals, args[1:])
+	case "set-status":
+		return setDisbursementStatus(ctx, globals, args[1:])
+	case "history":
+		return disbursementHistory(ctx, globals, args[1:])
+	}
+	return fmt.Errorf("%w: unknown disbursements action %q, expected list, approve, set-status or history", ErrorUsage, args[0])
+}
+
+func listDisbursements(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(disbursementsCommand())
+	status := fs.String("status", "", "Only list the disbursements in the status. Defaults to every status")
+	reference := fs.String("merchant", "", "Only list the disbursements of the merchant. Defaults to every merchant")
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+
+	err := parseAction(globals, fs, "disbursements list", args)
+	if err != nil {
+		return err
+	}
+
+	var filter entities.DisbursementFilter
+	if *status != "" {
+		filter.Status, err = disbursement_status.ParseStatus(*status)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrorUsage, err)
+		}
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	merchants, err := querier.SelectMerchants(ctx)
+	if err != nil {
+		return err
+	}
+	references := make(map[uuid.UUID]string, len(merchants))
+	for _, merchant := range merchants {
+		references[merchant.ID] = merchant.Reference
+		if merchant.Reference == *reference {
+			filter.MerchantID = merchant.ID
+		}
+	}
+	if *reference != "" && filter.MerchantID == uuid.Nil {
+		return fmt.Errorf("unknown merchant %q", *reference)
+	}
+
+	disbursements, err := querier.SelectDisbursements(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	table := report.NewTable("reference", "merchant", "frequency", "orders_start_at", "orders_end_at", "net_amount", "status", "status_changed_at")
+	for _, disbursement := range disbursements {
+		table.AddRow(
+			disbursement.Reference,
+			references[disbursement.MerchantID],
+			string(disbursement.DisbursementFrequency),
+			disbursement.OrdersStartAt,
+			disbursement.OrdersEndAt,
+			disbursement.NetAmount,
+			string(disbursement.Status),
+			disbursement.StatusChangedAt().Format(time.RFC3339))
+	}
+	return report.Write(globals.Stdout, outputFormat, table)
+}
+
+// approveDisbursements approves a disbursement, or the payable disbursements until a day, for the next payout file
+func approveDisbursements(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(disbursementsCommand())
+	reference := fs.String("reference", "", "Reference of the disbursement, like DSB-20230115-1A2B3C4D")
+	day := fs.String("day", "", "Approve the payable disbursements with orders until this day, included. Accepts a date expression like the process command")
+	reason := fs.String("reason", "", "Why the status changes, kept in the history. Optional")
+
+	err := parseAction(globals, fs, "disbursements approve", args)
+	if err != nil {
+		return err
+	}
+	if (*reference == "") == (*day == "") {
+		return fmt.Errorf("%w: disbursements approve requires either -reference or -day", ErrorUsage)
+	}
+
+	var until time.Time
+	if *day != "" {
+		dateRange, err := system.ParseDateRange("", "", *day, time.Now())
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrorUsage, err)
+		}
+		until = dateRange.To
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	service := disbursement_status.NewService(querier)
+	if *reference != "" {
+		disbursement, err := service.Transition(ctx, *reference, entities.ApprovedDisbursementStatus, *reason)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(globals.Stdout, "disbursement %s %s\n", disbursement.Reference, disbursement.Status)
+		return nil
+	}
+
+	approved, err := service.ApprovePayable(ctx, until, *reason)
+	for _, disbursement := range approved {
+		fmt.Fprintf(globals.Stdout, "disbursement %s %s\n", disbursement.Reference, disbursement.Status)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(globals.Stdout, "%d disbursement(s) with orders until %s approved\n", len(approved), until.Format(time.DateOnly))
+	return nil
+}
+
+// setDisbursementStatus moves a disbursement to a status, like settled once the bank confirms the payment
+func setDisbursementStatus(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(disbursementsCommand())
+	reference := fs.String("reference", "", "Reference of the disbursement, like DSB-20230115-1A2B3C4D")
+	status := fs.String("status", "", "New status: approved, sent, settled, failed or returned")
+	reason := fs.String("reason", "", "Why the status changes, kept in the history. Optional")
+
+	err := parseAction(globals, fs, "disbursements set-status", args)
+	if err != nil {
+		return err
+	}
+	if *reference == "" || *status == "" {
+		return fmt.Errorf("%w: disbursements set-status requires -reference and -status", ErrorUsage)
+	}
+
+	to, err := disbursement_status.ParseStatus(*status)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	disbursement, err := disbursement_status.NewService(querier).Transition(ctx, *reference, to, *reason)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(globals.Stdout, "disbursement %s %s\n", disbursement.Reference, disbursement.Status)
+	return nil
+}
+
+func disbursementHistory(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(disbursementsCommand())
+	reference := fs.String("reference", "", "Reference of the disbursement, like DSB-20230115-1A2B3C4D")
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+
+	err := parseAction(globals, fs, "disbursements history", args)
+	if err != nil {
+		return err
+	}
+	if *reference == "" {
+		return fmt.Errorf("%w: disbursements history requires -reference", ErrorUsage)
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	disbursement, changes, err := disbursement_status.NewService(querier).History(ctx, *reference)
+	if err != nil {
+		return err
+	}
+
+	table := report.NewTable("changed_at", "from_status", "to_status", "reason")
+	table.AddRow(disbursement.CreatedAt.Format(time.RFC3339), "", string(entities.CalculatedDisbursementStatus), "created by the processor")
+	for _, change := range changes {
+		table.AddRow(
+			change.ChangedAt.Format(time.RFC3339),
+			string(change.FromStatus),
+			string(change.ToStatus),
+			change.Reason)
+	}
+	return report.Write(globals.Stdout, outputFormat, table)
+}
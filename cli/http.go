@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// httpShutdownTimeout is how long the in-flight requests have to finish when a command returns
+const httpShutdownTimeout = 5 * time.Second
+
+// newServeMux returns the operational endpoints served by every long-running command
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+// serveHTTP starts serving the handler on the configured HTTP address, if any
+// The returned function stops the server, it must be called before the command returns
+func (g *Globals) serveHTTP(handler http.Handler) (func(), error) {
+	if g.Config.HTTP.Addr == "" {
+		return func() {}, nil
+	}
+	return listenAndServe(g.Config.HTTP.Addr, handler)
+}
+
+// listenAndServe starts serving the handler on the address, the returned function stops the server
+func listenAndServe(addr string, handler http.Handler) (func(), error) {
+	// Listen before returning so an address in use fails the command
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logger := slog.Default().With("addr", listener.Addr().String())
+	go func() {
+		logger.Info("serving HTTP")
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("error serving HTTP", system.LogErrorKey, err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("error stopping the HTTP server", system.LogErrorKey, err)
+		}
+	}, nil
+}
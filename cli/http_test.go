@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/api"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeHTTP(t *testing.T) {
+	var stderr bytes.Buffer
+
+	t.Run("Disabled", func(t *testing.T) {
+		globals := &Globals{Stderr: &stderr}
+		stop, err := globals.serveHTTP(newServeMux())
+		require.NoError(t, err)
+		stop()
+	})
+
+	t.Run("ServesMetrics", func(t *testing.T) {
+		// Take a free port
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := listener.Addr().String()
+		listener.Close()
+
+		globals := &Globals{Stderr: &stderr}
+		globals.Config.HTTP.Addr = addr
+		stop, err := globals.serveHTTP(newServeMux())
+		require.NoError(t, err)
+
+		response, err := http.Get("http://" + addr + "/metrics")
+		require.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		require.Contains(t, string(body), "disbursement_processor_last_success_day_timestamp_seconds")
+
+		// The address is taken until the server stops
+		_, err = globals.serveHTTP(newServeMux())
+		require.ErrorContains(t, err, "error listening on "+addr)
+
+		stop()
+		_, err = http.Get("http://" + addr + "/metrics")
+		require.Error(t, err)
+	})
+}
+
+type stubLoader struct {
+	lastIteration time.Time
+}
+
+func (l stubLoader) LastIteration() time.Time {
+	return l.lastIteration
+}
+
+func (l stubLoader) PendingFiles() (int, error) {
+	return 2, nil
+}
+
+func TestLoaderServeMux(t *testing.T) {
+	cfg := system.DefaultConfig().Loader
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("Ping", mock.Anything).Return(nil)
+
+	get := func(mux *http.ServeMux, path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	mux := loaderServeMux(cfg, mockQuerier, stubLoader{lastIteration: time.Now()})
+
+	code, body := get(mux, "/healthz")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, `"loader":{"status":"ok"`)
+
+	code, body = get(mux, "/readyz")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, `"pending_files":2`)
+
+	code, _ = get(mux, "/metrics")
+	require.Equal(t, http.StatusOK, code)
+
+	// A loader which did not iterate for longer than the job pause and the stall timeout is stuck
+	stalled := time.Now().Add(-cfg.JobPause - cfg.StallTimeout - time.Minute)
+	mux = loaderServeMux(cfg, mockQuerier, stubLoader{lastIteration: stalled})
+
+	code, body = get(mux, "/healthz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, "loader has not iterated in time")
+}
+
+func TestAPIServeMux(t *testing.T) {
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("Ping", mock.Anything).Return(nil)
+	mockQuerier.On("SelectDisbursementByReference", mock.Anything, "DSB-MISSING").Return(nil, nil)
+
+	mux := apiServeMux(mockQuerier, api.NewServer(mockQuerier))
+
+	for path, expectedCode := range map[string]int{
+		"/healthz":                   http.StatusOK,
+		"/readyz":                    http.StatusOK,
+		"/metrics":                   http.StatusOK,
+		"/disbursements/DSB-MISSING": http.StatusNotFound,
+	} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, expectedCode, recorder.Code, path)
+	}
+}
@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ildomm/cc_sq_disbursement/ledger"
+	"github.com/ildomm/cc_sq_disbursement/report"
+)
+
+func ledgerCommand() *command {
+	return &command{
+		name:    "ledger",
+		summary: "Check the double-entry ledger against the orders, refunds and disbursements, and show its balances",
+		usage: "ledger check [-format table|csv|json] [-output file]" +
+			" | ledger balances [-format table|csv|json] [-output file]",
+		run: runLedger,
+	}
+}
+
+func runLedger(ctx context.Context, globals *Globals, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing ledger action, expected check or balances", ErrorUsage)
+	}
+
+	switch args[0] {
+	case "check", "balances":
+		return ledgerReport(ctx, globals, args[0], args[1:])
+	}
+	return fmt.Errorf("%w: unknown ledger action %q, expected check or balances", ErrorUsage, args[0])
+}
+
+// ledgerReport writes the invariants of the ledger, failing when any is violated, or the balances of its accounts
+func ledgerReport(ctx context.Context, globals *Globals, action string, args []string) error {
+	fs := globals.newFlagSet(ledgerCommand())
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+	output := fs.String("output", "", "File to write the report to. Defaults to stdout")
+
+	err := parseAction(globals, fs, "ledger "+action, args)
+	if err != nil {
+		return err
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	if action == "balances" {
+		balances, err := querier.SelectLedgerBalances(ctx)
+		if err != nil {
+			return fmt.Errorf("error selecting the ledger balances: %w", err)
+		}
+		return writeReport(globals.Stdout, *output, outputFormat, ledger.BalancesTable(balances))
+	}
+
+	result, err := ledger.Check(ctx, querier)
+	if err != nil {
+		return err
+	}
+	err = writeReport(globals.Stdout, *output, outputFormat, result.Table())
+	if err != nil {
+		return err
+	}
+	return result.Err()
+}
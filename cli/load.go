@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ildomm/cc_sq_disbursement/health"
+	"github.com/ildomm/cc_sq_disbursement/order_load"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+func loadCommand() *command {
+	return &command{
+		name:    "load",
+		summary: "Load the orders CSV files waiting to be imported, as a background job",
+		usage:   "load [options]",
+		run:     runLoad,
+	}
+}
+
+func runLoad(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(loadCommand())
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	logger := system.ComponentLogger("loader")
+	logger.Info("starting job", "version", globals.Version)
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	loader := order_load.NewPipelineWithConfig(ctx, querier, globals.Config)
+
+	stopHTTP, err := globals.serveHTTP(loaderServeMux(globals.Config.Loader, querier, loader))
+	if err != nil {
+		return err
+	}
+	defer stopHTTP()
+
+	// Start pipeline as a goroutine
+	go loader.Run()
+
+	logger.Info("caught signal, terminating", "signal", system.WaitForSignal().String())
+	return nil
+}
+
+// loaderServeMux adds the health endpoints of the loader to the operational ones
+// /healthz fails when the loader loop is stuck, /readyz when the database or the waiting folder are not available
+func loaderServeMux(cfg system.LoaderConfig, db health.Pinger, loader health.Loader) *http.ServeMux {
+	mux := newServeMux()
+	mux.Handle("/healthz", health.NewHandler().
+		Add("loader", health.LoaderCheck(loader, cfg.JobPause+cfg.StallTimeout)))
+	mux.Handle("/readyz", health.NewHandler().
+		Add("database", health.DatabaseCheck(db)).
+		Add("waiting_folder", health.WaitingFolderCheck(loader)))
+	return mux
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/report"
+)
+
+func merchantsCommand() *command {
+	return &command{
+		name:    "merchants",
+		summary: "List the merchants and their disbursement configuration",
+		usage:   "merchants [list] [-format table|csv|json] | merchants set-currency -merchant reference -currency code",
+		run:     runMerchants,
+	}
+}
+
+func runMerchants(ctx context.Context, globals *Globals, args []string) error {
+	// list is the default action
+	if len(args) > 0 && args[0] == "set-currency" {
+		return setMerchantCurrency(ctx, globals, args[1:])
+	}
+	if len(args) > 0 && args[0] == "list" {
+		args = args[1:]
+	}
+
+	fs := globals.newFlagSet(merchantsCommand())
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%w: unknown merchants action %q", ErrorUsage, fs.Arg(0))
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	merchants, err := querier.SelectMerchants(ctx)
+	if err != nil {
+		return err
+	}
+
+	table := report.NewTable("reference", "email", "live_at", "disbursement_frequency", "minimum_monthly_fee", "currency", "webhook_url")
+	for _, merchant := range merchants {
+		table.AddRow(
+			merchant.Reference,
+			merchant.Email,
+			merchant.LiveAt,
+			string(merchant.DisbursementFrequency),
+			merchant.MinimumMonthlyFee,
+			merchant.Currency,
+			merchant.WebhookURL)
+	}
+
+	return report.Write(globals.Stdout, outputFormat, table)
+}
+
+// setMerchantCurrency changes the settlement currency of a merchant, once all its amounts are disbursed
+func setMerchantCurrency(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(merchantsCommand())
+	reference := fs.String("merchant", "", "Reference of the merchant")
+	currency := fs.String("currency", "", "Code of the settlement currency, like EUR")
+
+	err := parseAction(globals, fs, "merchants set-currency", args)
+	if err != nil {
+		return err
+	}
+	if *reference == "" {
+		return fmt.Errorf("%w: merchants set-currency requires -merchant", ErrorUsage)
+	}
+	if !entities.ValidCurrency(*currency) {
+		return fmt.Errorf("%w: invalid currency %q, expected a code like EUR", ErrorUsage, *currency)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	merchant, err := querier.SelectMerchantByReference(ctx, *reference)
+	if err != nil {
+		return err
+	}
+	if merchant == nil {
+		return fmt.Errorf("unknown merchant %q", *reference)
+	}
+
+	err = querier.UpdateMerchantCurrency(ctx, merchant.ID, *currency)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(globals.Stdout, "settlement currency of %s set to %s\n", *reference, *currency)
+	return nil
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+func migrateCommand() *command {
+	return &command{
+		name:    "migrate",
+		summary: "Manage the database schema with the migrations embedded in the binary",
+		usage:   "migrate up | down | to <version> | status | force <version>",
+		run:     runMigrate,
+	}
+}
+
+func runMigrate(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(migrateCommand())
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	action, version, err := parseMigrateAction(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	dBConnURL, err := system.ValidateDBConnURL(globals.Config.Database.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	migrator, err := database.NewMigrator(dBConnURL)
+	if err != nil {
+		return fmt.Errorf("error connecting to the database: %w", err)
+	}
+	defer migrator.Close()
+
+	switch action {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		err = migrator.Down()
+	case "to":
+		err = migrator.To(uint(version))
+	case "force":
+		err = migrator.Force(version)
+	}
+	if err != nil {
+		return fmt.Errorf("error running migrate %s: %w", action, err)
+	}
+	if action != "status" {
+		slog.Info("migrate complete", "action", action)
+	}
+
+	status, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(globals.Stdout, "%s\n", status)
+	return nil
+}
+
+// parseMigrateAction validates the migrate action and its version argument
+func parseMigrateAction(args []string) (string, int, error) {
+	if len(args) == 0 {
+		return "", 0, fmt.Errorf("%w: missing migrate action, expected up, down, to, status or force", ErrorUsage)
+	}
+
+	action := args[0]
+	switch action {
+	case "up", "down", "status":
+		if len(args) != 1 {
+			return "", 0, fmt.Errorf("%w: migrate %s does not take arguments", ErrorUsage, action)
+		}
+		return action, 0, nil
+
+	case "to", "force":
+		if len(args) != 2 {
+			return "", 0, fmt.Errorf("%w: migrate %s requires a version", ErrorUsage, action)
+		}
+		// to 0 rolls back every migration, force -1 clears the version
+		minVersion := 0
+		if action == "force" {
+			minVersion = -1
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < minVersion {
+			return "", 0, fmt.Errorf("%w: invalid version %q", ErrorUsage, args[1])
+		}
+		return action, version, nil
+	}
+
+	return "", 0, fmt.Errorf("%w: unknown migrate action %q, expected up, down, to, status or force", ErrorUsage, action)
+}
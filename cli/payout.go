@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/payout"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+func payoutCommand() *command {
+	return &command{
+		name:    "payout",
+		summary: "Export the disbursements not paid yet as a SEPA credit transfer file (pain.001)",
+		usage:   "payout -output file [-day date] [-execution-date yyyy-mm-dd] [-dry-run]",
+		run:     runPayout,
+	}
+}
+
+func runPayout(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(payoutCommand())
+	day := fs.String("day", "", "Pay the disbursements with orders until this day, included. Accepts a date expression like the process command. Defaults to yesterday")
+	executionDate := fs.String("execution-date", "", "Day the bank executes the transfers, yyyy-mm-dd. Defaults to today")
+	output := fs.String("output", "", "File to write the pain.001 XML to. Optional with -dry-run, which defaults to stdout")
+	dryRun := fs.Bool("dry-run", false, "Write the file without recording the batch, so the disbursements stay payable. Defaults to false")
+
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%w: payout does not take arguments", ErrorUsage)
+	}
+
+	now := time.Now()
+	dateRange, err := system.ParseDateRange("", "", *day, now)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	today := system.StartOfDay(now)
+	execution := today
+	if *executionDate != "" {
+		execution, err = time.Parse(time.DateOnly, *executionDate)
+		if err != nil {
+			return fmt.Errorf("%w: invalid execution date %q, expected a date like 2023-01-31", ErrorUsage, *executionDate)
+		}
+		if execution.Before(today) {
+			return fmt.Errorf("%w: the execution date %s is in the past", ErrorUsage, *executionDate)
+		}
+	}
+
+	if *output == "" && !*dryRun {
+		return fmt.Errorf("%w: missing -output, the payout file is only written to stdout with -dry-run", ErrorUsage)
+	}
+
+	err = payout.ValidateDebtor(globals.Config.Payout)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	exporter, err := payout.NewExporter(querier, globals.Config.Payout)
+	if err != nil {
+		return err
+	}
+
+	// The file goes to stdout on dry runs, so keep the summary apart from it
+	summary := globals.Stdout
+	if *dryRun {
+		summary = globals.Stderr
+	}
+
+	batch, err := exporter.Prepare(ctx, dateRange.To, execution)
+	if errors.Is(err, payout.ErrorNothingToPay) {
+		printSkipped(summary, batch.Skipped)
+		fmt.Fprintf(summary, "no disbursements to pay with orders until %s\n", dateRange.To.Format(time.DateOnly))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		err = writePayout(globals.Stdout, *output, batch)
+		if err != nil {
+			return fmt.Errorf("error writing the payout file: %w", err)
+		}
+	} else {
+		err = writePayout(nil, *output, batch)
+		if err != nil {
+			return fmt.Errorf("error writing the payout file: %w", err)
+		}
+
+		// Without the batch record the disbursements would be paid again, so the file must not be sent
+		err = exporter.Record(ctx, batch)
+		if err != nil {
+			_ = os.Remove(*output)
+			return err
+		}
+	}
+
+	printSkipped(summary, batch.Skipped)
+	fmt.Fprintf(summary, "payout batch %s: %d payment(s), %.2f EUR, execution date %s\n",
+		batch.Record.MessageID,
+		batch.Record.PaymentsCount,
+		batch.Record.ControlSum,
+		batch.Record.ExecutionDate.Format(time.DateOnly))
+	return nil
+}
+
+// writePayout writes the payout file to the output file, or stdout
+func writePayout(stdout io.Writer, output string, batch *payout.Batch) error {
+	if output == "" {
+		return batch.Write(stdout)
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+
+	err = batch.Write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(output)
+	}
+	return err
+}
+
+func printSkipped(w io.Writer, skipped []payout.Skipped) {
+	for _, s := range skipped {
+		fmt.Fprintf(w, "skipped %s of %s: %s\n", s.Disbursement.Reference, s.Disbursement.MerchantReference, s.Reason)
+	}
+}
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/order_process"
+	"github.com/ildomm/cc_sq_disbursement/report"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+func processCommand() *command {
+	return &command{
+		name:    "process",
+		summary: "Calculate the disbursements of the orders, for yesterday or the given days",
+		usage:   "process [-from date -to date | -day date] [-dry-run [-format table|csv|json] [-output file]] [-wait-lock] [-metrics-push-url url]",
+		run:     runProcess,
+	}
+}
+
+func runProcess(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(processCommand())
+	ordersFrom, ordersTo, ordersDay := system.DateRangeFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "Calculate the disbursements without writing them and print a preview. Defaults to false")
+	format := fs.String("format", string(report.TableFormat), "Format of the dry run preview: table, csv or json. Defaults to table")
+	output := fs.String("output", "", "File to write the dry run preview to. Defaults to stdout")
+	globals.boolFlag(fs, "wait-lock", "Wait for a running processor to finish instead of failing. Defaults to PROCESSOR_WAIT_FOR_LOCK, or false", func(cfg *system.Config, value bool) {
+		cfg.Processor.WaitForLock = value
+	})
+	fs.Func("metrics-push-url", "Push the metrics to the Prometheus Pushgateway at the `url` when finishing. Defaults to METRICS_PUSH_URL, or disabled", func(value string) error {
+		globals.override(func(cfg *system.Config) { cfg.Metrics.PushURL = value })
+		return nil
+	})
+
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	dateRange, err := system.ParseDateRange(*ordersFrom, *ordersTo, *ordersDay, time.Now())
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	previewFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	logger := system.ComponentLogger("processor")
+	logger.Info("starting job", "version", globals.Version)
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	stopHTTP, err := globals.serveHTTP(newServeMux())
+	if err != nil {
+		return err
+	}
+	defer stopHTTP()
+
+	pipeline := order_process.NewPipelineWithConfig(ctx, querier, globals.Config)
+	if *dryRun {
+		pipeline = order_process.NewDryRunPipeline(ctx, querier, globals.Config)
+	}
+	logger = logger.With(system.LogRunIDKey, pipeline.RunID())
+	if *dryRun {
+		logger.Info("dry run, disbursements will not be written")
+	} else {
+		defer pushMetrics(ctx, logger, globals.Config.Metrics.PushURL)
+	}
+
+	// The dry run preview goes to stdout, so keep the summary apart from it
+	summary := globals.Stdout
+	if *dryRun {
+		summary = globals.Stderr
+	}
+
+	// Run for each day in the date range, both ends included. Defaults to yesterday
+	days := dateRange.Days()
+	logger.Info("processing orders", "from", dateRange.From.Format(time.DateOnly), "to", dateRange.To.Format(time.DateOnly), "days", len(days))
+
+	// The days are processed under a single lock, so no other processor runs in between them
+	err = pipeline.Lock()
+	if err != nil {
+		return err
+	}
+	defer pipeline.Unlock()
+
+	var total order_process.Result
+	for _, day := range days {
+		result, err := pipeline.Run(day)
+		total.Add(result)
+		if err != nil {
+			fmt.Fprintf(summary, "summary: %s\n", total.String())
+			return fmt.Errorf("processing failed for day %s: %w", day.Format(time.DateOnly), err)
+		}
+	}
+
+	if *dryRun {
+		err = writePreview(globals.Stdout, *output, previewFormat, pipeline.Preview())
+		if err != nil {
+			return fmt.Errorf("error writing the dry run preview: %w", err)
+		}
+	}
+
+	fmt.Fprintf(summary, "processed %d day(s)\n", len(days))
+	fmt.Fprintf(summary, "summary: %s\n", total.String())
+	return nil
+}
+
+// pushMetrics sends the metrics of the run to the Pushgateway, if configured
+// A failed push is only logged, the disbursements are already written
+func pushMetrics(ctx context.Context, logger *slog.Logger, url string) {
+	if url == "" {
+		return
+	}
+
+	err := metrics.Push(ctx, url, "disbursement_processor")
+	if err != nil {
+		logger.Error("error pushing metrics", system.LogErrorKey, err)
+	}
+}
+
+// writePreview writes the disbursements calculated by a dry run to the output file, or stdout
+func writePreview(stdout io.Writer, output string, format report.Format, disbursements []entities.MerchantDisbursement) error {
+	w := stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return report.Write(w, format, order_process.PreviewTable(disbursements))
+}
@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/reconciliation"
+	"github.com/ildomm/cc_sq_disbursement/report"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+func reconcileCommand() *command {
+	return &command{
+		name:    "reconcile",
+		summary: "Reconcile the camt.053 and MT940 bank statements with the disbursements sent, settling the ones paid",
+		usage: "reconcile import [-watch] [file ...]" +
+			" | reconcile report [-from date -to date | -day date] [-all] [-format table|csv|json]",
+		run: runReconcile,
+	}
+}
+
+func runReconcile(ctx context.Context, globals *Globals, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing reconcile action, expected import or report", ErrorUsage)
+	}
+
+	switch args[0] {
+	case "import":
+		return importStatements(ctx, globals, args[1:])
+	case "report":
+		return reconciliationReport(ctx, globals, args[1:])
+	}
+	return fmt.Errorf("%w: unknown reconcile action %q, expected import or report", ErrorUsage, args[0])
+}
+
+// importStatements reconciles the statement files given, or the ones waiting in the statements folder
+func importStatements(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(reconcileCommand())
+	watch := fs.Bool("watch", false, "Keep importing the files arriving in the statements folder until stopped. Defaults to false")
+
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	files := fs.Args()
+	if *watch && len(files) > 0 {
+		return fmt.Errorf("%w: reconcile import -watch imports the statements folder, it does not take files", ErrorUsage)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	reconciler := reconciliation.NewReconciler(querier)
+	cfg := globals.Config.Statements
+	if len(files) == 0 {
+		err = reconciliation.CreateFolders(cfg)
+		if err != nil {
+			return fmt.Errorf("error creating the statements folders: %w", err)
+		}
+	}
+
+	if *watch {
+		logger := system.ComponentLogger("reconciliation")
+		logger.Info("starting job", "version", globals.Version)
+
+		stopHTTP, err := globals.serveHTTP(newServeMux())
+		if err != nil {
+			return err
+		}
+		defer stopHTTP()
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go reconciler.Watch(ctx, cfg)
+
+		logger.Info("caught signal, terminating", "signal", system.WaitForSignal().String())
+		return nil
+	}
+
+	if len(files) > 0 {
+		var errs []error
+		for _, file := range files {
+			imported, err := importStatementFile(ctx, reconciler, file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", file, err))
+				continue
+			}
+			fmt.Fprintln(globals.Stdout, imported)
+		}
+		return errors.Join(errs...)
+	}
+
+	result, err := reconciler.ImportFolder(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	for _, imported := range result.Imports {
+		fmt.Fprintln(globals.Stdout, imported)
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d statement file(s) failed, moved to %s", len(result.Failed), cfg.FailedPath)
+	}
+	return nil
+}
+
+func importStatementFile(ctx context.Context, reconciler *reconciliation.Reconciler, file string) (*reconciliation.Import, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return reconciler.Import(ctx, filepath.Base(file), content)
+}
+
+// reconciliationReport lists the statement debits booked within the days which need attention, or every debit
+func reconciliationReport(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(reconcileCommand())
+	from := fs.String("from", "", "First booking day to report, included. Accepts a date expression like the process command")
+	to := fs.String("to", "", "Last booking day to report, included")
+	day := fs.String("day", "", "Single booking day to report, instead of -from and -to")
+	all := fs.Bool("all", false, "Report the matched debits too. Defaults to the unmatched and mismatched ones")
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+
+	err := parseAction(globals, fs, "reconcile report", args)
+	if err != nil {
+		return err
+	}
+
+	var filter entities.ReconciliationFilter
+	if *from != "" || *to != "" || *day != "" {
+		dateRange, err := system.ParseDateRange(*from, *to, *day, time.Now())
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrorUsage, err)
+		}
+		filter.From = dateRange.From
+		filter.To = dateRange.To
+	}
+	if !*all {
+		filter.Results = []entities.ReconciliationResults{
+			entities.UnmatchedReconciliationResult,
+			entities.MismatchedReconciliationResult,
+		}
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	entries, err := querier.SelectReconciliationEntries(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	table := report.NewTable("booking_date", "statement", "bank_reference", "disbursement", "amount", "currency", "result", "detail")
+	for _, entry := range entries {
+		table.AddRow(
+			entry.BookingDate,
+			entry.FileName,
+			entry.BankReference,
+			entry.DisbursementReference,
+			entry.Amount,
+			entry.Currency,
+			string(entry.Result),
+			entry.Detail)
+	}
+	return report.Write(globals.Stdout, outputFormat, table)
+}
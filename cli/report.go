@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ildomm/cc_sq_disbursement/report"
+)
+
+func reportCommand() *command {
+	return &command{
+		name:    "report",
+		summary: "Report the disbursements and fees of each year, or the merchants in debt",
+		usage:   "report yearly [-year yyyy] [-format table|csv|json] [-output file] | report debts [-format table|csv|json] [-output file]",
+		run:     runReport,
+	}
+}
+
+func runReport(ctx context.Context, globals *Globals, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing report, expected yearly or debts", ErrorUsage)
+	}
+
+	switch args[0] {
+	case "yearly":
+		return yearlyReport(ctx, globals, args[1:])
+	case "debts":
+		return debtsReport(ctx, globals, args[1:])
+	}
+	return fmt.Errorf("%w: unknown report %q, expected yearly or debts", ErrorUsage, args[0])
+}
+
+// yearlyReport writes the disbursements and fees of each year
+func yearlyReport(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(reportCommand())
+	year := fs.Int("year", 0, "Only report the `year`. Defaults to every year")
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+	output := fs.String("output", "", "File to write the report to. Defaults to stdout")
+
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%w: report yearly does not take arguments", ErrorUsage)
+	}
+	if *year < 0 || *year > 9999 {
+		return fmt.Errorf("%w: invalid year %d", ErrorUsage, *year)
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	years, err := querier.SelectYearlyReport(ctx, *year)
+	if err != nil {
+		return fmt.Errorf("error selecting the yearly report: %w", err)
+	}
+
+	return writeReport(globals.Stdout, *output, outputFormat, report.YearlyTable(years))
+}
+
+// debtsReport writes the merchants whose balance is negative, owing what is deducted from their next disbursements
+func debtsReport(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(reportCommand())
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+	output := fs.String("output", "", "File to write the report to. Defaults to stdout")
+
+	err := parseAction(globals, fs, "report debts", args)
+	if err != nil {
+		return err
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	debts, err := querier.SelectMerchantDebts(ctx)
+	if err != nil {
+		return fmt.Errorf("error selecting the merchants in debt: %w", err)
+	}
+
+	return writeReport(globals.Stdout, *output, outputFormat, report.DebtsTable(debts))
+}
+
+// writeReport writes a report to the output file, or to stdout when there is none
+func writeReport(stdout io.Writer, output string, format report.Format, table *report.Table) error {
+	var w io.Writer = stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return report.Write(w, format, table)
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/ildomm/cc_sq_disbursement/api"
+	"github.com/ildomm/cc_sq_disbursement/health"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+func serveCommand() *command {
+	return &command{
+		name:    "serve",
+		summary: "Serve the REST API to query the disbursements and receive new orders, on the HTTP address",
+		usage:   "serve [options]",
+		run:     runServe,
+	}
+}
+
+func runServe(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(serveCommand())
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if globals.Config.HTTP.Addr == "" {
+		return fmt.Errorf("%w: the API requires an HTTP address, set -http-addr or HTTP_ADDR", ErrorUsage)
+	}
+
+	logger := system.ComponentLogger("api")
+	logger.Info("starting server", "version", globals.Version)
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	stopHTTP, err := globals.serveHTTP(apiServeMux(querier, api.NewServerWithConfig(ctx, querier, globals.Config)))
+	if err != nil {
+		return err
+	}
+	defer stopHTTP()
+
+	logger.Info("caught signal, terminating", "signal", system.WaitForSignal().String())
+	return nil
+}
+
+// apiServeMux adds the API routes to the operational endpoints
+// /readyz fails when the database is not available
+func apiServeMux(db health.Pinger, server *api.Server) *http.ServeMux {
+	mux := newServeMux()
+	server.Register(mux)
+	mux.Handle("/healthz", health.NewHandler())
+	mux.Handle("/readyz", health.NewHandler().
+		Add("database", health.DatabaseCheck(db)))
+	return mux
+}
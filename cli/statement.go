@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/statement"
+)
+
+func statementCommand() *command {
+	return &command{
+		name:    "statement",
+		summary: "Export the statement of a disbursement, or of a merchant for a month",
+		usage:   "statement -disbursement reference | -merchant reference -month yyyy-mm [-format csv|pdf] [-output file]",
+		run:     runStatement,
+	}
+}
+
+func runStatement(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(statementCommand())
+	disbursement := fs.String("disbursement", "", "Reference of the disbursement, like DSB-20230115-1A2B3C4D")
+	merchant := fs.String("merchant", "", "Reference of the merchant, with -month")
+	month := fs.String("month", "", "Month of the statement of the merchant, like 2023-01")
+	format := fs.String("format", string(statement.CSVFormat), "Output format: csv or pdf. Defaults to csv")
+	output := fs.String("output", "", "File to write the statement to. Defaults to stdout")
+
+	err := globals.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%w: statement does not take arguments", ErrorUsage)
+	}
+
+	outputFormat, err := statement.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	var statementMonth time.Time
+	switch {
+	case *disbursement != "" && (*merchant != "" || *month != ""):
+		return fmt.Errorf("%w: -disbursement cannot be given with -merchant and -month", ErrorUsage)
+	case *disbursement == "" && (*merchant == "" || *month == ""):
+		return fmt.Errorf("%w: expected -disbursement, or -merchant and -month", ErrorUsage)
+	case *disbursement == "":
+		statementMonth, err = time.Parse(statement.MonthLayout, *month)
+		if err != nil {
+			return fmt.Errorf("%w: invalid month %q, expected a month like 2023-01", ErrorUsage, *month)
+		}
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	var merchantStatement *statement.Statement
+	if *disbursement != "" {
+		merchantStatement, err = statement.ForDisbursement(ctx, querier, *disbursement)
+	} else {
+		merchantStatement, err = statement.ForMonth(ctx, querier, *merchant, statementMonth)
+	}
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = globals.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return statement.Write(w, outputFormat, merchantStatement)
+}
@@ -0,0 +1,267 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/report"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/webhook"
+)
+
+func webhooksCommand() *command {
+	return &command{
+		name:    "webhooks",
+		summary: "Notify the merchants of their disbursement events on their webhooks, signed with their secret",
+		usage: "webhooks set -merchant reference -url url | webhooks remove -merchant reference" +
+			" | webhooks list [-status status] [-merchant reference] [-limit n] [-format table|csv|json]" +
+			" | webhooks retry -id id | webhooks dispatch [-watch] | webhooks listen -addr addr -secret secret",
+		run: runWebhooks,
+	}
+}
+
+func runWebhooks(ctx context.Context, globals *Globals, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing webhooks action, expected set, remove, list, retry, dispatch or listen", ErrorUsage)
+	}
+
+	switch args[0] {
+	case "set", "remove":
+		return setWebhook(ctx, globals, args[0], args[1:])
+	case "list":
+		return listOutboxEvents(ctx, globals, args[1:])
+	case "retry":
+		return retryOutboxEvent(ctx, globals, args[1:])
+	case "dispatch":
+		return dispatchWebhooks(ctx, globals, args[1:])
+	case "listen":
+		return listenWebhooks(globals, args[1:])
+	}
+	return fmt.Errorf("%w: unknown webhooks action %q, expected set, remove, list, retry, dispatch or listen", ErrorUsage, args[0])
+}
+
+// setWebhook sets the webhook of a merchant, printing the new secret to share with the merchant, or removes it
+func setWebhook(ctx context.Context, globals *Globals, action string, args []string) error {
+	fs := globals.newFlagSet(webhooksCommand())
+	reference := fs.String("merchant", "", "Reference of the merchant")
+	var webhookURL *string
+	if action == "set" {
+		webhookURL = fs.String("url", "", "Absolute http or https URL the events are posted to")
+	}
+
+	err := parseAction(globals, fs, "webhooks "+action, args)
+	if err != nil {
+		return err
+	}
+	if *reference == "" {
+		return fmt.Errorf("%w: webhooks %s requires -merchant", ErrorUsage, action)
+	}
+	if action == "set" {
+		if *webhookURL == "" {
+			return fmt.Errorf("%w: webhooks set requires -url", ErrorUsage)
+		}
+		err = webhook.ValidateURL(*webhookURL)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrorUsage, err)
+		}
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	if action == "remove" {
+		err = webhook.RemoveMerchantWebhook(ctx, querier, *reference)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(globals.Stdout, "webhook of %s removed, its next events are skipped\n", *reference)
+		return nil
+	}
+
+	secret, err := webhook.SetMerchantWebhook(ctx, querier, *reference, *webhookURL)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(globals.Stdout, "webhook of %s set to %s\nsecret: %s\n", *reference, *webhookURL, secret)
+	return nil
+}
+
+// listOutboxEvents lists the latest events and their delivery status
+func listOutboxEvents(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(webhooksCommand())
+	status := fs.String("status", "", "Delivery status of the events: pending, delivered, dead or skipped. Defaults to any")
+	reference := fs.String("merchant", "", "Reference of the merchant. Defaults to every merchant")
+	limit := fs.Int("limit", 100, "Maximum number of events listed, the latest first. Defaults to 100")
+	format := fs.String("format", string(report.TableFormat), "Output format: table, csv or json. Defaults to table")
+
+	err := parseAction(globals, fs, "webhooks list", args)
+	if err != nil {
+		return err
+	}
+
+	filter := entities.OutboxFilter{Status: entities.OutboxStatuses(*status), Limit: *limit}
+	if *status != "" && !slices.Contains(entities.OutboxStatusesList, filter.Status) {
+		return fmt.Errorf("%w: unknown status %q, expected pending, delivered, dead or skipped", ErrorUsage, *status)
+	}
+	if *limit < 1 {
+		return fmt.Errorf("%w: -limit must be at least 1", ErrorUsage)
+	}
+
+	outputFormat, err := report.ParseFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorUsage, err)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	if *reference != "" {
+		merchant, err := querier.SelectMerchantByReference(ctx, *reference)
+		if err != nil {
+			return err
+		}
+		if merchant == nil {
+			return fmt.Errorf("%w: %q", webhook.ErrorMerchantNotFound, *reference)
+		}
+		filter.MerchantID = merchant.ID
+	}
+
+	events, err := querier.SelectOutboxEvents(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	table := report.NewTable("id", "created_at", "event_type", "disbursement_id", "status", "attempts", "next_attempt_at", "last_error")
+	for _, event := range events {
+		table.AddRow(
+			event.ID,
+			event.CreatedAt.Format(time.RFC3339),
+			event.EventType,
+			event.DisbursementID,
+			string(event.Status),
+			event.Attempts,
+			event.NextAttemptAt.Format(time.RFC3339),
+			event.LastError)
+	}
+	return report.Write(globals.Stdout, outputFormat, table)
+}
+
+// retryOutboxEvent delivers a dead or skipped event again on the next dispatch
+func retryOutboxEvent(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(webhooksCommand())
+	id := fs.String("id", "", "ID of the event")
+
+	err := parseAction(globals, fs, "webhooks retry", args)
+	if err != nil {
+		return err
+	}
+	if *id == "" {
+		return fmt.Errorf("%w: webhooks retry requires -id", ErrorUsage)
+	}
+	eventID, err := uuid.Parse(*id)
+	if err != nil {
+		return fmt.Errorf("%w: invalid event id %q", ErrorUsage, *id)
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	event, err := webhook.NewDispatcher(querier, globals.Config.Webhooks).Retry(ctx, eventID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(globals.Stdout, "event %s %s, delivered on the next dispatch\n", event.ID, event.Status)
+	return nil
+}
+
+// dispatchWebhooks delivers the events due once, or keeps delivering them until stopped
+func dispatchWebhooks(ctx context.Context, globals *Globals, args []string) error {
+	fs := globals.newFlagSet(webhooksCommand())
+	watch := fs.Bool("watch", false, "Keep delivering the events until stopped. Defaults to false")
+
+	err := parseAction(globals, fs, "webhooks dispatch", args)
+	if err != nil {
+		return err
+	}
+
+	querier, err := globals.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	dispatcher := webhook.NewDispatcher(querier, globals.Config.Webhooks)
+
+	if *watch {
+		logger := system.ComponentLogger("webhooks")
+		logger.Info("starting job", "version", globals.Version)
+
+		stopHTTP, err := globals.serveHTTP(newServeMux())
+		if err != nil {
+			return err
+		}
+		defer stopHTTP()
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go dispatcher.Watch(ctx)
+
+		logger.Info("caught signal, terminating", "signal", system.WaitForSignal().String())
+		return nil
+	}
+
+	// A single dispatch does not wait for a watching dispatcher
+	err = querier.AcquireLock(ctx, database.WebhooksLockName, false)
+	if err != nil {
+		return err
+	}
+	defer querier.ReleaseLock(context.Background(), database.WebhooksLockName) //nolint:errcheck
+
+	result, err := dispatcher.Dispatch(ctx)
+	fmt.Fprintln(globals.Stdout, result)
+	return err
+}
+
+// listenWebhooks runs a stand-in merchant webhook, printing each delivery verified with the secret
+func listenWebhooks(globals *Globals, args []string) error {
+	fs := globals.newFlagSet(webhooksCommand())
+	addr := fs.String("addr", "localhost:8090", "Address the stand-in webhook listens on. Defaults to localhost:8090")
+	secret := fs.String("secret", "", "Secret of the merchant, as printed by webhooks set")
+
+	err := parseAction(globals, fs, "webhooks listen", args)
+	if err != nil {
+		return err
+	}
+	if *secret == "" {
+		return fmt.Errorf("%w: webhooks listen requires -secret", ErrorUsage)
+	}
+
+	receiver := webhook.NewReceiver(*secret)
+	receiver.OnDelivery(func(delivery webhook.Delivery) {
+		fmt.Fprintf(globals.Stdout, "%s %s %s %s\n", delivery.CreatedAt.Format(time.RFC3339), delivery.ID, delivery.Type, delivery.Data)
+	})
+
+	stop, err := listenAndServe(*addr, receiver)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	logger := system.ComponentLogger("webhook_receiver")
+	logger.Info("caught signal, terminating", "signal", system.WaitForSignal().String())
+	return nil
+}
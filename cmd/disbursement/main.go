@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/ildomm/cc_sq_disbursement/cli"
+	"os"
+)
+
+var (
+	semVer = "unknown" // Populated with semantic version at build time
+)
+
+func main() {
+	os.Exit(cli.Main(semVer, os.Args[1:]))
+}
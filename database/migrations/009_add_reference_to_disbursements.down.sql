@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS merchant_disbursements_pxt_start;
+DROP INDEX IF EXISTS merchant_disbursements_pxt_merchant_start;
+DROP INDEX IF EXISTS merchant_disbursements_pxt_reference;
+
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS reference;
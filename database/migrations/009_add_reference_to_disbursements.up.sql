@@ -0,0 +1,12 @@
+ALTER TABLE merchant_disbursements ADD COLUMN reference VARCHAR;
+
+/* Disbursements created before references existed get one derived from their id */
+UPDATE merchant_disbursements
+SET reference = 'DSB-' || TO_CHAR(orders_start_at, 'YYYYMMDD') || '-' || UPPER(SUBSTRING(REPLACE(id::TEXT, '-', '') FROM 1 FOR 8))
+WHERE reference IS NULL;
+
+ALTER TABLE merchant_disbursements ALTER COLUMN reference SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS merchant_disbursements_pxt_reference ON merchant_disbursements (reference);
+CREATE INDEX IF NOT EXISTS merchant_disbursements_pxt_merchant_start ON merchant_disbursements (merchant_id, orders_start_at);
+CREATE INDEX IF NOT EXISTS merchant_disbursements_pxt_start ON merchant_disbursements (orders_start_at);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key           VARCHAR(255) PRIMARY KEY,
+    request_hash  VARCHAR(64) NOT NULL, /* SHA-256 of the request body, a key cannot be reused for another request */
+    status_code   INT NOT NULL,
+    response      BYTEA NOT NULL,
+
+    created_at    TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
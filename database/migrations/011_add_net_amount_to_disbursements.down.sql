@@ -0,0 +1,2 @@
+ALTER TABLE merchant_disbursements DROP CONSTRAINT IF EXISTS merchant_disbursements_net_amount_check;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS net_amount;
@@ -0,0 +1,11 @@
+ALTER TABLE merchant_disbursements ADD COLUMN net_amount DECIMAL(10,2);
+
+/* Amount owed to the merchant: the orders amount minus the order fees and the minimum monthly fee correction */
+UPDATE merchant_disbursements
+SET net_amount = orders_sum_amount - fee_amount - fee_amount_correction
+WHERE net_amount IS NULL;
+
+ALTER TABLE merchant_disbursements ALTER COLUMN net_amount SET NOT NULL;
+
+ALTER TABLE merchant_disbursements ADD CONSTRAINT merchant_disbursements_net_amount_check
+    CHECK (net_amount = orders_sum_amount - fee_amount - fee_amount_correction);
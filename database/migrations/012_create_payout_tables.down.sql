@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS payout_instructions;
+DROP TABLE IF EXISTS payout_batches;
+
+ALTER TABLE merchants DROP COLUMN IF EXISTS bic;
+ALTER TABLE merchants DROP COLUMN IF EXISTS iban;
@@ -0,0 +1,32 @@
+/* Bank account the disbursements of the merchant are paid to, empty until it is known */
+ALTER TABLE merchants ADD COLUMN IF NOT EXISTS iban VARCHAR(34) NOT NULL DEFAULT '';
+ALTER TABLE merchants ADD COLUMN IF NOT EXISTS bic VARCHAR(11) NOT NULL DEFAULT '';
+
+/* A payout file sent to the bank, a pain.001 credit transfer initiation */
+CREATE TABLE IF NOT EXISTS payout_batches (
+    id              UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    message_id      VARCHAR(35) NOT NULL,
+    execution_date  DATE NOT NULL,
+    payments_count  INT NOT NULL,
+    control_sum     DECIMAL(12,2) NOT NULL,
+
+    created_at      TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS payout_batches_pxt_message_id ON payout_batches (message_id);
+
+/* A credit transfer of a payout file, a disbursement is paid once */
+CREATE TABLE IF NOT EXISTS payout_instructions (
+    id               UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    batch_id         UUID NOT NULL REFERENCES payout_batches (id),
+    disbursement_id  UUID NOT NULL REFERENCES merchant_disbursements (id),
+    end_to_end_id    VARCHAR(35) NOT NULL,
+    amount           DECIMAL(10,2) NOT NULL,
+    iban             VARCHAR(34) NOT NULL,
+    bic              VARCHAR(11) NOT NULL,
+
+    created_at       TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS payout_instructions_pxt_disbursement ON payout_instructions (disbursement_id);
+CREATE INDEX IF NOT EXISTS payout_instructions_pxt_batch ON payout_instructions (batch_id);
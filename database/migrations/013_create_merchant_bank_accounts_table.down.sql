@@ -0,0 +1,14 @@
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS bank_account_id;
+
+ALTER TABLE merchants ADD COLUMN IF NOT EXISTS iban VARCHAR(34) NOT NULL DEFAULT '';
+ALTER TABLE merchants ADD COLUMN IF NOT EXISTS bic VARCHAR(11) NOT NULL DEFAULT '';
+
+/* Keep the verified account of each merchant */
+UPDATE merchants m
+SET iban = a.iban, bic = a.bic
+FROM merchant_bank_accounts a
+WHERE a.merchant_id = m.id AND a.status = 'verified' AND a.valid_to IS NULL;
+
+DROP TABLE IF EXISTS merchant_bank_account_changes;
+DROP TABLE IF EXISTS merchant_bank_accounts;
+DROP TYPE IF EXISTS bank_account_statuses;
@@ -0,0 +1,52 @@
+DROP TYPE IF EXISTS bank_account_statuses;
+CREATE TYPE bank_account_statuses AS ENUM ('pending', 'verified', 'rejected');
+
+/* The accounts a merchant is paid to, only a verified account within its validity period receives payouts */
+CREATE TABLE IF NOT EXISTS merchant_bank_accounts (
+    id           UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    merchant_id  UUID NOT NULL REFERENCES merchants (id),
+    iban         VARCHAR(34) NOT NULL,
+    bic          VARCHAR(11) NOT NULL DEFAULT '',
+    holder_name  VARCHAR(70) NOT NULL,
+    valid_from   DATE NOT NULL,
+    valid_to     DATE,
+    status       BANK_ACCOUNT_STATUSES NOT NULL DEFAULT 'pending',
+
+    created_at   TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL,
+    updated_at   TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL,
+
+    CONSTRAINT merchant_bank_accounts_validity_check CHECK (valid_to IS NULL OR valid_to >= valid_from)
+);
+
+CREATE INDEX IF NOT EXISTS merchant_bank_accounts_pxt_merchant ON merchant_bank_accounts (merchant_id);
+
+/* Every change of an account, with the account as it was after the change */
+CREATE TABLE IF NOT EXISTS merchant_bank_account_changes (
+    id               UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    bank_account_id  UUID NOT NULL REFERENCES merchant_bank_accounts (id),
+    merchant_id      UUID NOT NULL,
+    change           VARCHAR NOT NULL,
+    status           BANK_ACCOUNT_STATUSES NOT NULL,
+    valid_from       DATE NOT NULL,
+    valid_to         DATE,
+
+    changed_at       TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS merchant_bank_account_changes_pxt_merchant ON merchant_bank_account_changes (merchant_id, changed_at);
+
+/* The accounts set on the merchants were entered by the operators, they are kept as verified */
+INSERT INTO merchant_bank_accounts (merchant_id, iban, bic, holder_name, valid_from, status, created_at, updated_at)
+SELECT id, iban, bic, reference, CURRENT_DATE, 'verified', NOW(), NOW()
+FROM merchants
+WHERE iban <> '';
+
+INSERT INTO merchant_bank_account_changes (bank_account_id, merchant_id, change, status, valid_from, valid_to, changed_at)
+SELECT id, merchant_id, 'created', status, valid_from, valid_to, created_at
+FROM merchant_bank_accounts;
+
+ALTER TABLE merchants DROP COLUMN IF EXISTS iban;
+ALTER TABLE merchants DROP COLUMN IF EXISTS bic;
+
+/* The account a disbursement is paid to, set by the processor once the merchant has a verified account */
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS bank_account_id UUID REFERENCES merchant_bank_accounts (id);
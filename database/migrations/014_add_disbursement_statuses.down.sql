@@ -0,0 +1,19 @@
+/* Only the last instruction of a disbursement paid again is kept */
+DELETE FROM payout_instructions i
+USING payout_instructions newer
+WHERE newer.disbursement_id = i.disbursement_id AND newer.created_at > i.created_at;
+
+DROP INDEX IF EXISTS payout_instructions_pxt_disbursement;
+CREATE UNIQUE INDEX IF NOT EXISTS payout_instructions_pxt_disbursement ON payout_instructions (disbursement_id);
+
+DROP TABLE IF EXISTS merchant_disbursement_status_changes;
+
+DROP INDEX IF EXISTS merchant_disbursements_pxt_status;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS returned_at;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS failed_at;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS settled_at;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS sent_at;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS approved_at;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS status;
+
+DROP TYPE IF EXISTS disbursement_statuses;
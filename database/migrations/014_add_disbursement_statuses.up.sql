@@ -0,0 +1,40 @@
+DROP TYPE IF EXISTS disbursement_statuses;
+CREATE TYPE disbursement_statuses AS ENUM ('calculated', 'approved', 'sent', 'settled', 'failed', 'returned');
+
+/* Where the payout of a disbursement is, with the last time it entered each status */
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS status DISBURSEMENT_STATUSES NOT NULL DEFAULT 'calculated';
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS approved_at TIMESTAMP(6) WITHOUT TIME ZONE;
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS sent_at TIMESTAMP(6) WITHOUT TIME ZONE;
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS settled_at TIMESTAMP(6) WITHOUT TIME ZONE;
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS failed_at TIMESTAMP(6) WITHOUT TIME ZONE;
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS returned_at TIMESTAMP(6) WITHOUT TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS merchant_disbursements_pxt_status ON merchant_disbursements (status, orders_end_at);
+
+/* Every status change of a disbursement */
+CREATE TABLE IF NOT EXISTS merchant_disbursement_status_changes (
+    id               UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    disbursement_id  UUID NOT NULL REFERENCES merchant_disbursements (id),
+    from_status      DISBURSEMENT_STATUSES NOT NULL,
+    to_status        DISBURSEMENT_STATUSES NOT NULL,
+    reason           VARCHAR NOT NULL DEFAULT '',
+
+    changed_at       TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS merchant_disbursement_status_changes_pxt_disbursement ON merchant_disbursement_status_changes (disbursement_id, changed_at);
+
+/* The disbursements already in a payout file were sent */
+UPDATE merchant_disbursements d
+SET status = 'sent', sent_at = i.created_at
+FROM payout_instructions i
+WHERE i.disbursement_id = d.id;
+
+INSERT INTO merchant_disbursement_status_changes (disbursement_id, from_status, to_status, reason, changed_at)
+SELECT disbursement_id, 'calculated', 'sent', 'payout batch ' || b.message_id, i.created_at
+FROM payout_instructions i
+JOIN payout_batches b ON b.id = i.batch_id;
+
+/* A failed or returned payout is paid again in a later file, the status tells whether a disbursement can be paid */
+DROP INDEX IF EXISTS payout_instructions_pxt_disbursement;
+CREATE INDEX IF NOT EXISTS payout_instructions_pxt_disbursement ON payout_instructions (disbursement_id);
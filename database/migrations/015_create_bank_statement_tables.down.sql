@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS bank_statement_entries;
+DROP TABLE IF EXISTS bank_statements;
+
+DROP TYPE IF EXISTS reconciliation_results;
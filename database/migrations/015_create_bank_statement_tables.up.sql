@@ -0,0 +1,36 @@
+DROP TYPE IF EXISTS reconciliation_results;
+CREATE TYPE reconciliation_results AS ENUM ('matched', 'already_settled', 'unmatched', 'mismatched');
+
+/* A statement file of the payout account, camt.053 or MT940, imported once */
+CREATE TABLE IF NOT EXISTS bank_statements (
+    id            UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    file_name     VARCHAR NOT NULL,
+    file_hash     VARCHAR(64) NOT NULL,
+    format        VARCHAR(10) NOT NULL,
+    statement_id  VARCHAR(35) NOT NULL DEFAULT '',
+    iban          VARCHAR(34) NOT NULL DEFAULT '',
+
+    imported_at   TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS bank_statements_pxt_file_hash ON bank_statements (file_hash);
+
+/* A debit of a statement, with the disbursement it pays when it was matched */
+CREATE TABLE IF NOT EXISTS bank_statement_entries (
+    id                      UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    statement_id            UUID NOT NULL REFERENCES bank_statements (id),
+    booking_date            DATE NOT NULL,
+    amount                  DECIMAL(12,2) NOT NULL,
+    currency                CHAR(3) NOT NULL,
+    bank_reference          VARCHAR NOT NULL DEFAULT '',
+    disbursement_reference  VARCHAR NOT NULL DEFAULT '',
+    disbursement_id         UUID REFERENCES merchant_disbursements (id),
+    result                  RECONCILIATION_RESULTS NOT NULL,
+    detail                  VARCHAR NOT NULL DEFAULT '',
+
+    created_at              TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS bank_statement_entries_pxt_statement ON bank_statement_entries (statement_id);
+CREATE INDEX IF NOT EXISTS bank_statement_entries_pxt_booking_date ON bank_statement_entries (booking_date, result);
+CREATE INDEX IF NOT EXISTS bank_statement_entries_pxt_disbursement ON bank_statement_entries (disbursement_id);
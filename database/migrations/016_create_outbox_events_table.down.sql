@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS outbox_events;
+
+DROP TYPE IF EXISTS outbox_statuses;
+
+ALTER TABLE merchants DROP COLUMN IF EXISTS webhook_secret;
+ALTER TABLE merchants DROP COLUMN IF EXISTS webhook_url;
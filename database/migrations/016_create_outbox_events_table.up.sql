@@ -0,0 +1,25 @@
+/* Webhook the disbursement events of the merchant are delivered to, signed with the secret */
+ALTER TABLE merchants ADD COLUMN IF NOT EXISTS webhook_url VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE merchants ADD COLUMN IF NOT EXISTS webhook_secret VARCHAR NOT NULL DEFAULT '';
+
+DROP TYPE IF EXISTS outbox_statuses;
+CREATE TYPE outbox_statuses AS ENUM ('pending', 'delivered', 'dead', 'skipped');
+
+/* Events written in the transaction changing the disbursement, delivered afterwards by the dispatcher */
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id               UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    event_type       VARCHAR NOT NULL,
+    disbursement_id  UUID NOT NULL REFERENCES merchant_disbursements (id),
+    merchant_id      UUID NOT NULL REFERENCES merchants (id),
+    payload          JSONB NOT NULL,
+    status           OUTBOX_STATUSES NOT NULL DEFAULT 'pending',
+    attempts         INT NOT NULL DEFAULT 0,
+    next_attempt_at  TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL,
+    last_error       VARCHAR NOT NULL DEFAULT '',
+
+    created_at       TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL,
+    delivered_at     TIMESTAMP(6) WITHOUT TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_pxt_pending ON outbox_events (next_attempt_at, created_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS outbox_events_pxt_status ON outbox_events (status, created_at);
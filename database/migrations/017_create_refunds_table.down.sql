@@ -0,0 +1,8 @@
+ALTER TABLE merchant_disbursements DROP CONSTRAINT IF EXISTS merchant_disbursements_net_amount_check;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS fee_reversal_amount;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS refunds_total_entries;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS refunds_amount;
+ALTER TABLE merchant_disbursements ADD CONSTRAINT merchant_disbursements_net_amount_check
+    CHECK (net_amount = orders_sum_amount - fee_amount - fee_amount_correction);
+
+DROP TABLE IF EXISTS refunds;
@@ -0,0 +1,23 @@
+/* Refunds of the orders, full or partial, deducted from the next daily disbursement of the merchant */
+CREATE TABLE IF NOT EXISTS refunds (
+    id            VARCHAR PRIMARY KEY,
+    order_id      VARCHAR NOT NULL REFERENCES orders (id),
+    merchant_id   UUID NOT NULL,
+    amount        DECIMAL(10,2) NOT NULL CHECK (amount > 0),
+    fee_reversal  DECIMAL(10,2) NOT NULL DEFAULT 0 CHECK (fee_reversal >= 0), /* Part of the order fee given back */
+    created_at    DATE NOT NULL,
+    deducted_on   DATE /* Day of the daily disbursement it is deducted from, NULL until processed */
+);
+
+CREATE INDEX IF NOT EXISTS refunds_pxt_order ON refunds (order_id);
+CREATE INDEX IF NOT EXISTS refunds_pxt_pending ON refunds (created_at) WHERE deducted_on IS NULL;
+CREATE INDEX IF NOT EXISTS refunds_pxt_deducted ON refunds (merchant_id, deducted_on);
+
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS refunds_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS refunds_total_entries INT NOT NULL DEFAULT 0;
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS fee_reversal_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+/* The refunds are deducted from the amount owed to the merchant, and the fees reversed given back */
+ALTER TABLE merchant_disbursements DROP CONSTRAINT IF EXISTS merchant_disbursements_net_amount_check;
+ALTER TABLE merchant_disbursements ADD CONSTRAINT merchant_disbursements_net_amount_check
+    CHECK (net_amount = orders_sum_amount - fee_amount - fee_amount_correction - refunds_amount + fee_reversal_amount);
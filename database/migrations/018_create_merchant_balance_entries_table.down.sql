@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS merchant_balance_entries;
+DROP TYPE IF EXISTS balance_entry_types;
+
+ALTER TABLE merchant_disbursements DROP CONSTRAINT IF EXISTS merchant_disbursements_net_amount_check;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS carry_forward_amount;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS carried_amount;
+ALTER TABLE merchant_disbursements ADD CONSTRAINT merchant_disbursements_net_amount_check
+    CHECK (net_amount = orders_sum_amount - fee_amount - fee_amount_correction - refunds_amount + fee_reversal_amount);
@@ -0,0 +1,24 @@
+/* The debt of the merchant brought in from its previous daily disbursements, and the negative result carried to the next one */
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS carried_amount DECIMAL(10,2) NOT NULL DEFAULT 0 CHECK (carried_amount >= 0);
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS carry_forward_amount DECIMAL(10,2) NOT NULL DEFAULT 0 CHECK (carry_forward_amount >= 0);
+
+ALTER TABLE merchant_disbursements DROP CONSTRAINT IF EXISTS merchant_disbursements_net_amount_check;
+ALTER TABLE merchant_disbursements ADD CONSTRAINT merchant_disbursements_net_amount_check
+    CHECK (net_amount = orders_sum_amount - fee_amount - fee_amount_correction - refunds_amount + fee_reversal_amount
+                        - carried_amount + carry_forward_amount);
+
+DROP TYPE IF EXISTS balance_entry_types;
+CREATE TYPE balance_entry_types AS ENUM ('earned', 'disbursed');
+
+/* Ledger of the balance of the merchants, posted by their daily disbursements. A negative balance is owed by the merchant */
+CREATE TABLE IF NOT EXISTS merchant_balance_entries (
+    id               UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    merchant_id      UUID NOT NULL,
+    disbursement_id  UUID NOT NULL REFERENCES merchant_disbursements (id),
+    entry_type       BALANCE_ENTRY_TYPES NOT NULL,
+    amount           DECIMAL(10,2) NOT NULL,
+    balance          DECIMAL(10,2) NOT NULL, /* Balance of the merchant after the entry */
+    created_at       TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS merchant_balance_entries_pxt_merchant ON merchant_balance_entries (merchant_id, created_at);
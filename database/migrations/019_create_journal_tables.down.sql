@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS journal_lines;
+DROP TABLE IF EXISTS journal_entries;
+DROP TYPE IF EXISTS journal_sources;
+DROP TYPE IF EXISTS ledger_accounts;
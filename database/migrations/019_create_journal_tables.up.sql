@@ -0,0 +1,96 @@
+DROP TYPE IF EXISTS ledger_accounts;
+CREATE TYPE ledger_accounts AS ENUM ('cash', 'merchant_payable', 'fee_revenue', 'monthly_fee_receivable');
+
+DROP TYPE IF EXISTS journal_sources;
+CREATE TYPE journal_sources AS ENUM ('order', 'refund', 'monthly_fee', 'disbursement');
+
+/* Double-entry ledger: each money movement posts one entry, whose lines debit and credit the accounts by the same total */
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id           UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    source       JOURNAL_SOURCES NOT NULL,
+    source_id    VARCHAR NOT NULL, /* Order or refund id, or disbursement id */
+    merchant_id  UUID NOT NULL,
+    description  VARCHAR NOT NULL DEFAULT '',
+    posted_at    TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL,
+
+    UNIQUE (source, source_id)
+);
+
+CREATE TABLE IF NOT EXISTS journal_lines (
+    id                UUID PRIMARY KEY DEFAULT UUID_GENERATE_V4(),
+    journal_entry_id  UUID NOT NULL REFERENCES journal_entries (id),
+    account           LEDGER_ACCOUNTS NOT NULL,
+    debit             DECIMAL(12,2) NOT NULL DEFAULT 0 CHECK (debit >= 0),
+    credit            DECIMAL(12,2) NOT NULL DEFAULT 0 CHECK (credit >= 0),
+
+    CHECK (debit = 0 OR credit = 0)
+);
+
+CREATE INDEX IF NOT EXISTS journal_entries_pxt_merchant ON journal_entries (merchant_id);
+CREATE INDEX IF NOT EXISTS journal_lines_pxt_entry ON journal_lines (journal_entry_id);
+CREATE INDEX IF NOT EXISTS journal_lines_pxt_account ON journal_lines (account);
+
+/* Post the money movements made before the ledger, with the same rules as the processor */
+INSERT INTO journal_entries ( source, source_id, merchant_id, description, posted_at )
+SELECT 'order', id, merchant_id, 'order paid by the shopper', NOW() FROM orders;
+
+INSERT INTO journal_entries ( source, source_id, merchant_id, description, posted_at )
+SELECT 'refund', id, merchant_id, 'refund given back to the shopper', NOW() FROM refunds;
+
+INSERT INTO journal_entries ( source, source_id, merchant_id, description, posted_at )
+SELECT 'monthly_fee', id::TEXT, merchant_id, 'minimum monthly fee charged', NOW()
+FROM merchant_disbursements
+WHERE disbursement_frequency = 'daily' AND fee_amount_correction <> 0;
+
+INSERT INTO journal_entries ( source, source_id, merchant_id, description, posted_at )
+SELECT 'disbursement', id::TEXT, merchant_id, 'disbursement ' || reference, NOW()
+FROM merchant_disbursements
+WHERE disbursement_frequency = 'daily' AND (net_amount <> 0 OR fee_amount_correction <> 0);
+
+/* A positive amount is a debit, a negative one a credit */
+INSERT INTO journal_lines ( journal_entry_id, account, debit, credit )
+SELECT e.id, l.account, GREATEST(l.amount, 0), GREATEST(-l.amount, 0)
+FROM
+    journal_entries e
+    JOIN orders o ON e.source = 'order' AND e.source_id = o.id
+    CROSS JOIN LATERAL (VALUES
+        ('cash'::LEDGER_ACCOUNTS, o.amount),
+        ('merchant_payable',      -(o.amount - o.fee_amount)),
+        ('fee_revenue',           -o.fee_amount)
+    ) AS l (account, amount)
+WHERE l.amount <> 0;
+
+INSERT INTO journal_lines ( journal_entry_id, account, debit, credit )
+SELECT e.id, l.account, GREATEST(l.amount, 0), GREATEST(-l.amount, 0)
+FROM
+    journal_entries e
+    JOIN refunds r ON e.source = 'refund' AND e.source_id = r.id
+    CROSS JOIN LATERAL (VALUES
+        ('merchant_payable'::LEDGER_ACCOUNTS, r.amount - r.fee_reversal),
+        ('fee_revenue',                       r.fee_reversal),
+        ('cash',                              -r.amount)
+    ) AS l (account, amount)
+WHERE l.amount <> 0;
+
+INSERT INTO journal_lines ( journal_entry_id, account, debit, credit )
+SELECT e.id, l.account, GREATEST(l.amount, 0), GREATEST(-l.amount, 0)
+FROM
+    journal_entries e
+    JOIN merchant_disbursements d ON e.source = 'monthly_fee' AND e.source_id = d.id::TEXT
+    CROSS JOIN LATERAL (VALUES
+        ('monthly_fee_receivable'::LEDGER_ACCOUNTS, d.fee_amount_correction),
+        ('fee_revenue',                             -d.fee_amount_correction)
+    ) AS l (account, amount)
+WHERE l.amount <> 0;
+
+INSERT INTO journal_lines ( journal_entry_id, account, debit, credit )
+SELECT e.id, l.account, GREATEST(l.amount, 0), GREATEST(-l.amount, 0)
+FROM
+    journal_entries e
+    JOIN merchant_disbursements d ON e.source = 'disbursement' AND e.source_id = d.id::TEXT
+    CROSS JOIN LATERAL (VALUES
+        ('merchant_payable'::LEDGER_ACCOUNTS, d.net_amount + d.fee_amount_correction),
+        ('monthly_fee_receivable',            -d.fee_amount_correction),
+        ('cash',                              -d.net_amount)
+    ) AS l (account, amount)
+WHERE l.amount <> 0;
@@ -0,0 +1,13 @@
+/* The chargeback value of journal_sources is kept, an enum value cannot be dropped */
+DELETE FROM journal_lines WHERE journal_entry_id IN (SELECT id FROM journal_entries WHERE source = 'chargeback');
+DELETE FROM journal_entries WHERE source = 'chargeback';
+
+ALTER TABLE merchant_disbursements DROP CONSTRAINT IF EXISTS merchant_disbursements_net_amount_check;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS chargeback_fee_amount;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS chargebacks_total_entries;
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS chargebacks_amount;
+ALTER TABLE merchant_disbursements ADD CONSTRAINT merchant_disbursements_net_amount_check
+    CHECK (net_amount = orders_sum_amount - fee_amount - fee_amount_correction - refunds_amount + fee_reversal_amount
+                        - carried_amount + carry_forward_amount);
+
+DROP TABLE IF EXISTS chargebacks;
@@ -0,0 +1,27 @@
+/* Chargebacks of the orders disputed by the shoppers, deducted with their fee from the next daily disbursement of the merchant */
+CREATE TABLE IF NOT EXISTS chargebacks (
+    id            VARCHAR PRIMARY KEY,
+    order_id      VARCHAR NOT NULL REFERENCES orders (id),
+    merchant_id   UUID NOT NULL,
+    amount        DECIMAL(10,2) NOT NULL CHECK (amount > 0),
+    fee           DECIMAL(10,2) NOT NULL DEFAULT 0 CHECK (fee >= 0), /* Chargeback fee charged to the merchant */
+    reason        VARCHAR NOT NULL DEFAULT '',
+    created_at    DATE NOT NULL,
+    deducted_on   DATE /* Day of the daily disbursement it is deducted from, NULL until processed */
+);
+
+CREATE INDEX IF NOT EXISTS chargebacks_pxt_order ON chargebacks (order_id);
+CREATE INDEX IF NOT EXISTS chargebacks_pxt_pending ON chargebacks (created_at) WHERE deducted_on IS NULL;
+CREATE INDEX IF NOT EXISTS chargebacks_pxt_deducted ON chargebacks (merchant_id, deducted_on);
+
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS chargebacks_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS chargebacks_total_entries INT NOT NULL DEFAULT 0;
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS chargeback_fee_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+/* The chargebacks and their fees are deducted from the amount owed to the merchant */
+ALTER TABLE merchant_disbursements DROP CONSTRAINT IF EXISTS merchant_disbursements_net_amount_check;
+ALTER TABLE merchant_disbursements ADD CONSTRAINT merchant_disbursements_net_amount_check
+    CHECK (net_amount = orders_sum_amount - fee_amount - fee_amount_correction - refunds_amount + fee_reversal_amount
+                        - chargebacks_amount - chargeback_fee_amount - carried_amount + carry_forward_amount);
+
+ALTER TYPE journal_sources ADD VALUE IF NOT EXISTS 'chargeback';
@@ -0,0 +1,3 @@
+ALTER TABLE merchant_disbursements DROP COLUMN IF EXISTS currency;
+ALTER TABLE orders DROP COLUMN IF EXISTS currency;
+ALTER TABLE merchants DROP COLUMN IF EXISTS currency;
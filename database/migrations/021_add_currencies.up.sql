@@ -0,0 +1,4 @@
+/* ISO 4217 code of the currency of the amounts. Everything before currencies existed is in euros */
+ALTER TABLE merchants ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'EUR' CHECK (currency ~ '^[A-Z]{3}$'); /* Settlement currency of the merchant */
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'EUR' CHECK (currency ~ '^[A-Z]{3}$');
+ALTER TABLE merchant_disbursements ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'EUR' CHECK (currency ~ '^[A-Z]{3}$');
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS journal_entries_pxt_currency;
+ALTER TABLE journal_entries DROP COLUMN IF EXISTS currency;
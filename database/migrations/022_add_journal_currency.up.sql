@@ -0,0 +1,20 @@
+/* Currency of the amounts of the journal entry, the one of the order or disbursement posting it */
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'EUR' CHECK (currency ~ '^[A-Z]{3}$');
+
+UPDATE journal_entries e SET currency = o.currency
+FROM orders o
+WHERE e.source = 'order' AND e.source_id = o.id;
+
+UPDATE journal_entries e SET currency = o.currency
+FROM refunds r JOIN orders o ON o.id = r.order_id
+WHERE e.source = 'refund' AND e.source_id = r.id;
+
+UPDATE journal_entries e SET currency = o.currency
+FROM chargebacks c JOIN orders o ON o.id = c.order_id
+WHERE e.source = 'chargeback' AND e.source_id = c.id;
+
+UPDATE journal_entries e SET currency = d.currency
+FROM merchant_disbursements d
+WHERE e.source IN ('monthly_fee', 'disbursement') AND e.source_id = d.id::TEXT;
+
+CREATE INDEX IF NOT EXISTS journal_entries_pxt_currency ON journal_entries (currency);
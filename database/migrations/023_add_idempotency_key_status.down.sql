@@ -0,0 +1,5 @@
+DELETE FROM idempotency_keys WHERE status = 'pending';
+ALTER TABLE idempotency_keys ALTER COLUMN response DROP DEFAULT;
+ALTER TABLE idempotency_keys ALTER COLUMN status_code DROP DEFAULT;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS status;
+DROP TYPE IF EXISTS idempotency_key_statuses;
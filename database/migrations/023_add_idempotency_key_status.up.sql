@@ -0,0 +1,8 @@
+DROP TYPE IF EXISTS idempotency_key_statuses;
+CREATE TYPE idempotency_key_statuses AS ENUM ('pending', 'completed');
+
+/* A key is reserved as pending before the request is processed, and completed with its response */
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS status IDEMPOTENCY_KEY_STATUSES NOT NULL DEFAULT 'completed';
+ALTER TABLE idempotency_keys ALTER COLUMN status SET DEFAULT 'pending';
+ALTER TABLE idempotency_keys ALTER COLUMN status_code SET DEFAULT 0;
+ALTER TABLE idempotency_keys ALTER COLUMN response SET DEFAULT ''::BYTEA;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS merchant_disbursements_pxt_period;
@@ -0,0 +1,2 @@
+/* A merchant gets one disbursement per currency, frequency and period, a run resumed after a failure cannot create it twice */
+CREATE UNIQUE INDEX IF NOT EXISTS merchant_disbursements_pxt_period ON merchant_disbursements (merchant_id, currency, disbursement_frequency, orders_start_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS merchant_balance_entries_pxt_merchant;
+ALTER TABLE merchant_balance_entries DROP COLUMN IF EXISTS currency;
+CREATE INDEX IF NOT EXISTS merchant_balance_entries_pxt_merchant ON merchant_balance_entries (merchant_id, created_at);
@@ -0,0 +1,9 @@
+/* Currency of the balance entry, the one of the disbursement posting it. A merchant has a balance per currency */
+ALTER TABLE merchant_balance_entries ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'EUR' CHECK (currency ~ '^[A-Z]{3}$');
+
+UPDATE merchant_balance_entries e SET currency = d.currency
+FROM merchant_disbursements d
+WHERE e.disbursement_id = d.id;
+
+DROP INDEX IF EXISTS merchant_balance_entries_pxt_merchant;
+CREATE INDEX IF NOT EXISTS merchant_balance_entries_pxt_merchant ON merchant_balance_entries (merchant_id, currency, created_at);
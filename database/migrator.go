@@ -0,0 +1,168 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+var ErrorSchemaVersionMismatch = errors.New("database schema version mismatch")
+
+// MigrationStatus describes the schema version of a database
+type MigrationStatus struct {
+	Version  uint // Version of the last migration applied, 0 when none was applied
+	Dirty    bool // A migration failed halfway and the schema must be fixed and forced
+	Expected uint // Version of the last migration embedded in the binary
+}
+
+// UpToDate tells whether the database schema is the one expected by the binary
+func (s MigrationStatus) UpToDate() bool {
+	return !s.Dirty && s.Version == s.Expected
+}
+
+func (s MigrationStatus) String() string {
+	return fmt.Sprintf("version: %d, dirty: %t, expected: %d", s.Version, s.Dirty, s.Expected)
+}
+
+// Migrator runs the migrations embedded in the binary against a database
+type Migrator struct {
+	m *migrate.Migrate
+}
+
+func NewMigrator(dbURL string) (*Migrator, error) {
+	// Amend the database URl with custom parameter so that we can specify the
+	// table name to be used to hold database migration state
+	migrationsURL, err := migrationsURL(dbURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the migrations from our embedded resources
+	d, err := iofs.New(fs, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	// Use a custom table name for schema migrations
+	m, err := migrate.NewWithSourceInstance("iofs", d, migrationsURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{m: m}, nil
+}
+
+// Up migrates all the way up
+func (mg *Migrator) Up() error {
+	return ignoreNoChange(mg.m.Up())
+}
+
+// Down rolls back the last migration applied
+func (mg *Migrator) Down() error {
+	return ignoreNoChange(mg.m.Steps(-1))
+}
+
+// To migrates up or down to the given version, 0 rolling back every migration
+func (mg *Migrator) To(version uint) error {
+	// There is no migration 0 to migrate to
+	if version == 0 {
+		return ignoreNoChange(mg.m.Down())
+	}
+	return ignoreNoChange(mg.m.Migrate(version))
+}
+
+// Force sets the schema version without running any migration, used to recover from a dirty state
+// -1 clears the version, as if no migration was applied
+func (mg *Migrator) Force(version int) error {
+	return mg.m.Force(version)
+}
+
+// Status returns the current and expected schema versions
+func (mg *Migrator) Status() (MigrationStatus, error) {
+	expected, err := ExpectedSchemaVersion()
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	version, dirty, err := mg.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return MigrationStatus{Expected: expected}, nil
+	}
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	return MigrationStatus{Version: version, Dirty: dirty, Expected: expected}, nil
+}
+
+// Verify fails when the database schema is not the one expected by the binary
+func (mg *Migrator) Verify() error {
+	status, err := mg.Status()
+	if err != nil {
+		return err
+	}
+	if !status.UpToDate() {
+		return fmt.Errorf("%w: %s", ErrorSchemaVersionMismatch, status)
+	}
+	return nil
+}
+
+func (mg *Migrator) Close() error {
+	sourceErr, dbErr := mg.m.Close()
+	return errors.Join(sourceErr, dbErr)
+}
+
+// ExpectedSchemaVersion returns the version of the last migration embedded in the binary
+func ExpectedSchemaVersion() (uint, error) {
+	entries, err := fs.ReadDir("migrations")
+	if err != nil {
+		return 0, err
+	}
+
+	var expected uint
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".up.sql") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid migration file name %s: %w", entry.Name(), err)
+		}
+		expected = max(expected, uint(version))
+	}
+
+	return expected, nil
+}
+
+func ignoreNoChange(err error) error {
+	if errors.Is(err, migrate.ErrNoChange) {
+		return nil
+	}
+	return err
+}
+
+const (
+	CustomMigrationParam = "x-migrations-table"
+	CustomMigrationValue = "schema_migrations"
+)
+
+func migrationsURL(dbURL string) (string, error) {
+	url, err := url.Parse(dbURL)
+	if err != nil {
+		return "", err
+	}
+
+	// Add the new Query parameter that specifies the table name for the migrations
+	values := url.Query()
+	values.Add(CustomMigrationParam, CustomMigrationValue)
+
+	// Replace the Query parameters in the original URL & return
+	url.RawQuery = values.Encode()
+	return url.String(), nil
+}
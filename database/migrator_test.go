@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpectedSchemaVersion(t *testing.T) {
+	migrationFiles, err := fs.ReadDir("migrations")
+	require.NoError(t, err)
+
+	// Each migration file has a corresponding .down.sql file
+	expected, err := ExpectedSchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, uint(len(migrationFiles)/2), expected)
+}
+
+func TestMigrationStatus(t *testing.T) {
+	status := MigrationStatus{Version: 8, Expected: 8}
+	assert.True(t, status.UpToDate())
+	assert.Equal(t, "version: 8, dirty: false, expected: 8", status.String())
+
+	assert.False(t, MigrationStatus{Version: 7, Expected: 8}.UpToDate())
+	assert.False(t, MigrationStatus{Version: 8, Dirty: true, Expected: 8}.UpToDate())
+}
+
+func TestMigrator(t *testing.T) {
+	testDB := test_helpers.NewTestDatabase(t)
+	defer testDB.Close(t)
+	dbURL := testDB.ConnectionString(t) + "?sslmode=disable"
+	ctx := context.Background()
+
+	expected, err := ExpectedSchemaVersion()
+	require.NoError(t, err)
+
+	t.Run("SkipMigrationsOnEmptyDatabase", func(t *testing.T) {
+		_, err := NewPostgresQuerier(ctx, dbURL, WithoutMigrations())
+		require.ErrorIs(t, err, ErrorSchemaVersionMismatch)
+	})
+
+	migrator, err := NewMigrator(dbURL)
+	require.NoError(t, err)
+	defer migrator.Close()
+
+	t.Run("StatusBeforeMigrating", func(t *testing.T) {
+		status, err := migrator.Status()
+		require.NoError(t, err)
+		assert.Equal(t, MigrationStatus{Version: 0, Expected: expected}, status)
+	})
+
+	t.Run("Up", func(t *testing.T) {
+		require.NoError(t, migrator.Up())
+		require.NoError(t, migrator.Verify())
+
+		// Nothing left to migrate is not an error
+		require.NoError(t, migrator.Up())
+
+		querier, err := NewPostgresQuerier(ctx, dbURL, WithoutMigrations())
+		require.NoError(t, err)
+		querier.Close()
+	})
+
+	t.Run("Down", func(t *testing.T) {
+		require.NoError(t, migrator.Down())
+
+		status, err := migrator.Status()
+		require.NoError(t, err)
+		assert.Equal(t, expected-1, status.Version)
+		require.ErrorIs(t, migrator.Verify(), ErrorSchemaVersionMismatch)
+	})
+
+	t.Run("To", func(t *testing.T) {
+		require.NoError(t, migrator.To(expected))
+
+		status, err := migrator.Status()
+		require.NoError(t, err)
+		assert.True(t, status.UpToDate())
+	})
+
+	t.Run("Force", func(t *testing.T) {
+		require.NoError(t, migrator.Force(int(expected)))
+
+		status, err := migrator.Status()
+		require.NoError(t, err)
+		assert.Equal(t, expected, status.Version)
+		assert.False(t, status.Dirty)
+	})
+
+	t.Run("ForceNoVersion", func(t *testing.T) {
+		require.NoError(t, migrator.Force(-1))
+
+		status, err := migrator.Status()
+		require.NoError(t, err)
+		assert.Equal(t, MigrationStatus{Version: 0, Expected: expected}, status)
+
+		require.NoError(t, migrator.Force(int(expected)))
+	})
+
+	t.Run("ToZero", func(t *testing.T) {
+		require.NoError(t, migrator.To(0))
+
+		status, err := migrator.Status()
+		require.NoError(t, err)
+		assert.Equal(t, MigrationStatus{Version: 0, Expected: expected}, status)
+
+		// Nothing left to roll back is not an error
+		require.NoError(t, migrator.To(0))
+		require.NoError(t, migrator.Up())
+	})
+}
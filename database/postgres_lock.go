@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+const (
+	// ProcessorLockName is the name of the lock held while disbursements are being calculated
+	ProcessorLockName = "order_process"
+	// WebhooksLockName is the name of the lock held while the outbox events are being delivered
+	WebhooksLockName = "webhooks_dispatch"
+)
+
+var (
+	ErrorLockHeld    = errors.New("lock is held by another process")
+	ErrorLockNotHeld = errors.New("lock is not held")
+)
+
+const (
+	tryAdvisoryLockSQL = `SELECT pg_try_advisory_lock($1)`
+	advisoryLockSQL    = `SELECT pg_advisory_lock($1)`
+	advisoryUnlockSQL  = `SELECT pg_advisory_unlock($1)`
+)
+
+// AcquireLock acquires the named Postgres advisory lock
+// When wait is false it returns ErrorLockHeld immediately if another session holds the lock,
+// otherwise it blocks until the lock is free or the context is cancelled.
+// Advisory locks belong to the session that acquired them, so the lock keeps
+// its own connection out of the pool until it is released.
+// The mutex only guards the held locks, it is not held while waiting for Postgres.
+func (q *PostgresQuerier) AcquireLock(ctx context.Context, name string, wait bool) error {
+	q.locksMu.Lock()
+	_, exists := q.locks[name]
+	q.locksMu.Unlock()
+	if exists {
+		return ErrorLockHeld
+	}
+
+	conn, err := q.dbConn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := lockKey(name)
+	if wait {
+		_, err = conn.ExecContext(ctx, advisoryLockSQL, key)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		var acquired bool
+		err = conn.QueryRowContext(ctx, tryAdvisoryLockSQL, key).Scan(&acquired)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if !acquired {
+			conn.Close()
+			return ErrorLockHeld
+		}
+	}
+
+	// Postgres grants the lock to a single session, so no other connection was recorded meanwhile
+	q.locksMu.Lock()
+	q.locks[name] = conn
+	q.locksMu.Unlock()
+
+	q.logger.Info("acquired lock", "lock", name)
+	return nil
+}
+
+// ReleaseLock releases the named advisory lock and returns its connection to the pool
+func (q *PostgresQuerier) ReleaseLock(ctx context.Context, name string) error {
+	q.locksMu.Lock()
+	defer q.locksMu.Unlock()
+
+	conn, exists := q.locks[name]
+	if !exists {
+		return ErrorLockNotHeld
+	}
+	delete(q.locks, name)
+	defer conn.Close()
+
+	var released bool
+	err := conn.QueryRowContext(ctx, advisoryUnlockSQL, lockKey(name)).Scan(&released)
+	if err != nil {
+		// The session could still hold the lock, so discard the connection instead of pooling it
+		_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		return err
+	}
+	if !released {
+		return fmt.Errorf("%w: %s", ErrorLockNotHeld, name)
+	}
+
+	q.logger.Info("released lock", "lock", name)
+	return nil
+}
+
+// releaseLocks releases every lock still held, used when closing the querier
+func (q *PostgresQuerier) releaseLocks() {
+	q.locksMu.Lock()
+	names := make([]string, 0, len(q.locks))
+	for name := range q.locks {
+		names = append(names, name)
+	}
+	q.locksMu.Unlock()
+
+	for _, name := range names {
+		if err := q.ReleaseLock(context.Background(), name); err != nil {
+			q.logger.Error("error releasing lock", "lock", name, system.LogErrorKey, err)
+		}
+	}
+}
+
+// lockKey maps a lock name into the 64 bits key space used by Postgres advisory locks
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
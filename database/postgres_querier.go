@@ -5,29 +5,58 @@ import (
 	"database/sql"
 	"embed"
 	"errors"
-	"github.com/golang-migrate/migrate/v4"
+	"fmt"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/google/uuid"
 	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/system"
 	"github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
-	"log"
-	"net/url"
+	"github.com/lib/pq"
+	"log/slog"
+	"sync"
 	"time"
 )
 
 type PostgresQuerier struct {
-	dbURL  string
-	dbConn *sqlx.DB
-	ctx    context.Context
+	dbURL   string
+	dbConn  *sqlx.DB
+	ctx     context.Context
+	locks   map[string]*sql.Conn
+	locksMu sync.Mutex
+	logger  *slog.Logger
 }
 
-func NewPostgresQuerier(ctx context.Context, url string) (*PostgresQuerier, error) {
-	querier := PostgresQuerier{dbURL: url, ctx: ctx}
+// Option customises how NewPostgresQuerier sets up the database
+type Option func(*options)
+
+type options struct {
+	skipMigrations bool
+}
+
+// WithoutMigrations skips running the migrations on connect.
+// The schema version is verified instead, and the querier fails with
+// ErrorSchemaVersionMismatch when it is not the one expected by the binary.
+func WithoutMigrations() Option {
+	return func(o *options) {
+		o.skipMigrations = true
+	}
+}
+
+func NewPostgresQuerier(ctx context.Context, url string, opts ...Option) (*PostgresQuerier, error) {
+	querier := PostgresQuerier{
+		dbURL:  url,
+		ctx:    ctx,
+		locks:  make(map[string]*sql.Conn),
+		logger: system.ComponentLogger("database"),
+	}
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
 
 	_, err := pgx.ParseConfig(url)
 	if err != nil {
@@ -39,7 +68,7 @@ func NewPostgresQuerier(ctx context.Context, url string) (*PostgresQuerier, erro
 	if err != nil {
 		return &querier, err
 	}
-	log.Print("opened database connection")
+	querier.logger.Debug("opened database connection")
 
 	// Ping the database to check that the connection is actually working
 	err = querier.dbConn.Ping()
@@ -47,73 +76,78 @@ func NewPostgresQuerier(ctx context.Context, url string) (*PostgresQuerier, erro
 		return &querier, err
 	}
 
+	if o.skipMigrations {
+		// Verify the schema instead of changing it
+		err = querier.verifySchema()
+		if err != nil {
+			return &querier, err
+		}
+		querier.logger.Info("database schema verified")
+		return &querier, nil
+	}
+
 	// Migrate the database
 	err = querier.migrate()
 	if err != nil {
 		return &querier, err
 	}
-	log.Print("database migration complete")
+	querier.logger.Info("database migration complete")
 
 	return &querier, nil
 }
 
+// Ping checks the database is reachable, used by the health checks
+func (q *PostgresQuerier) Ping(ctx context.Context) error {
+	return q.dbConn.PingContext(ctx)
+}
+
 func (q *PostgresQuerier) Close() {
+	q.releaseLocks()
 	q.dbConn.Close()
-	log.Print("closed database connection")
+	q.logger.Debug("closed database connection")
 }
 
 var (
 	//go:embed migrations/*.sql
 	fs           embed.FS
 	ErrorNilUUID = errors.New("UUID is nil")
-)
 
-func (q *PostgresQuerier) migrate() error {
+	// ErrorStatusChanged is returned when a disbursement is no longer in the status a transition starts from
+	ErrorStatusChanged = errors.New("disbursement status changed")
 
-	// Amend the database URl with custom parameter so that we can specify the
-	// table name to be used to hold database migration state
-	migrationsURL, err := q.migrationsURL()
-	if err != nil {
-		return err
-	}
+	// ErrorMerchantNotSettled is returned when changing the currency of a merchant with amounts not disbursed yet
+	ErrorMerchantNotSettled = errors.New("merchant has amounts not disbursed yet")
 
-	// Load the migrations from our embedded resources
-	d, err := iofs.New(fs, "migrations")
-	if err != nil {
-		return err
-	}
+	// ErrorOrderAmountExceeded is returned when a refund or a chargeback exceeds what is left of its order
+	ErrorOrderAmountExceeded = errors.New("amount exceeds what is left of the order")
+
+	// ErrorDisbursementExists is returned when a merchant already has a disbursement for the period
+	ErrorDisbursementExists = errors.New("disbursement already exists")
+
+	// ErrorAlreadyDisbursed is returned when an order, refund or chargeback summed by a disbursement was disbursed meanwhile
+	ErrorAlreadyDisbursed = errors.New("already disbursed")
+)
 
-	// Use a custom table name for schema migrations
-	m, err := migrate.NewWithSourceInstance("iofs", d, migrationsURL)
+// migrate migrates the database all the way up
+func (q *PostgresQuerier) migrate() error {
+	migrator, err := NewMigrator(q.dbURL)
 	if err != nil {
 		return err
 	}
+	defer migrator.Close()
 
-	// Migrate all the way up ...
-	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
-		return err
-	}
-	return nil
+	return migrator.Up()
 }
 
-const (
-	CustomMigrationParam = "x-migrations-table"
-	CustomMigrationValue = "schema_migrations"
-)
-
-func (q *PostgresQuerier) migrationsURL() (string, error) {
-	url, err := url.Parse(q.dbURL)
+// verifySchema checks the schema version matches the migrations embedded in the binary
+func (q *PostgresQuerier) verifySchema() error {
+	migrator, err := NewMigrator(q.dbURL)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer migrator.Close()
 
-	// Add the new Query parameter that specifies the table name for the migrations
-	values := url.Query()
-	values.Add(CustomMigrationParam, CustomMigrationValue)
-
-	// Replace the Query parameters in the original URL & return
-	url.RawQuery = values.Encode()
-	return url.String(), nil
+	return migrator.Verify()
 }
 
 ////////////////////////////////// Database Querier operations /////////////////////////////////////////////////////////
@@ -137,6 +171,19 @@ func (q *PostgresQuerier) count(ctx context.Context, sql string) (int64, error)
 	return count, err
 }
 
+const selectMerchantsSQL = `SELECT * FROM merchants ORDER BY reference`
+
+func (q *PostgresQuerier) SelectMerchants(ctx context.Context) ([]entities.Merchant, error) {
+	var merchants []entities.Merchant
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&merchants,
+		selectMerchantsSQL)
+
+	return merchants, err
+}
+
 const selectMerchantByReferenceSQL = `SELECT * FROM merchants WHERE reference = $1`
 
 func (q *PostgresQuerier) SelectMerchantByReference(ctx context.Context, reference string) (*entities.Merchant, error) {
@@ -180,26 +227,36 @@ func (q *PostgresQuerier) SelectMerchant(ctx context.Context, id uuid.UUID) (*en
 }
 
 const insertOrderSQL = `
-	INSERT INTO orders ( id, merchant_id, amount, created_at, fee_amount )
-	VALUES             ( $1, $2,          $3,     $4,         $5 )`
+	INSERT INTO orders ( id, merchant_id, amount, created_at, fee_amount, currency )
+	VALUES             ( $1, $2,          $3,     $4,         $5,         $6 )`
 
+// InsertOrder persists an order, and posts it to the ledger in the same transaction
 func (q *PostgresQuerier) InsertOrder(ctx context.Context, order entities.Order) error {
-	err := q.dbConn.GetContext(
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	_, err = tx.ExecContext(
 		ctx,
-		&order.ID,
 		insertOrderSQL,
 		order.ID,
 		order.MerchantID,
 		order.Amount,
 		order.CreatedAt,
-		order.FeeAmount)
+		order.FeeAmount,
+		order.Currency)
+	if err != nil {
+		return err
+	}
 
-	// False positive error, ignore
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+	err = insertJournalEntry(ctx, tx, entities.OrderJournalEntry(order))
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 const selectOrderSQL = `SELECT * FROM orders WHERE id = $1`
@@ -227,47 +284,97 @@ const selectSumOrdersSQL = `
 SELECT 
     uuid_generate_v4() AS id,
     merchant_id,
+    currency,
     $1                AS disbursement_frequency,
     created_at        AS orders_start_at,
     created_at        AS orders_end_at,    
     SUM(fee_amount)   AS fee_amount,
     0                 AS fee_amount_correction,
     SUM(amount)       AS orders_sum_amount,
-    COUNT(*)          AS orders_total_entries     
+    COUNT(*)          AS orders_total_entries,
+    ARRAY_AGG(id ORDER BY id) AS order_ids
 FROM
     orders
 WHERE
     created_at = $2 AND disbursed = false
 GROUP BY
     merchant_id,
+    currency,
     created_at;
 `
 
+// ordersSum is a sum of orders with the IDs of the orders summed
+type ordersSum struct {
+	entities.MerchantDisbursement
+	IDs pq.StringArray `db:"order_ids"`
+}
+
+// SelectSumOrders returns, per merchant and currency, the orders of the day not disbursed yet, with their IDs
 func (q *PostgresQuerier) SelectSumOrders(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error) {
-	var disbursements []entities.MerchantDisbursement
+	var sums []ordersSum
 
 	err := q.dbConn.SelectContext(
 		ctx,
-		&disbursements,
+		&sums,
 		selectSumOrdersSQL,
 		entities.DailyDisbursementFrequency,
 		day)
+	if err != nil {
+		return nil, err
+	}
 
-	return disbursements, err
+	disbursements := make([]entities.MerchantDisbursement, 0, len(sums))
+	for _, sum := range sums {
+		sum.MerchantDisbursement.OrderIDs = sum.IDs
+		disbursements = append(disbursements, sum.MerchantDisbursement)
+	}
+	return disbursements, nil
 }
 
 const insertDisbursementSQL = `
-	INSERT INTO merchant_disbursements ( merchant_id, disbursement_frequency, orders_start_at, orders_end_at, fee_amount, fee_amount_correction, orders_sum_amount, orders_total_entries, created_at)
-	VALUES                             ( $1,          $2,                     $3,              $4, 		      $5,         $6,                    $7,                $8,                   $9)`
-
+	INSERT INTO merchant_disbursements ( reference, merchant_id, currency, disbursement_frequency, orders_start_at, orders_end_at, fee_amount, fee_amount_correction, orders_sum_amount, orders_total_entries, refunds_amount, refunds_total_entries, fee_reversal_amount, chargebacks_amount, chargebacks_total_entries, chargeback_fee_amount, carried_amount, carry_forward_amount, net_amount, created_at)
+	VALUES                             ( $1,        $2,          $3,       $4,                     $5,              $6,            $7,         $8,                    $9,                $10,                  $11,            $12,                   $13,                 $14,                $15,                       $16,                   $17,            $18,                  $19,        $20)
+	ON CONFLICT (merchant_id, currency, disbursement_frequency, orders_start_at) DO NOTHING
+	RETURNING id`
+
+const insertBalanceEntrySQL = `
+	INSERT INTO merchant_balance_entries ( merchant_id, currency, disbursement_id, entry_type, amount, balance, created_at )
+	VALUES                               ( $1,          $2,       $3,              $4,         $5,     $6,      $7 )`
+
+// insertDisbursementCreatedEventSQL writes the creation event of a disbursement with the frequency of its merchant,
+// the one paid to it. The disbursements calculated for the other frequencies are not notified.
+const insertDisbursementCreatedEventSQL = `
+	INSERT INTO outbox_events ( event_type, disbursement_id, merchant_id, payload, next_attempt_at, created_at )
+	SELECT                      $1,         $2,              m.id,        $3,      $4,              $4
+	FROM merchants m
+	WHERE m.id = $5 AND m.disbursement_frequency = $6`
+
+// InsertDisbursement persists a disbursement, with a new reference unless it has one
+// Its net amount must be calculated, the database checks it matches the other amounts.
+// A daily disbursement marks the orders, refunds and chargebacks it sums, see markSummed, posts its entries
+// to the balance of the merchant, see MerchantDisbursement.BalanceEntries, and its minimum monthly fee and payment to the ledger.
+// The event notifying the merchant is written to the outbox in the same transaction.
+// Returns ErrorDisbursementExists if the merchant already has a disbursement for the period, frequency and currency.
 func (q *PostgresQuerier) InsertDisbursement(ctx context.Context, disbursement entities.MerchantDisbursement) error {
 	disbursement.CreatedAt = time.Now()
+	disbursement.Status = entities.CalculatedDisbursementStatus
+	if disbursement.Reference == "" {
+		disbursement.Reference = entities.NewDisbursementReference(disbursement.OrdersStartAt)
+	}
 
-	err := q.dbConn.GetContext(
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	err = tx.GetContext(
 		ctx,
 		&disbursement.ID,
 		insertDisbursementSQL,
+		disbursement.Reference,
 		disbursement.MerchantID,
+		disbursement.Currency,
 		disbursement.DisbursementFrequency,
 		disbursement.OrdersStartAt,
 		disbursement.OrdersEndAt,
@@ -275,20 +382,88 @@ func (q *PostgresQuerier) InsertDisbursement(ctx context.Context, disbursement e
 		disbursement.FeeAmountCorrection,
 		disbursement.OrdersSumAmount,
 		disbursement.OrdersTotalEntries,
+		disbursement.RefundsAmount,
+		disbursement.RefundsTotalEntries,
+		disbursement.FeeReversalAmount,
+		disbursement.ChargebacksAmount,
+		disbursement.ChargebacksTotalEntries,
+		disbursement.ChargebackFeeAmount,
+		disbursement.CarriedAmount,
+		disbursement.CarryForwardAmount,
+		disbursement.NetAmount,
 		disbursement.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s disbursement of merchant %s in %s from %s", ErrorDisbursementExists,
+			disbursement.DisbursementFrequency, disbursement.MerchantID, disbursement.Currency, disbursement.OrdersStartAt.Format(time.DateOnly))
+	}
+	if err != nil {
+		return err
+	}
 
-	// False positive error, ignore
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+	// The weekly and monthly disbursements sum the daily ones, which already posted to the balance
+	if disbursement.DisbursementFrequency == entities.DailyDisbursementFrequency {
+		err = markSummed(ctx, tx, disbursement)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range disbursement.BalanceEntries() {
+			_, err = tx.ExecContext(
+				ctx,
+				insertBalanceEntrySQL,
+				entry.MerchantID,
+				entry.Currency,
+				entry.DisbursementID,
+				entry.EntryType,
+				entry.Amount,
+				entry.Balance,
+				entry.CreatedAt)
+			if err != nil {
+				return err
+			}
+		}
+
+		if entry, ok := entities.MonthlyFeeJournalEntry(disbursement); ok {
+			err = insertJournalEntry(ctx, tx, entry)
+			if err != nil {
+				return err
+			}
+		}
+		if entry, ok := entities.DisbursementJournalEntry(disbursement); ok {
+			err = insertJournalEntry(ctx, tx, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	event, err := entities.NewDisbursementEvent(entities.DisbursementCreatedEvent, disbursement, "")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		insertDisbursementCreatedEventSQL,
+		event.EventType,
+		event.DisbursementID,
+		string(event.Payload),
+		disbursement.CreatedAt,
+		disbursement.MerchantID,
+		disbursement.DisbursementFrequency)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
+// selectSumDisbursementsSQL sums the daily disbursements within the dates, the weekly and monthly ones
+// being sums of them already
 const selectSumDisbursementsSQL = `
 SELECT 
     uuid_generate_v4() AS id,
     merchant_id,
+    currency,
     $1                         AS disbursement_frequency,
     DATE($2::timestamp)        AS orders_start_at,
     DATE($3::timestamp)        AS orders_end_at,
@@ -296,13 +471,24 @@ SELECT
     SUM(fee_amount_correction) AS fee_amount_correction,
     SUM(orders_sum_amount)     AS orders_sum_amount,
     SUM(orders_total_entries)  AS orders_total_entries, 
+    SUM(refunds_amount)        AS refunds_amount,
+    SUM(refunds_total_entries) AS refunds_total_entries,
+    SUM(fee_reversal_amount)   AS fee_reversal_amount,
+    SUM(chargebacks_amount)    AS chargebacks_amount,
+    SUM(chargebacks_total_entries) AS chargebacks_total_entries,
+    SUM(chargeback_fee_amount) AS chargeback_fee_amount,
+    SUM(carried_amount)        AS carried_amount,
+    SUM(carry_forward_amount)  AS carry_forward_amount,
+    SUM(net_amount)            AS net_amount,
     NOW()                      AS created_at
 FROM
     merchant_disbursements
 WHERE
     orders_start_at >= $4 and orders_end_at <= $5 
+    AND disbursement_frequency = 'daily'
 GROUP BY
-    merchant_id;
+    merchant_id,
+    currency;
 `
 
 func (q *PostgresQuerier) SelectSumDisbursements(ctx context.Context, from, to time.Time, frequency entities.DisbursementFrequencies) ([]entities.MerchantDisbursement, error) {
@@ -319,10 +505,12 @@ func (q *PostgresQuerier) SelectSumDisbursements(ctx context.Context, from, to t
 	return disbursements, err
 }
 
+// selectSumDisbursementsPerMerchantSQL sums the daily disbursements of a merchant, like selectSumDisbursementsSQL
 const selectSumDisbursementsPerMerchantSQL = `
 SELECT 
     uuid_generate_v4() AS id,
     merchant_id,
+    currency,
     $1                         AS disbursement_frequency,
     DATE($2::timestamp)        AS orders_start_at,
     DATE($3::timestamp)        AS orders_end_at,
@@ -330,17 +518,30 @@ SELECT
     SUM(fee_amount_correction) AS fee_amount_correction,
     SUM(orders_sum_amount)     AS orders_sum_amount,
     SUM(orders_total_entries)  AS orders_total_entries, 
+    SUM(refunds_amount)        AS refunds_amount,
+    SUM(refunds_total_entries) AS refunds_total_entries,
+    SUM(fee_reversal_amount)   AS fee_reversal_amount,
+    SUM(chargebacks_amount)    AS chargebacks_amount,
+    SUM(chargebacks_total_entries) AS chargebacks_total_entries,
+    SUM(chargeback_fee_amount) AS chargeback_fee_amount,
+    SUM(carried_amount)        AS carried_amount,
+    SUM(carry_forward_amount)  AS carry_forward_amount,
+    SUM(net_amount)            AS net_amount,
     NOW()                      AS created_at
 FROM
     merchant_disbursements
 WHERE
     merchant_id = $4 
-    AND orders_start_at >= $5 and orders_end_at <= $6 
+    AND currency = $5
+    AND orders_start_at >= $6 and orders_end_at <= $7 
+    AND disbursement_frequency = 'daily'
 GROUP BY
-    merchant_id;
+    merchant_id,
+    currency;
 `
 
-func (q *PostgresQuerier) SelectSumDisbursementsForMerchant(ctx context.Context, merchantId uuid.UUID, from, to time.Time, frequency entities.DisbursementFrequencies) (*entities.MerchantDisbursement, error) {
+// SelectSumDisbursementsForMerchant sums the daily disbursements of a merchant in a currency within the dates, nil when there are none
+func (q *PostgresQuerier) SelectSumDisbursementsForMerchant(ctx context.Context, merchantId uuid.UUID, currency string, from, to time.Time, frequency entities.DisbursementFrequencies) (*entities.MerchantDisbursement, error) {
 	var disbursement entities.MerchantDisbursement
 
 	err := q.dbConn.GetContext(
@@ -350,6 +551,7 @@ func (q *PostgresQuerier) SelectSumDisbursementsForMerchant(ctx context.Context,
 		frequency,
 		from, to,
 		merchantId,
+		currency,
 		from, to)
 
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
@@ -365,10 +567,1539 @@ func (q *PostgresQuerier) SelectSumDisbursementsForMerchant(ctx context.Context,
 const updateOrdersSQL = `
 	UPDATE orders
 	SET disbursed = true
-	WHERE created_at = $1`
+	WHERE id = ANY($1::TEXT[]) AND disbursed = false`
+
+const updateRefundsSQL = `
+	UPDATE refunds
+	SET deducted_on = $1
+	WHERE id = ANY($2::TEXT[]) AND deducted_on IS NULL`
+
+const updateChargebacksSQL = `
+	UPDATE chargebacks
+	SET deducted_on = $1
+	WHERE id = ANY($2::TEXT[]) AND deducted_on IS NULL`
+
+// markSummed marks the orders summed by a daily disbursement as disbursed, and its refunds and chargebacks
+// as deducted on its day, within its transaction. A run failing halfway leaves the ones of the merchants
+// not disbursed yet to be summed again, and the ones inserted since they were summed to the next day.
+// Returns ErrorAlreadyDisbursed if one of them was disbursed meanwhile.
+func markSummed(ctx context.Context, tx *sqlx.Tx, disbursement entities.MerchantDisbursement) error {
+	marks := []struct {
+		ids   []string
+		query string
+		args  []any
+	}{
+		{disbursement.OrderIDs, updateOrdersSQL, []any{disbursement.OrderIDs}},
+		{disbursement.RefundIDs, updateRefundsSQL, []any{disbursement.OrdersStartAt, disbursement.RefundIDs}},
+		{disbursement.ChargebackIDs, updateChargebacksSQL, []any{disbursement.OrdersStartAt, disbursement.ChargebackIDs}},
+	}
+	for _, mark := range marks {
+		if len(mark.ids) == 0 {
+			continue
+		}
+
+		result, err := tx.ExecContext(ctx, mark.query, mark.args...)
+		if err != nil {
+			return err
+		}
+		marked, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if marked != int64(len(mark.ids)) {
+			return fmt.Errorf("%w: %d of %v", ErrorAlreadyDisbursed, int64(len(mark.ids))-marked, mark.ids)
+		}
+	}
+	return nil
+}
+
+const lockOrderSQL = `SELECT amount, fee_amount, currency FROM orders WHERE id = $1 FOR UPDATE`
+
+const selectOrderDeductionsSQL = `
+SELECT
+    (SELECT COALESCE(SUM(amount), 0)       FROM refunds     WHERE order_id = $1) AS refunded,
+    (SELECT COALESCE(SUM(fee_reversal), 0) FROM refunds     WHERE order_id = $1) AS reversed,
+    (SELECT COALESCE(SUM(amount), 0)       FROM chargebacks WHERE order_id = $1) AS charged_back`
+
+// orderLeft is what is left of the amount and fee of an order once refunded and charged back, in its currency
+type orderLeft struct {
+	amount   float64
+	fee      float64
+	currency string
+}
+
+// lockOrderLeft locks the order within the transaction and returns what is left of it.
+// The lock is held until the transaction ends, so the refunds and chargebacks of an order
+// are checked and inserted one at a time.
+func lockOrderLeft(ctx context.Context, tx *sqlx.Tx, orderID string) (*orderLeft, error) {
+	var order struct {
+		Amount    float64 `db:"amount"`
+		FeeAmount float64 `db:"fee_amount"`
+		Currency  string  `db:"currency"`
+	}
+	err := tx.GetContext(ctx, &order, lockOrderSQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	var deductions struct {
+		Refunded    float64 `db:"refunded"`
+		Reversed    float64 `db:"reversed"`
+		ChargedBack float64 `db:"charged_back"`
+	}
+	err = tx.GetContext(ctx, &deductions, selectOrderDeductionsSQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &orderLeft{
+		amount:   entities.RoundAmount(order.Amount - deductions.Refunded - deductions.ChargedBack),
+		fee:      entities.RoundAmount(order.FeeAmount - deductions.Reversed),
+		currency: order.Currency,
+	}, nil
+}
+
+const insertRefundSQL = `
+	INSERT INTO refunds ( id, order_id, merchant_id, amount, fee_reversal, created_at )
+	VALUES              ( $1, $2,       $3,          $4,     $5,           $6 )`
+
+// InsertRefund persists a refund, deducted from the next daily disbursement of its merchant
+// Returns ErrorOrderAmountExceeded if the refund, or its fee reversal, exceeds what is left of the order
+func (q *PostgresQuerier) InsertRefund(ctx context.Context, refund entities.Refund) error {
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	left, err := lockOrderLeft(ctx, tx, refund.OrderID)
+	if err != nil {
+		return err
+	}
+	if entities.RoundAmount(refund.Amount) > left.amount || entities.RoundAmount(refund.FeeReversal) > left.fee {
+		return fmt.Errorf("%w: refund of %.2f, %.2f left of order %q", ErrorOrderAmountExceeded, refund.Amount, left.amount, refund.OrderID)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		insertRefundSQL,
+		refund.ID,
+		refund.OrderID,
+		refund.MerchantID,
+		refund.Amount,
+		refund.FeeReversal,
+		refund.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = insertJournalEntry(ctx, tx, entities.RefundJournalEntry(refund, left.currency))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const selectRefundSQL = `SELECT * FROM refunds WHERE id = $1`
+
+func (q *PostgresQuerier) SelectRefund(ctx context.Context, id string) (*entities.Refund, error) {
+	var refund entities.Refund
+
+	err := q.dbConn.GetContext(
+		ctx,
+		&refund,
+		selectRefundSQL,
+		id)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &refund, nil
+}
+
+const selectOrderRefundsSQL = `SELECT * FROM refunds WHERE order_id = $1 ORDER BY created_at, id`
+
+// SelectOrderRefunds returns the refunds of an order, the oldest first
+func (q *PostgresQuerier) SelectOrderRefunds(ctx context.Context, orderID string) ([]entities.Refund, error) {
+	refunds := []entities.Refund{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&refunds,
+		selectOrderRefundsSQL,
+		orderID)
+
+	return refunds, err
+}
+
+const selectSumRefundsSQL = `
+SELECT 
+    uuid_generate_v4() AS id,
+    r.merchant_id,
+    o.currency,
+    $1                 AS disbursement_frequency,
+    DATE($2::timestamp) AS orders_start_at,
+    DATE($2::timestamp) AS orders_end_at,
+    SUM(r.amount)       AS refunds_amount,
+    COUNT(*)            AS refunds_total_entries,
+    SUM(r.fee_reversal) AS fee_reversal_amount,
+    ARRAY_AGG(r.id ORDER BY r.id) AS refund_ids
+FROM
+    refunds r
+    JOIN orders o ON o.id = r.order_id
+WHERE
+    r.created_at <= $2 AND r.deducted_on IS NULL
+GROUP BY
+    r.merchant_id,
+    o.currency;
+`
+
+// refundsSum is a sum of refunds with the IDs of the refunds summed
+type refundsSum struct {
+	entities.MerchantDisbursement
+	IDs pq.StringArray `db:"refund_ids"`
+}
+
+// SelectSumRefunds returns, per merchant and currency of their orders, the refunds up to the day not deducted yet,
+// with their IDs. They are deducted from the daily disbursement of the day.
+func (q *PostgresQuerier) SelectSumRefunds(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error) {
+	var sums []refundsSum
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&sums,
+		selectSumRefundsSQL,
+		entities.DailyDisbursementFrequency,
+		day)
+	if err != nil {
+		return nil, err
+	}
+
+	disbursements := make([]entities.MerchantDisbursement, 0, len(sums))
+	for _, sum := range sums {
+		sum.MerchantDisbursement.RefundIDs = sum.IDs
+		disbursements = append(disbursements, sum.MerchantDisbursement)
+	}
+	return disbursements, nil
+}
+
+const selectDeductedRefundsSQL = `
+SELECT * FROM refunds
+WHERE merchant_id = $1 AND deducted_on >= $2 AND deducted_on <= $3
+ORDER BY deducted_on, created_at, id`
+
+// SelectDeductedRefunds returns the refunds of a merchant deducted between two days, both included
+// These are the refunds covered by the merchant disbursements of the period
+func (q *PostgresQuerier) SelectDeductedRefunds(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Refund, error) {
+	refunds := []entities.Refund{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&refunds,
+		selectDeductedRefundsSQL,
+		merchantID,
+		from, to)
+
+	return refunds, err
+}
+
+const insertChargebackSQL = `
+	INSERT INTO chargebacks ( id, order_id, merchant_id, amount, fee, reason, created_at )
+	VALUES                  ( $1, $2,       $3,          $4,     $5,  $6,     $7 )`
+
+// InsertChargeback persists a chargeback, deducted with its fee from the next daily disbursement of its merchant
+// Returns ErrorOrderAmountExceeded if the chargeback exceeds what is left of the order
+func (q *PostgresQuerier) InsertChargeback(ctx context.Context, chargeback entities.Chargeback) error {
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	left, err := lockOrderLeft(ctx, tx, chargeback.OrderID)
+	if err != nil {
+		return err
+	}
+	if entities.RoundAmount(chargeback.Amount) > left.amount {
+		return fmt.Errorf("%w: chargeback of %.2f, %.2f left of order %q", ErrorOrderAmountExceeded, chargeback.Amount, left.amount, chargeback.OrderID)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		insertChargebackSQL,
+		chargeback.ID,
+		chargeback.OrderID,
+		chargeback.MerchantID,
+		chargeback.Amount,
+		chargeback.Fee,
+		chargeback.Reason,
+		chargeback.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = insertJournalEntry(ctx, tx, entities.ChargebackJournalEntry(chargeback, left.currency))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const selectChargebackSQL = `SELECT * FROM chargebacks WHERE id = $1`
+
+func (q *PostgresQuerier) SelectChargeback(ctx context.Context, id string) (*entities.Chargeback, error) {
+	var chargeback entities.Chargeback
+
+	err := q.dbConn.GetContext(
+		ctx,
+		&chargeback,
+		selectChargebackSQL,
+		id)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &chargeback, nil
+}
+
+const selectOrderChargebacksSQL = `SELECT * FROM chargebacks WHERE order_id = $1 ORDER BY created_at, id`
+
+// SelectOrderChargebacks returns the chargebacks of an order, the oldest first
+func (q *PostgresQuerier) SelectOrderChargebacks(ctx context.Context, orderID string) ([]entities.Chargeback, error) {
+	chargebacks := []entities.Chargeback{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&chargebacks,
+		selectOrderChargebacksSQL,
+		orderID)
+
+	return chargebacks, err
+}
+
+const selectSumChargebacksSQL = `
+SELECT 
+    uuid_generate_v4() AS id,
+    c.merchant_id,
+    o.currency,
+    $1                 AS disbursement_frequency,
+    DATE($2::timestamp) AS orders_start_at,
+    DATE($2::timestamp) AS orders_end_at,
+    SUM(c.amount)      AS chargebacks_amount,
+    COUNT(*)           AS chargebacks_total_entries,
+    SUM(c.fee)         AS chargeback_fee_amount,
+    ARRAY_AGG(c.id ORDER BY c.id) AS chargeback_ids
+FROM
+    chargebacks c
+    JOIN orders o ON o.id = c.order_id
+WHERE
+    c.created_at <= $2 AND c.deducted_on IS NULL
+GROUP BY
+    c.merchant_id,
+    o.currency;
+`
 
-func (q *PostgresQuerier) MarkOrdersAsDisbursed(ctx context.Context, day time.Time) error {
-	_, err := q.dbConn.ExecContext(ctx, updateOrdersSQL, day)
+// chargebacksSum is a sum of chargebacks with the IDs of the chargebacks summed
+type chargebacksSum struct {
+	entities.MerchantDisbursement
+	IDs pq.StringArray `db:"chargeback_ids"`
+}
+
+// SelectSumChargebacks returns, per merchant and currency of their orders, the chargebacks up to the day not deducted yet,
+// with their IDs. They are deducted with their fees from the daily disbursement of the day.
+func (q *PostgresQuerier) SelectSumChargebacks(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error) {
+	var sums []chargebacksSum
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&sums,
+		selectSumChargebacksSQL,
+		entities.DailyDisbursementFrequency,
+		day)
+	if err != nil {
+		return nil, err
+	}
+
+	disbursements := make([]entities.MerchantDisbursement, 0, len(sums))
+	for _, sum := range sums {
+		sum.MerchantDisbursement.ChargebackIDs = sum.IDs
+		disbursements = append(disbursements, sum.MerchantDisbursement)
+	}
+	return disbursements, nil
+}
+
+const selectDeductedChargebacksSQL = `
+SELECT * FROM chargebacks
+WHERE merchant_id = $1 AND deducted_on >= $2 AND deducted_on <= $3
+ORDER BY deducted_on, created_at, id`
+
+// SelectDeductedChargebacks returns the chargebacks of a merchant deducted between two days, both included
+// These are the chargebacks covered by the merchant disbursements of the period
+func (q *PostgresQuerier) SelectDeductedChargebacks(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Chargeback, error) {
+	chargebacks := []entities.Chargeback{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&chargebacks,
+		selectDeductedChargebacksSQL,
+		merchantID,
+		from, to)
+
+	return chargebacks, err
+}
+
+const selectMerchantBalanceSQL = `SELECT COALESCE(SUM(amount), 0) FROM merchant_balance_entries WHERE merchant_id = $1 AND currency = $2`
+
+// SelectMerchantBalance returns the balance of a merchant in a currency, negative when it owes an amount to be deducted
+// from its next disbursements in that currency. It is zero for a merchant without any entry in it.
+func (q *PostgresQuerier) SelectMerchantBalance(ctx context.Context, merchantID uuid.UUID, currency string) (float64, error) {
+	var balance float64
+	err := q.dbConn.GetContext(ctx, &balance, selectMerchantBalanceSQL, merchantID, currency)
+	return balance, err
+}
 
+const selectBalanceEntriesSQL = `
+SELECT * FROM merchant_balance_entries
+WHERE merchant_id = $1
+ORDER BY created_at, entry_type`
+
+// SelectBalanceEntries returns the entries of the balance of a merchant, oldest first
+func (q *PostgresQuerier) SelectBalanceEntries(ctx context.Context, merchantID uuid.UUID) ([]entities.MerchantBalanceEntry, error) {
+	entries := []entities.MerchantBalanceEntry{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&entries,
+		selectBalanceEntriesSQL,
+		merchantID)
+
+	return entries, err
+}
+
+// The debt of a merchant in a currency started with the first entry leaving its balance negative, after the last one leaving it at zero
+const selectMerchantDebtsSQL = `
+WITH balances AS (
+    SELECT
+        merchant_id,
+        currency,
+        SUM(amount)      AS balance,
+        MAX(created_at)  AS last_entry_at,
+        MAX(created_at) FILTER (WHERE balance >= 0) AS settled_at
+    FROM
+        merchant_balance_entries
+    GROUP BY
+        merchant_id,
+        currency
+    HAVING
+        SUM(amount) < 0
+)
+SELECT
+    b.merchant_id,
+    m.reference,
+    -b.balance AS amount,
+    b.currency,
+    (SELECT MIN(e.created_at)
+     FROM merchant_balance_entries e
+     WHERE e.merchant_id = b.merchant_id AND e.currency = b.currency AND e.balance < 0
+       AND (b.settled_at IS NULL OR e.created_at > b.settled_at)) AS since,
+    b.last_entry_at
+FROM
+    balances b
+    JOIN merchants m ON m.id = b.merchant_id
+ORDER BY
+    amount DESC, m.reference, b.currency`
+
+// SelectMerchantDebts returns the merchants whose balance in a currency is negative, one debt per currency, the largest first
+func (q *PostgresQuerier) SelectMerchantDebts(ctx context.Context) ([]entities.MerchantDebt, error) {
+	debts := []entities.MerchantDebt{}
+
+	err := q.dbConn.SelectContext(ctx, &debts, selectMerchantDebtsSQL)
+
+	return debts, err
+}
+
+const insertJournalEntrySQL = `
+	INSERT INTO journal_entries ( source, source_id, merchant_id, currency, description, posted_at )
+	VALUES                      ( $1,     $2,        $3,          $4,       $5,          $6 )
+	RETURNING id`
+
+const insertJournalLineSQL = `
+	INSERT INTO journal_lines ( journal_entry_id, account, debit, credit )
+	VALUES                    ( $1,               $2,      $3,    $4 )`
+
+// insertJournalEntry posts a journal entry with its lines, within the transaction of the money movement
+// The entry is rejected when it does not balance.
+func insertJournalEntry(ctx context.Context, tx *sqlx.Tx, entry entities.JournalEntry) error {
+	err := entry.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = tx.GetContext(
+		ctx,
+		&entry.ID,
+		insertJournalEntrySQL,
+		entry.Source,
+		entry.SourceID,
+		entry.MerchantID,
+		entry.Currency,
+		entry.Description,
+		entry.PostedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range entry.Lines {
+		_, err = tx.ExecContext(ctx, insertJournalLineSQL, entry.ID, line.Account, line.Debit, line.Credit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const selectLedgerBalancesSQL = `
+SELECT
+    e.currency,
+    l.account,
+    SUM(l.debit)  AS debits,
+    SUM(l.credit) AS credits
+FROM
+    journal_lines l
+    JOIN journal_entries e ON e.id = l.journal_entry_id
+GROUP BY
+    e.currency,
+    l.account
+ORDER BY
+    e.currency,
+    l.account`
+
+// SelectLedgerBalances returns the debits and credits of each account of the ledger with any line, per currency
+func (q *PostgresQuerier) SelectLedgerBalances(ctx context.Context) ([]entities.LedgerBalance, error) {
+	balances := []entities.LedgerBalance{}
+
+	err := q.dbConn.SelectContext(ctx, &balances, selectLedgerBalancesSQL)
+
+	return balances, err
+}
+
+// The daily disbursements post to the ledger, the weekly and monthly ones sum them
+// The refunds and chargebacks are in the currency of their order
+const selectLedgerTotalsSQL = `
+WITH
+    order_refunds AS (SELECT r.amount, r.fee_reversal, o.currency FROM refunds r JOIN orders o ON o.id = r.order_id),
+    order_chargebacks AS (SELECT c.amount, c.fee, o.currency FROM chargebacks c JOIN orders o ON o.id = c.order_id),
+    daily AS (SELECT * FROM merchant_disbursements WHERE disbursement_frequency = 'daily'),
+    currencies AS (
+        SELECT currency FROM orders
+        UNION SELECT currency FROM daily
+        UNION SELECT currency FROM journal_entries
+    )
+SELECT
+    c.currency,
+    (SELECT COALESCE(SUM(amount), 0) FROM orders WHERE currency = c.currency)                   AS orders_amount,
+    (SELECT COALESCE(SUM(fee_amount), 0) FROM orders WHERE currency = c.currency)               AS orders_fee_amount,
+    (SELECT COALESCE(SUM(amount), 0) FROM order_refunds WHERE currency = c.currency)            AS refunds_amount,
+    (SELECT COALESCE(SUM(fee_reversal), 0) FROM order_refunds WHERE currency = c.currency)      AS fee_reversal_amount,
+    (SELECT COALESCE(SUM(amount), 0) FROM order_chargebacks WHERE currency = c.currency)        AS chargebacks_amount,
+    (SELECT COALESCE(SUM(fee), 0) FROM order_chargebacks WHERE currency = c.currency)           AS chargeback_fees_amount,
+    (SELECT COALESCE(SUM(fee_amount_correction), 0) FROM daily WHERE currency = c.currency)     AS monthly_fees_amount,
+    (SELECT COALESCE(SUM(net_amount), 0) FROM daily WHERE currency = c.currency)                AS disbursement_amount,
+    (SELECT COUNT(*) FROM journal_entries WHERE currency = c.currency)                          AS journal_entries,
+    (SELECT COUNT(*) FROM orders WHERE currency = c.currency) +
+    (SELECT COUNT(*) FROM order_refunds WHERE currency = c.currency) +
+    (SELECT COUNT(*) FROM order_chargebacks WHERE currency = c.currency) +
+    (SELECT COUNT(*) FILTER (WHERE fee_amount_correction <> 0) +
+            COUNT(*) FILTER (WHERE net_amount <> 0 OR fee_amount_correction <> 0)
+     FROM daily WHERE currency = c.currency)                                                    AS expected_entries,
+    (SELECT COUNT(*) FROM (
+        SELECT l.journal_entry_id
+        FROM journal_lines l JOIN journal_entries e ON e.id = l.journal_entry_id
+        WHERE e.currency = c.currency
+        GROUP BY l.journal_entry_id HAVING SUM(l.debit) <> SUM(l.credit)
+     ) unbalanced)                                                                              AS unbalanced_entries
+FROM
+    currencies c
+ORDER BY
+    c.currency`
+
+// SelectLedgerTotals returns, per currency, the sums of the operational tables the ledger is checked against
+func (q *PostgresQuerier) SelectLedgerTotals(ctx context.Context) ([]entities.LedgerTotals, error) {
+	totals := []entities.LedgerTotals{}
+
+	err := q.dbConn.SelectContext(ctx, &totals, selectLedgerTotalsSQL)
+
+	return totals, err
+}
+
+// What is owed to each merchant in each currency, in the ledger, and from its orders not disbursed yet,
+// less its refunds and chargebacks not deducted yet and its debt, the negative balance carried forward
+const selectMerchantPayablesSQL = `
+WITH ledger AS (
+    SELECT e.merchant_id, e.currency, SUM(l.credit - l.debit) AS amount
+    FROM journal_lines l JOIN journal_entries e ON e.id = l.journal_entry_id
+    WHERE l.account = 'merchant_payable'
+    GROUP BY e.merchant_id, e.currency
+),
+expected AS (
+    SELECT merchant_id, currency, SUM(amount) AS amount
+    FROM (
+        SELECT merchant_id, currency, amount - fee_amount AS amount FROM orders WHERE disbursed = false
+        UNION ALL
+        SELECT r.merchant_id, o.currency, -(r.amount - r.fee_reversal)
+        FROM refunds r JOIN orders o ON o.id = r.order_id WHERE r.deducted_on IS NULL
+        UNION ALL
+        SELECT c.merchant_id, o.currency, -(c.amount + c.fee)
+        FROM chargebacks c JOIN orders o ON o.id = c.order_id WHERE c.deducted_on IS NULL
+        UNION ALL
+        SELECT merchant_id, currency, amount FROM merchant_balance_entries
+    ) movements
+    GROUP BY merchant_id, currency
+)
+SELECT
+    COALESCE(l.merchant_id, x.merchant_id) AS merchant_id,
+    COALESCE(l.currency, x.currency)       AS currency,
+    COALESCE(l.amount, 0)                  AS ledger,
+    COALESCE(x.amount, 0)                  AS expected
+FROM
+    ledger l
+    FULL JOIN expected x ON x.merchant_id = l.merchant_id AND x.currency = l.currency
+ORDER BY
+    1, 2`
+
+// SelectMerchantPayables returns, per merchant and currency, what the ledger owes it next to what its operational tables add up to
+func (q *PostgresQuerier) SelectMerchantPayables(ctx context.Context) ([]entities.MerchantPayable, error) {
+	payables := []entities.MerchantPayable{}
+
+	err := q.dbConn.SelectContext(ctx, &payables, selectMerchantPayablesSQL)
+
+	return payables, err
+}
+
+// Filters of the disbursements, an unset parameter does not filter
+const disbursementFilterSQL = `
+WHERE
+    ($1::UUID IS NULL OR merchant_id = $1)
+    AND ($2::TEXT IS NULL OR disbursement_frequency::TEXT = $2)
+    AND ($3::DATE IS NULL OR orders_start_at >= $3)
+    AND ($4::DATE IS NULL OR orders_end_at <= $4)
+    AND ($5::TEXT IS NULL OR status::TEXT = $5)`
+
+const selectDisbursementsSQL = `SELECT * FROM merchant_disbursements` + disbursementFilterSQL + `
+ORDER BY orders_start_at DESC, disbursement_frequency, reference
+LIMIT $6 OFFSET $7`
+
+// SelectDisbursements returns the disbursements matching the filter, latest first
+func (q *PostgresQuerier) SelectDisbursements(ctx context.Context, filter entities.DisbursementFilter) ([]entities.MerchantDisbursement, error) {
+	disbursements := []entities.MerchantDisbursement{}
+
+	var limit any
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+
+	args := append(disbursementFilterArgs(filter), limit, filter.Offset)
+	err := q.dbConn.SelectContext(
+		ctx,
+		&disbursements,
+		selectDisbursementsSQL,
+		args...)
+
+	return disbursements, err
+}
+
+const countDisbursementsSQL = `SELECT COUNT(*) FROM merchant_disbursements` + disbursementFilterSQL
+
+// CountDisbursements counts the disbursements matching the filter, ignoring its limit and offset
+func (q *PostgresQuerier) CountDisbursements(ctx context.Context, filter entities.DisbursementFilter) (int64, error) {
+	row := q.dbConn.QueryRowContext(ctx, countDisbursementsSQL, disbursementFilterArgs(filter)...)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+// disbursementFilterArgs returns the parameters of disbursementFilterSQL
+func disbursementFilterArgs(filter entities.DisbursementFilter) []any {
+	args := []any{nil, nil, nil, nil, nil}
+	if filter.MerchantID != uuid.Nil {
+		args[0] = filter.MerchantID
+	}
+	if filter.Frequency != "" {
+		args[1] = string(filter.Frequency)
+	}
+	if !filter.From.IsZero() {
+		args[2] = filter.From
+	}
+	if !filter.To.IsZero() {
+		args[3] = filter.To
+	}
+	if filter.Status != "" {
+		args[4] = string(filter.Status)
+	}
+	return args
+}
+
+const selectDisbursementByReferenceSQL = `SELECT * FROM merchant_disbursements WHERE reference = $1`
+
+func (q *PostgresQuerier) SelectDisbursementByReference(ctx context.Context, reference string) (*entities.MerchantDisbursement, error) {
+	var disbursement entities.MerchantDisbursement
+
+	err := q.dbConn.GetContext(
+		ctx,
+		&disbursement,
+		selectDisbursementByReferenceSQL,
+		reference)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &disbursement, nil
+}
+
+const selectDisbursedOrdersSQL = `
+SELECT * FROM orders
+WHERE merchant_id = $1 AND created_at >= $2 AND created_at <= $3 AND disbursed = true
+ORDER BY created_at, id`
+
+// SelectDisbursedOrders returns the disbursed orders of a merchant between two days, both included
+// These are the orders covered by the merchant disbursements of the period
+func (q *PostgresQuerier) SelectDisbursedOrders(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Order, error) {
+	orders := []entities.Order{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&orders,
+		selectDisbursedOrdersSQL,
+		merchantID,
+		from, to)
+
+	return orders, err
+}
+
+const selectIdempotencyKeySQL = `SELECT * FROM idempotency_keys WHERE key = $1`
+
+func (q *PostgresQuerier) SelectIdempotencyKey(ctx context.Context, key string) (*entities.IdempotencyKey, error) {
+	var idempotencyKey entities.IdempotencyKey
+
+	err := q.dbConn.GetContext(
+		ctx,
+		&idempotencyKey,
+		selectIdempotencyKeySQL,
+		key)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &idempotencyKey, nil
+}
+
+const reserveIdempotencyKeySQL = `
+	INSERT INTO idempotency_keys ( key, request_hash, status, created_at )
+	VALUES                       ( $1,  $2,           $3,     NOW() )
+	ON CONFLICT (key) DO NOTHING`
+
+// ReserveIdempotencyKey reserves a key for a request, as pending until its response is stored
+// will return false if the key is already reserved or completed, by this request or another one
+func (q *PostgresQuerier) ReserveIdempotencyKey(ctx context.Context, key, requestHash string) (bool, error) {
+	result, err := q.dbConn.ExecContext(
+		ctx,
+		reserveIdempotencyKeySQL,
+		key,
+		requestHash,
+		entities.PendingIdempotencyKeyStatus)
+	if err != nil {
+		return false, err
+	}
+
+	reserved, err := result.RowsAffected()
+	return reserved == 1, err
+}
+
+const completeIdempotencyKeySQL = `
+	UPDATE idempotency_keys
+	SET status = $2, status_code = $3, response = $4
+	WHERE key = $1 AND status = $5`
+
+// CompleteIdempotencyKey stores the response of the request a key was reserved for
+func (q *PostgresQuerier) CompleteIdempotencyKey(ctx context.Context, idempotencyKey entities.IdempotencyKey) error {
+	_, err := q.dbConn.ExecContext(
+		ctx,
+		completeIdempotencyKeySQL,
+		idempotencyKey.Key,
+		entities.CompletedIdempotencyKeyStatus,
+		idempotencyKey.StatusCode,
+		idempotencyKey.Response,
+		entities.PendingIdempotencyKeyStatus)
+
+	return err
+}
+
+const releaseIdempotencyKeySQL = `DELETE FROM idempotency_keys WHERE key = $1 AND status = $2`
+
+// ReleaseIdempotencyKey frees a key still pending, when its request failed, so it can be retried
+func (q *PostgresQuerier) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := q.dbConn.ExecContext(
+		ctx,
+		releaseIdempotencyKeySQL,
+		key,
+		entities.PendingIdempotencyKeyStatus)
+
+	return err
+}
+
+// selectYearlyReportSQL sums the daily disbursements, which every merchant gets whatever its frequency,
+// and counts the disbursements paid with the frequency of their merchant
+// Years are the ones of the first day of the orders of the disbursements
+const selectYearlyReportSQL = `
+WITH paid AS (
+    SELECT
+        EXTRACT(YEAR FROM d.orders_start_at)::INT AS year,
+        d.currency,
+        COUNT(*)                                  AS disbursements
+    FROM
+        merchant_disbursements d
+        JOIN merchants m ON m.id = d.merchant_id AND m.disbursement_frequency = d.disbursement_frequency
+    GROUP BY
+        1, 2
+), amounts AS (
+    SELECT
+        EXTRACT(YEAR FROM orders_start_at)::INT                        AS year,
+        currency,
+        SUM(net_amount)                                                AS amount_disbursed,
+        SUM(fee_amount)                                                AS order_fees,
+        COUNT(*) FILTER (WHERE fee_amount_correction > 0)              AS monthly_fees,
+        SUM(fee_amount_correction)                                     AS monthly_fees_amount
+    FROM
+        merchant_disbursements
+    WHERE
+        disbursement_frequency = 'daily'
+    GROUP BY
+        1, 2
+)
+SELECT
+    a.year,
+    a.currency,
+    COALESCE(p.disbursements, 0) AS disbursements,
+    a.amount_disbursed,
+    a.order_fees,
+    a.monthly_fees,
+    a.monthly_fees_amount
+FROM
+    amounts a
+    LEFT JOIN paid p ON p.year = a.year AND p.currency = a.currency
+WHERE
+    $1::INT IS NULL OR a.year = $1
+ORDER BY
+    a.year,
+    a.currency`
+
+// SelectYearlyReport returns the totals of each year and currency, or only of the given year when not 0
+func (q *PostgresQuerier) SelectYearlyReport(ctx context.Context, year int) ([]entities.YearlyReport, error) {
+	reports := []entities.YearlyReport{}
+
+	var yearArg any
+	if year != 0 {
+		yearArg = year
+	}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&reports,
+		selectYearlyReportSQL,
+		yearArg)
+
+	return reports, err
+}
+
+const insertBankAccountSQL = `
+	INSERT INTO merchant_bank_accounts ( merchant_id, iban, bic, holder_name, valid_from, valid_to, status, created_at, updated_at )
+	VALUES                             ( $1,          $2,   $3,  $4,          $5,         $6,       $7,     $8,         $8 )
+	RETURNING id`
+
+const insertBankAccountChangeSQL = `
+	INSERT INTO merchant_bank_account_changes ( bank_account_id, merchant_id, change, status, valid_from, valid_to, changed_at )
+	VALUES                                    ( $1,              $2,          $3,     $4,     $5,         $6,       $7 )`
+
+// InsertBankAccount persists a bank account, and records its creation in the history
+func (q *PostgresQuerier) InsertBankAccount(ctx context.Context, account *entities.MerchantBankAccount) error {
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	account.CreatedAt = time.Now()
+	account.UpdatedAt = account.CreatedAt
+	err = tx.GetContext(
+		ctx,
+		&account.ID,
+		insertBankAccountSQL,
+		account.MerchantID,
+		account.IBAN,
+		account.BIC,
+		account.HolderName,
+		account.ValidFrom,
+		account.ValidTo,
+		account.Status,
+		account.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = insertBankAccountChange(ctx, tx, account, entities.BankAccountCreated)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const updateBankAccountSQL = `UPDATE merchant_bank_accounts SET status = $2, valid_to = $3, updated_at = $4 WHERE id = $1`
+
+// UpdateBankAccount persists the status and the end of validity of a bank account, and records the change in the history
+func (q *PostgresQuerier) UpdateBankAccount(ctx context.Context, account *entities.MerchantBankAccount, change string) error {
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	account.UpdatedAt = time.Now()
+	result, err := tx.ExecContext(
+		ctx,
+		updateBankAccountSQL,
+		account.ID,
+		account.Status,
+		account.ValidTo,
+		account.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = insertBankAccountChange(ctx, tx, account, change)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertBankAccountChange(ctx context.Context, tx *sqlx.Tx, account *entities.MerchantBankAccount, change string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		insertBankAccountChangeSQL,
+		account.ID,
+		account.MerchantID,
+		change,
+		account.Status,
+		account.ValidFrom,
+		account.ValidTo,
+		account.UpdatedAt)
+
+	return err
+}
+
+const selectBankAccountSQL = `SELECT * FROM merchant_bank_accounts WHERE id = $1`
+
+func (q *PostgresQuerier) SelectBankAccount(ctx context.Context, id uuid.UUID) (*entities.MerchantBankAccount, error) {
+	var account entities.MerchantBankAccount
+
+	err := q.dbConn.GetContext(
+		ctx,
+		&account,
+		selectBankAccountSQL,
+		id)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &account, nil
+}
+
+const selectBankAccountsSQL = `SELECT * FROM merchant_bank_accounts WHERE merchant_id = $1 ORDER BY valid_from DESC, created_at DESC`
+
+// SelectBankAccounts returns the bank accounts of a merchant, the most recent first
+func (q *PostgresQuerier) SelectBankAccounts(ctx context.Context, merchantID uuid.UUID) ([]entities.MerchantBankAccount, error) {
+	accounts := []entities.MerchantBankAccount{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&accounts,
+		selectBankAccountsSQL,
+		merchantID)
+
+	return accounts, err
+}
+
+const selectBankAccountChangesSQL = `SELECT * FROM merchant_bank_account_changes WHERE merchant_id = $1 ORDER BY changed_at, id`
+
+// SelectBankAccountChanges returns the history of the bank accounts of a merchant, in the order of the changes
+func (q *PostgresQuerier) SelectBankAccountChanges(ctx context.Context, merchantID uuid.UUID) ([]entities.BankAccountChange, error) {
+	changes := []entities.BankAccountChange{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&changes,
+		selectBankAccountChangesSQL,
+		merchantID)
+
+	return changes, err
+}
+
+// currentBankAccountSQL is the condition of the account a disbursement can be paid to today
+const currentBankAccountSQL = `a.status = 'verified' AND a.valid_from <= CURRENT_DATE AND (a.valid_to IS NULL OR a.valid_to >= CURRENT_DATE)`
+
+// unpaidDisbursementSQL is the condition of the disbursements still to be paid, failed and returned payouts are paid again
+const unpaidDisbursementSQL = `d.status IN ('calculated', 'approved', 'failed', 'returned')`
+
+// markDisbursementsPayableSQL links the unpaid disbursements, with the frequency of their merchant,
+// to the current verified bank account of the merchant. Only one account of a merchant is current at a time.
+const markDisbursementsPayableSQL = `
+UPDATE merchant_disbursements d
+SET
+    bank_account_id = a.id
+FROM
+    merchants m,
+    merchant_bank_accounts a
+WHERE
+    m.id = d.merchant_id
+    AND m.disbursement_frequency = d.disbursement_frequency
+    AND a.merchant_id = d.merchant_id
+    AND ` + currentBankAccountSQL + `
+    AND d.orders_end_at <= $1
+    AND d.bank_account_id IS DISTINCT FROM a.id
+    AND ` + unpaidDisbursementSQL
+
+// MarkDisbursementsPayable links the disbursements with orders until the day, included, not paid yet
+// to the current verified bank account of their merchant, which makes them payable
+func (q *PostgresQuerier) MarkDisbursementsPayable(ctx context.Context, until time.Time) (int64, error) {
+	result, err := q.dbConn.ExecContext(
+		ctx,
+		markDisbursementsPayableSQL,
+		until)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+const selectUnpayableDisbursementsSQL = `
+SELECT
+    d.*
+FROM
+    merchant_disbursements d
+    JOIN merchants m ON m.id = d.merchant_id AND m.disbursement_frequency = d.disbursement_frequency
+    LEFT JOIN merchant_bank_accounts a ON a.id = d.bank_account_id AND ` + currentBankAccountSQL + `
+WHERE
+    d.orders_end_at <= $1
+    AND a.id IS NULL
+    AND ` + unpaidDisbursementSQL + `
+ORDER BY
+    d.orders_end_at, d.reference`
+
+// SelectUnpayableDisbursements returns the disbursements with orders until the day, included, not paid yet
+// whose merchant has no current verified bank account
+func (q *PostgresQuerier) SelectUnpayableDisbursements(ctx context.Context, until time.Time) ([]entities.MerchantDisbursement, error) {
+	disbursements := []entities.MerchantDisbursement{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&disbursements,
+		selectUnpayableDisbursementsSQL,
+		until)
+
+	return disbursements, err
+}
+
+// selectPayableDisbursementsSQL selects the approved disbursements linked by the processor to a bank account
+// that is still current, so an account rejected or closed since does not receive payouts
+const selectPayableDisbursementsSQL = `
+SELECT
+    d.*,
+    m.reference AS merchant_reference,
+    a.iban,
+    a.bic,
+    a.holder_name
+FROM
+    merchant_disbursements d
+    JOIN merchants m ON m.id = d.merchant_id
+    JOIN merchant_bank_accounts a ON a.id = d.bank_account_id AND ` + currentBankAccountSQL + `
+WHERE
+    d.orders_end_at <= $1
+    AND d.status = 'approved'
+ORDER BY
+    d.orders_end_at, m.reference, d.reference`
+
+// SelectPayableDisbursements returns the approved payable disbursements with orders until the day, included
+func (q *PostgresQuerier) SelectPayableDisbursements(ctx context.Context, until time.Time) ([]entities.PayableDisbursement, error) {
+	disbursements := []entities.PayableDisbursement{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&disbursements,
+		selectPayableDisbursementsSQL,
+		until)
+
+	return disbursements, err
+}
+
+const insertPayoutBatchSQL = `
+	INSERT INTO payout_batches ( message_id, execution_date, payments_count, control_sum, created_at )
+	VALUES                     ( $1,         $2,             $3,             $4,          $5 )
+	RETURNING id`
+
+const insertPayoutInstructionSQL = `
+	INSERT INTO payout_instructions ( batch_id, disbursement_id, end_to_end_id, amount, iban, bic, created_at )
+	VALUES                          ( $1,       $2,              $3,            $4,     $5,   $6,  $7 )`
+
+// InsertPayoutBatch persists a payout batch and its instructions, and marks the disbursements as sent, in a transaction
+// It fails with ErrorStatusChanged when one of the disbursements is not approved anymore, e.g. already in a batch
+func (q *PostgresQuerier) InsertPayoutBatch(ctx context.Context, batch *entities.PayoutBatch, instructions []entities.PayoutInstruction) error {
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	batch.CreatedAt = time.Now()
+	err = tx.GetContext(
+		ctx,
+		&batch.ID,
+		insertPayoutBatchSQL,
+		batch.MessageID,
+		batch.ExecutionDate,
+		batch.PaymentsCount,
+		batch.ControlSum,
+		batch.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, instruction := range instructions {
+		_, err = tx.ExecContext(
+			ctx,
+			insertPayoutInstructionSQL,
+			batch.ID,
+			instruction.DisbursementID,
+			instruction.EndToEndID,
+			instruction.Amount,
+			instruction.IBAN,
+			instruction.BIC,
+			batch.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		err = transitionDisbursement(ctx, tx, &entities.DisbursementStatusChange{
+			DisbursementID: instruction.DisbursementID,
+			FromStatus:     entities.ApprovedDisbursementStatus,
+			ToStatus:       entities.SentDisbursementStatus,
+			Reason:         "payout batch " + batch.MessageID,
+			ChangedAt:      batch.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// transitionDisbursementSQL changes the status of a disbursement still in the status the change starts from,
+// and sets the time it entered the new status
+const transitionDisbursementSQL = `
+UPDATE merchant_disbursements
+SET
+    status = $3,
+    approved_at = CASE WHEN $3::TEXT = 'approved' THEN $4 ELSE approved_at END,
+    sent_at = CASE WHEN $3::TEXT = 'sent' THEN $4 ELSE sent_at END,
+    settled_at = CASE WHEN $3::TEXT = 'settled' THEN $4 ELSE settled_at END,
+    failed_at = CASE WHEN $3::TEXT = 'failed' THEN $4 ELSE failed_at END,
+    returned_at = CASE WHEN $3::TEXT = 'returned' THEN $4 ELSE returned_at END
+WHERE
+    id = $1
+    AND status = $2
+RETURNING *`
+
+const insertDisbursementStatusChangeSQL = `
+	INSERT INTO merchant_disbursement_status_changes ( disbursement_id, from_status, to_status, reason, changed_at )
+	VALUES                                           ( $1,              $2,          $3,        $4,     $5 )
+	RETURNING id`
+
+const insertOutboxEventSQL = `
+	INSERT INTO outbox_events ( event_type, disbursement_id, merchant_id, payload, next_attempt_at, created_at )
+	VALUES                    ( $1,         $2,              $3,          $4,      $5,              $5 )`
+
+// TransitionDisbursement changes the status of a disbursement, and records the change in its history
+// The statuses notified to the merchant write an event to the outbox, in the same transaction.
+// It fails with ErrorStatusChanged when the disbursement is not in the status the change starts from
+func (q *PostgresQuerier) TransitionDisbursement(ctx context.Context, change *entities.DisbursementStatusChange) error {
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	err = transitionDisbursement(ctx, tx, change)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func transitionDisbursement(ctx context.Context, tx *sqlx.Tx, change *entities.DisbursementStatusChange) error {
+	var disbursement entities.MerchantDisbursement
+	err := tx.GetContext(
+		ctx,
+		&disbursement,
+		transitionDisbursementSQL,
+		change.DisbursementID,
+		change.FromStatus,
+		change.ToStatus,
+		change.ChangedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: disbursement %s is not %s", ErrorStatusChanged, change.DisbursementID, change.FromStatus)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tx.GetContext(
+		ctx,
+		&change.ID,
+		insertDisbursementStatusChangeSQL,
+		change.DisbursementID,
+		change.FromStatus,
+		change.ToStatus,
+		change.Reason,
+		change.ChangedAt)
+	if err != nil {
+		return err
+	}
+
+	eventType := entities.StatusEventType(change.ToStatus)
+	if eventType == "" {
+		return nil
+	}
+	event, err := entities.NewDisbursementEvent(eventType, disbursement, change.FromStatus)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		insertOutboxEventSQL,
+		event.EventType,
+		event.DisbursementID,
+		event.MerchantID,
+		string(event.Payload),
+		change.ChangedAt)
+	return err
+}
+
+const selectDisbursementStatusChangesSQL = `SELECT * FROM merchant_disbursement_status_changes WHERE disbursement_id = $1 ORDER BY changed_at, id`
+
+// SelectDisbursementStatusChanges returns the status history of a disbursement, in the order of the changes
+func (q *PostgresQuerier) SelectDisbursementStatusChanges(ctx context.Context, disbursementID uuid.UUID) ([]entities.DisbursementStatusChange, error) {
+	changes := []entities.DisbursementStatusChange{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&changes,
+		selectDisbursementStatusChangesSQL,
+		disbursementID)
+
+	return changes, err
+}
+
+const selectBankStatementByHashSQL = `SELECT * FROM bank_statements WHERE file_hash = $1`
+
+// SelectBankStatementByHash returns the statement imported from a file with the content hash, nil when none was
+func (q *PostgresQuerier) SelectBankStatementByHash(ctx context.Context, hash string) (*entities.BankStatement, error) {
+	var statement entities.BankStatement
+
+	err := q.dbConn.GetContext(
+		ctx,
+		&statement,
+		selectBankStatementByHashSQL,
+		hash)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &statement, nil
+}
+
+const insertBankStatementSQL = `
+	INSERT INTO bank_statements ( file_name, file_hash, format, statement_id, iban, imported_at )
+	VALUES                      ( $1,        $2,        $3,     $4,           $5,   $6 )
+	RETURNING id`
+
+const insertBankStatementEntrySQL = `
+	INSERT INTO bank_statement_entries ( statement_id, booking_date, amount, currency, bank_reference, disbursement_reference, disbursement_id, result, detail, created_at )
+	VALUES                             ( $1,           $2,           $3,     $4,       $5,             $6,                     $7,              $8,     $9,     $10 )
+	RETURNING id`
+
+// InsertBankStatement persists a statement and its entries, applying the status changes of the disbursements it settles
+// in the same transaction, so a statement is never stored without its settlements, nor the other way around
+func (q *PostgresQuerier) InsertBankStatement(ctx context.Context, statement *entities.BankStatement, entries []entities.BankStatementEntry, changes []*entities.DisbursementStatusChange) error {
+	tx, err := q.dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	statement.ImportedAt = time.Now()
+	err = tx.GetContext(
+		ctx,
+		&statement.ID,
+		insertBankStatementSQL,
+		statement.FileName,
+		statement.FileHash,
+		statement.Format,
+		statement.StatementID,
+		statement.IBAN,
+		statement.ImportedAt)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		entry.StatementID = statement.ID
+		entry.CreatedAt = statement.ImportedAt
+		err = tx.GetContext(
+			ctx,
+			&entry.ID,
+			insertBankStatementEntrySQL,
+			entry.StatementID,
+			entry.BookingDate,
+			entry.Amount,
+			entry.Currency,
+			entry.BankReference,
+			entry.DisbursementReference,
+			entry.DisbursementID,
+			entry.Result,
+			entry.Detail,
+			entry.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, change := range changes {
+		err = transitionDisbursement(ctx, tx, change)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const selectReconciliationEntriesSQL = `
+SELECT
+    e.*,
+    s.file_name
+FROM
+    bank_statement_entries e
+    JOIN bank_statements s ON s.id = e.statement_id
+WHERE
+    ($1::DATE IS NULL OR e.booking_date >= $1)
+    AND ($2::DATE IS NULL OR e.booking_date <= $2)
+    AND ($3::TEXT[] IS NULL OR e.result::TEXT = ANY($3))
+ORDER BY
+    e.booking_date, s.file_name, e.created_at, e.id`
+
+// SelectReconciliationEntries returns the bank statement entries matching the filter, in the order they were booked
+func (q *PostgresQuerier) SelectReconciliationEntries(ctx context.Context, filter entities.ReconciliationFilter) ([]entities.ReconciliationEntry, error) {
+	entries := []entities.ReconciliationEntry{}
+
+	args := []any{nil, nil, nil}
+	if !filter.From.IsZero() {
+		args[0] = filter.From
+	}
+	if !filter.To.IsZero() {
+		args[1] = filter.To
+	}
+	if len(filter.Results) > 0 {
+		results := make([]string, len(filter.Results))
+		for i, result := range filter.Results {
+			results[i] = string(result)
+		}
+		args[2] = results
+	}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&entries,
+		selectReconciliationEntriesSQL,
+		args...)
+
+	return entries, err
+}
+
+const updateMerchantWebhookSQL = `UPDATE merchants SET webhook_url = $2, webhook_secret = $3, updated_at = $4 WHERE id = $1`
+
+// UpdateMerchantWebhook sets the webhook the disbursement events of a merchant are delivered to, removing it when empty
+func (q *PostgresQuerier) UpdateMerchantWebhook(ctx context.Context, merchantID uuid.UUID, url, secret string) error {
+	_, err := q.dbConn.ExecContext(ctx, updateMerchantWebhookSQL, merchantID, url, secret, time.Now())
+	return err
+}
+
+// updateMerchantCurrencySQL changes the settlement currency of a merchant only when everything was disbursed:
+// no pending orders, refunds or chargebacks, and a zero balance in every currency, so no amount is carried between currencies
+const updateMerchantCurrencySQL = `
+UPDATE merchants SET currency = $2, updated_at = $3
+WHERE
+    id = $1
+    AND NOT EXISTS (SELECT 1 FROM orders WHERE merchant_id = $1 AND disbursed = false)
+    AND NOT EXISTS (SELECT 1 FROM refunds WHERE merchant_id = $1 AND deducted_on IS NULL)
+    AND NOT EXISTS (SELECT 1 FROM chargebacks WHERE merchant_id = $1 AND deducted_on IS NULL)
+    AND NOT EXISTS (SELECT 1 FROM merchant_balance_entries WHERE merchant_id = $1 GROUP BY currency HAVING SUM(amount) <> 0)`
+
+// UpdateMerchantCurrency changes the settlement currency of a merchant, the one its next orders must be in
+// It fails with ErrorMerchantNotSettled when the merchant has orders, refunds or chargebacks not disbursed yet, or a balance.
+func (q *PostgresQuerier) UpdateMerchantCurrency(ctx context.Context, merchantID uuid.UUID, currency string) error {
+	result, err := q.dbConn.ExecContext(ctx, updateMerchantCurrencySQL, merchantID, currency, time.Now())
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w: merchant %s", ErrorMerchantNotSettled, merchantID)
+	}
+	return nil
+}
+
+const selectDueOutboxEventsSQL = `
+SELECT * FROM outbox_events
+WHERE status = 'pending' AND next_attempt_at <= $1
+ORDER BY next_attempt_at, created_at
+LIMIT $2`
+
+// SelectDueOutboxEvents returns the pending events whose next delivery attempt is due, the oldest first
+func (q *PostgresQuerier) SelectDueOutboxEvents(ctx context.Context, now time.Time, limit int) ([]entities.OutboxEvent, error) {
+	events := []entities.OutboxEvent{}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&events,
+		selectDueOutboxEventsSQL,
+		now,
+		limit)
+
+	return events, err
+}
+
+const selectOutboxEventSQL = `SELECT * FROM outbox_events WHERE id = $1`
+
+func (q *PostgresQuerier) SelectOutboxEvent(ctx context.Context, id uuid.UUID) (*entities.OutboxEvent, error) {
+	var event entities.OutboxEvent
+
+	err := q.dbConn.GetContext(
+		ctx,
+		&event,
+		selectOutboxEventSQL,
+		id)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &event, nil
+}
+
+const selectOutboxEventsSQL = `
+SELECT * FROM outbox_events
+WHERE
+    ($1::TEXT IS NULL OR status::TEXT = $1)
+    AND ($2::UUID IS NULL OR merchant_id = $2)
+ORDER BY created_at DESC, id
+LIMIT $3`
+
+// SelectOutboxEvents returns the events matching the filter, latest first
+func (q *PostgresQuerier) SelectOutboxEvents(ctx context.Context, filter entities.OutboxFilter) ([]entities.OutboxEvent, error) {
+	events := []entities.OutboxEvent{}
+
+	args := []any{nil, nil, nil}
+	if filter.Status != "" {
+		args[0] = string(filter.Status)
+	}
+	if filter.MerchantID != uuid.Nil {
+		args[1] = filter.MerchantID
+	}
+	if filter.Limit > 0 {
+		args[2] = filter.Limit
+	}
+
+	err := q.dbConn.SelectContext(
+		ctx,
+		&events,
+		selectOutboxEventsSQL,
+		args...)
+
+	return events, err
+}
+
+const updateOutboxEventSQL = `
+UPDATE outbox_events
+SET status = $2, attempts = $3, next_attempt_at = $4, last_error = $5, delivered_at = $6
+WHERE id = $1`
+
+// UpdateOutboxEvent persists the delivery status of an event
+func (q *PostgresQuerier) UpdateOutboxEvent(ctx context.Context, event *entities.OutboxEvent) error {
+	_, err := q.dbConn.ExecContext(
+		ctx,
+		updateOutboxEventSQL,
+		event.ID,
+		event.Status,
+		event.Attempts,
+		event.NextAttemptAt,
+		event.LastError,
+		event.DeliveredAt)
 	return err
 }
@@ -2,9 +2,13 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/system"
 	"github.com/ildomm/cc_sq_disbursement/test_helpers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -28,6 +32,7 @@ func TestPostgresQuerier(t *testing.T) {
 		defer querier.Close()
 
 		assert.NotNil(t, querier.dbConn)
+		require.NoError(t, querier.Ping(ctx))
 
 		// Check if at least one migration has run by querying the database
 		var extensionExists bool
@@ -81,6 +86,12 @@ func TestDatabaseBasicOperations(t *testing.T) {
 	require.Equal(t, int64(50), count, "Rows counted")
 	require.NoError(t, err)
 
+	// Select all merchants, ordered by reference
+	merchants, err := q.SelectMerchants(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 50, len(merchants))
+	require.Equal(t, "bins_inc", merchants[0].Reference)
+
 	// Select an existing merchant
 	merchant, err := q.SelectMerchantByReference(ctx, "reichert_group")
 	require.NoError(t, err)
@@ -105,6 +116,7 @@ func TestDatabaseBasicOperations(t *testing.T) {
 	require.NotNil(t, disbursements)
 	require.Equal(t, 1, len(disbursements))
 
+	disbursements[0].CalculateNetAmount()
 	err = q.InsertDisbursement(ctx, disbursements[0])
 	require.NoError(t, err)
 
@@ -114,24 +126,586 @@ func TestDatabaseBasicOperations(t *testing.T) {
 	require.NotNil(t, disbursements)
 	require.Equal(t, 1, len(disbursements))
 
-	// Mark orders as disbursed
-	err = q.MarkOrdersAsDisbursed(ctx, order.CreatedAt)
-	require.NoError(t, err)
-
-	// Check that the order is marked as disbursed
+	// Check that the order is marked as disbursed by its disbursement
 	orderReloaded, err = q.SelectOrder(ctx, order.ID)
 	require.NoError(t, err)
 	require.NotNil(t, orderReloaded)
 	require.Equal(t, true, orderReloaded.Disbursed)
 }
 
+func TestInsertDisbursementChecksNetAmount(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	disbursement := entities.MerchantDisbursement{
+		MerchantID:            uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62"),
+		Currency:              entities.DefaultCurrency,
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day,
+		OrdersEndAt:           day,
+		FeeAmount:             0.9501,
+		FeeAmountCorrection:   5.0,
+		OrdersSumAmount:       100.004,
+		OrdersTotalEntries:    1,
+	}
+
+	// The net amount must match the other amounts
+	err := querier.InsertDisbursement(ctx, disbursement)
+	require.ErrorContains(t, err, "merchant_disbursements_net_amount_check")
+
+	disbursement.CalculateNetAmount()
+	assert.Equal(t, 94.05, disbursement.NetAmount)
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.NoError(t, err)
+
+	disbursements, err := querier.SelectDisbursements(ctx, entities.DisbursementFilter{})
+	require.NoError(t, err)
+	require.Len(t, disbursements, 1)
+	assert.Equal(t, 94.05, disbursements[0].NetAmount)
+}
+
+func TestInsertDisbursementMarksSummed(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	order := test_helpers.SetupOrderTemplate()
+	order.Amount = 100
+	order.FeeAmount = 0.95
+	order.CreatedAt = day
+	err := querier.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	sums, err := querier.SelectSumOrders(ctx, day)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	assert.Equal(t, []string{order.ID}, sums[0].OrderIDs)
+
+	disbursement := sums[0]
+	disbursement.CalculateNetAmount()
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.NoError(t, err)
+
+	reloaded, err := querier.SelectOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.True(t, reloaded.Disbursed)
+
+	// A run resumed after a failure cannot create the disbursement of the period twice
+	disbursement.ID = uuid.New()
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.ErrorIs(t, err, ErrorDisbursementExists)
+
+	// Nor disburse the same orders in another one, which is rolled back
+	disbursement.OrdersStartAt = day.AddDate(0, 0, 1)
+	disbursement.OrdersEndAt = disbursement.OrdersStartAt
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.ErrorIs(t, err, ErrorAlreadyDisbursed)
+
+	disbursements, err := querier.SelectDisbursements(ctx, entities.DisbursementFilter{})
+	require.NoError(t, err)
+	require.Len(t, disbursements, 1)
+	assert.True(t, disbursements[0].OrdersStartAt.Equal(day))
+}
+
+func TestRefunds(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	order := test_helpers.SetupOrderTemplate()
+	order.Amount = 100
+	order.FeeAmount = 0.95
+	order.CreatedAt = day
+	err := querier.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// A refund must be of a known order
+	refund := entities.Refund{ID: "r-1", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 20, FeeReversal: 0.19, CreatedAt: day}
+	err = querier.InsertRefund(ctx, entities.Refund{ID: "r-0", OrderID: "unknown", MerchantID: order.MerchantID, Amount: 20, CreatedAt: day})
+	require.Error(t, err)
+	err = querier.InsertRefund(ctx, refund)
+	require.NoError(t, err)
+	err = querier.InsertRefund(ctx, entities.Refund{ID: "r-2", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 30, FeeReversal: 0.29, CreatedAt: day.AddDate(0, 0, 1)})
+	require.NoError(t, err)
+
+	reloaded, err := querier.SelectRefund(ctx, refund.ID)
+	require.NoError(t, err)
+	require.NotNil(t, reloaded)
+	assert.Equal(t, 0.19, reloaded.FeeReversal)
+	assert.Nil(t, reloaded.DeductedOn)
+
+	missing, err := querier.SelectRefund(ctx, "missing")
+	require.NoError(t, err)
+	require.Nil(t, missing)
+
+	refunds, err := querier.SelectOrderRefunds(ctx, order.ID)
+	require.NoError(t, err)
+	require.Len(t, refunds, 2)
+	assert.Equal(t, "r-1", refunds[0].ID)
+
+	// Only the refunds up to the day are summed
+	sums, err := querier.SelectSumRefunds(ctx, day)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	assert.Equal(t, order.MerchantID, sums[0].MerchantID)
+	assert.Equal(t, 20.0, sums[0].RefundsAmount)
+	assert.Equal(t, 1, sums[0].RefundsTotalEntries)
+	assert.Equal(t, 0.19, sums[0].FeeReversalAmount)
+	assert.Equal(t, []string{"r-1"}, sums[0].RefundIDs)
+
+	// The disbursement deducting the refunds keeps their amounts, and the net amount check includes them
+	disbursement := sums[0]
+	disbursement.CalculateNetAmount()
+	assert.Equal(t, -19.81, disbursement.NetAmount)
+
+	// A refund of the day inserted once the refunds are summed is not marked by the disbursement, it is deducted later
+	err = querier.InsertRefund(ctx, entities.Refund{ID: "r-3", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 10, CreatedAt: day})
+	require.NoError(t, err)
+
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.NoError(t, err)
+
+	sums, err = querier.SelectSumRefunds(ctx, day)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	assert.Equal(t, []string{"r-3"}, sums[0].RefundIDs)
+	assert.Equal(t, 10.0, sums[0].RefundsAmount)
+	next := sums[0]
+	next.OrdersStartAt = day.AddDate(0, 0, 1)
+	next.OrdersEndAt = next.OrdersStartAt
+	next.CalculateNetAmount()
+	require.NoError(t, querier.InsertDisbursement(ctx, next))
+
+	// The refund of the next day is deducted on a later day, even after its own
+	sums, err = querier.SelectSumRefunds(ctx, day.AddDate(0, 0, 5))
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	assert.Equal(t, 30.0, sums[0].RefundsAmount)
+	assert.Equal(t, []string{"r-2"}, sums[0].RefundIDs)
+
+	deducted, err := querier.SelectDeductedRefunds(ctx, order.MerchantID, day, day)
+	require.NoError(t, err)
+	require.Len(t, deducted, 1)
+	assert.Equal(t, "r-1", deducted[0].ID)
+	require.NotNil(t, deducted[0].DeductedOn)
+	assert.True(t, deducted[0].DeductedOn.Equal(day))
+
+	weekly, err := querier.SelectSumDisbursements(ctx, day, day, entities.WeeklyDisbursementFrequency)
+	require.NoError(t, err)
+	require.Len(t, weekly, 1)
+	assert.Equal(t, 20.0, weekly[0].RefundsAmount)
+	assert.Equal(t, 0.19, weekly[0].FeeReversalAmount)
+	assert.Equal(t, -19.81, weekly[0].NetAmount)
+}
+
+func TestRefundsExceedingOrder(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	order := test_helpers.SetupOrderTemplate()
+	order.Amount = 100
+	order.FeeAmount = 0.95
+	order.CreatedAt = day
+	err := querier.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	err = querier.InsertRefund(ctx, entities.Refund{ID: "r-1", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 50, FeeReversal: 0.48, CreatedAt: day})
+	require.NoError(t, err)
+
+	// Refunds built at the same time, each fitting in what was left of the order, are inserted one at a time
+	results := make(chan error, 2)
+	for _, id := range []string{"r-2", "r-3"} {
+		go func(id string) {
+			results <- querier.InsertRefund(ctx, entities.Refund{ID: id, OrderID: order.ID, MerchantID: order.MerchantID, Amount: 30, FeeReversal: 0.29, CreatedAt: day})
+		}(id)
+	}
+	var inserted, exceeded int
+	for range []string{"r-2", "r-3"} {
+		err := <-results
+		if errors.Is(err, ErrorOrderAmountExceeded) {
+			exceeded++
+			continue
+		}
+		require.NoError(t, err)
+		inserted++
+	}
+	assert.Equal(t, 1, inserted)
+	assert.Equal(t, 1, exceeded)
+
+	refunds, err := querier.SelectOrderRefunds(ctx, order.ID)
+	require.NoError(t, err)
+	require.Len(t, refunds, 2)
+
+	// The fees reversed cannot exceed the fee of the order either
+	err = querier.InsertRefund(ctx, entities.Refund{ID: "r-4", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 20, FeeReversal: 0.5, CreatedAt: day})
+	require.ErrorIs(t, err, ErrorOrderAmountExceeded)
+}
+
+func TestChargebacks(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	order := test_helpers.SetupOrderTemplate()
+	order.Amount = 100
+	order.FeeAmount = 0.95
+	order.CreatedAt = day
+	err := querier.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// A chargeback must be of a known order
+	chargeback := entities.Chargeback{ID: "cb-1", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 60, Fee: 15, Reason: "fraud", CreatedAt: day}
+	err = querier.InsertChargeback(ctx, entities.Chargeback{ID: "cb-0", OrderID: "unknown", MerchantID: order.MerchantID, Amount: 60, CreatedAt: day})
+	require.Error(t, err)
+	err = querier.InsertChargeback(ctx, chargeback)
+	require.NoError(t, err)
+
+	reloaded, err := querier.SelectChargeback(ctx, chargeback.ID)
+	require.NoError(t, err)
+	require.NotNil(t, reloaded)
+	assert.Equal(t, 15.0, reloaded.Fee)
+	assert.Equal(t, "fraud", reloaded.Reason)
+	assert.Nil(t, reloaded.DeductedOn)
+
+	missing, err := querier.SelectChargeback(ctx, "missing")
+	require.NoError(t, err)
+	require.Nil(t, missing)
+
+	// A refund imported meanwhile leaves less of the order than the chargeback was built for
+	err = querier.InsertRefund(ctx, entities.Refund{ID: "r-1", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 30, FeeReversal: 0.29, CreatedAt: day.AddDate(0, 0, 1)})
+	require.NoError(t, err)
+	err = querier.InsertChargeback(ctx, entities.Chargeback{ID: "cb-2", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 40, Fee: 15, CreatedAt: day})
+	require.ErrorIs(t, err, ErrorOrderAmountExceeded)
+
+	chargebacks, err := querier.SelectOrderChargebacks(ctx, order.ID)
+	require.NoError(t, err)
+	require.Len(t, chargebacks, 1)
+
+	sums, err := querier.SelectSumChargebacks(ctx, day)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	assert.Equal(t, 60.0, sums[0].ChargebacksAmount)
+	assert.Equal(t, 1, sums[0].ChargebacksTotalEntries)
+	assert.Equal(t, 15.0, sums[0].ChargebackFeeAmount)
+	assert.Equal(t, []string{"cb-1"}, sums[0].ChargebackIDs)
+
+	// The disbursement deducting the chargeback keeps its amounts, and the net amount check includes them
+	disbursement := sums[0]
+	disbursement.CalculateNetAmount()
+	assert.Equal(t, -75.0, disbursement.NetAmount)
+
+	// A chargeback of the day inserted once the chargebacks are summed is not marked by the disbursement, it is deducted later
+	err = querier.InsertChargeback(ctx, entities.Chargeback{ID: "cb-3", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 10, Fee: 15, CreatedAt: day})
+	require.NoError(t, err)
+
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.NoError(t, err)
+
+	sums, err = querier.SelectSumChargebacks(ctx, day)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	assert.Equal(t, []string{"cb-3"}, sums[0].ChargebackIDs)
+
+	deducted, err := querier.SelectDeductedChargebacks(ctx, order.MerchantID, day, day)
+	require.NoError(t, err)
+	require.Len(t, deducted, 1)
+	require.NotNil(t, deducted[0].DeductedOn)
+	assert.True(t, deducted[0].DeductedOn.Equal(day))
+
+	weekly, err := querier.SelectSumDisbursements(ctx, day, day, entities.WeeklyDisbursementFrequency)
+	require.NoError(t, err)
+	require.Len(t, weekly, 1)
+	assert.Equal(t, 60.0, weekly[0].ChargebacksAmount)
+	assert.Equal(t, 15.0, weekly[0].ChargebackFeeAmount)
+	assert.Equal(t, -75.0, weekly[0].NetAmount)
+}
+
+func TestMerchantBalance(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	balance, err := querier.SelectMerchantBalance(ctx, merchantID, entities.DefaultCurrency)
+	require.NoError(t, err)
+	assert.Zero(t, balance)
+
+	// The refunds exceed the orders, the merchant owes the difference
+	inDebt := entities.MerchantDisbursement{
+		MerchantID:            merchantID,
+		Currency:              entities.DefaultCurrency,
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day,
+		OrdersEndAt:           day,
+		OrdersSumAmount:       10,
+		FeeAmount:             0.1,
+		RefundsAmount:         50,
+	}
+	inDebt.CarryBalance(balance)
+	assert.Zero(t, inDebt.NetAmount)
+	assert.Equal(t, 40.1, inDebt.CarryForwardAmount)
+	err = querier.InsertDisbursement(ctx, inDebt)
+	require.NoError(t, err)
+
+	balance, err = querier.SelectMerchantBalance(ctx, merchantID, entities.DefaultCurrency)
+	require.NoError(t, err)
+	assert.Equal(t, -40.1, balance)
+
+	debts, err := querier.SelectMerchantDebts(ctx)
+	require.NoError(t, err)
+	require.Len(t, debts, 1)
+	assert.Equal(t, "apadberg_group", debts[0].Reference)
+	assert.Equal(t, 40.1, debts[0].Amount)
+
+	// The next disbursement deducts the debt and pays the rest, settling the balance
+	paid := entities.MerchantDisbursement{
+		MerchantID:            merchantID,
+		Currency:              entities.DefaultCurrency,
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day.AddDate(0, 0, 1),
+		OrdersEndAt:           day.AddDate(0, 0, 1),
+		OrdersSumAmount:       100,
+		FeeAmount:             0.95,
+	}
+	paid.CarryBalance(balance)
+	assert.Equal(t, 40.1, paid.CarriedAmount)
+	assert.Equal(t, 58.95, paid.NetAmount)
+	err = querier.InsertDisbursement(ctx, paid)
+	require.NoError(t, err)
+
+	balance, err = querier.SelectMerchantBalance(ctx, merchantID, entities.DefaultCurrency)
+	require.NoError(t, err)
+	assert.Zero(t, balance)
+
+	entries, err := querier.SelectBalanceEntries(ctx, merchantID)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, entities.EarnedBalanceEntry, entries[0].EntryType)
+	assert.Equal(t, -40.1, entries[0].Balance)
+	assert.Equal(t, entities.DisbursedBalanceEntry, entries[2].EntryType)
+	assert.Equal(t, -58.95, entries[2].Amount)
+	assert.Zero(t, entries[2].Balance)
+
+	debts, err = querier.SelectMerchantDebts(ctx)
+	require.NoError(t, err)
+	require.Empty(t, debts)
+
+	// The weekly disbursement sums what the daily ones carried, and posts nothing
+	weekly, err := querier.SelectSumDisbursements(ctx, day, day.AddDate(0, 0, 6), entities.WeeklyDisbursementFrequency)
+	require.NoError(t, err)
+	require.Len(t, weekly, 1)
+	weekly[0].CalculateNetAmount()
+	assert.Equal(t, 58.95, weekly[0].NetAmount)
+	err = querier.InsertDisbursement(ctx, weekly[0])
+	require.NoError(t, err)
+
+	entries, err = querier.SelectBalanceEntries(ctx, merchantID)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+func TestMerchantBalanceCurrencies(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	// The merchant owes in euros
+	inDebt := entities.MerchantDisbursement{
+		MerchantID:            merchantID,
+		Currency:              "EUR",
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day,
+		OrdersEndAt:           day,
+		OrdersSumAmount:       10,
+		FeeAmount:             0.1,
+		RefundsAmount:         50,
+	}
+	inDebt.CarryBalance(0)
+	err = querier.InsertDisbursement(ctx, inDebt)
+	require.NoError(t, err)
+
+	// The debt in euros is not deducted from the disbursement in pounds
+	balance, err := querier.SelectMerchantBalance(ctx, merchantID, "GBP")
+	require.NoError(t, err)
+	assert.Zero(t, balance)
+
+	paid := entities.MerchantDisbursement{
+		MerchantID:            merchantID,
+		Currency:              "GBP",
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day,
+		OrdersEndAt:           day,
+		OrdersSumAmount:       100,
+		FeeAmount:             1,
+	}
+	paid.CarryBalance(balance)
+	assert.Equal(t, 99.0, paid.NetAmount)
+	err = querier.InsertDisbursement(ctx, paid)
+	require.NoError(t, err)
+
+	// Then the merchant owes in pounds too
+	owed := entities.MerchantDisbursement{
+		MerchantID:            merchantID,
+		Currency:              "GBP",
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day.AddDate(0, 0, 1),
+		OrdersEndAt:           day.AddDate(0, 0, 1),
+		OrdersSumAmount:       10,
+		RefundsAmount:         30,
+	}
+	owed.CarryBalance(0)
+	err = querier.InsertDisbursement(ctx, owed)
+	require.NoError(t, err)
+
+	balance, err = querier.SelectMerchantBalance(ctx, merchantID, "EUR")
+	require.NoError(t, err)
+	assert.Equal(t, -40.1, balance)
+	balance, err = querier.SelectMerchantBalance(ctx, merchantID, "GBP")
+	require.NoError(t, err)
+	assert.Equal(t, -20.0, balance)
+
+	entries, err := querier.SelectBalanceEntries(ctx, merchantID)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, "EUR", entries[0].Currency)
+	assert.Equal(t, "GBP", entries[3].Currency)
+	assert.Equal(t, -20.0, entries[3].Balance)
+
+	// One debt per currency
+	debts, err := querier.SelectMerchantDebts(ctx)
+	require.NoError(t, err)
+	require.Len(t, debts, 2)
+	assert.Equal(t, "EUR", debts[0].Currency)
+	assert.Equal(t, 40.1, debts[0].Amount)
+	assert.Equal(t, "GBP", debts[1].Currency)
+	assert.Equal(t, 20.0, debts[1].Amount)
+
+	// The settlement currency cannot change while the merchant owes in any of them
+	err = querier.UpdateMerchantCurrency(ctx, merchantID, "GBP")
+	require.ErrorIs(t, err, ErrorMerchantNotSettled)
+}
+
+func TestLedger(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	order := test_helpers.SetupOrderTemplate()
+	order.Amount = 100
+	order.FeeAmount = 0.95
+	order.CreatedAt = day
+	err := querier.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// The order is posted once, with the order
+	err = querier.InsertOrder(ctx, order)
+	require.Error(t, err)
+
+	err = querier.InsertRefund(ctx, entities.Refund{ID: "r-1", OrderID: order.ID, MerchantID: order.MerchantID, Amount: 20, FeeReversal: 0.19, CreatedAt: day})
+	require.NoError(t, err)
+
+	sums, err := querier.SelectSumOrders(ctx, day)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	refunds, err := querier.SelectSumRefunds(ctx, day)
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+
+	disbursement := sums[0]
+	disbursement.FeeAmountCorrection = 5
+	disbursement.RefundsAmount = refunds[0].RefundsAmount
+	disbursement.RefundsTotalEntries = refunds[0].RefundsTotalEntries
+	disbursement.FeeReversalAmount = refunds[0].FeeReversalAmount
+	disbursement.RefundIDs = refunds[0].RefundIDs
+	disbursement.CarryBalance(0)
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.NoError(t, err)
+
+	// An order in pounds, with a refund, is checked apart from the euros
+	gbpOrder := order
+	gbpOrder.ID = "gbp-order"
+	gbpOrder.Currency = "GBP"
+	gbpOrder.Amount = 50
+	gbpOrder.FeeAmount = 0.5
+	err = querier.InsertOrder(ctx, gbpOrder)
+	require.NoError(t, err)
+	err = querier.InsertRefund(ctx, entities.Refund{ID: "gbp-refund", OrderID: gbpOrder.ID, MerchantID: gbpOrder.MerchantID, Amount: 10, FeeReversal: 0.1, CreatedAt: day})
+	require.NoError(t, err)
+
+	totals, err := querier.SelectLedgerTotals(ctx)
+	require.NoError(t, err)
+	require.Len(t, totals, 2)
+	assert.Equal(t, "EUR", totals[0].Currency)
+	assert.Equal(t, int64(4), totals[0].JournalEntries)
+	assert.Equal(t, totals[0].ExpectedEntries, totals[0].JournalEntries)
+	assert.Zero(t, totals[0].UnbalancedEntries)
+	assert.Equal(t, 100.0, totals[0].OrdersAmount)
+	assert.Equal(t, 74.24, totals[0].DisbursementAmount)
+	assert.Equal(t, "GBP", totals[1].Currency)
+	assert.Equal(t, int64(2), totals[1].JournalEntries)
+	assert.Equal(t, totals[1].ExpectedEntries, totals[1].JournalEntries)
+	assert.Equal(t, 50.0, totals[1].OrdersAmount)
+	assert.Equal(t, 10.0, totals[1].RefundsAmount)
+
+	balances, err := querier.SelectLedgerBalances(ctx)
+	require.NoError(t, err)
+	byAccount := make(map[string]map[entities.LedgerAccounts]float64)
+	for _, balance := range balances {
+		if byAccount[balance.Currency] == nil {
+			byAccount[balance.Currency] = make(map[entities.LedgerAccounts]float64)
+		}
+		byAccount[balance.Currency][balance.Account] = balance.Balance()
+	}
+	assert.Equal(t, 5.76, byAccount["EUR"][entities.CashAccount])
+	assert.Equal(t, 5.76, byAccount["EUR"][entities.FeeRevenueAccount])
+	assert.Zero(t, byAccount["EUR"][entities.MerchantPayableAccount])
+	assert.Zero(t, byAccount["EUR"][entities.MonthlyFeeReceivableAccount])
+	assert.Equal(t, 40.0, byAccount["GBP"][entities.CashAccount])
+	assert.Equal(t, 0.4, byAccount["GBP"][entities.FeeRevenueAccount])
+	assert.Equal(t, 39.6, byAccount["GBP"][entities.MerchantPayableAccount])
+
+	payables, err := querier.SelectMerchantPayables(ctx)
+	require.NoError(t, err)
+	require.Len(t, payables, 2)
+	for _, payable := range payables {
+		assert.Equal(t, payable.Expected, payable.Ledger, payable.Currency)
+	}
+	assert.Equal(t, "GBP", payables[1].Currency)
+	assert.Equal(t, 39.6, payables[1].Ledger)
+
+	// The weekly disbursement sums the daily one, and posts nothing
+	weekly, err := querier.SelectSumDisbursements(ctx, day, day, entities.WeeklyDisbursementFrequency)
+	require.NoError(t, err)
+	require.Len(t, weekly, 1)
+	weekly[0].CalculateNetAmount()
+	err = querier.InsertDisbursement(ctx, weekly[0])
+	require.NoError(t, err)
+
+	totals, err = querier.SelectLedgerTotals(ctx)
+	require.NoError(t, err)
+	require.Len(t, totals, 2)
+	assert.Equal(t, int64(4), totals[0].JournalEntries)
+}
+
 func TestSelectSumDisbursementsForMerchant(t *testing.T) {
 	ctx, teardownTest, querier := setupTestQuerier(t)
 	defer teardownTest(t)
 
 	// Create a merchant
 	merchant := entities.Merchant{
-		ID: uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62"),
+		ID:       uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62"),
+		Currency: entities.DefaultCurrency,
 	}
 
 	err := insertTestMerchants(ctx, querier)
@@ -140,6 +714,7 @@ func TestSelectSumDisbursementsForMerchant(t *testing.T) {
 	// Create a disbursement for the merchant
 	disbursement := entities.MerchantDisbursement{
 		MerchantID:            merchant.ID,
+		Currency:              entities.DefaultCurrency,
 		DisbursementFrequency: entities.DailyDisbursementFrequency,
 		OrdersStartAt:         time.Now().Add(-24 * time.Hour),
 		OrdersEndAt:           time.Now(),
@@ -147,6 +722,7 @@ func TestSelectSumDisbursementsForMerchant(t *testing.T) {
 		FeeAmountCorrection:   0.0,
 		OrdersSumAmount:       100.0,
 		OrdersTotalEntries:    1,
+		NetAmount:             100.0,
 	}
 	err = querier.InsertDisbursement(ctx, disbursement)
 	require.NoError(t, err)
@@ -156,42 +732,939 @@ func TestSelectSumDisbursementsForMerchant(t *testing.T) {
 	endTime := time.Now()
 
 	// Call the method under test
-	result, err := querier.SelectSumDisbursementsForMerchant(ctx, merchant.ID, startTime, endTime, entities.DailyDisbursementFrequency)
+	result, err := querier.SelectSumDisbursementsForMerchant(ctx, merchant.ID, merchant.Currency, startTime, endTime, entities.DailyDisbursementFrequency)
 	require.NoError(t, err)
 
 	// Assert that the result is as expected
 	assert.NotNil(t, result)
 }
 
-func TestSelectMerchant(t *testing.T) {
+func TestSelectSumDisbursementsOnlyDaily(t *testing.T) {
 	ctx, teardownTest, querier := setupTestQuerier(t)
 	defer teardownTest(t)
 
-	// Insert test merchant data
 	err := insertTestMerchants(ctx, querier)
 	require.NoError(t, err)
 
-	t.Run("SelectExistingMerchant", func(t *testing.T) {
-		// UUID of one of the predefined merchants
-		testUUID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	date := func(day int) time.Time {
+		return time.Date(2023, 1, day, 0, 0, 0, 0, time.UTC)
+	}
 
-		// Call the method under test
-		merchant, err := querier.SelectMerchant(ctx, testUUID)
+	// Two daily disbursements of January, and the weekly one summing them within the month
+	for _, disbursement := range []entities.MerchantDisbursement{
+		{MerchantID: merchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(2), OrdersEndAt: date(2), OrdersTotalEntries: 2, OrdersSumAmount: 100, FeeAmount: 1, RefundsAmount: 10},
+		{MerchantID: merchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(3), OrdersEndAt: date(3), OrdersTotalEntries: 1, OrdersSumAmount: 50, FeeAmount: 0.5},
+		{MerchantID: merchantID, DisbursementFrequency: entities.WeeklyDisbursementFrequency, OrdersStartAt: date(2), OrdersEndAt: date(8), OrdersTotalEntries: 3, OrdersSumAmount: 150, FeeAmount: 1.5, RefundsAmount: 10},
+	} {
+		disbursement.Currency = entities.DefaultCurrency
+		disbursement.CalculateNetAmount()
+		err = querier.InsertDisbursement(ctx, disbursement)
 		require.NoError(t, err)
-		require.NotNil(t, merchant)
-		assert.Equal(t, testUUID, merchant.ID)
-		assert.Equal(t, "apadberg_group", merchant.Reference)
-	})
+	}
 
-	t.Run("SelectNonExistingMerchant", func(t *testing.T) {
-		// UUID that does not exist in the database
-		nonExistingUUID := uuid.New()
+	sums, err := querier.SelectSumDisbursements(ctx, date(1), date(31), entities.MonthlyDisbursementFrequency)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	assert.Equal(t, 150.0, sums[0].OrdersSumAmount)
+	assert.Equal(t, 3, sums[0].OrdersTotalEntries)
+	assert.Equal(t, 1.5, sums[0].FeeAmount)
+	assert.Equal(t, 10.0, sums[0].RefundsAmount)
+	assert.Equal(t, 138.5, sums[0].NetAmount)
 
-		// Call the method under test
-		merchant, err := querier.SelectMerchant(ctx, nonExistingUUID)
+	sum, err := querier.SelectSumDisbursementsForMerchant(ctx, merchantID, entities.DefaultCurrency, date(1), date(31), entities.MonthlyDisbursementFrequency)
+	require.NoError(t, err)
+	require.NotNil(t, sum)
+	assert.Equal(t, 138.5, sum.NetAmount)
+}
+
+func TestSelectSumDisbursementsForMerchantFees(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	date := func(day int) time.Time {
+		return time.Date(2023, 1, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	// The weekly disbursement sums the daily ones, its fees must not count twice towards the minimum monthly fee
+	for _, disbursement := range []entities.MerchantDisbursement{
+		{MerchantID: merchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(9), OrdersEndAt: date(9), OrdersSumAmount: 200, FeeAmount: 2, RefundsAmount: 50, FeeReversalAmount: 0.5},
+		{MerchantID: merchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(10), OrdersEndAt: date(10), OrdersSumAmount: 300, FeeAmount: 3},
+		{MerchantID: merchantID, DisbursementFrequency: entities.WeeklyDisbursementFrequency, OrdersStartAt: date(9), OrdersEndAt: date(15), OrdersSumAmount: 500, FeeAmount: 5, RefundsAmount: 50, FeeReversalAmount: 0.5},
+	} {
+		disbursement.Currency = entities.DefaultCurrency
+		disbursement.CalculateNetAmount()
+		err = querier.InsertDisbursement(ctx, disbursement)
 		require.NoError(t, err)
-		assert.Nil(t, merchant)
-	})
+	}
+
+	// The last month, as summed for the fee correction of the 1st of February
+	feb := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	sum, err := querier.SelectSumDisbursementsForMerchant(ctx, merchantID, entities.DefaultCurrency,
+		system.FirstDayOfLastMonth(feb), system.LastDayOfLastMonth(feb), entities.MonthlyDisbursementFrequency)
+	require.NoError(t, err)
+	require.NotNil(t, sum)
+	assert.Equal(t, 5.0, sum.FeeAmount)
+	assert.Equal(t, 0.5, sum.FeeReversalAmount)
+}
+
+func TestCurrencies(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	merchant, err := querier.SelectMerchant(ctx, merchantID)
+	require.NoError(t, err)
+	require.NotNil(t, merchant)
+	assert.Equal(t, entities.DefaultCurrency, merchant.Currency)
+
+	// The orders of a merchant are summed by currency
+	for i, currency := range []string{"EUR", "EUR", "GBP"} {
+		order := test_helpers.SetupOrderTemplate()
+		order.ID = fmt.Sprintf("currency-%d", i)
+		order.MerchantID = merchantID
+		order.Amount = 100
+		order.FeeAmount = 1
+		order.Currency = currency
+		order.CreatedAt = day
+		err = querier.InsertOrder(ctx, order)
+		require.NoError(t, err)
+	}
+
+	sums, err := querier.SelectSumOrders(ctx, day)
+	require.NoError(t, err)
+	require.Len(t, sums, 2)
+	byCurrency := map[string]entities.MerchantDisbursement{}
+	for _, sum := range sums {
+		byCurrency[sum.Currency] = sum
+	}
+	assert.Equal(t, 200.0, byCurrency["EUR"].OrdersSumAmount)
+	assert.Equal(t, 2, byCurrency["EUR"].OrdersTotalEntries)
+	assert.Equal(t, 100.0, byCurrency["GBP"].OrdersSumAmount)
+
+	// The settlement currency only changes once the orders are disbursed
+	err = querier.UpdateMerchantCurrency(ctx, merchantID, "GBP")
+	require.ErrorIs(t, err, ErrorMerchantNotSettled)
+
+	for _, sum := range sums {
+		sum.CalculateNetAmount()
+		err = querier.InsertDisbursement(ctx, sum)
+		require.NoError(t, err)
+	}
+	err = querier.UpdateMerchantCurrency(ctx, merchantID, "GBP")
+	require.NoError(t, err)
+
+	merchant, err = querier.SelectMerchant(ctx, merchantID)
+	require.NoError(t, err)
+	assert.Equal(t, "GBP", merchant.Currency)
+}
+
+func TestSelectMerchant(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	// Insert test merchant data
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	t.Run("SelectExistingMerchant", func(t *testing.T) {
+		// UUID of one of the predefined merchants
+		testUUID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+
+		// Call the method under test
+		merchant, err := querier.SelectMerchant(ctx, testUUID)
+		require.NoError(t, err)
+		require.NotNil(t, merchant)
+		assert.Equal(t, testUUID, merchant.ID)
+		assert.Equal(t, "apadberg_group", merchant.Reference)
+	})
+
+	t.Run("SelectNonExistingMerchant", func(t *testing.T) {
+		// UUID that does not exist in the database
+		nonExistingUUID := uuid.New()
+
+		// Call the method under test
+		merchant, err := querier.SelectMerchant(ctx, nonExistingUUID)
+		require.NoError(t, err)
+		assert.Nil(t, merchant)
+	})
+}
+
+func TestSelectDisbursements(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	otherMerchantID := uuid.MustParse("61649242-a612-46ba-82d8-225542bb9576")
+
+	// Three days of daily disbursements for the merchant, one for another merchant
+	for day := 1; day <= 3; day++ {
+		date := time.Date(2023, 1, day, 0, 0, 0, 0, time.UTC)
+		err = querier.InsertDisbursement(ctx, entities.MerchantDisbursement{
+			MerchantID:            merchantID,
+			Currency:              entities.DefaultCurrency,
+			DisbursementFrequency: entities.DailyDisbursementFrequency,
+			OrdersStartAt:         date,
+			OrdersEndAt:           date,
+			OrdersSumAmount:       100.0,
+			OrdersTotalEntries:    1,
+			NetAmount:             100.0,
+		})
+		require.NoError(t, err)
+	}
+	err = querier.InsertDisbursement(ctx, entities.MerchantDisbursement{
+		Reference:             "DSB-20230102-OTHER",
+		MerchantID:            otherMerchantID,
+		Currency:              entities.DefaultCurrency,
+		DisbursementFrequency: entities.WeeklyDisbursementFrequency,
+		OrdersStartAt:         time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+		OrdersEndAt:           time.Date(2023, 1, 8, 0, 0, 0, 0, time.UTC),
+	})
+	require.NoError(t, err)
+
+	t.Run("All", func(t *testing.T) {
+		disbursements, err := querier.SelectDisbursements(ctx, entities.DisbursementFilter{})
+		require.NoError(t, err)
+		require.Len(t, disbursements, 4)
+
+		count, err := querier.CountDisbursements(ctx, entities.DisbursementFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), count)
+	})
+
+	t.Run("FilteredAndPaged", func(t *testing.T) {
+		filter := entities.DisbursementFilter{
+			MerchantID: merchantID,
+			Frequency:  entities.DailyDisbursementFrequency,
+			From:       time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+			Limit:      1,
+			Offset:     1,
+		}
+		disbursements, err := querier.SelectDisbursements(ctx, filter)
+		require.NoError(t, err)
+		require.Len(t, disbursements, 1)
+		assert.True(t, strings.HasPrefix(disbursements[0].Reference, "DSB-20230102-"))
+
+		count, err := querier.CountDisbursements(ctx, filter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), count)
+	})
+
+	t.Run("ByReference", func(t *testing.T) {
+		disbursement, err := querier.SelectDisbursementByReference(ctx, "DSB-20230102-OTHER")
+		require.NoError(t, err)
+		require.NotNil(t, disbursement)
+		assert.Equal(t, otherMerchantID, disbursement.MerchantID)
+
+		disbursement, err = querier.SelectDisbursementByReference(ctx, "DSB-MISSING")
+		require.NoError(t, err)
+		assert.Nil(t, disbursement)
+	})
+}
+
+func TestSelectYearlyReport(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	dailyMerchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	weeklyMerchantID := uuid.MustParse("6b6d2b8a-f06c-4298-8f27-f33545eb5899")
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	for _, disbursement := range []entities.MerchantDisbursement{
+		{MerchantID: dailyMerchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(2022, 12, 31), OrdersEndAt: date(2022, 12, 31), OrdersSumAmount: 100, FeeAmount: 1, FeeAmountCorrection: 5},
+		{MerchantID: dailyMerchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(2023, 1, 2), OrdersEndAt: date(2023, 1, 2), OrdersSumAmount: 200, FeeAmount: 2},
+		{MerchantID: weeklyMerchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(2023, 1, 3), OrdersEndAt: date(2023, 1, 3), OrdersSumAmount: 50, FeeAmount: 0.5, FeeAmountCorrection: 10},
+		// Only the disbursements with the frequency of the merchant are paid
+		{MerchantID: weeklyMerchantID, DisbursementFrequency: entities.WeeklyDisbursementFrequency, OrdersStartAt: date(2023, 1, 2), OrdersEndAt: date(2023, 1, 8), OrdersSumAmount: 50, FeeAmount: 0.5, FeeAmountCorrection: 10},
+		{MerchantID: dailyMerchantID, DisbursementFrequency: entities.WeeklyDisbursementFrequency, OrdersStartAt: date(2023, 1, 2), OrdersEndAt: date(2023, 1, 8), OrdersSumAmount: 200, FeeAmount: 2},
+	} {
+		disbursement.Currency = entities.DefaultCurrency
+		disbursement.CalculateNetAmount()
+		err = querier.InsertDisbursement(ctx, disbursement)
+		require.NoError(t, err)
+	}
+
+	reports, err := querier.SelectYearlyReport(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, []entities.YearlyReport{
+		{Year: 2022, Currency: "EUR", Disbursements: 1, AmountDisbursed: 94, OrderFees: 1, MonthlyFees: 1, MonthlyFeesAmount: 5},
+		{Year: 2023, Currency: "EUR", Disbursements: 2, AmountDisbursed: 237.5, OrderFees: 2.5, MonthlyFees: 1, MonthlyFeesAmount: 10},
+	}, reports)
+
+	reports, err = querier.SelectYearlyReport(ctx, 2023)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, 2023, reports[0].Year)
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	idempotencyKey, err := querier.SelectIdempotencyKey(ctx, "key-1")
+	require.NoError(t, err)
+	assert.Nil(t, idempotencyKey)
+
+	reserved, err := querier.ReserveIdempotencyKey(ctx, "key-1", "hash")
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	// A key is reserved once
+	reserved, err = querier.ReserveIdempotencyKey(ctx, "key-1", "other")
+	require.NoError(t, err)
+	assert.False(t, reserved)
+
+	idempotencyKey, err = querier.SelectIdempotencyKey(ctx, "key-1")
+	require.NoError(t, err)
+	require.NotNil(t, idempotencyKey)
+	assert.Equal(t, "hash", idempotencyKey.RequestHash)
+	assert.Equal(t, entities.PendingIdempotencyKeyStatus, idempotencyKey.Status)
+
+	stored := entities.IdempotencyKey{Key: "key-1", RequestHash: "hash", StatusCode: 201, Response: []byte(`{"status":"created"}`)}
+	err = querier.CompleteIdempotencyKey(ctx, stored)
+	require.NoError(t, err)
+
+	// A completed key is kept
+	err = querier.ReleaseIdempotencyKey(ctx, "key-1")
+	require.NoError(t, err)
+
+	idempotencyKey, err = querier.SelectIdempotencyKey(ctx, "key-1")
+	require.NoError(t, err)
+	require.NotNil(t, idempotencyKey)
+	assert.Equal(t, entities.CompletedIdempotencyKeyStatus, idempotencyKey.Status)
+	assert.Equal(t, 201, idempotencyKey.StatusCode)
+	assert.Equal(t, stored.Response, idempotencyKey.Response)
+
+	// A pending key is released, to be reserved again
+	reserved, err = querier.ReserveIdempotencyKey(ctx, "key-2", "hash")
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	err = querier.ReleaseIdempotencyKey(ctx, "key-2")
+	require.NoError(t, err)
+
+	idempotencyKey, err = querier.SelectIdempotencyKey(ctx, "key-2")
+	require.NoError(t, err)
+	assert.Nil(t, idempotencyKey)
+}
+
+func TestBankAccounts(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	account := entities.MerchantBankAccount{
+		MerchantID: merchantID,
+		IBAN:       "DE89370400440532013000",
+		BIC:        "COBADEFFXXX",
+		HolderName: "Padberg Group GmbH",
+		ValidFrom:  time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		Status:     entities.PendingBankAccountStatus,
+	}
+	err = querier.InsertBankAccount(ctx, &account)
+	require.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, account.ID)
+
+	lastDay := time.Date(2023, 6, 30, 0, 0, 0, 0, time.UTC)
+	account.Status = entities.VerifiedBankAccountStatus
+	account.ValidTo = &lastDay
+	err = querier.UpdateBankAccount(ctx, &account, entities.BankAccountVerified)
+	require.NoError(t, err)
+
+	stored, err := querier.SelectBankAccount(ctx, account.ID)
+	require.NoError(t, err)
+	assert.Equal(t, entities.VerifiedBankAccountStatus, stored.Status)
+	assert.Equal(t, "Padberg Group GmbH", stored.HolderName)
+	require.NotNil(t, stored.ValidTo)
+	assert.True(t, stored.ValidTo.Equal(lastDay))
+
+	accounts, err := querier.SelectBankAccounts(ctx, merchantID)
+	require.NoError(t, err)
+	assert.Len(t, accounts, 1)
+
+	// Every change is kept in the history
+	changes, err := querier.SelectBankAccountChanges(ctx, merchantID)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, entities.BankAccountCreated, changes[0].Change)
+	assert.Equal(t, entities.PendingBankAccountStatus, changes[0].Status)
+	assert.Nil(t, changes[0].ValidTo)
+	assert.Equal(t, entities.BankAccountVerified, changes[1].Change)
+	assert.Equal(t, entities.VerifiedBankAccountStatus, changes[1].Status)
+	assert.NotNil(t, changes[1].ValidTo)
+
+	missing, err := querier.SelectBankAccount(ctx, uuid.New())
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	err = querier.UpdateBankAccount(ctx, &entities.MerchantBankAccount{ID: uuid.New(), Status: entities.RejectedBankAccountStatus}, entities.BankAccountRejected)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	// The last day cannot be before the first one
+	invalid := account
+	invalid.ValidTo = &time.Time{}
+	err = querier.UpdateBankAccount(ctx, &invalid, entities.BankAccountClosed)
+	require.Error(t, err)
+}
+
+func TestPayoutBatches(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	dailyMerchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	weeklyMerchantID := uuid.MustParse("6b6d2b8a-f06c-4298-8f27-f33545eb5899")
+	date := func(day int) time.Time {
+		return time.Date(2023, 1, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	for _, disbursement := range []entities.MerchantDisbursement{
+		{MerchantID: dailyMerchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(2), OrdersEndAt: date(2), OrdersSumAmount: 100, FeeAmount: 1},
+		{MerchantID: dailyMerchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(9), OrdersEndAt: date(9), OrdersSumAmount: 50, FeeAmount: 0.5},
+		// Paid in the weekly disbursement of the merchant
+		{MerchantID: weeklyMerchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(3), OrdersEndAt: date(3), OrdersSumAmount: 30, FeeAmount: 0.3},
+		{MerchantID: weeklyMerchantID, DisbursementFrequency: entities.WeeklyDisbursementFrequency, OrdersStartAt: date(2), OrdersEndAt: date(8), OrdersSumAmount: 30, FeeAmount: 0.3},
+	} {
+		disbursement.Currency = entities.DefaultCurrency
+		disbursement.CalculateNetAmount()
+		err = querier.InsertDisbursement(ctx, disbursement)
+		require.NoError(t, err)
+	}
+
+	// Without a verified bank account nothing is payable
+	account := entities.MerchantBankAccount{
+		MerchantID: dailyMerchantID,
+		IBAN:       "DE89370400440532013000",
+		BIC:        "COBADEFFXXX",
+		HolderName: "Padberg Group GmbH",
+		ValidFrom:  date(1),
+		Status:     entities.PendingBankAccountStatus,
+	}
+	err = querier.InsertBankAccount(ctx, &account)
+	require.NoError(t, err)
+
+	marked, err := querier.MarkDisbursementsPayable(ctx, date(8))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), marked)
+
+	unpayable, err := querier.SelectUnpayableDisbursements(ctx, date(8))
+	require.NoError(t, err)
+	require.Len(t, unpayable, 2)
+	assert.Equal(t, dailyMerchantID, unpayable[0].MerchantID)
+	assert.Equal(t, entities.WeeklyDisbursementFrequency, unpayable[1].DisbursementFrequency)
+
+	account.Status = entities.VerifiedBankAccountStatus
+	err = querier.UpdateBankAccount(ctx, &account, entities.BankAccountVerified)
+	require.NoError(t, err)
+
+	marked, err = querier.MarkDisbursementsPayable(ctx, date(8))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), marked)
+
+	// Linked disbursements are not linked again
+	marked, err = querier.MarkDisbursementsPayable(ctx, date(8))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), marked)
+
+	unpayable, err = querier.SelectUnpayableDisbursements(ctx, date(8))
+	require.NoError(t, err)
+	require.Len(t, unpayable, 1)
+	assert.Equal(t, weeklyMerchantID, unpayable[0].MerchantID)
+
+	// Only the approved disbursements are paid
+	payable, err := querier.SelectPayableDisbursements(ctx, date(8))
+	require.NoError(t, err)
+	assert.Empty(t, payable)
+
+	approveLinkedDisbursements(ctx, t, querier, dailyMerchantID)
+
+	payable, err = querier.SelectPayableDisbursements(ctx, date(8))
+	require.NoError(t, err)
+	require.Len(t, payable, 1)
+	assert.Equal(t, dailyMerchantID, payable[0].MerchantID)
+	assert.Equal(t, 99.0, payable[0].NetAmount)
+	assert.Equal(t, uuid.NullUUID{UUID: account.ID, Valid: true}, payable[0].BankAccountID)
+	assert.Equal(t, "DE89370400440532013000", payable[0].IBAN)
+	assert.Equal(t, "COBADEFFXXX", payable[0].BIC)
+	assert.Equal(t, "Padberg Group GmbH", payable[0].HolderName)
+
+	batch := entities.PayoutBatch{MessageID: "PAY-20230109-1A2B3C4D", ExecutionDate: date(9), PaymentsCount: 1, ControlSum: 99}
+	instructions := []entities.PayoutInstruction{
+		{DisbursementID: payable[0].ID, EndToEndID: payable[0].Reference, Amount: 99, IBAN: payable[0].IBAN, BIC: payable[0].BIC},
+	}
+	err = querier.InsertPayoutBatch(ctx, &batch, instructions)
+	require.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, batch.ID)
+
+	// Paid disbursements are sent, and not payable anymore
+	changes, err := querier.SelectDisbursementStatusChanges(ctx, payable[0].ID)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, entities.SentDisbursementStatus, changes[1].ToStatus)
+	assert.Equal(t, "payout batch PAY-20230109-1A2B3C4D", changes[1].Reason)
+
+	marked, err = querier.MarkDisbursementsPayable(ctx, date(9))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), marked)
+	approveLinkedDisbursements(ctx, t, querier, dailyMerchantID)
+
+	payable, err = querier.SelectPayableDisbursements(ctx, date(9))
+	require.NoError(t, err)
+	require.Len(t, payable, 1)
+	assert.Equal(t, date(9), payable[0].OrdersEndAt)
+
+	// A disbursement is paid once, the whole batch is rolled back
+	other := entities.PayoutBatch{MessageID: "PAY-20230109-5E6F7A8B", ExecutionDate: date(9), PaymentsCount: 1, ControlSum: 99}
+	err = querier.InsertPayoutBatch(ctx, &other, instructions)
+	require.ErrorIs(t, err, ErrorStatusChanged)
+
+	payable, err = querier.SelectPayableDisbursements(ctx, date(9))
+	require.NoError(t, err)
+	assert.Len(t, payable, 1)
+
+	// Once the account is closed its disbursements are not payable to it
+	lastDay := date(31)
+	account.ValidTo = &lastDay
+	err = querier.UpdateBankAccount(ctx, &account, entities.BankAccountClosed)
+	require.NoError(t, err)
+
+	payable, err = querier.SelectPayableDisbursements(ctx, date(9))
+	require.NoError(t, err)
+	assert.Empty(t, payable)
+
+	unpayable, err = querier.SelectUnpayableDisbursements(ctx, date(9))
+	require.NoError(t, err)
+	assert.Len(t, unpayable, 2)
+}
+
+func TestPayoutMonthlyMerchant(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("61649242-a612-46ba-82d8-225542bb9576")
+	_, err = querier.dbConn.ExecContext(ctx, `UPDATE merchants SET disbursement_frequency = 'monthly' WHERE id = $1`, merchantID)
+	require.NoError(t, err)
+	date := func(day int) time.Time {
+		return time.Date(2023, 1, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	// The daily disbursements of January, and the weekly one of the first week, summing them
+	var dailyNetAmount float64
+	for _, disbursement := range []entities.MerchantDisbursement{
+		{MerchantID: merchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(2), OrdersEndAt: date(2), OrdersSumAmount: 100, FeeAmount: 1},
+		{MerchantID: merchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(3), OrdersEndAt: date(3), OrdersSumAmount: 40, FeeAmount: 0.4, RefundsAmount: 20, FeeReversalAmount: 0.2},
+		{MerchantID: merchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: date(16), OrdersEndAt: date(16), OrdersSumAmount: 60, FeeAmount: 0.6, FeeAmountCorrection: 5},
+		{MerchantID: merchantID, DisbursementFrequency: entities.WeeklyDisbursementFrequency, OrdersStartAt: date(2), OrdersEndAt: date(8), OrdersSumAmount: 140, FeeAmount: 1.4, RefundsAmount: 20, FeeReversalAmount: 0.2},
+	} {
+		disbursement.Currency = entities.DefaultCurrency
+		disbursement.CalculateNetAmount()
+		err = querier.InsertDisbursement(ctx, disbursement)
+		require.NoError(t, err)
+		if disbursement.DisbursementFrequency == entities.DailyDisbursementFrequency {
+			dailyNetAmount += disbursement.NetAmount
+		}
+	}
+
+	// The monthly disbursement, created on the 1st of February, sums the daily ones only
+	sums, err := querier.SelectSumDisbursements(ctx, date(1), date(31), entities.MonthlyDisbursementFrequency)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	monthly := sums[0]
+	monthly.CalculateNetAmount()
+	err = querier.InsertDisbursement(ctx, monthly)
+	require.NoError(t, err)
+
+	account := entities.MerchantBankAccount{
+		MerchantID: merchantID,
+		IBAN:       "DE89370400440532013000",
+		BIC:        "COBADEFFXXX",
+		HolderName: "Deckow Gibson GmbH",
+		ValidFrom:  date(1),
+		Status:     entities.PendingBankAccountStatus,
+	}
+	err = querier.InsertBankAccount(ctx, &account)
+	require.NoError(t, err)
+	account.Status = entities.VerifiedBankAccountStatus
+	err = querier.UpdateBankAccount(ctx, &account, entities.BankAccountVerified)
+	require.NoError(t, err)
+
+	// Only the monthly disbursement is paid, with the net amount of the daily ones
+	marked, err := querier.MarkDisbursementsPayable(ctx, date(31))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), marked)
+	approveLinkedDisbursements(ctx, t, querier, merchantID)
+
+	payable, err := querier.SelectPayableDisbursements(ctx, date(31))
+	require.NoError(t, err)
+	require.Len(t, payable, 1)
+	assert.Equal(t, entities.MonthlyDisbursementFrequency, payable[0].DisbursementFrequency)
+	assert.Equal(t, entities.RoundAmount(dailyNetAmount), payable[0].NetAmount)
+	assert.Equal(t, 173.2, payable[0].NetAmount)
+}
+
+func TestDisbursementStatuses(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	disbursement := entities.MerchantDisbursement{MerchantID: merchantID, Currency: entities.DefaultCurrency, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: day, OrdersEndAt: day, OrdersSumAmount: 100, FeeAmount: 1}
+	disbursement.CalculateNetAmount()
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.NoError(t, err)
+
+	// New disbursements are calculated
+	calculated, err := querier.SelectDisbursements(ctx, entities.DisbursementFilter{Status: entities.CalculatedDisbursementStatus})
+	require.NoError(t, err)
+	require.Len(t, calculated, 1)
+	assert.Nil(t, calculated[0].ApprovedAt)
+
+	approvedAt := time.Date(2023, 1, 3, 9, 0, 0, 0, time.UTC)
+	change := entities.DisbursementStatusChange{
+		DisbursementID: calculated[0].ID,
+		FromStatus:     entities.CalculatedDisbursementStatus,
+		ToStatus:       entities.ApprovedDisbursementStatus,
+		Reason:         "checked",
+		ChangedAt:      approvedAt,
+	}
+	err = querier.TransitionDisbursement(ctx, &change)
+	require.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, change.ID)
+
+	approved, err := querier.SelectDisbursementByReference(ctx, calculated[0].Reference)
+	require.NoError(t, err)
+	assert.Equal(t, entities.ApprovedDisbursementStatus, approved.Status)
+	require.NotNil(t, approved.ApprovedAt)
+	assert.True(t, approved.ApprovedAt.Equal(approvedAt))
+	assert.Nil(t, approved.SentAt)
+
+	count, err := querier.CountDisbursements(ctx, entities.DisbursementFilter{Status: entities.CalculatedDisbursementStatus})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+
+	// The change starts from a status the disbursement is not in anymore, nothing is recorded
+	stale := change
+	stale.ID = uuid.Nil
+	err = querier.TransitionDisbursement(ctx, &stale)
+	require.ErrorIs(t, err, ErrorStatusChanged)
+
+	changes, err := querier.SelectDisbursementStatusChanges(ctx, calculated[0].ID)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, entities.CalculatedDisbursementStatus, changes[0].FromStatus)
+	assert.Equal(t, entities.ApprovedDisbursementStatus, changes[0].ToStatus)
+	assert.Equal(t, "checked", changes[0].Reason)
+}
+
+func TestBankStatements(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	merchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	disbursement := entities.MerchantDisbursement{MerchantID: merchantID, Currency: entities.DefaultCurrency, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: day, OrdersEndAt: day, OrdersSumAmount: 100, FeeAmount: 1}
+	disbursement.CalculateNetAmount()
+	err = querier.InsertDisbursement(ctx, disbursement)
+	require.NoError(t, err)
+
+	disbursements, err := querier.SelectDisbursements(ctx, entities.DisbursementFilter{})
+	require.NoError(t, err)
+	require.Len(t, disbursements, 1)
+
+	statement := entities.BankStatement{
+		FileName:    "camt053_20230104.xml",
+		FileHash:    "6f1ed002ab5595859014ebf0951522d9",
+		Format:      entities.Camt053StatementFormat,
+		StatementID: "STMT-20230104-1",
+		IBAN:        "ES9121000418450200051332",
+	}
+	entries := []entities.BankStatementEntry{
+		{
+			BookingDate:           time.Date(2023, 1, 4, 0, 0, 0, 0, time.UTC),
+			Amount:                99,
+			Currency:              "EUR",
+			BankReference:         "BANK-0001",
+			DisbursementReference: disbursements[0].Reference,
+			DisbursementID:        uuid.NullUUID{UUID: disbursements[0].ID, Valid: true},
+			Result:                entities.MatchedReconciliationResult,
+		},
+		{
+			BookingDate:   time.Date(2023, 1, 5, 0, 0, 0, 0, time.UTC),
+			Amount:        12.5,
+			Currency:      "EUR",
+			BankReference: "BANK-0002",
+			Result:        entities.UnmatchedReconciliationResult,
+			Detail:        "no disbursement reference",
+		},
+	}
+
+	missing, err := querier.SelectBankStatementByHash(ctx, statement.FileHash)
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	// A stale settlement rolls back the whole statement
+	stale := entities.DisbursementStatusChange{
+		DisbursementID: disbursements[0].ID,
+		FromStatus:     entities.SentDisbursementStatus,
+		ToStatus:       entities.SettledDisbursementStatus,
+		Reason:         "bank statement camt053_20230104.xml",
+		ChangedAt:      time.Now(),
+	}
+	err = querier.InsertBankStatement(ctx, &statement, entries, []*entities.DisbursementStatusChange{&stale})
+	require.ErrorIs(t, err, ErrorStatusChanged)
+
+	missing, err = querier.SelectBankStatementByHash(ctx, statement.FileHash)
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	settlement := stale
+	settlement.FromStatus = disbursements[0].Status
+	err = querier.InsertBankStatement(ctx, &statement, entries, []*entities.DisbursementStatusChange{&settlement})
+	require.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, statement.ID)
+	assert.Equal(t, statement.ID, entries[0].StatementID)
+	assert.NotEqual(t, uuid.Nil, entries[1].ID)
+
+	imported, err := querier.SelectBankStatementByHash(ctx, statement.FileHash)
+	require.NoError(t, err)
+	require.NotNil(t, imported)
+	assert.Equal(t, "camt053_20230104.xml", imported.FileName)
+	assert.Equal(t, entities.Camt053StatementFormat, imported.Format)
+
+	// A file is imported once
+	duplicate := statement
+	err = querier.InsertBankStatement(ctx, &duplicate, nil, nil)
+	require.Error(t, err)
+
+	settled, err := querier.SelectDisbursementByReference(ctx, disbursements[0].Reference)
+	require.NoError(t, err)
+	assert.Equal(t, entities.SettledDisbursementStatus, settled.Status)
+
+	all, err := querier.SelectReconciliationEntries(ctx, entities.ReconciliationFilter{})
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "camt053_20230104.xml", all[0].FileName)
+	assert.Equal(t, disbursements[0].ID, all[0].DisbursementID.UUID)
+	assert.Equal(t, 99.0, all[0].Amount)
+	assert.False(t, all[1].DisbursementID.Valid)
+
+	problems, err := querier.SelectReconciliationEntries(ctx, entities.ReconciliationFilter{
+		Results: []entities.ReconciliationResults{entities.UnmatchedReconciliationResult, entities.MismatchedReconciliationResult},
+	})
+	require.NoError(t, err)
+	require.Len(t, problems, 1)
+	assert.Equal(t, "no disbursement reference", problems[0].Detail)
+
+	booked, err := querier.SelectReconciliationEntries(ctx, entities.ReconciliationFilter{From: entries[0].BookingDate, To: entries[0].BookingDate})
+	require.NoError(t, err)
+	require.Len(t, booked, 1)
+	assert.Equal(t, "BANK-0001", booked[0].BankReference)
+}
+
+func TestOutboxEvents(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	err := insertTestMerchants(ctx, querier)
+	require.NoError(t, err)
+
+	// Only the disbursement of the merchant frequency is notified, not the daily one of a weekly merchant
+	dailyMerchantID := uuid.MustParse("66312006-4d7e-45c4-9c28-788f4aa68a62")
+	weeklyMerchantID := uuid.MustParse("6b6d2b8a-f06c-4298-8f27-f33545eb5899")
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, merchantID := range []uuid.UUID{dailyMerchantID, weeklyMerchantID} {
+		disbursement := entities.MerchantDisbursement{MerchantID: merchantID, Currency: entities.DefaultCurrency, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: day, OrdersEndAt: day, OrdersSumAmount: 100, FeeAmount: 1}
+		disbursement.CalculateNetAmount()
+		err = querier.InsertDisbursement(ctx, disbursement)
+		require.NoError(t, err)
+	}
+
+	events, err := querier.SelectOutboxEvents(ctx, entities.OutboxFilter{})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	created := events[0]
+	assert.Equal(t, entities.DisbursementCreatedEvent, created.EventType)
+	assert.Equal(t, dailyMerchantID, created.MerchantID)
+	assert.Equal(t, entities.PendingOutboxStatus, created.Status)
+
+	var data entities.DisbursementEventData
+	require.NoError(t, json.Unmarshal(created.Payload, &data))
+	assert.Equal(t, "calculated", data.Status)
+	assert.Equal(t, 99.0, data.NetAmount)
+
+	// Approving is internal to operations, sending is notified
+	now := time.Now().UTC()
+	for _, to := range []entities.DisbursementStatuses{entities.ApprovedDisbursementStatus, entities.SentDisbursementStatus} {
+		from := entities.CalculatedDisbursementStatus
+		if to == entities.SentDisbursementStatus {
+			from = entities.ApprovedDisbursementStatus
+		}
+		change := entities.DisbursementStatusChange{DisbursementID: created.DisbursementID, FromStatus: from, ToStatus: to, ChangedAt: now}
+		err = querier.TransitionDisbursement(ctx, &change)
+		require.NoError(t, err)
+	}
+
+	due, err := querier.SelectDueOutboxEvents(ctx, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+	assert.Equal(t, entities.DisbursementCreatedEvent, due[0].EventType)
+	sent := due[1]
+	assert.Equal(t, entities.DisbursementSentEvent, sent.EventType)
+	require.NoError(t, json.Unmarshal(sent.Payload, &data))
+	assert.Equal(t, "sent", data.Status)
+	assert.Equal(t, "approved", data.PreviousStatus)
+
+	// A delivered event and an event retried later are not due anymore
+	deliveredAt := now.Truncate(time.Microsecond)
+	created.Status = entities.DeliveredOutboxStatus
+	created.Attempts = 1
+	created.DeliveredAt = &deliveredAt
+	err = querier.UpdateOutboxEvent(ctx, &created)
+	require.NoError(t, err)
+
+	sent.Attempts = 1
+	sent.NextAttemptAt = now.Add(time.Hour)
+	sent.LastError = "webhook delivery failed: the webhook responded 503 Service Unavailable"
+	err = querier.UpdateOutboxEvent(ctx, &sent)
+	require.NoError(t, err)
+
+	due, err = querier.SelectDueOutboxEvents(ctx, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	retried, err := querier.SelectOutboxEvent(ctx, sent.ID)
+	require.NoError(t, err)
+	require.NotNil(t, retried)
+	assert.Equal(t, 1, retried.Attempts)
+	assert.Equal(t, sent.LastError, retried.LastError)
+	assert.Nil(t, retried.DeliveredAt)
+
+	delivered, err := querier.SelectOutboxEvents(ctx, entities.OutboxFilter{Status: entities.DeliveredOutboxStatus, MerchantID: dailyMerchantID})
+	require.NoError(t, err)
+	require.Len(t, delivered, 1)
+	assert.True(t, delivered[0].DeliveredAt.Equal(deliveredAt))
+
+	missing, err := querier.SelectOutboxEvent(ctx, uuid.New())
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	// The webhook of the merchant
+	err = querier.UpdateMerchantWebhook(ctx, dailyMerchantID, "https://merchant.example/hooks", "whsec_test")
+	require.NoError(t, err)
+	merchant, err := querier.SelectMerchant(ctx, dailyMerchantID)
+	require.NoError(t, err)
+	assert.Equal(t, "https://merchant.example/hooks", merchant.WebhookURL)
+	assert.Equal(t, "whsec_test", merchant.WebhookSecret)
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	ctx, teardownTest, querier := setupTestQuerier(t)
+	defer teardownTest(t)
+
+	// A second querier simulates another processor running at the same time
+	other, err := NewPostgresQuerier(ctx, querier.dbURL)
+	require.NoError(t, err)
+	defer other.Close()
+
+	err = querier.AcquireLock(ctx, ProcessorLockName, false)
+	require.NoError(t, err)
+
+	t.Run("LockHeldByAnotherSession", func(t *testing.T) {
+		err := other.AcquireLock(ctx, ProcessorLockName, false)
+		require.ErrorIs(t, err, ErrorLockHeld)
+	})
+
+	t.Run("WaitForLockCancelled", func(t *testing.T) {
+		waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+
+		err := other.AcquireLock(waitCtx, ProcessorLockName, true)
+		require.Error(t, err)
+	})
+
+	t.Run("WaitingDoesNotBlockOtherLocks", func(t *testing.T) {
+		waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+
+		waited := make(chan error)
+		go func() {
+			waited <- other.AcquireLock(waitCtx, ProcessorLockName, true)
+		}()
+
+		// The querier takes other locks while one of its sessions waits
+		err := other.AcquireLock(ctx, WebhooksLockName, false)
+		require.NoError(t, err)
+		err = other.ReleaseLock(ctx, WebhooksLockName)
+		require.NoError(t, err)
+
+		require.Error(t, <-waited)
+	})
+
+	t.Run("LockReleased", func(t *testing.T) {
+		err := querier.ReleaseLock(ctx, ProcessorLockName)
+		require.NoError(t, err)
+
+		err = other.AcquireLock(ctx, ProcessorLockName, false)
+		require.NoError(t, err)
+
+		err = other.ReleaseLock(ctx, ProcessorLockName)
+		require.NoError(t, err)
+	})
+
+	t.Run("ReleaseLockNotHeld", func(t *testing.T) {
+		err := querier.ReleaseLock(ctx, ProcessorLockName)
+		require.ErrorIs(t, err, ErrorLockNotHeld)
+	})
+}
+
+// approveLinkedDisbursements approves the calculated disbursements of the merchant linked to a bank account
+func approveLinkedDisbursements(ctx context.Context, t *testing.T, querier *PostgresQuerier, merchantID uuid.UUID) {
+	disbursements, err := querier.SelectDisbursements(ctx, entities.DisbursementFilter{MerchantID: merchantID, Status: entities.CalculatedDisbursementStatus})
+	require.NoError(t, err)
+
+	for _, disbursement := range disbursements {
+		if !disbursement.BankAccountID.Valid {
+			continue
+		}
+		err = querier.TransitionDisbursement(ctx, &entities.DisbursementStatusChange{
+			DisbursementID: disbursement.ID,
+			FromStatus:     entities.CalculatedDisbursementStatus,
+			ToStatus:       entities.ApprovedDisbursementStatus,
+			ChangedAt:      time.Now(),
+		})
+		require.NoError(t, err)
+	}
 }
 
 func insertTestMerchants(ctx context.Context, querier *PostgresQuerier) error {
@@ -9,8 +9,13 @@ import (
 
 type Querier interface {
 	Close()
+	Ping(ctx context.Context) error
+
+	AcquireLock(ctx context.Context, name string, wait bool) error
+	ReleaseLock(ctx context.Context, name string) error
 
 	CountMerchants(ctx context.Context) (int64, error)
+	SelectMerchants(ctx context.Context) ([]entities.Merchant, error)
 	SelectMerchantByReference(ctx context.Context, reference string) (*entities.Merchant, error)
 	SelectMerchant(ctx context.Context, id uuid.UUID) (*entities.Merchant, error)
 	InsertOrder(ctx context.Context, order entities.Order) error
@@ -22,6 +27,61 @@ type Querier interface {
 
 	SelectSumDisbursements(ctx context.Context, from, to time.Time, frequency entities.DisbursementFrequencies) ([]entities.MerchantDisbursement, error)
 
-	MarkOrdersAsDisbursed(ctx context.Context, day time.Time) error
-	SelectSumDisbursementsForMerchant(ctx context.Context, merchantId uuid.UUID, from, to time.Time, frequency entities.DisbursementFrequencies) (*entities.MerchantDisbursement, error)
+	SelectSumDisbursementsForMerchant(ctx context.Context, merchantId uuid.UUID, currency string, from, to time.Time, frequency entities.DisbursementFrequencies) (*entities.MerchantDisbursement, error)
+
+	SelectDisbursements(ctx context.Context, filter entities.DisbursementFilter) ([]entities.MerchantDisbursement, error)
+	CountDisbursements(ctx context.Context, filter entities.DisbursementFilter) (int64, error)
+	SelectDisbursementByReference(ctx context.Context, reference string) (*entities.MerchantDisbursement, error)
+	SelectDisbursedOrders(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Order, error)
+
+	InsertRefund(ctx context.Context, refund entities.Refund) error
+	SelectRefund(ctx context.Context, id string) (*entities.Refund, error)
+	SelectOrderRefunds(ctx context.Context, orderID string) ([]entities.Refund, error)
+	SelectSumRefunds(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error)
+	SelectDeductedRefunds(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Refund, error)
+	InsertChargeback(ctx context.Context, chargeback entities.Chargeback) error
+	SelectChargeback(ctx context.Context, id string) (*entities.Chargeback, error)
+	SelectOrderChargebacks(ctx context.Context, orderID string) ([]entities.Chargeback, error)
+	SelectSumChargebacks(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error)
+	SelectDeductedChargebacks(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Chargeback, error)
+
+	SelectMerchantBalance(ctx context.Context, merchantID uuid.UUID, currency string) (float64, error)
+	SelectBalanceEntries(ctx context.Context, merchantID uuid.UUID) ([]entities.MerchantBalanceEntry, error)
+	SelectMerchantDebts(ctx context.Context) ([]entities.MerchantDebt, error)
+
+	SelectLedgerBalances(ctx context.Context) ([]entities.LedgerBalance, error)
+	SelectLedgerTotals(ctx context.Context) ([]entities.LedgerTotals, error)
+	SelectMerchantPayables(ctx context.Context) ([]entities.MerchantPayable, error)
+
+	SelectYearlyReport(ctx context.Context, year int) ([]entities.YearlyReport, error)
+
+	SelectIdempotencyKey(ctx context.Context, key string) (*entities.IdempotencyKey, error)
+	ReserveIdempotencyKey(ctx context.Context, key, requestHash string) (bool, error)
+	CompleteIdempotencyKey(ctx context.Context, idempotencyKey entities.IdempotencyKey) error
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+
+	InsertBankAccount(ctx context.Context, account *entities.MerchantBankAccount) error
+	SelectBankAccount(ctx context.Context, id uuid.UUID) (*entities.MerchantBankAccount, error)
+	SelectBankAccounts(ctx context.Context, merchantID uuid.UUID) ([]entities.MerchantBankAccount, error)
+	UpdateBankAccount(ctx context.Context, account *entities.MerchantBankAccount, change string) error
+	SelectBankAccountChanges(ctx context.Context, merchantID uuid.UUID) ([]entities.BankAccountChange, error)
+
+	MarkDisbursementsPayable(ctx context.Context, until time.Time) (int64, error)
+	SelectUnpayableDisbursements(ctx context.Context, until time.Time) ([]entities.MerchantDisbursement, error)
+	SelectPayableDisbursements(ctx context.Context, until time.Time) ([]entities.PayableDisbursement, error)
+	InsertPayoutBatch(ctx context.Context, batch *entities.PayoutBatch, instructions []entities.PayoutInstruction) error
+
+	TransitionDisbursement(ctx context.Context, change *entities.DisbursementStatusChange) error
+	SelectDisbursementStatusChanges(ctx context.Context, disbursementID uuid.UUID) ([]entities.DisbursementStatusChange, error)
+
+	SelectBankStatementByHash(ctx context.Context, hash string) (*entities.BankStatement, error)
+	InsertBankStatement(ctx context.Context, statement *entities.BankStatement, entries []entities.BankStatementEntry, changes []*entities.DisbursementStatusChange) error
+	SelectReconciliationEntries(ctx context.Context, filter entities.ReconciliationFilter) ([]entities.ReconciliationEntry, error)
+
+	UpdateMerchantWebhook(ctx context.Context, merchantID uuid.UUID, url, secret string) error
+	UpdateMerchantCurrency(ctx context.Context, merchantID uuid.UUID, currency string) error
+	SelectDueOutboxEvents(ctx context.Context, now time.Time, limit int) ([]entities.OutboxEvent, error)
+	SelectOutboxEvent(ctx context.Context, id uuid.UUID) (*entities.OutboxEvent, error)
+	SelectOutboxEvents(ctx context.Context, filter entities.OutboxFilter) ([]entities.OutboxEvent, error)
+	UpdateOutboxEvent(ctx context.Context, event *entities.OutboxEvent) error
 }
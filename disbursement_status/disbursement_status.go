@@ -0,0 +1,192 @@
+package disbursement_status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+var (
+	ErrorDisbursementNotFound = errors.New("disbursement not found")
+	ErrorInvalidTransition    = errors.New("invalid disbursement status change")
+	ErrorUnknownStatus        = errors.New("unknown disbursement status")
+)
+
+// transitions lists the statuses each status can change to
+// A failed or returned payout is approved again to be paid in a later payout file
+var transitions = map[entities.DisbursementStatuses][]entities.DisbursementStatuses{
+	entities.CalculatedDisbursementStatus: {entities.ApprovedDisbursementStatus},
+	entities.ApprovedDisbursementStatus:   {entities.SentDisbursementStatus},
+	entities.SentDisbursementStatus:       {entities.SettledDisbursementStatus, entities.FailedDisbursementStatus},
+	entities.SettledDisbursementStatus:    {entities.ReturnedDisbursementStatus},
+	entities.FailedDisbursementStatus:     {entities.ApprovedDisbursementStatus},
+	entities.ReturnedDisbursementStatus:   {entities.ApprovedDisbursementStatus},
+}
+
+// CanTransition tells whether a disbursement can change from a status to another
+func CanTransition(from, to entities.DisbursementStatuses) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseStatus parses the name of a status
+func ParseStatus(value string) (entities.DisbursementStatuses, error) {
+	for _, status := range entities.DisbursementStatusesList {
+		if string(status) == value {
+			return status, nil
+		}
+	}
+
+	names := make([]string, 0, len(entities.DisbursementStatusesList))
+	for _, status := range entities.DisbursementStatusesList {
+		names = append(names, string(status))
+	}
+	return "", fmt.Errorf("%w %q, expected one of %s", ErrorUnknownStatus, value, strings.Join(names, ", "))
+}
+
+// Service moves the disbursements through the payout lifecycle, recording every change in their history
+type Service struct {
+	querier database.Querier
+	logger  *slog.Logger
+	now     func() time.Time
+}
+
+func NewService(querier database.Querier) *Service {
+	return &Service{
+		querier: querier,
+		logger:  system.ComponentLogger("disbursement_status"),
+		now:     time.Now,
+	}
+}
+
+// Transition changes the status of the disbursement with the reference
+func (s *Service) Transition(ctx context.Context, reference string, to entities.DisbursementStatuses, reason string) (*entities.MerchantDisbursement, error) {
+	disbursement, err := s.disbursement(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.transition(ctx, disbursement, to, reason)
+	if err != nil {
+		return nil, err
+	}
+	return disbursement, nil
+}
+
+// ApprovePayable approves the calculated disbursements with orders until the day, included, that are payable
+// The disbursements changed meanwhile by someone else are skipped
+func (s *Service) ApprovePayable(ctx context.Context, until time.Time, reason string) ([]entities.MerchantDisbursement, error) {
+	disbursements, err := s.querier.SelectDisbursements(ctx, entities.DisbursementFilter{
+		Status: entities.CalculatedDisbursementStatus,
+		To:     until,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error selecting calculated disbursements: %w", err)
+	}
+
+	var approved []entities.MerchantDisbursement
+	for i := range disbursements {
+		disbursement := &disbursements[i]
+		if !disbursement.BankAccountID.Valid {
+			continue
+		}
+
+		err = s.transition(ctx, disbursement, entities.ApprovedDisbursementStatus, reason)
+		if errors.Is(err, database.ErrorStatusChanged) {
+			s.logger.Warn("disbursement not approved", "disbursement", disbursement.Reference, system.LogErrorKey, err)
+			continue
+		}
+		if err != nil {
+			return approved, err
+		}
+		approved = append(approved, *disbursement)
+	}
+
+	return approved, nil
+}
+
+// History returns the disbursement with the reference and its status changes, in order
+func (s *Service) History(ctx context.Context, reference string) (*entities.MerchantDisbursement, []entities.DisbursementStatusChange, error) {
+	disbursement, err := s.disbursement(ctx, reference)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes, err := s.querier.SelectDisbursementStatusChanges(ctx, disbursement.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return disbursement, changes, nil
+}
+
+// Change validates a status change of the disbursement, for the caller to persist along with its own writes
+// Changed must be called once the change is persisted
+// Only the disbursements linked to a bank account by the processor can be approved, as the others are not paid
+func (s *Service) Change(disbursement *entities.MerchantDisbursement, to entities.DisbursementStatuses, reason string) (*entities.DisbursementStatusChange, error) {
+	if !CanTransition(disbursement.Status, to) {
+		return nil, fmt.Errorf("%w: a %s disbursement cannot be %s", ErrorInvalidTransition, disbursement.Status, to)
+	}
+	if to == entities.ApprovedDisbursementStatus && !disbursement.BankAccountID.Valid {
+		return nil, fmt.Errorf("%w: the disbursement %s is not payable, its merchant has no verified bank account",
+			ErrorInvalidTransition, disbursement.Reference)
+	}
+
+	return &entities.DisbursementStatusChange{
+		DisbursementID: disbursement.ID,
+		FromStatus:     disbursement.Status,
+		ToStatus:       to,
+		Reason:         reason,
+		ChangedAt:      s.now(),
+	}, nil
+}
+
+// Changed applies a persisted status change to the disbursement, and records it
+func (s *Service) Changed(disbursement *entities.MerchantDisbursement, change *entities.DisbursementStatusChange) {
+	disbursement.SetStatus(change.ToStatus, change.ChangedAt)
+	metrics.ObserveStatusChange(change.ToStatus)
+	s.logger.Info("disbursement status changed",
+		system.LogMerchantIDKey, disbursement.MerchantID,
+		"disbursement", disbursement.Reference,
+		"from", change.FromStatus,
+		"to", change.ToStatus,
+		"reason", change.Reason)
+}
+
+// transition validates and persists a status change of the disbursement
+func (s *Service) transition(ctx context.Context, disbursement *entities.MerchantDisbursement, to entities.DisbursementStatuses, reason string) error {
+	change, err := s.Change(disbursement, to, reason)
+	if err != nil {
+		return err
+	}
+
+	err = s.querier.TransitionDisbursement(ctx, change)
+	if err != nil {
+		return fmt.Errorf("error changing the status of disbursement %s: %w", disbursement.Reference, err)
+	}
+
+	s.Changed(disbursement, change)
+	return nil
+}
+
+func (s *Service) disbursement(ctx context.Context, reference string) (*entities.MerchantDisbursement, error) {
+	disbursement, err := s.querier.SelectDisbursementByReference(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	if disbursement == nil {
+		return nil, fmt.Errorf("%w: %q", ErrorDisbursementNotFound, reference)
+	}
+	return disbursement, nil
+}
@@ -0,0 +1,182 @@
+package disbursement_status
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupDisbursement(reference string, status entities.DisbursementStatuses, payable bool) *entities.MerchantDisbursement {
+	disbursement := &entities.MerchantDisbursement{
+		ID:                    uuid.New(),
+		Reference:             reference,
+		MerchantID:            uuid.New(),
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC),
+		OrdersEndAt:           time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC),
+		NetAmount:             99.1,
+		Status:                status,
+		CreatedAt:             time.Date(2023, 1, 16, 6, 0, 0, 0, time.UTC),
+	}
+	if payable {
+		disbursement.BankAccountID = uuid.NullUUID{UUID: uuid.New(), Valid: true}
+	}
+	return disbursement
+}
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[entities.DisbursementStatuses][]entities.DisbursementStatuses{
+		entities.CalculatedDisbursementStatus: {entities.ApprovedDisbursementStatus},
+		entities.ApprovedDisbursementStatus:   {entities.SentDisbursementStatus},
+		entities.SentDisbursementStatus:       {entities.SettledDisbursementStatus, entities.FailedDisbursementStatus},
+		entities.SettledDisbursementStatus:    {entities.ReturnedDisbursementStatus},
+		entities.FailedDisbursementStatus:     {entities.ApprovedDisbursementStatus},
+		entities.ReturnedDisbursementStatus:   {entities.ApprovedDisbursementStatus},
+	}
+
+	for _, from := range entities.DisbursementStatusesList {
+		for _, to := range entities.DisbursementStatusesList {
+			expected := false
+			for _, status := range allowed[from] {
+				expected = expected || status == to
+			}
+			require.Equal(t, expected, CanTransition(from, to), "%s to %s", from, to)
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	status, err := ParseStatus("settled")
+	require.NoError(t, err)
+	require.Equal(t, entities.SettledDisbursementStatus, status)
+
+	_, err = ParseStatus("paid")
+	require.ErrorIs(t, err, ErrorUnknownStatus)
+	require.EqualError(t, err, `unknown disbursement status "paid", expected one of calculated, approved, sent, settled, failed, returned`)
+}
+
+func TestTransition(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 1, 20, 10, 0, 0, 0, time.UTC)
+	sent := setupDisbursement("DSB-20230115-00000001", entities.SentDisbursementStatus, true)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDisbursementByReference", ctx, sent.Reference).Return(sent, nil)
+	mockQuerier.On("TransitionDisbursement", ctx, mock.Anything).Return(nil)
+
+	settled := testutil.ToFloat64(metrics.StatusChanges.WithLabelValues(string(entities.SettledDisbursementStatus)))
+
+	service := NewService(mockQuerier)
+	service.now = func() time.Time { return now }
+
+	disbursement, err := service.Transition(ctx, sent.Reference, entities.SettledDisbursementStatus, "bank statement 2023-01-20")
+	require.NoError(t, err)
+	require.Equal(t, entities.SettledDisbursementStatus, disbursement.Status)
+	require.Equal(t, now, *disbursement.SettledAt)
+	require.Equal(t, now, disbursement.StatusChangedAt())
+
+	mockQuerier.AssertCalled(t, "TransitionDisbursement", ctx, &entities.DisbursementStatusChange{
+		DisbursementID: sent.ID,
+		FromStatus:     entities.SentDisbursementStatus,
+		ToStatus:       entities.SettledDisbursementStatus,
+		Reason:         "bank statement 2023-01-20",
+		ChangedAt:      now,
+	})
+	require.Equal(t, settled+1, testutil.ToFloat64(metrics.StatusChanges.WithLabelValues(string(entities.SettledDisbursementStatus))))
+}
+
+func TestTransitionInvalid(t *testing.T) {
+	ctx := context.Background()
+	calculated := setupDisbursement("DSB-20230115-00000001", entities.CalculatedDisbursementStatus, true)
+	unpayable := setupDisbursement("DSB-20230115-00000002", entities.CalculatedDisbursementStatus, false)
+	changed := setupDisbursement("DSB-20230115-00000003", entities.ApprovedDisbursementStatus, true)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDisbursementByReference", ctx, calculated.Reference).Return(calculated, nil)
+	mockQuerier.On("SelectDisbursementByReference", ctx, unpayable.Reference).Return(unpayable, nil)
+	mockQuerier.On("SelectDisbursementByReference", ctx, changed.Reference).Return(changed, nil)
+	mockQuerier.On("SelectDisbursementByReference", ctx, "DSB-MISSING").Return(nil, nil)
+	mockQuerier.On("TransitionDisbursement", ctx, mock.Anything).Return(database.ErrorStatusChanged)
+
+	service := NewService(mockQuerier)
+
+	_, err := service.Transition(ctx, calculated.Reference, entities.SettledDisbursementStatus, "")
+	require.ErrorIs(t, err, ErrorInvalidTransition)
+	require.ErrorContains(t, err, "a calculated disbursement cannot be settled")
+
+	_, err = service.Transition(ctx, unpayable.Reference, entities.ApprovedDisbursementStatus, "")
+	require.ErrorIs(t, err, ErrorInvalidTransition)
+	require.ErrorContains(t, err, "its merchant has no verified bank account")
+
+	_, err = service.Transition(ctx, "DSB-MISSING", entities.ApprovedDisbursementStatus, "")
+	require.ErrorIs(t, err, ErrorDisbursementNotFound)
+
+	mockQuerier.AssertNotCalled(t, "TransitionDisbursement", mock.Anything, mock.Anything)
+
+	// Changed by someone else since it was read
+	_, err = service.Transition(ctx, changed.Reference, entities.SentDisbursementStatus, "")
+	require.ErrorIs(t, err, database.ErrorStatusChanged)
+	require.Equal(t, entities.ApprovedDisbursementStatus, changed.Status)
+}
+
+func TestApprovePayable(t *testing.T) {
+	ctx := context.Background()
+	until := time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)
+	payable := setupDisbursement("DSB-20230115-00000001", entities.CalculatedDisbursementStatus, true)
+	unpayable := setupDisbursement("DSB-20230115-00000002", entities.CalculatedDisbursementStatus, false)
+	changed := setupDisbursement("DSB-20230115-00000003", entities.CalculatedDisbursementStatus, true)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDisbursements", ctx, entities.DisbursementFilter{Status: entities.CalculatedDisbursementStatus, To: until}).Return(
+		[]entities.MerchantDisbursement{*payable, *unpayable, *changed}, nil)
+	mockQuerier.On("TransitionDisbursement", ctx, mock.MatchedBy(func(change *entities.DisbursementStatusChange) bool {
+		return change.DisbursementID == payable.ID
+	})).Return(nil)
+	mockQuerier.On("TransitionDisbursement", ctx, mock.MatchedBy(func(change *entities.DisbursementStatusChange) bool {
+		return change.DisbursementID == changed.ID
+	})).Return(database.ErrorStatusChanged)
+
+	approved, err := NewService(mockQuerier).ApprovePayable(ctx, until, "weekly approval")
+	require.NoError(t, err)
+	require.Len(t, approved, 1)
+	require.Equal(t, payable.ID, approved[0].ID)
+	require.Equal(t, entities.ApprovedDisbursementStatus, approved[0].Status)
+	require.NotNil(t, approved[0].ApprovedAt)
+
+	// The unpayable disbursement is left calculated
+	mockQuerier.AssertNumberOfCalls(t, "TransitionDisbursement", 2)
+
+	dbError := errors.New("database error")
+	failing := test_helpers.NewMockQuerier()
+	failing.On("SelectDisbursements", ctx, mock.Anything).Return(nil, dbError)
+	_, err = NewService(failing).ApprovePayable(ctx, until, "")
+	require.ErrorIs(t, err, dbError)
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	sent := setupDisbursement("DSB-20230115-00000001", entities.SentDisbursementStatus, true)
+	changes := []entities.DisbursementStatusChange{
+		{DisbursementID: sent.ID, FromStatus: entities.CalculatedDisbursementStatus, ToStatus: entities.ApprovedDisbursementStatus},
+		{DisbursementID: sent.ID, FromStatus: entities.ApprovedDisbursementStatus, ToStatus: entities.SentDisbursementStatus},
+	}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDisbursementByReference", ctx, sent.Reference).Return(sent, nil)
+	mockQuerier.On("SelectDisbursementStatusChanges", ctx, sent.ID).Return(changes, nil)
+
+	disbursement, history, err := NewService(mockQuerier).History(ctx, sent.Reference)
+	require.NoError(t, err)
+	require.Equal(t, sent, disbursement)
+	require.Equal(t, changes, history)
+}
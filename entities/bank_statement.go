@@ -0,0 +1,73 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Formats of the bank statement files
+const (
+	Camt053StatementFormat = "camt.053"
+	MT940StatementFormat   = "mt940"
+)
+
+// ReconciliationResults represents the results of matching the bank statement entries enum type.
+type ReconciliationResults string
+
+const (
+	MatchedReconciliationResult        ReconciliationResults = "matched"         // Paid a sent disbursement, now settled
+	AlreadySettledReconciliationResult ReconciliationResults = "already_settled" // Paid a disbursement settled by a previous statement
+	UnmatchedReconciliationResult      ReconciliationResults = "unmatched"       // No disbursement with the reference of the entry
+	MismatchedReconciliationResult     ReconciliationResults = "mismatched"      // The amount or the status of the disbursement do not match
+)
+
+// ReconciliationResultsList lists the results, the ones needing attention last
+var ReconciliationResultsList = []ReconciliationResults{
+	MatchedReconciliationResult,
+	AlreadySettledReconciliationResult,
+	UnmatchedReconciliationResult,
+	MismatchedReconciliationResult,
+}
+
+// BankStatement represents the bank_statements table in the database.
+// It is a statement file of the account the payouts are sent from, imported once.
+type BankStatement struct {
+	ID          uuid.UUID `db:"id"`
+	FileName    string    `db:"file_name"`
+	FileHash    string    `db:"file_hash"` // SHA-256 of the file content, a file is imported once
+	Format      string    `db:"format"`
+	StatementID string    `db:"statement_id"` // Identifier given by the bank
+	IBAN        string    `db:"iban"`
+	ImportedAt  time.Time `db:"imported_at"`
+}
+
+// BankStatementEntry represents the bank_statement_entries table in the database.
+// It is a debit of a statement, with the result of matching it to a disbursement.
+type BankStatementEntry struct {
+	ID                    uuid.UUID             `db:"id"`
+	StatementID           uuid.UUID             `db:"statement_id"`
+	BookingDate           time.Time             `db:"booking_date"`
+	Amount                float64               `db:"amount"`
+	Currency              string                `db:"currency"`
+	BankReference         string                `db:"bank_reference"`
+	DisbursementReference string                `db:"disbursement_reference"` // Empty when the entry has no disbursement reference
+	DisbursementID        uuid.NullUUID         `db:"disbursement_id"`
+	Result                ReconciliationResults `db:"result"`
+	Detail                string                `db:"detail"` // Why the entry is unmatched or mismatched
+	CreatedAt             time.Time             `db:"created_at"`
+}
+
+// ReconciliationEntry is a bank statement entry with the file it was imported from
+type ReconciliationEntry struct {
+	BankStatementEntry
+	FileName string `db:"file_name"`
+}
+
+// ReconciliationFilter selects the bank statement entries booked within the days, included, with one of the results
+// Zero values do not filter.
+type ReconciliationFilter struct {
+	From    time.Time
+	To      time.Time
+	Results []ReconciliationResults
+}
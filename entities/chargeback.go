@@ -0,0 +1,22 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Chargeback represents the chargebacks table in the database.
+// A chargeback takes back all or part of an order disputed by the shopper, and is deducted with its fee
+// from the next daily disbursement of the merchant, whether the order was already disbursed or not.
+// Unlike a refund, the order fee is kept.
+type Chargeback struct {
+	ID         string     `db:"id"`
+	OrderID    string     `db:"order_id"`
+	MerchantID uuid.UUID  `db:"merchant_id"`
+	Amount     float64    `db:"amount"`
+	Fee        float64    `db:"fee"`    // Chargeback fee charged to the merchant
+	Reason     string     `db:"reason"` // Given by the card scheme, like fraud, may be empty
+	CreatedAt  time.Time  `db:"created_at"`
+	DeductedOn *time.Time `db:"deducted_on"` // Day of the daily disbursement it is deducted from, nil until processed
+}
@@ -0,0 +1,13 @@
+package entities
+
+import "regexp"
+
+// DefaultCurrency is the currency of the amounts given without one, the one of everything before currencies existed
+const DefaultCurrency = "EUR"
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// ValidCurrency tells if a code is shaped like an ISO 4217 currency code, three upper case letters like EUR
+func ValidCurrency(code string) bool {
+	return currencyPattern.MatchString(code)
+}
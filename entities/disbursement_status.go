@@ -0,0 +1,77 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DisbursementStatuses represents the payout statuses of the disbursements enum type.
+type DisbursementStatuses string
+
+const (
+	CalculatedDisbursementStatus DisbursementStatuses = "calculated" // Created by the processor
+	ApprovedDisbursementStatus   DisbursementStatuses = "approved"   // Approved by operations, the next payout file pays it
+	SentDisbursementStatus       DisbursementStatuses = "sent"       // In a payout file sent to the bank
+	SettledDisbursementStatus    DisbursementStatuses = "settled"    // Credited to the merchant account
+	FailedDisbursementStatus     DisbursementStatuses = "failed"     // Rejected by the bank before being credited
+	ReturnedDisbursementStatus   DisbursementStatuses = "returned"   // Returned by the merchant bank after being credited
+)
+
+// DisbursementStatusesList lists the statuses in the order of the lifecycle
+var DisbursementStatusesList = []DisbursementStatuses{
+	CalculatedDisbursementStatus,
+	ApprovedDisbursementStatus,
+	SentDisbursementStatus,
+	SettledDisbursementStatus,
+	FailedDisbursementStatus,
+	ReturnedDisbursementStatus,
+}
+
+// DisbursementStatusChange represents the merchant_disbursement_status_changes table in the database.
+type DisbursementStatusChange struct {
+	ID             uuid.UUID            `db:"id"`
+	DisbursementID uuid.UUID            `db:"disbursement_id"`
+	FromStatus     DisbursementStatuses `db:"from_status"`
+	ToStatus       DisbursementStatuses `db:"to_status"`
+	Reason         string               `db:"reason"`
+	ChangedAt      time.Time            `db:"changed_at"`
+}
+
+// SetStatus changes the status of the disbursement, and the time it entered it
+func (d *MerchantDisbursement) SetStatus(status DisbursementStatuses, at time.Time) {
+	d.Status = status
+	switch status {
+	case ApprovedDisbursementStatus:
+		d.ApprovedAt = &at
+	case SentDisbursementStatus:
+		d.SentAt = &at
+	case SettledDisbursementStatus:
+		d.SettledAt = &at
+	case FailedDisbursementStatus:
+		d.FailedAt = &at
+	case ReturnedDisbursementStatus:
+		d.ReturnedAt = &at
+	}
+}
+
+// StatusChangedAt returns the time the disbursement entered its status
+func (d *MerchantDisbursement) StatusChangedAt() time.Time {
+	var changedAt *time.Time
+	switch d.Status {
+	case ApprovedDisbursementStatus:
+		changedAt = d.ApprovedAt
+	case SentDisbursementStatus:
+		changedAt = d.SentAt
+	case SettledDisbursementStatus:
+		changedAt = d.SettledAt
+	case FailedDisbursementStatus:
+		changedAt = d.FailedAt
+	case ReturnedDisbursementStatus:
+		changedAt = d.ReturnedAt
+	}
+	if changedAt == nil {
+		return d.CreatedAt
+	}
+	return *changedAt
+}
@@ -0,0 +1,22 @@
+package entities
+
+import "time"
+
+// IdempotencyKeyStatuses represents the statuses of the idempotency keys enum type.
+type IdempotencyKeyStatuses string
+
+const (
+	PendingIdempotencyKeyStatus   IdempotencyKeyStatuses = "pending"   // Reserved, the request is being processed
+	CompletedIdempotencyKeyStatus IdempotencyKeyStatuses = "completed" // The response of the request is stored
+)
+
+// IdempotencyKey represents the idempotency_keys table in the database.
+// It keeps the response of a request, to replay it when the request is retried with the same key.
+type IdempotencyKey struct {
+	Key         string                 `db:"key"`
+	RequestHash string                 `db:"request_hash"`
+	Status      IdempotencyKeyStatuses `db:"status"`
+	StatusCode  int                    `db:"status_code"`
+	Response    []byte                 `db:"response"`
+	CreatedAt   time.Time              `db:"created_at"`
+}
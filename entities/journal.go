@@ -0,0 +1,195 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrorUnbalancedEntry is returned for a journal entry whose debits do not match its credits
+var ErrorUnbalancedEntry = errors.New("unbalanced journal entry")
+
+// LedgerAccounts represents the accounts of the double-entry ledger.
+type LedgerAccounts string
+
+const (
+	CashAccount                 LedgerAccounts = "cash"                   // Paid by the shoppers, less the refunds and the disbursements
+	MerchantPayableAccount      LedgerAccounts = "merchant_payable"       // Owed to the merchants, negative while they are in debt
+	FeeRevenueAccount           LedgerAccounts = "fee_revenue"            // Order fees and minimum monthly fees earned
+	MonthlyFeeReceivableAccount LedgerAccounts = "monthly_fee_receivable" // Minimum monthly fees charged, until deducted from a disbursement
+)
+
+// LedgerAccountsList lists the accounts of the ledger
+var LedgerAccountsList = []LedgerAccounts{
+	CashAccount,
+	MerchantPayableAccount,
+	FeeRevenueAccount,
+	MonthlyFeeReceivableAccount,
+}
+
+// CreditNormal tells if the balance of the account is its credits minus its debits, like the liabilities and revenues
+func (a LedgerAccounts) CreditNormal() bool {
+	return a == MerchantPayableAccount || a == FeeRevenueAccount
+}
+
+// JournalSources represents the money movements posting to the ledger.
+type JournalSources string
+
+const (
+	OrderJournalSource        JournalSources = "order"        // An order imported, paid by the shopper
+	RefundJournalSource       JournalSources = "refund"       // A refund imported, given back to the shopper
+	ChargebackJournalSource   JournalSources = "chargeback"   // A chargeback imported, taken back by the card scheme
+	MonthlyFeeJournalSource   JournalSources = "monthly_fee"  // A minimum monthly fee correction charged on a daily disbursement
+	DisbursementJournalSource JournalSources = "disbursement" // A daily disbursement, paying the merchant
+)
+
+// JournalEntry represents the journal_entries table in the database.
+// Each money movement posts one entry, once, whose lines debit and credit the accounts by the same total.
+type JournalEntry struct {
+	ID          uuid.UUID      `db:"id"`
+	Source      JournalSources `db:"source"`
+	SourceID    string         `db:"source_id"` // Order, refund or chargeback id, or disbursement id
+	MerchantID  uuid.UUID      `db:"merchant_id"`
+	Currency    string         `db:"currency"` // Of the order or the disbursement posting the entry
+	Description string         `db:"description"`
+	PostedAt    time.Time      `db:"posted_at"`
+	Lines       []JournalLine  `db:"-"`
+}
+
+// JournalLine represents the journal_lines table in the database.
+// A line either debits or credits its account.
+type JournalLine struct {
+	ID             uuid.UUID      `db:"id"`
+	JournalEntryID uuid.UUID      `db:"journal_entry_id"`
+	Account        LedgerAccounts `db:"account"`
+	Debit          float64        `db:"debit"`
+	Credit         float64        `db:"credit"`
+}
+
+// post adds a line to the entry, debiting a positive amount and crediting a negative one
+// Amounts rounding to zero are not posted.
+func (e *JournalEntry) post(account LedgerAccounts, amount float64) {
+	amount = RoundAmount(amount)
+	switch {
+	case amount > 0:
+		e.Lines = append(e.Lines, JournalLine{Account: account, Debit: amount})
+	case amount < 0:
+		e.Lines = append(e.Lines, JournalLine{Account: account, Credit: -amount})
+	}
+}
+
+// Validate checks the debits of the entry match its credits
+func (e *JournalEntry) Validate() error {
+	var debits, credits float64
+	for _, line := range e.Lines {
+		debits += line.Debit
+		credits += line.Credit
+	}
+	if RoundAmount(debits) != RoundAmount(credits) {
+		return fmt.Errorf("%w: %s %s debits %.2f and credits %.2f", ErrorUnbalancedEntry, e.Source, e.SourceID, debits, credits)
+	}
+	return nil
+}
+
+func newJournalEntry(source JournalSources, sourceID string, merchantID uuid.UUID, currency, description string) JournalEntry {
+	return JournalEntry{
+		Source:      source,
+		SourceID:    sourceID,
+		MerchantID:  merchantID,
+		Currency:    currency,
+		Description: description,
+		PostedAt:    time.Now(),
+	}
+}
+
+// OrderJournalEntry posts an order: the shopper pays its amount, owed to the merchant less the order fee
+func OrderJournalEntry(order Order) JournalEntry {
+	entry := newJournalEntry(OrderJournalSource, order.ID, order.MerchantID, order.Currency, "order paid by the shopper")
+	entry.post(CashAccount, order.Amount)
+	entry.post(MerchantPayableAccount, -(order.Amount - order.FeeAmount))
+	entry.post(FeeRevenueAccount, -order.FeeAmount)
+	return entry
+}
+
+// RefundJournalEntry posts a refund: its amount is given back to the shopper, deducted from what is owed
+// to the merchant, and its fee reversal is taken back from the fee revenue, in the currency of its order
+func RefundJournalEntry(refund Refund, currency string) JournalEntry {
+	entry := newJournalEntry(RefundJournalSource, refund.ID, refund.MerchantID, currency, "refund given back to the shopper")
+	entry.post(MerchantPayableAccount, refund.Amount-refund.FeeReversal)
+	entry.post(FeeRevenueAccount, refund.FeeReversal)
+	entry.post(CashAccount, -refund.Amount)
+	return entry
+}
+
+// ChargebackJournalEntry posts a chargeback: its amount is taken back from the cash, and with its fee is deducted
+// from what is owed to the merchant, the fee being earned, in the currency of its order
+func ChargebackJournalEntry(chargeback Chargeback, currency string) JournalEntry {
+	entry := newJournalEntry(ChargebackJournalSource, chargeback.ID, chargeback.MerchantID, currency, "chargeback taken back by the card scheme")
+	entry.post(MerchantPayableAccount, chargeback.Amount+chargeback.Fee)
+	entry.post(CashAccount, -chargeback.Amount)
+	entry.post(FeeRevenueAccount, -chargeback.Fee)
+	return entry
+}
+
+// MonthlyFeeJournalEntry posts the minimum monthly fee correction charged on a daily disbursement, if any
+func MonthlyFeeJournalEntry(disbursement MerchantDisbursement) (JournalEntry, bool) {
+	entry := newJournalEntry(MonthlyFeeJournalSource, disbursement.ID.String(), disbursement.MerchantID, disbursement.Currency, "minimum monthly fee charged")
+	entry.post(MonthlyFeeReceivableAccount, disbursement.FeeAmountCorrection)
+	entry.post(FeeRevenueAccount, -disbursement.FeeAmountCorrection)
+	return entry, len(entry.Lines) > 0
+}
+
+// DisbursementJournalEntry posts a daily disbursement, if it moves any money: the merchant is paid its net amount,
+// and the minimum monthly fee charged is deducted from what is owed to it
+// The refunds, the chargebacks and the debt carried were deducted from what is owed when they were posted.
+func DisbursementJournalEntry(disbursement MerchantDisbursement) (JournalEntry, bool) {
+	entry := newJournalEntry(DisbursementJournalSource, disbursement.ID.String(), disbursement.MerchantID, disbursement.Currency, "disbursement "+disbursement.Reference)
+	entry.post(MerchantPayableAccount, disbursement.NetAmount+disbursement.FeeAmountCorrection)
+	entry.post(MonthlyFeeReceivableAccount, -disbursement.FeeAmountCorrection)
+	entry.post(CashAccount, -disbursement.NetAmount)
+	return entry, len(entry.Lines) > 0
+}
+
+// LedgerBalance is the balance of an account in a currency, its debits minus its credits,
+// or the reverse for the credit normal ones
+type LedgerBalance struct {
+	Currency string         `db:"currency"`
+	Account  LedgerAccounts `db:"account"`
+	Debits   float64        `db:"debits"`
+	Credits  float64        `db:"credits"`
+}
+
+// Balance returns the balance of the account on its normal side
+func (b LedgerBalance) Balance() float64 {
+	if b.Account.CreditNormal() {
+		return RoundAmount(b.Credits - b.Debits)
+	}
+	return RoundAmount(b.Debits - b.Credits)
+}
+
+// LedgerTotals are the sums of the operational tables, in a currency, the ledger balances are checked against
+type LedgerTotals struct {
+	Currency             string  `db:"currency"`
+	OrdersAmount         float64 `db:"orders_amount"`
+	OrdersFeeAmount      float64 `db:"orders_fee_amount"`
+	RefundsAmount        float64 `db:"refunds_amount"`
+	FeeReversalAmount    float64 `db:"fee_reversal_amount"`
+	ChargebacksAmount    float64 `db:"chargebacks_amount"`
+	ChargebackFeesAmount float64 `db:"chargeback_fees_amount"`
+	MonthlyFeesAmount    float64 `db:"monthly_fees_amount"` // Of the daily disbursements
+	DisbursementAmount   float64 `db:"disbursement_amount"` // Net amount of the daily disbursements
+	JournalEntries       int64   `db:"journal_entries"`     // Posted
+	ExpectedEntries      int64   `db:"expected_entries"`    // Orders, refunds, chargebacks, monthly fees and daily disbursements moving money
+	UnbalancedEntries    int64   `db:"unbalanced_entries"`  // Journal entries whose debits do not match their credits
+}
+
+// MerchantPayable compares what the ledger owes a merchant to what its pending orders, refunds and chargebacks,
+// and its balance add up to, in a currency
+type MerchantPayable struct {
+	MerchantID uuid.UUID `db:"merchant_id"`
+	Currency   string    `db:"currency"`
+	Ledger     float64   `db:"ledger"`
+	Expected   float64   `db:"expected"`
+}
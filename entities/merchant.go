@@ -23,6 +23,9 @@ type Merchant struct {
 	LiveAt                time.Time               `db:"live_at"`
 	DisbursementFrequency DisbursementFrequencies `db:"disbursement_frequency"`
 	MinimumMonthlyFee     float64                 `db:"minimum_monthly_fee"`
+	Currency              string                  `db:"currency"`       // Settlement currency, the one of its orders and disbursements
+	WebhookURL            string                  `db:"webhook_url"`    // Where the disbursement events are delivered, empty when not notified
+	WebhookSecret         string                  `db:"webhook_secret"` // Key of the HMAC signature of the deliveries
 	CreatedAt             time.Time               `db:"created_at"`
 	UpdatedAt             time.Time               `db:"updated_at"`
 }
@@ -0,0 +1,40 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BalanceEntryTypes represents the movements of the balance of a merchant.
+type BalanceEntryTypes string
+
+const (
+	EarnedBalanceEntry    BalanceEntryTypes = "earned"    // Result of a daily disbursement, negative when the refunds and fees exceed the orders
+	DisbursedBalanceEntry BalanceEntryTypes = "disbursed" // Net amount of a daily disbursement, owed to the merchant
+)
+
+// MerchantBalanceEntry represents the merchant_balance_entries table in the database.
+// The balance of a merchant in a currency is the sum of its entries in it. It is zero once its disbursements paid what it earned,
+// and negative while it owes the refunds and fees exceeding its orders, carried forward to its next disbursements.
+type MerchantBalanceEntry struct {
+	ID             uuid.UUID         `db:"id"`
+	MerchantID     uuid.UUID         `db:"merchant_id"`
+	Currency       string            `db:"currency"` // Currency of the disbursement posting the entry
+	DisbursementID uuid.UUID         `db:"disbursement_id"`
+	EntryType      BalanceEntryTypes `db:"entry_type"`
+	Amount         float64           `db:"amount"`
+	Balance        float64           `db:"balance"` // Balance of the merchant in the currency after the entry
+	CreatedAt      time.Time         `db:"created_at"`
+}
+
+// MerchantDebt is a merchant whose balance in a currency is negative, owing the amount to be deducted from its next disbursements
+// in that currency
+type MerchantDebt struct {
+	MerchantID  uuid.UUID `db:"merchant_id"`
+	Reference   string    `db:"reference"`
+	Amount      float64   `db:"amount"`   // Owed by the merchant, positive
+	Currency    string    `db:"currency"` // Currency of the balance
+	Since       time.Time `db:"since"`    // Since when the merchant owes, without its balance getting back to zero
+	LastEntryAt time.Time `db:"last_entry_at"`
+}
@@ -0,0 +1,57 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BankAccountStatuses represents the verification statuses of the bank accounts enum type.
+type BankAccountStatuses string
+
+const (
+	PendingBankAccountStatus  BankAccountStatuses = "pending"
+	VerifiedBankAccountStatus BankAccountStatuses = "verified"
+	RejectedBankAccountStatus BankAccountStatuses = "rejected"
+)
+
+// Changes recorded in the history of the bank accounts
+const (
+	BankAccountCreated  = "created"
+	BankAccountVerified = "verified"
+	BankAccountRejected = "rejected"
+	BankAccountClosed   = "closed"
+)
+
+// MerchantBankAccount represents the merchant_bank_accounts table in the database.
+// The disbursements are paid to the verified account of the merchant valid on the payout day.
+type MerchantBankAccount struct {
+	ID         uuid.UUID           `db:"id"`
+	MerchantID uuid.UUID           `db:"merchant_id"`
+	IBAN       string              `db:"iban"`
+	BIC        string              `db:"bic"` // Optional for SEPA transfers
+	HolderName string              `db:"holder_name"`
+	ValidFrom  time.Time           `db:"valid_from"`
+	ValidTo    *time.Time          `db:"valid_to"` // Last day the account is valid, nil while open
+	Status     BankAccountStatuses `db:"status"`
+	CreatedAt  time.Time           `db:"created_at"`
+	UpdatedAt  time.Time           `db:"updated_at"`
+}
+
+// ValidOn tells whether the account is within its validity period on the day
+func (a *MerchantBankAccount) ValidOn(day time.Time) bool {
+	return !day.Before(a.ValidFrom) && (a.ValidTo == nil || !day.After(*a.ValidTo))
+}
+
+// BankAccountChange represents the merchant_bank_account_changes table in the database.
+// It keeps the account as it was after each change.
+type BankAccountChange struct {
+	ID            uuid.UUID           `db:"id"`
+	BankAccountID uuid.UUID           `db:"bank_account_id"`
+	MerchantID    uuid.UUID           `db:"merchant_id"`
+	Change        string              `db:"change"`
+	Status        BankAccountStatuses `db:"status"`
+	ValidFrom     time.Time           `db:"valid_from"`
+	ValidTo       *time.Time          `db:"valid_to"`
+	ChangedAt     time.Time           `db:"changed_at"`
+}
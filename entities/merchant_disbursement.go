@@ -1,6 +1,9 @@
 package entities
 
 import (
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,14 +11,129 @@ import (
 
 // MerchantDisbursement represents the merchant_disbursements table in the database.
 type MerchantDisbursement struct {
-	ID                    uuid.UUID               `db:"id"`
-	MerchantID            uuid.UUID               `db:"merchant_id"`
-	DisbursementFrequency DisbursementFrequencies `db:"disbursement_frequency"`
-	OrdersStartAt         time.Time               `db:"orders_start_at"`
-	OrdersEndAt           time.Time               `db:"orders_end_at"`
-	FeeAmount             float64                 `db:"fee_amount"`
-	FeeAmountCorrection   float64                 `db:"fee_amount_correction"`
-	OrdersSumAmount       float64                 `db:"orders_sum_amount"`
-	OrdersTotalEntries    int                     `db:"orders_total_entries"`
-	CreatedAt             time.Time               `db:"created_at"`
+	ID                      uuid.UUID               `db:"id"`
+	Reference               string                  `db:"reference"`
+	MerchantID              uuid.UUID               `db:"merchant_id"`
+	Currency                string                  `db:"currency"` // Of all its amounts, disbursements are grouped by merchant and currency
+	DisbursementFrequency   DisbursementFrequencies `db:"disbursement_frequency"`
+	OrdersStartAt           time.Time               `db:"orders_start_at"`
+	OrdersEndAt             time.Time               `db:"orders_end_at"`
+	FeeAmount               float64                 `db:"fee_amount"`
+	FeeAmountCorrection     float64                 `db:"fee_amount_correction"`
+	OrdersSumAmount         float64                 `db:"orders_sum_amount"`
+	OrdersTotalEntries      int                     `db:"orders_total_entries"`
+	RefundsAmount           float64                 `db:"refunds_amount"` // Refunds deducted, see Refund
+	RefundsTotalEntries     int                     `db:"refunds_total_entries"`
+	FeeReversalAmount       float64                 `db:"fee_reversal_amount"` // Fees of the refunded orders given back
+	ChargebacksAmount       float64                 `db:"chargebacks_amount"`  // Chargebacks deducted, see Chargeback
+	ChargebacksTotalEntries int                     `db:"chargebacks_total_entries"`
+	ChargebackFeeAmount     float64                 `db:"chargeback_fee_amount"` // Fees of the chargebacks charged to the merchant
+	CarriedAmount           float64                 `db:"carried_amount"`        // Debt of the merchant brought in from its previous disbursements
+	CarryForwardAmount      float64                 `db:"carry_forward_amount"`  // Negative result carried to the next disbursement, see CarryBalance
+	NetAmount               float64                 `db:"net_amount"`            // Amount owed to the merchant, see CalculateNetAmount
+	BankAccountID           uuid.NullUUID           `db:"bank_account_id"`       // Account it is paid to, set when it is payable
+	Status                  DisbursementStatuses    `db:"status"`
+	ApprovedAt              *time.Time              `db:"approved_at"` // Last time it entered each status, nil if it never did
+	SentAt                  *time.Time              `db:"sent_at"`
+	SettledAt               *time.Time              `db:"settled_at"`
+	FailedAt                *time.Time              `db:"failed_at"`
+	ReturnedAt              *time.Time              `db:"returned_at"`
+	CreatedAt               time.Time               `db:"created_at"`
+	OrderIDs                []string                `db:"-"` // Orders summed by a daily disbursement, the ones marked as disbursed
+	RefundIDs               []string                `db:"-"` // Refunds summed by a daily disbursement, the ones marked as deducted
+	ChargebackIDs           []string                `db:"-"` // Chargebacks summed by a daily disbursement, the ones marked as deducted
+}
+
+// RoundAmount rounds an amount to cents, as stored in the DECIMAL(10,2) columns
+func RoundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// CalculateNetAmount rounds the amounts to cents and sets the net amount owed to the merchant:
+// the orders amount minus the order fees, the minimum monthly fee correction, the refunds, the chargebacks with their fees
+// and the debt carried in, plus the fees reversed for the refunds and the negative result carried forward.
+// The amounts are rounded first, so the net amount is exactly the one checked by the database.
+func (d *MerchantDisbursement) CalculateNetAmount() {
+	d.OrdersSumAmount = RoundAmount(d.OrdersSumAmount)
+	d.FeeAmount = RoundAmount(d.FeeAmount)
+	d.FeeAmountCorrection = RoundAmount(d.FeeAmountCorrection)
+	d.RefundsAmount = RoundAmount(d.RefundsAmount)
+	d.FeeReversalAmount = RoundAmount(d.FeeReversalAmount)
+	d.ChargebacksAmount = RoundAmount(d.ChargebacksAmount)
+	d.ChargebackFeeAmount = RoundAmount(d.ChargebackFeeAmount)
+	d.CarriedAmount = RoundAmount(d.CarriedAmount)
+	d.CarryForwardAmount = RoundAmount(d.CarryForwardAmount)
+	d.NetAmount = RoundAmount(d.Result() - d.CarriedAmount + d.CarryForwardAmount)
+}
+
+// Result is what the merchant earned in the disbursement before any balance is carried:
+// the orders amount minus the order fees, the minimum monthly fee correction, the refunds and the chargebacks
+// with their fees, plus the fees reversed.
+// It is negative when the refunds, chargebacks and fees exceed the orders.
+func (d *MerchantDisbursement) Result() float64 {
+	return RoundAmount(d.OrdersSumAmount - d.FeeAmount - d.FeeAmountCorrection - d.RefundsAmount + d.FeeReversalAmount -
+		d.ChargebacksAmount - d.ChargebackFeeAmount)
+}
+
+// CarryBalance applies the balance of the merchant before the disbursement, and calculates the net amount
+// A negative balance is a debt, carried in and deducted from the disbursement.
+// The disbursement never pays a negative net amount: what is still owed by the merchant is carried forward
+// to its next disbursement, and the net amount is zero.
+func (d *MerchantDisbursement) CarryBalance(balance float64) {
+	d.CarriedAmount = 0
+	d.CarryForwardAmount = 0
+	if balance < 0 {
+		d.CarriedAmount = -balance
+	}
+	d.CalculateNetAmount()
+
+	if d.NetAmount < 0 {
+		d.CarryForwardAmount = -d.NetAmount
+		d.CalculateNetAmount()
+	}
+}
+
+// BalanceEntries returns the entries the disbursement posts to the balance of its merchant in its currency:
+// its result earned by the merchant, then the net amount disbursed, if any
+// The balance after them is the amount carried forward, owed by the merchant.
+func (d *MerchantDisbursement) BalanceEntries() []MerchantBalanceEntry {
+	entries := []MerchantBalanceEntry{{
+		MerchantID:     d.MerchantID,
+		Currency:       d.Currency,
+		DisbursementID: d.ID,
+		EntryType:      EarnedBalanceEntry,
+		Amount:         d.Result(),
+		Balance:        RoundAmount(d.Result() - d.CarriedAmount),
+		CreatedAt:      d.CreatedAt,
+	}}
+	if d.NetAmount > 0 {
+		entries = append(entries, MerchantBalanceEntry{
+			MerchantID:     d.MerchantID,
+			Currency:       d.Currency,
+			DisbursementID: d.ID,
+			EntryType:      DisbursedBalanceEntry,
+			Amount:         -d.NetAmount,
+			Balance:        -d.CarryForwardAmount,
+			CreatedAt:      d.CreatedAt,
+		})
+	}
+	return entries
+}
+
+// NewDisbursementReference returns a unique reference for a disbursement, eg: DSB-20230115-1A2B3C4D
+// It starts with the first day of the orders, so references sort by period
+func NewDisbursementReference(ordersStartAt time.Time) string {
+	suffix := strings.ToUpper(strings.ReplaceAll(uuid.NewString(), "-", "")[:8])
+	return fmt.Sprintf("DSB-%s-%s", ordersStartAt.Format("20060102"), suffix)
+}
+
+// DisbursementFilter selects disbursements, zero values do not filter
+type DisbursementFilter struct {
+	MerchantID uuid.UUID
+	Frequency  DisbursementFrequencies
+	Status     DisbursementStatuses
+	From       time.Time // Disbursements with orders from this day, included
+	To         time.Time // Disbursements with orders until this day, included
+	Limit      int
+	Offset     int
 }
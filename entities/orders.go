@@ -11,6 +11,7 @@ type Order struct {
 	ID         string    `db:"id"`
 	MerchantID uuid.UUID `db:"merchant_id"`
 	Amount     float64   `db:"amount"`
+	Currency   string    `db:"currency"` // The settlement currency of the merchant
 	CreatedAt  time.Time `db:"created_at"`
 	Disbursed  bool      `db:"disbursed"`
 	FeeAmount  float64   `db:"fee_amount"`
@@ -0,0 +1,132 @@
+package entities
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OutboxStatuses represents the delivery statuses of the outbox events enum type.
+type OutboxStatuses string
+
+const (
+	PendingOutboxStatus   OutboxStatuses = "pending"   // Waiting for its next delivery attempt
+	DeliveredOutboxStatus OutboxStatuses = "delivered" // Accepted by the webhook of the merchant
+	DeadOutboxStatus      OutboxStatuses = "dead"      // Every delivery attempt failed, retried by hand
+	SkippedOutboxStatus   OutboxStatuses = "skipped"   // The merchant has no webhook
+)
+
+// OutboxStatusesList lists the delivery statuses
+var OutboxStatusesList = []OutboxStatuses{
+	PendingOutboxStatus,
+	DeliveredOutboxStatus,
+	DeadOutboxStatus,
+	SkippedOutboxStatus,
+}
+
+// Types of the events notified to the merchants
+const (
+	DisbursementCreatedEvent  = "disbursement.created"
+	DisbursementSentEvent     = "disbursement.sent"
+	DisbursementSettledEvent  = "disbursement.settled"
+	DisbursementFailedEvent   = "disbursement.failed"
+	DisbursementReturnedEvent = "disbursement.returned"
+)
+
+// StatusEventType returns the type of the event notifying a disbursement entering a status,
+// empty for the statuses internal to operations
+func StatusEventType(status DisbursementStatuses) string {
+	switch status {
+	case SentDisbursementStatus:
+		return DisbursementSentEvent
+	case SettledDisbursementStatus:
+		return DisbursementSettledEvent
+	case FailedDisbursementStatus:
+		return DisbursementFailedEvent
+	case ReturnedDisbursementStatus:
+		return DisbursementReturnedEvent
+	}
+	return ""
+}
+
+// OutboxEvent represents the outbox_events table in the database.
+// Events are written in the transaction changing the disbursement, and delivered afterwards to the webhook of the merchant.
+type OutboxEvent struct {
+	ID             uuid.UUID      `db:"id"`
+	EventType      string         `db:"event_type"`
+	DisbursementID uuid.UUID      `db:"disbursement_id"`
+	MerchantID     uuid.UUID      `db:"merchant_id"`
+	Payload        []byte         `db:"payload"` // JSON of the DisbursementEventData
+	Status         OutboxStatuses `db:"status"`
+	Attempts       int            `db:"attempts"`
+	NextAttemptAt  time.Time      `db:"next_attempt_at"`
+	LastError      string         `db:"last_error"`
+	CreatedAt      time.Time      `db:"created_at"`
+	DeliveredAt    *time.Time     `db:"delivered_at"`
+}
+
+// DisbursementEventData is the disbursement as notified to the merchant when the event happened
+type DisbursementEventData struct {
+	Reference         string    `json:"reference"`
+	Frequency         string    `json:"frequency"`
+	Currency          string    `json:"currency"`
+	OrdersStartAt     string    `json:"orders_start_at"`
+	OrdersEndAt       string    `json:"orders_end_at"`
+	OrdersAmount      float64   `json:"orders_amount"`
+	Fees              float64   `json:"fees"`
+	FeeCorrection     float64   `json:"fee_correction"`
+	RefundsAmount     float64   `json:"refunds_amount"`
+	FeeReversal       float64   `json:"fee_reversal"`
+	ChargebacksAmount float64   `json:"chargebacks_amount"`
+	ChargebackFees    float64   `json:"chargeback_fees"`
+	CarriedAmount     float64   `json:"carried_amount"`
+	CarryForward      float64   `json:"carry_forward_amount"`
+	NetAmount         float64   `json:"net_amount"`
+	Status            string    `json:"status"`
+	PreviousStatus    string    `json:"previous_status,omitempty"`
+	StatusChangedAt   time.Time `json:"status_changed_at"`
+}
+
+// NewDisbursementEvent builds the outbox event of a disbursement, pending delivery
+// The previous status is empty for the creation of the disbursement.
+func NewDisbursementEvent(eventType string, disbursement MerchantDisbursement, previous DisbursementStatuses) (OutboxEvent, error) {
+	payload, err := json.Marshal(DisbursementEventData{
+		Reference:         disbursement.Reference,
+		Frequency:         string(disbursement.DisbursementFrequency),
+		Currency:          disbursement.Currency,
+		OrdersStartAt:     disbursement.OrdersStartAt.Format(time.DateOnly),
+		OrdersEndAt:       disbursement.OrdersEndAt.Format(time.DateOnly),
+		OrdersAmount:      disbursement.OrdersSumAmount,
+		Fees:              disbursement.FeeAmount,
+		FeeCorrection:     disbursement.FeeAmountCorrection,
+		RefundsAmount:     disbursement.RefundsAmount,
+		FeeReversal:       disbursement.FeeReversalAmount,
+		ChargebacksAmount: disbursement.ChargebacksAmount,
+		ChargebackFees:    disbursement.ChargebackFeeAmount,
+		CarriedAmount:     disbursement.CarriedAmount,
+		CarryForward:      disbursement.CarryForwardAmount,
+		NetAmount:         disbursement.NetAmount,
+		Status:            string(disbursement.Status),
+		PreviousStatus:    string(previous),
+		StatusChangedAt:   disbursement.StatusChangedAt().UTC(),
+	})
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+
+	return OutboxEvent{
+		EventType:      eventType,
+		DisbursementID: disbursement.ID,
+		MerchantID:     disbursement.MerchantID,
+		Payload:        payload,
+		Status:         PendingOutboxStatus,
+	}, nil
+}
+
+// OutboxFilter selects the outbox events, latest first, zero values do not filter
+type OutboxFilter struct {
+	Status     OutboxStatuses
+	MerchantID uuid.UUID
+	Limit      int
+}
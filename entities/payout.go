@@ -0,0 +1,48 @@
+package entities
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PayoutBatch represents the payout_batches table in the database.
+// It is a payout file sent to the bank, paying a set of disbursements.
+type PayoutBatch struct {
+	ID            uuid.UUID `db:"id"`
+	MessageID     string    `db:"message_id"`
+	ExecutionDate time.Time `db:"execution_date"`
+	PaymentsCount int       `db:"payments_count"`
+	ControlSum    float64   `db:"control_sum"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
+// PayoutInstruction represents the payout_instructions table in the database.
+// It links a disbursement to the credit transfer paying it.
+type PayoutInstruction struct {
+	ID             uuid.UUID `db:"id"`
+	BatchID        uuid.UUID `db:"batch_id"`
+	DisbursementID uuid.UUID `db:"disbursement_id"`
+	EndToEndID     string    `db:"end_to_end_id"`
+	Amount         float64   `db:"amount"`
+	IBAN           string    `db:"iban"`
+	BIC            string    `db:"bic"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+// PayableDisbursement is a disbursement not paid yet, with the bank account it is paid to
+type PayableDisbursement struct {
+	MerchantDisbursement
+	MerchantReference string `db:"merchant_reference"`
+	IBAN              string `db:"iban"`
+	BIC               string `db:"bic"`
+	HolderName        string `db:"holder_name"`
+}
+
+// NewPayoutMessageID generates the identifier of a payout file, like PAY-20230115-1A2B3C4D
+func NewPayoutMessageID(executionDate time.Time) string {
+	suffix := strings.ToUpper(strings.ReplaceAll(uuid.NewString(), "-", "")[:8])
+	return fmt.Sprintf("PAY-%s-%s", executionDate.Format("20060102"), suffix)
+}
@@ -0,0 +1,34 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FeeReversals represents the rules giving back the fee of a refunded order.
+type FeeReversals string
+
+const (
+	ProportionalFeeReversal FeeReversals = "proportional" // The part of the order fee of the amount refunded
+	NoFeeReversal           FeeReversals = "none"         // The order fee is kept
+)
+
+// FeeReversalsList lists the fee reversal rules
+var FeeReversalsList = []FeeReversals{
+	ProportionalFeeReversal,
+	NoFeeReversal,
+}
+
+// Refund represents the refunds table in the database.
+// A refund gives back all or part of an order to the shopper, and is deducted from the next daily disbursement
+// of the merchant, whether the order was already disbursed or not.
+type Refund struct {
+	ID          string     `db:"id"`
+	OrderID     string     `db:"order_id"`
+	MerchantID  uuid.UUID  `db:"merchant_id"`
+	Amount      float64    `db:"amount"`
+	FeeReversal float64    `db:"fee_reversal"` // Part of the order fee given back to the merchant
+	CreatedAt   time.Time  `db:"created_at"`
+	DeductedOn  *time.Time `db:"deducted_on"` // Day of the daily disbursement it is deducted from, nil until processed
+}
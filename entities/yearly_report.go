@@ -0,0 +1,12 @@
+package entities
+
+// YearlyReport sums the disbursements and fees of a year, in one currency.
+type YearlyReport struct {
+	Year              int     `db:"year"`
+	Currency          string  `db:"currency"`
+	Disbursements     int64   `db:"disbursements"`       // Disbursements paid with the frequency of their merchant
+	AmountDisbursed   float64 `db:"amount_disbursed"`    // Orders amount minus the order fees, monthly fees, refunds and chargebacks, plus the fees reversed
+	OrderFees         float64 `db:"order_fees"`          // Fees of the orders
+	MonthlyFees       int64   `db:"monthly_fees"`        // Minimum monthly fee corrections charged
+	MonthlyFeesAmount float64 `db:"monthly_fees_amount"` // Amount of the minimum monthly fee corrections
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/ildomm/cc_sq_disbursement/database"
 	"github.com/ildomm/cc_sq_disbursement/entities"
 	"github.com/ildomm/cc_sq_disbursement/system"
+	"log/slog"
 	"math"
 	"time"
 )
@@ -32,36 +33,105 @@ const (
 
 // FeeCalculator is the struct that calculates the fee amount for an order and disbursement.
 type FeeCalculator struct {
-	ctx     context.Context
-	querier database.Querier
+	ctx           context.Context
+	querier       database.Querier
+	tiers         []system.FeeTier
+	currencyTiers map[string][]system.FeeTier // Of the currencies priced with their own tiers
+	feeReversal   entities.FeeReversals
+	chargebackFee float64
+	logger        *slog.Logger
 }
 
 func NewFeeCalculator(ctx context.Context, querier database.Querier) *FeeCalculator {
+	return NewFeeCalculatorWithTiers(ctx, querier, nil)
+}
+
+// NewFeeCalculatorWithTiers creates a calculator with a configured pricing
+// The tiers must be sorted by MinAmount, the built-in pricing is used when there are none
+func NewFeeCalculatorWithTiers(ctx context.Context, querier database.Querier, tiers []system.FeeTier) *FeeCalculator {
+	return NewFeeCalculatorWithConfig(ctx, querier, system.FeesConfig{Tiers: tiers})
+}
+
+// NewFeeCalculatorWithConfig creates a calculator with the pricing, the refund fee reversal and the chargeback fee of the config
+// The fees of the refunded orders are reversed proportionally when no rule is configured.
+// The orders in a currency without its own tiers are priced with the tiers of the config, or the built-in pricing.
+func NewFeeCalculatorWithConfig(ctx context.Context, querier database.Querier, cfg system.FeesConfig) *FeeCalculator {
+	tiers := cfg.Tiers
+	if len(tiers) == 0 {
+		tiers = DefaultFeeTiers()
+	}
+	feeReversal := cfg.RefundFeeReversal
+	if feeReversal == "" {
+		feeReversal = entities.ProportionalFeeReversal
+	}
+
 	calculator := FeeCalculator{
-		ctx:     ctx,
-		querier: querier,
+		ctx:           ctx,
+		querier:       querier,
+		tiers:         tiers,
+		currencyTiers: cfg.CurrencyTiers,
+		feeReversal:   feeReversal,
+		chargebackFee: cfg.ChargebackFee,
+		logger:        system.ComponentLogger("fee_calculator"),
 	}
 
 	return &calculator
 }
 
-// CalculateFeeAmount calculates the fee amount based on the order amount and fee percentages.
-func (fc FeeCalculator) CalculateFeeAmount(amount float64) (feeAmount float64) {
-	switch {
-	case amount < AmountThreshold1:
-		feeAmount = amount * FeePercentage1
-	case amount >= AmountThreshold2 && amount <= AmountThreshold3:
-		feeAmount = amount * FeePercentage2
-	case amount > AmountThreshold3:
-		feeAmount = amount * FeePercentage3
+// SetLogger replaces the logger, so the records carry the fields of the caller, like its run ID
+func (fc *FeeCalculator) SetLogger(logger *slog.Logger) {
+	fc.logger = logger
+}
+
+// DefaultFeeTiers returns the built-in pricing
+func DefaultFeeTiers() []system.FeeTier {
+	return []system.FeeTier{
+		{MinAmount: 0, Percentage: FeePercentage1},
+		{MinAmount: AmountThreshold2, Percentage: FeePercentage2},
+		{MinAmount: AmountThreshold3, Percentage: FeePercentage3},
+	}
+}
+
+// CalculateFeeAmount calculates the fee amount based on the order amount, in its currency, and fee percentages.
+// The percentage applied is the one of the last tier of the currency starting at or below the amount.
+func (fc FeeCalculator) CalculateFeeAmount(amount float64, currency string) (feeAmount float64) {
+	tiers, ok := fc.currencyTiers[currency]
+	if !ok {
+		tiers = fc.tiers
+	}
+	for _, tier := range tiers {
+		if amount >= tier.MinAmount {
+			feeAmount = amount * tier.Percentage
+		}
 	}
 	// Round the fee amount to two decimal places
 	return math.Round(feeAmount*100) / 100
 }
 
+// CalculateFeeReversal calculates the part of the order fee given back to the merchant for a refund
+// With the proportional rule it is the fee of the amount refunded, and the refund completing a full refund
+// gives back what is left of the fee, so the reversals of an order sum exactly its fee.
+// refunded and reversed are the amount and fee reversal of the previous refunds of the order.
+func (fc FeeCalculator) CalculateFeeReversal(order entities.Order, amount, refunded, reversed float64) float64 {
+	if fc.feeReversal == entities.NoFeeReversal || order.Amount <= 0 {
+		return 0
+	}
+
+	if entities.RoundAmount(refunded+amount) >= entities.RoundAmount(order.Amount) {
+		return math.Max(entities.RoundAmount(order.FeeAmount-reversed), 0)
+	}
+	return entities.RoundAmount(order.FeeAmount * amount / order.Amount)
+}
+
+// CalculateChargebackFee returns the fee charged to the merchant for a chargeback, whatever its amount
+func (fc FeeCalculator) CalculateChargebackFee() float64 {
+	return entities.RoundAmount(fc.chargebackFee)
+}
+
 // CalculateFeeAmountCorrection calculates the fee amount correction for the disbursement
 // It is calculated by comparing the fee amount for the last month with the minimum monthly fee
 // Only the first disbursement of the month is corrected, and if the minimum monthly fee is greater than the fee amount
+// The minimum monthly fee is in the settlement currency of the merchant, only the disbursements in it are corrected.
 func (fc *FeeCalculator) CalculateFeeAmountCorrection(day time.Time, disbursement entities.MerchantDisbursement) (float64, error) {
 	// Check if it is the first disbursement for the merchant in this month
 	if day.Day() != 1 {
@@ -71,6 +141,7 @@ func (fc *FeeCalculator) CalculateFeeAmountCorrection(day time.Time, disbursemen
 	// Get the disbursement for the last month
 	lastMonthDisbursement, err := fc.querier.SelectSumDisbursementsForMerchant(fc.ctx,
 		disbursement.MerchantID,
+		disbursement.Currency,
 		system.FirstDayOfLastMonth(day),
 		system.LastDayOfLastMonth(day),
 		entities.MonthlyDisbursementFrequency)
@@ -88,10 +159,21 @@ func (fc *FeeCalculator) CalculateFeeAmountCorrection(day time.Time, disbursemen
 	if err != nil {
 		return 0, err
 	}
+	if merchant.Currency != disbursement.Currency {
+		return 0, nil
+	}
 
-	// Check if the fee amount needs to be corrected
-	if merchant.MinimumMonthlyFee > lastMonthDisbursement.FeeAmount {
-		return merchant.MinimumMonthlyFee - lastMonthDisbursement.FeeAmount, nil
+	// Check if the fee amount needs to be corrected, the fees reversed for refunds were not earned
+	feeAmount := lastMonthDisbursement.FeeAmount - lastMonthDisbursement.FeeReversalAmount
+	if merchant.MinimumMonthlyFee > feeAmount {
+		correction := merchant.MinimumMonthlyFee - feeAmount
+		fc.logger.Debug("minimum monthly fee not reached",
+			system.LogMerchantIDKey, disbursement.MerchantID,
+			system.LogDayKey, day.Format(time.DateOnly),
+			"minimum_monthly_fee", merchant.MinimumMonthlyFee,
+			"last_month_fee_amount", feeAmount,
+			"fee_amount_correction", correction)
+		return correction, nil
 	}
 
 	return 0, nil
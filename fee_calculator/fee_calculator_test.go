@@ -2,12 +2,14 @@ package fee_calculator
 
 import (
 	"context"
+	"github.com/google/uuid"
 	"github.com/ildomm/cc_sq_disbursement/test_helpers"
 	"github.com/stretchr/testify/mock"
 	"testing"
 	"time"
 
 	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/system"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,12 +29,75 @@ func TestCalculateFeeAmount(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
-			result := calculator.CalculateFeeAmount(test.amount)
+			result := calculator.CalculateFeeAmount(test.amount, entities.DefaultCurrency)
 			assert.Equal(t, test.expectedFee, result, "Fee calculation mismatch")
 		})
 	}
 }
 
+func TestCalculateFeeAmountWithTiers(t *testing.T) {
+	mockQuerier := test_helpers.NewMockQuerier()
+
+	t.Run("DefaultTiersBoundaries", func(t *testing.T) {
+		calculator := NewFeeCalculator(context.Background(), mockQuerier)
+		assert.Equal(t, 0.5, calculator.CalculateFeeAmount(49.99, entities.DefaultCurrency))
+		assert.Equal(t, 0.48, calculator.CalculateFeeAmount(50.0, entities.DefaultCurrency))
+		assert.Equal(t, 2.55, calculator.CalculateFeeAmount(300.0, entities.DefaultCurrency))
+	})
+
+	t.Run("ConfiguredTiers", func(t *testing.T) {
+		tiers := []system.FeeTier{{MinAmount: 0, Percentage: 0.02}, {MinAmount: 100, Percentage: 0.01}}
+		calculator := NewFeeCalculatorWithTiers(context.Background(), mockQuerier, tiers)
+		assert.Equal(t, 1.98, calculator.CalculateFeeAmount(99.0, entities.DefaultCurrency))
+		assert.Equal(t, 1.0, calculator.CalculateFeeAmount(100.0, entities.DefaultCurrency))
+	})
+
+	t.Run("CurrencyTiers", func(t *testing.T) {
+		calculator := NewFeeCalculatorWithConfig(context.Background(), mockQuerier, system.FeesConfig{
+			CurrencyTiers: map[string][]system.FeeTier{"JPY": {{MinAmount: 0, Percentage: 0.01}, {MinAmount: 10000, Percentage: 0.008}}},
+		})
+		assert.Equal(t, 99.0, calculator.CalculateFeeAmount(9900.0, "JPY"))
+		assert.Equal(t, 80.0, calculator.CalculateFeeAmount(10000.0, "JPY"))
+
+		// A currency without its own tiers is priced with the default ones
+		assert.Equal(t, 0.48, calculator.CalculateFeeAmount(50.0, "GBP"))
+	})
+}
+
+func TestCalculateFeeReversal(t *testing.T) {
+	mockQuerier := test_helpers.NewMockQuerier()
+	order := entities.Order{ID: "order-1", Amount: 100, FeeAmount: 0.95}
+
+	t.Run("Proportional", func(t *testing.T) {
+		calculator := NewFeeCalculator(context.Background(), mockQuerier)
+		assert.Equal(t, 0.95, calculator.CalculateFeeReversal(order, 100, 0, 0))
+		assert.Equal(t, 0.31, calculator.CalculateFeeReversal(order, 33, 0, 0))
+
+		// The refund completing a full refund gives back what is left of the fee, whatever the rounding
+		assert.Equal(t, 0.31, calculator.CalculateFeeReversal(order, 33, 33, 0.31))
+		assert.Equal(t, 0.33, calculator.CalculateFeeReversal(order, 34, 66, 0.62))
+	})
+
+	t.Run("None", func(t *testing.T) {
+		calculator := NewFeeCalculatorWithConfig(context.Background(), mockQuerier, system.FeesConfig{RefundFeeReversal: entities.NoFeeReversal})
+		assert.Equal(t, 0.0, calculator.CalculateFeeReversal(order, 100, 0, 0))
+		assert.Equal(t, 0.48, calculator.CalculateFeeAmount(50.0, entities.DefaultCurrency))
+	})
+}
+
+func TestCalculateChargebackFee(t *testing.T) {
+	mockQuerier := test_helpers.NewMockQuerier()
+
+	calculator := NewFeeCalculatorWithConfig(context.Background(), mockQuerier, system.DefaultConfig().Fees)
+	assert.Equal(t, system.DefaultChargebackFee, calculator.CalculateChargebackFee())
+
+	calculator = NewFeeCalculatorWithConfig(context.Background(), mockQuerier, system.FeesConfig{ChargebackFee: 12.345})
+	assert.Equal(t, 12.35, calculator.CalculateChargebackFee())
+
+	calculator = NewFeeCalculatorWithConfig(context.Background(), mockQuerier, system.FeesConfig{})
+	assert.Equal(t, 0.0, calculator.CalculateChargebackFee())
+}
+
 func TestCalculateFeeAmountCorrection(t *testing.T) {
 	mockQuerier := test_helpers.NewMockQuerier()
 	mockQuerier.On("SelectSumDisbursementsForMerchant", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
@@ -101,6 +166,17 @@ func TestCalculateFeeAmountCorrectionWithLastMonthPresent(t *testing.T) {
 			"First disbursement of the month, with last month disbursement present"},
 	}
 
+	// The fees reversed for the refunds of last month do not count towards the minimum monthly fee
+	reversed := test_helpers.NewMockQuerier()
+	reversed.On("SelectSumDisbursementsForMerchant", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(&entities.MerchantDisbursement{FeeAmount: 12, FeeReversalAmount: 4}, nil)
+	reversed.On("SelectMerchant", mock.Anything, mock.Anything).Return(&entities.Merchant{MinimumMonthlyFee: 10}, nil)
+
+	correction, err := NewFeeCalculator(context.Background(), reversed).
+		CalculateFeeAmountCorrection(time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC), entities.MerchantDisbursement{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, correction)
+
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
 			result, err := calculator.CalculateFeeAmountCorrection(test.day, test.disbursement)
@@ -113,3 +189,52 @@ func TestCalculateFeeAmountCorrectionWithLastMonthPresent(t *testing.T) {
 		})
 	}
 }
+
+func TestCalculateFeeAmountCorrectionLogsMerchant(t *testing.T) {
+	merchantID := uuid.New()
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumDisbursementsForMerchant", mock.Anything, merchantID, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(&entities.MerchantDisbursement{FeeAmount: 4}, nil)
+	mockQuerier.On("SelectMerchant", mock.Anything, merchantID).
+		Return(&entities.Merchant{MinimumMonthlyFee: 10}, nil)
+
+	mockLog := test_helpers.NewLogMocker()
+	calculator := NewFeeCalculator(context.Background(), mockQuerier)
+	calculator.SetLogger(mockLog.Logger().With("run_id", "test-run"))
+
+	day := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+	result, err := calculator.CalculateFeeAmountCorrection(day, entities.MerchantDisbursement{MerchantID: merchantID})
+	assert.NoError(t, err)
+	assert.Equal(t, 6.0, result)
+
+	mockLog.AssertRecord(t, "minimum monthly fee not reached", map[string]any{
+		"run_id":                "test-run",
+		"merchant_id":           merchantID,
+		"day":                   "2022-02-01",
+		"fee_amount_correction": 6,
+	})
+}
+
+func TestCalculateFeeAmountCorrectionInSettlementCurrency(t *testing.T) {
+	merchantID := uuid.New()
+	day := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumDisbursementsForMerchant", mock.Anything, merchantID, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(&entities.MerchantDisbursement{FeeAmount: 4}, nil)
+	mockQuerier.On("SelectMerchant", mock.Anything, merchantID).
+		Return(&entities.Merchant{MinimumMonthlyFee: 10, Currency: "GBP"}, nil)
+
+	calculator := NewFeeCalculator(context.Background(), mockQuerier)
+
+	result, err := calculator.CalculateFeeAmountCorrection(day, entities.MerchantDisbursement{MerchantID: merchantID, Currency: "GBP"})
+	assert.NoError(t, err)
+	assert.Equal(t, 6.0, result)
+	mockQuerier.AssertCalled(t, "SelectSumDisbursementsForMerchant", mock.Anything, merchantID, "GBP", mock.Anything, mock.Anything, entities.MonthlyDisbursementFrequency)
+
+	// A disbursement in a previous currency of the merchant, like the refunds of its older orders, is not charged the minimum monthly fee
+	result, err = calculator.CalculateFeeAmountCorrection(day, entities.MerchantDisbursement{MerchantID: merchantID, Currency: "EUR"})
+	assert.NoError(t, err)
+	assert.Zero(t, result)
+}
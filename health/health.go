@@ -0,0 +1,161 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+
+	// DefaultTimeout bounds the time given to each check
+	DefaultTimeout = 2 * time.Second
+)
+
+// Check verifies a dependency of the service
+// It returns details to report, like counters, even when failing
+type Check func(ctx context.Context) (map[string]any, error)
+
+// CheckResult is the outcome of a check, as reported by the endpoints
+type CheckResult struct {
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Report is the body of the health endpoints
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Handler runs its checks on every request
+// It responds 200 when all of them pass, 503 otherwise
+type Handler struct {
+	checks  map[string]Check
+	Timeout time.Duration // Time given to each check. This is exported so it can be overridden
+}
+
+func NewHandler() *Handler {
+	return &Handler{
+		checks:  make(map[string]Check),
+		Timeout: DefaultTimeout,
+	}
+}
+
+// Add registers a check, replacing any other with the same name
+func (h *Handler) Add(name string, check Check) *Handler {
+	h.checks[name] = check
+	return h
+}
+
+// Run runs all the checks
+func (h *Handler) Run(ctx context.Context) Report {
+	report := Report{
+		Status: StatusOK,
+		Checks: make(map[string]CheckResult, len(h.checks)),
+	}
+
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		result := h.runCheck(ctx, h.checks[name])
+		if result.Status != StatusOK {
+			report.Status = StatusFailing
+		}
+		report.Checks[name] = result
+	}
+
+	return report
+}
+
+func (h *Handler) runCheck(ctx context.Context, check Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	details, err := check(ctx)
+	if err != nil {
+		return CheckResult{Status: StatusFailing, Error: err.Error(), Details: details}
+	}
+	return CheckResult{Status: StatusOK, Details: details}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := h.Run(r.Context())
+
+	code := http.StatusOK
+	if report.Status != StatusOK {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Pinger is implemented by database.Querier
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// DatabaseCheck checks the database is reachable
+func DatabaseCheck(db Pinger) Check {
+	return func(ctx context.Context) (map[string]any, error) {
+		err := db.Ping(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("database ping failed: %w", err)
+		}
+		return nil, nil
+	}
+}
+
+// Loader is implemented by the order_load pipeline
+type Loader interface {
+	LastIteration() time.Time
+	PendingFiles() (int, error)
+}
+
+var ErrorLoaderStalled = errors.New("loader has not iterated in time")
+
+// LoaderCheck checks the loader loop iterated within maxAge
+// It fails when the loader is stuck, so it is meant for liveness
+func LoaderCheck(loader Loader, maxAge time.Duration) Check {
+	return func(ctx context.Context) (map[string]any, error) {
+		last := loader.LastIteration()
+		details := map[string]any{"last_iteration": last.UTC().Format(time.RFC3339)}
+
+		if time.Since(last) > maxAge {
+			return details, fmt.Errorf("%w: last iteration %s ago, expected within %s",
+				ErrorLoaderStalled, time.Since(last).Round(time.Second), maxAge)
+		}
+		return details, nil
+	}
+}
+
+// WaitingFolderCheck checks the orders waiting folder is readable and reports its pending files
+func WaitingFolderCheck(loader Loader) Check {
+	return func(ctx context.Context) (map[string]any, error) {
+		pending, err := loader.PendingFiles()
+		if err != nil {
+			return nil, fmt.Errorf("waiting folder is not readable: %w", err)
+		}
+		return map[string]any{"pending_files": pending}, nil
+	}
+}
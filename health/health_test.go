@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLoader struct {
+	lastIteration time.Time
+	pending       int
+	err           error
+}
+
+func (l fakeLoader) LastIteration() time.Time {
+	return l.lastIteration
+}
+
+func (l fakeLoader) PendingFiles() (int, error) {
+	return l.pending, l.err
+}
+
+func serve(t *testing.T, handler http.Handler, method string) (int, Report) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, "/readyz", nil))
+
+	var report Report
+	if recorder.Code != http.StatusMethodNotAllowed {
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	}
+	return recorder.Code, report
+}
+
+func TestHandler(t *testing.T) {
+	t.Run("AllChecksPass", func(t *testing.T) {
+		mockQuerier := test_helpers.NewMockQuerier()
+		mockQuerier.On("Ping", mock.Anything).Return(nil)
+
+		handler := NewHandler().
+			Add("database", DatabaseCheck(mockQuerier)).
+			Add("waiting_folder", WaitingFolderCheck(fakeLoader{pending: 3}))
+
+		code, report := serve(t, handler, http.MethodGet)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, StatusOK, report.Status)
+		require.Equal(t, StatusOK, report.Checks["database"].Status)
+		require.Equal(t, float64(3), report.Checks["waiting_folder"].Details["pending_files"])
+		mockQuerier.AssertExpectations(t)
+	})
+
+	t.Run("CheckFails", func(t *testing.T) {
+		mockQuerier := test_helpers.NewMockQuerier()
+		mockQuerier.On("Ping", mock.Anything).Return(errors.New("connection refused"))
+
+		handler := NewHandler().
+			Add("database", DatabaseCheck(mockQuerier)).
+			Add("waiting_folder", WaitingFolderCheck(fakeLoader{err: errors.New("permission denied")}))
+
+		code, report := serve(t, handler, http.MethodGet)
+		require.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, StatusFailing, report.Status)
+		require.Equal(t, "database ping failed: connection refused", report.Checks["database"].Error)
+		require.Equal(t, "waiting folder is not readable: permission denied", report.Checks["waiting_folder"].Error)
+	})
+
+	t.Run("NoChecks", func(t *testing.T) {
+		code, report := serve(t, NewHandler(), http.MethodGet)
+		require.Equal(t, http.StatusOK, code)
+		require.Empty(t, report.Checks)
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		code, _ := serve(t, NewHandler(), http.MethodPost)
+		require.Equal(t, http.StatusMethodNotAllowed, code)
+	})
+
+	t.Run("CheckTimesOut", func(t *testing.T) {
+		handler := NewHandler().Add("slow", func(ctx context.Context) (map[string]any, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		handler.Timeout = 10 * time.Millisecond
+
+		report := handler.Run(context.Background())
+		require.Equal(t, StatusFailing, report.Status)
+		require.Equal(t, context.DeadlineExceeded.Error(), report.Checks["slow"].Error)
+	})
+}
+
+func TestLoaderCheck(t *testing.T) {
+	ctx := context.Background()
+
+	details, err := LoaderCheck(fakeLoader{lastIteration: time.Now().Add(-time.Minute)}, 5*time.Minute)(ctx)
+	require.NoError(t, err)
+	require.Contains(t, details, "last_iteration")
+
+	_, err = LoaderCheck(fakeLoader{lastIteration: time.Now().Add(-time.Hour)}, 5*time.Minute)(ctx)
+	require.ErrorIs(t, err, ErrorLoaderStalled)
+}
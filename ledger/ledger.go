@@ -0,0 +1,192 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/report"
+)
+
+// ErrorInvariantViolated is returned when the ledger does not match the operational tables
+var ErrorInvariantViolated = errors.New("ledger invariant violated")
+
+// Invariant is a property the ledger must hold, comparing what it records to what is expected
+type Invariant struct {
+	Name     string
+	Currency string // Of the amounts or entries compared, empty for the merchant payables counted in every currency
+	Expected float64
+	Actual   float64
+	Count    bool // Counts entries or merchants, instead of an amount
+}
+
+// Holds tells if the ledger records what is expected, to the cent
+func (i Invariant) Holds() bool {
+	return entities.RoundAmount(i.Expected) == entities.RoundAmount(i.Actual)
+}
+
+// Report is the result of checking the invariants of the ledger
+type Report struct {
+	Invariants []Invariant
+}
+
+func (r *Report) add(name, currency string, expected, actual float64) {
+	r.Invariants = append(r.Invariants, Invariant{Name: name, Currency: currency, Expected: expected, Actual: actual})
+}
+
+func (r *Report) addCount(name, currency string, expected, actual int64) {
+	r.Invariants = append(r.Invariants, Invariant{Name: name, Currency: currency, Expected: float64(expected), Actual: float64(actual), Count: true})
+}
+
+// Violations returns the invariants which do not hold
+func (r *Report) Violations() []Invariant {
+	var violations []Invariant
+	for _, invariant := range r.Invariants {
+		if !invariant.Holds() {
+			violations = append(violations, invariant)
+		}
+	}
+	return violations
+}
+
+// Err returns an ErrorInvariantViolated when any invariant does not hold
+func (r *Report) Err() error {
+	violations := r.Violations()
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d of %d invariants, first %s", ErrorInvariantViolated, len(violations), len(r.Invariants), violations[0].Name)
+}
+
+// Table builds the report of the invariants, with the result of each: ok or violated
+func (r *Report) Table() *report.Table {
+	table := report.NewTable("invariant", "currency", "expected", "actual", "result")
+	for _, invariant := range r.Invariants {
+		result := "ok"
+		if !invariant.Holds() {
+			result = "violated"
+		}
+		if invariant.Count {
+			table.AddRow(invariant.Name, invariant.Currency, int64(invariant.Expected), int64(invariant.Actual), result)
+			continue
+		}
+		table.AddRow(invariant.Name, invariant.Currency, invariant.Expected, invariant.Actual, result)
+	}
+	return table
+}
+
+// Check verifies the ledger against the operational tables, in each currency, as amounts in different currencies
+// do not add up:
+//   - every money movement posted one entry, and every entry balances
+//   - the debits of all the accounts match their credits
+//   - cash holds what the orders brought in, less the refunds, the chargebacks and the daily disbursements
+//   - the fee revenue holds the order fees, less the fee reversals, plus the chargeback fees and the minimum monthly fees
+//   - the monthly fees receivable were all deducted from the disbursements they were charged on
+//   - the merchant payable holds what the merchants earned and were not paid, in total and for each merchant
+func Check(ctx context.Context, querier database.Querier) (*Report, error) {
+	totals, err := querier.SelectLedgerTotals(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting the ledger totals: %w", err)
+	}
+
+	accounts, err := querier.SelectLedgerBalances(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting the ledger balances: %w", err)
+	}
+	type currencyBalances struct {
+		accounts        map[entities.LedgerAccounts]float64
+		debits, credits float64
+	}
+	balances := make(map[string]*currencyBalances)
+	for _, account := range accounts {
+		currency, ok := balances[account.Currency]
+		if !ok {
+			currency = &currencyBalances{accounts: make(map[entities.LedgerAccounts]float64)}
+			balances[account.Currency] = currency
+		}
+		currency.accounts[account.Account] = account.Balance()
+		currency.debits += account.Debits
+		currency.credits += account.Credits
+	}
+
+	payables, err := querier.SelectMerchantPayables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting the merchant payables: %w", err)
+	}
+
+	result := &Report{}
+	for _, total := range totals {
+		currency := total.Currency
+		balance, ok := balances[currency]
+		if !ok {
+			balance = &currencyBalances{accounts: map[entities.LedgerAccounts]float64{}}
+		}
+
+		result.addCount("journal_entries", currency, total.ExpectedEntries, total.JournalEntries)
+		result.addCount("unbalanced_entries", currency, 0, total.UnbalancedEntries)
+		result.add("trial_balance", currency, balance.debits, balance.credits)
+		result.add(string(entities.CashAccount), currency,
+			total.OrdersAmount-total.RefundsAmount-total.ChargebacksAmount-total.DisbursementAmount,
+			balance.accounts[entities.CashAccount])
+		result.add(string(entities.FeeRevenueAccount), currency,
+			total.OrdersFeeAmount-total.FeeReversalAmount+total.ChargebackFeesAmount+total.MonthlyFeesAmount,
+			balance.accounts[entities.FeeRevenueAccount])
+		result.add(string(entities.MonthlyFeeReceivableAccount), currency, 0, balance.accounts[entities.MonthlyFeeReceivableAccount])
+		result.add(string(entities.MerchantPayableAccount), currency,
+			total.OrdersAmount-total.OrdersFeeAmount-total.RefundsAmount+total.FeeReversalAmount-
+				total.ChargebacksAmount-total.ChargebackFeesAmount-total.MonthlyFeesAmount-total.DisbursementAmount,
+			balance.accounts[entities.MerchantPayableAccount])
+	}
+
+	// Only the merchants whose payable does not match are listed, next to the count of those matching
+	var matching int64
+	for _, payable := range payables {
+		invariant := Invariant{
+			Name:     fmt.Sprintf("merchant_payable %s", payable.MerchantID),
+			Currency: payable.Currency,
+			Expected: payable.Expected,
+			Actual:   payable.Ledger,
+		}
+		if invariant.Holds() {
+			matching++
+			continue
+		}
+		result.Invariants = append(result.Invariants, invariant)
+	}
+	result.addCount("merchant_payables", "", int64(len(payables)), matching)
+
+	return result, nil
+}
+
+// BalancesTable builds the trial balance of the ledger, with the debits, credits and balance of every account
+// in each currency of the ledger, or in the default currency while it is empty
+func BalancesTable(balances []entities.LedgerBalance) *report.Table {
+	type accountKey struct {
+		currency string
+		account  entities.LedgerAccounts
+	}
+	var currencies []string
+	byAccount := make(map[accountKey]entities.LedgerBalance, len(balances))
+	for _, balance := range balances {
+		if !slices.Contains(currencies, balance.Currency) {
+			currencies = append(currencies, balance.Currency)
+		}
+		byAccount[accountKey{balance.Currency, balance.Account}] = balance
+	}
+	if len(currencies) == 0 {
+		currencies = []string{entities.DefaultCurrency}
+	}
+
+	table := report.NewTable("currency", "account", "debits", "credits", "balance")
+	for _, currency := range currencies {
+		for _, account := range entities.LedgerAccountsList {
+			balance := byAccount[accountKey{currency, account}]
+			balance.Account = account
+			table.AddRow(currency, string(account), balance.Debits, balance.Credits, balance.Balance())
+		}
+	}
+	return table
+}
@@ -0,0 +1,222 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/report"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalEntriesBalance(t *testing.T) {
+	merchantID := uuid.New()
+	disbursement := entities.MerchantDisbursement{
+		ID:                  uuid.New(),
+		MerchantID:          merchantID,
+		Currency:            "GBP",
+		OrdersSumAmount:     100,
+		FeeAmount:           0.95,
+		FeeAmountCorrection: 5.3,
+		RefundsAmount:       20,
+		FeeReversalAmount:   0.19,
+	}
+	disbursement.CarryBalance(-10)
+
+	monthlyFee, ok := entities.MonthlyFeeJournalEntry(disbursement)
+	require.True(t, ok)
+	disbursed, ok := entities.DisbursementJournalEntry(disbursement)
+	require.True(t, ok)
+
+	for _, entry := range []entities.JournalEntry{
+		entities.OrderJournalEntry(entities.Order{ID: "order-1", MerchantID: merchantID, Currency: "GBP", Amount: 100.333, FeeAmount: 0.95}),
+		entities.RefundJournalEntry(entities.Refund{ID: "refund-1", MerchantID: merchantID, Amount: 20, FeeReversal: 0.19}, "GBP"),
+		entities.ChargebackJournalEntry(entities.Chargeback{ID: "chargeback-1", MerchantID: merchantID, Amount: 30, Fee: 15}, "GBP"),
+		monthlyFee,
+		disbursed,
+	} {
+		require.NoError(t, entry.Validate(), entry.Source)
+		require.Equal(t, merchantID, entry.MerchantID)
+		require.Equal(t, "GBP", entry.Currency, entry.Source)
+	}
+
+	// The payable is debited by the net amount paid and the monthly fee deducted
+	require.Equal(t, []entities.JournalLine{
+		{Account: entities.MerchantPayableAccount, Debit: 69.24},
+		{Account: entities.MonthlyFeeReceivableAccount, Credit: 5.3},
+		{Account: entities.CashAccount, Credit: 63.94},
+	}, disbursed.Lines)
+
+	// Nothing moves without a net amount nor a monthly fee
+	_, ok = entities.MonthlyFeeJournalEntry(entities.MerchantDisbursement{})
+	require.False(t, ok)
+	_, ok = entities.DisbursementJournalEntry(entities.MerchantDisbursement{})
+	require.False(t, ok)
+
+	unbalanced := entities.OrderJournalEntry(entities.Order{ID: "order-2", Amount: 100, FeeAmount: 0.95})
+	unbalanced.Lines = unbalanced.Lines[1:]
+	require.ErrorIs(t, unbalanced.Validate(), entities.ErrorUnbalancedEntry)
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+
+	// Orders of 300 with 3 of fees, a refund of 20 giving back 0.2, a chargeback of 30 with a fee of 15,
+	// a monthly fee of 5 and 200 disbursed, in euros, and an order of 50 with 0.5 of fees in pounds
+	totals := []entities.LedgerTotals{
+		{
+			Currency:             "EUR",
+			OrdersAmount:         300,
+			OrdersFeeAmount:      3,
+			RefundsAmount:        20,
+			FeeReversalAmount:    0.2,
+			ChargebacksAmount:    30,
+			ChargebackFeesAmount: 15,
+			MonthlyFeesAmount:    5,
+			DisbursementAmount:   200,
+			JournalEntries:       7,
+			ExpectedEntries:      7,
+		},
+		{Currency: "GBP", OrdersAmount: 50, OrdersFeeAmount: 0.5, JournalEntries: 1, ExpectedEntries: 1},
+	}
+	balances := []entities.LedgerBalance{
+		{Currency: "EUR", Account: entities.CashAccount, Debits: 300, Credits: 250},
+		{Currency: "EUR", Account: entities.MerchantPayableAccount, Debits: 269.8, Credits: 297},
+		{Currency: "EUR", Account: entities.FeeRevenueAccount, Debits: 0.2, Credits: 23},
+		{Currency: "EUR", Account: entities.MonthlyFeeReceivableAccount, Debits: 5, Credits: 5},
+		{Currency: "GBP", Account: entities.CashAccount, Debits: 50},
+		{Currency: "GBP", Account: entities.MerchantPayableAccount, Credits: 49.5},
+		{Currency: "GBP", Account: entities.FeeRevenueAccount, Credits: 0.5},
+	}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectLedgerTotals", ctx).Return(totals, nil)
+	mockQuerier.On("SelectLedgerBalances", ctx).Return(balances, nil)
+	mockQuerier.On("SelectMerchantPayables", ctx).Return([]entities.MerchantPayable{
+		{MerchantID: merchantID, Currency: "EUR", Ledger: 27.2, Expected: 27.2},
+		{MerchantID: merchantID, Currency: "GBP", Ledger: 49.5, Expected: 49.5},
+	}, nil)
+
+	result, err := Check(ctx, mockQuerier)
+	require.NoError(t, err)
+	require.Empty(t, result.Violations())
+	require.NoError(t, result.Err())
+
+	var buf bytes.Buffer
+	require.NoError(t, report.Write(&buf, report.CSVFormat, result.Table()))
+	require.Contains(t, buf.String(), "journal_entries,EUR,7,7,ok\n")
+	require.Contains(t, buf.String(), "cash,EUR,50.00,50.00,ok\n")
+	require.Contains(t, buf.String(), "fee_revenue,EUR,22.80,22.80,ok\n")
+	require.Contains(t, buf.String(), "merchant_payable,EUR,27.20,27.20,ok\n")
+	require.Contains(t, buf.String(), "cash,GBP,50.00,50.00,ok\n")
+	require.Contains(t, buf.String(), "merchant_payable,GBP,49.50,49.50,ok\n")
+	require.Contains(t, buf.String(), "merchant_payables,,2,2,ok\n")
+}
+
+func TestCheckPerCurrency(t *testing.T) {
+	ctx := context.Background()
+
+	// An order of 100 in pounds was posted in euros: the totals of every currency match, not the ones of each
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectLedgerTotals", ctx).Return([]entities.LedgerTotals{
+		{Currency: "EUR", JournalEntries: 1},
+		{Currency: "GBP", OrdersAmount: 100, OrdersFeeAmount: 1, ExpectedEntries: 1},
+	}, nil)
+	mockQuerier.On("SelectLedgerBalances", ctx).Return([]entities.LedgerBalance{
+		{Currency: "EUR", Account: entities.CashAccount, Debits: 100},
+		{Currency: "EUR", Account: entities.MerchantPayableAccount, Credits: 99},
+		{Currency: "EUR", Account: entities.FeeRevenueAccount, Credits: 1},
+	}, nil)
+	mockQuerier.On("SelectMerchantPayables", ctx)
+
+	result, err := Check(ctx, mockQuerier)
+	require.NoError(t, err)
+	require.ErrorIs(t, result.Err(), ErrorInvariantViolated)
+
+	var violated []string
+	for _, invariant := range result.Violations() {
+		violated = append(violated, invariant.Name+" "+invariant.Currency)
+	}
+	require.Equal(t, []string{
+		"journal_entries EUR",
+		"cash EUR",
+		"fee_revenue EUR",
+		"merchant_payable EUR",
+		"journal_entries GBP",
+		"cash GBP",
+		"fee_revenue GBP",
+		"merchant_payable GBP",
+	}, violated)
+}
+
+func TestCheckViolations(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+
+	// An order of 100 was never posted
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectLedgerTotals", ctx).Return([]entities.LedgerTotals{
+		{Currency: "EUR", OrdersAmount: 100, OrdersFeeAmount: 1, ExpectedEntries: 1},
+	}, nil)
+	mockQuerier.On("SelectLedgerBalances", ctx).Return([]entities.LedgerBalance{}, nil)
+	mockQuerier.On("SelectMerchantPayables", ctx).Return([]entities.MerchantPayable{
+		{MerchantID: merchantID, Currency: "EUR", Ledger: 0, Expected: 99},
+	}, nil)
+
+	result, err := Check(ctx, mockQuerier)
+	require.NoError(t, err)
+	require.ErrorIs(t, result.Err(), ErrorInvariantViolated)
+
+	var names []string
+	for _, invariant := range result.Violations() {
+		names = append(names, invariant.Name)
+	}
+	require.Equal(t, []string{
+		"journal_entries",
+		"cash",
+		"fee_revenue",
+		"merchant_payable",
+		"merchant_payable " + merchantID.String(),
+		"merchant_payables",
+	}, names)
+
+	// Failing to read the ledger is not a violation
+	mockQuerier = test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectLedgerTotals", ctx).Return(nil, errors.New("connection refused"))
+	_, err = Check(ctx, mockQuerier)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrorInvariantViolated)
+}
+
+func TestBalancesTable(t *testing.T) {
+	var buf bytes.Buffer
+	err := report.Write(&buf, report.CSVFormat, BalancesTable([]entities.LedgerBalance{
+		{Currency: "EUR", Account: entities.FeeRevenueAccount, Debits: 0.2, Credits: 8},
+		{Currency: "EUR", Account: entities.CashAccount, Debits: 300, Credits: 220},
+		{Currency: "GBP", Account: entities.CashAccount, Debits: 50},
+	}))
+	require.NoError(t, err)
+
+	expected := "" +
+		"currency,account,debits,credits,balance\n" +
+		"EUR,cash,300.00,220.00,80.00\n" +
+		"EUR,merchant_payable,0.00,0.00,0.00\n" +
+		"EUR,fee_revenue,0.20,8.00,7.80\n" +
+		"EUR,monthly_fee_receivable,0.00,0.00,0.00\n" +
+		"GBP,cash,50.00,0.00,50.00\n" +
+		"GBP,merchant_payable,0.00,0.00,0.00\n" +
+		"GBP,fee_revenue,0.00,0.00,0.00\n" +
+		"GBP,monthly_fee_receivable,0.00,0.00,0.00\n"
+	require.Equal(t, expected, buf.String())
+
+	// An empty ledger shows the accounts in the default currency
+	buf.Reset()
+	err = report.Write(&buf, report.CSVFormat, BalancesTable(nil))
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "EUR,cash,0.00,0.00,0.00\n")
+}
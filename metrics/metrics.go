@@ -0,0 +1,302 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const namespace = "disbursement"
+
+// Results of the files and rows imported by the loader, and of the processor runs
+const (
+	ResultImported  = "imported"
+	ResultFailed    = "failed"
+	ResultRejected  = "rejected"
+	ResultDuplicate = "duplicate"
+	ResultSuccess   = "success"
+)
+
+// Registry holds the metrics of the loader, the API and the processor, plus the Go runtime and process ones
+var Registry = prometheus.NewRegistry()
+
+var (
+	FilesImported = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "loader",
+		Name:      "files_total",
+		Help:      "Orders, refunds and chargebacks CSV files processed by the loader, by result: imported or failed.",
+	}, []string{"result"})
+
+	RowsImported = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "loader",
+		Name:      "rows_total",
+		Help:      "Orders CSV rows processed by the loader, by result: imported, duplicate or rejected.",
+	}, []string{"result"})
+
+	ImportDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "loader",
+		Name:      "import_duration_seconds",
+		Help:      "Time taken to import an orders, refunds or chargebacks CSV file, by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"result"})
+
+	RefundRowsImported = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "loader",
+		Name:      "refund_rows_total",
+		Help:      "Refunds CSV rows processed by the loader, by result: imported, duplicate or rejected.",
+	}, []string{"result"})
+
+	ChargebackRowsImported = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "loader",
+		Name:      "chargeback_rows_total",
+		Help:      "Chargebacks CSV rows processed by the loader, by result: imported, duplicate or rejected.",
+	}, []string{"result"})
+
+	OrdersReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "orders_total",
+		Help:      "Orders received by the API, by result: imported, duplicate or rejected.",
+	}, []string{"result"})
+
+	RefundsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "refunds_total",
+		Help:      "Refunds received by the API, by result: imported, duplicate or rejected.",
+	}, []string{"result"})
+
+	ChargebacksReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "chargebacks_total",
+		Help:      "Chargebacks received by the API, by result: imported, duplicate or rejected.",
+	}, []string{"result"})
+
+	LoaderLastIteration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "loader",
+		Name:      "last_iteration_timestamp_seconds",
+		Help:      "Time of the last iteration of the loader job.",
+	})
+
+	DisbursementsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "disbursements_total",
+		Help:      "Disbursements created by the processor, by frequency.",
+	}, []string{"frequency"})
+
+	OrdersAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "orders_amount_total",
+		Help:      "Amount of the orders included in the daily disbursements, by currency.",
+	}, []string{"currency"})
+
+	FeesAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "fees_amount_total",
+		Help:      "Fees of the orders included in the daily disbursements, by currency.",
+	}, []string{"currency"})
+
+	FeeCorrectionsAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "fee_corrections_amount_total",
+		Help:      "Minimum monthly fee corrections charged in the daily disbursements, by currency.",
+	}, []string{"currency"})
+
+	RefundsAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "refunds_amount_total",
+		Help:      "Refunds deducted in the daily disbursements, by currency.",
+	}, []string{"currency"})
+
+	FeeReversalsAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "fee_reversals_amount_total",
+		Help:      "Fees of the refunded orders given back in the daily disbursements, by currency.",
+	}, []string{"currency"})
+
+	ChargebacksAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "chargebacks_amount_total",
+		Help:      "Chargebacks deducted in the daily disbursements, by currency.",
+	}, []string{"currency"})
+
+	ChargebackFeesAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "chargeback_fees_amount_total",
+		Help:      "Fees of the chargebacks charged in the daily disbursements, by currency.",
+	}, []string{"currency"})
+
+	CarriedAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "carried_amount_total",
+		Help:      "Debts of the merchants deducted from the daily disbursements, by currency.",
+	}, []string{"currency"})
+
+	CarryForwardAmount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "carry_forward_amount_total",
+		Help:      "Negative results of the daily disbursements carried forward to the next ones, by currency.",
+	}, []string{"currency"})
+
+	RunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "run_duration_seconds",
+		Help:      "Time taken to process the orders of a day, by result: success or failed.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"result"})
+
+	LastProcessedDay = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "processor",
+		Name:      "last_success_day_timestamp_seconds",
+		Help:      "Day of the orders processed by the last successful run, as a Unix timestamp.",
+	})
+
+	StatusChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "payout",
+		Name:      "status_changes_total",
+		Help:      "Disbursement status changes, by the status entered: approved, sent, settled, failed or returned.",
+	}, []string{"status"})
+
+	ReconciledEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "reconciliation",
+		Name:      "entries_total",
+		Help:      "Debits of the bank statements reconciled, by result: matched, already_settled, unmatched or mismatched.",
+	}, []string{"result"})
+
+	WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhooks",
+		Name:      "deliveries_total",
+		Help:      "Outbox events processed by the webhooks dispatcher, by result: delivered, retried, dead or skipped.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		FilesImported,
+		RowsImported,
+		RefundRowsImported,
+		ChargebackRowsImported,
+		ImportDuration,
+		LoaderLastIteration,
+		OrdersReceived,
+		RefundsReceived,
+		ChargebacksReceived,
+		DisbursementsCreated,
+		OrdersAmount,
+		FeesAmount,
+		FeeCorrectionsAmount,
+		RefundsAmount,
+		FeeReversalsAmount,
+		ChargebacksAmount,
+		ChargebackFeesAmount,
+		CarriedAmount,
+		CarryForwardAmount,
+		RunDuration,
+		LastProcessedDay,
+		StatusChanges,
+		ReconciledEntries,
+		WebhookDeliveries,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Push sends the metrics to a Prometheus Pushgateway, replacing the ones of the previous push of the job
+func Push(ctx context.Context, url, job string) error {
+	return push.New(url, job).Gatherer(Registry).PushContext(ctx)
+}
+
+// ObserveFileImport records an orders, refunds or chargebacks file processed by the loader
+func ObserveFileImport(started time.Time, err error) {
+	result := ResultImported
+	if err != nil {
+		result = ResultFailed
+	}
+	FilesImported.WithLabelValues(result).Inc()
+	ImportDuration.WithLabelValues(result).Observe(time.Since(started).Seconds())
+}
+
+// ObserveDisbursement records a disbursement created by the processor
+// Amounts are only added for the daily disbursements, as the weekly and monthly ones sum them
+func ObserveDisbursement(disbursement entities.MerchantDisbursement, frequency entities.DisbursementFrequencies) {
+	DisbursementsCreated.WithLabelValues(string(frequency)).Inc()
+	if frequency != entities.DailyDisbursementFrequency {
+		return
+	}
+	addAmount(OrdersAmount.WithLabelValues(disbursement.Currency), disbursement.OrdersSumAmount)
+	addAmount(FeesAmount.WithLabelValues(disbursement.Currency), disbursement.FeeAmount)
+	addAmount(FeeCorrectionsAmount.WithLabelValues(disbursement.Currency), disbursement.FeeAmountCorrection)
+	addAmount(RefundsAmount.WithLabelValues(disbursement.Currency), disbursement.RefundsAmount)
+	addAmount(FeeReversalsAmount.WithLabelValues(disbursement.Currency), disbursement.FeeReversalAmount)
+	addAmount(ChargebacksAmount.WithLabelValues(disbursement.Currency), disbursement.ChargebacksAmount)
+	addAmount(ChargebackFeesAmount.WithLabelValues(disbursement.Currency), disbursement.ChargebackFeeAmount)
+	addAmount(CarriedAmount.WithLabelValues(disbursement.Currency), disbursement.CarriedAmount)
+	addAmount(CarryForwardAmount.WithLabelValues(disbursement.Currency), disbursement.CarryForwardAmount)
+}
+
+// addAmount adds an amount to a counter, which can only increase
+func addAmount(counter prometheus.Counter, amount float64) {
+	if amount > 0 {
+		counter.Add(amount)
+	}
+}
+
+// ObserveRun records a processor run for a day
+func ObserveRun(day, started time.Time, err error) {
+	result := ResultSuccess
+	if err != nil {
+		result = ResultFailed
+	}
+	RunDuration.WithLabelValues(result).Observe(time.Since(started).Seconds())
+	if err == nil {
+		LastProcessedDay.Set(float64(day.Unix()))
+	}
+}
+
+// ObserveStatusChange records a disbursement entering a status
+func ObserveStatusChange(status entities.DisbursementStatuses) {
+	StatusChanges.WithLabelValues(string(status)).Inc()
+}
+
+// ObserveReconciliation records a debit of a bank statement reconciled with the disbursements
+func ObserveReconciliation(result entities.ReconciliationResults) {
+	ReconciledEntries.WithLabelValues(string(result)).Inc()
+}
+
+// ObserveWebhookDelivery records an outbox event processed by the webhooks dispatcher
+func ObserveWebhookDelivery(result string) {
+	WebhookDeliveries.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveFileImport(t *testing.T) {
+	imported := testutil.ToFloat64(FilesImported.WithLabelValues(ResultImported))
+	failed := testutil.ToFloat64(FilesImported.WithLabelValues(ResultFailed))
+
+	ObserveFileImport(time.Now(), nil)
+	ObserveFileImport(time.Now(), nil)
+	ObserveFileImport(time.Now(), errors.New("invalid CSV format"))
+
+	require.Equal(t, imported+2, testutil.ToFloat64(FilesImported.WithLabelValues(ResultImported)))
+	require.Equal(t, failed+1, testutil.ToFloat64(FilesImported.WithLabelValues(ResultFailed)))
+	require.Equal(t, 2, testutil.CollectAndCount(ImportDuration))
+}
+
+func TestObserveDisbursement(t *testing.T) {
+	daily := testutil.ToFloat64(DisbursementsCreated.WithLabelValues(string(entities.DailyDisbursementFrequency)))
+	weekly := testutil.ToFloat64(DisbursementsCreated.WithLabelValues(string(entities.WeeklyDisbursementFrequency)))
+	amount := testutil.ToFloat64(OrdersAmount.WithLabelValues("EUR"))
+	fees := testutil.ToFloat64(FeesAmount.WithLabelValues("EUR"))
+	corrections := testutil.ToFloat64(FeeCorrectionsAmount.WithLabelValues("EUR"))
+	refunds := testutil.ToFloat64(RefundsAmount.WithLabelValues("EUR"))
+	reversals := testutil.ToFloat64(FeeReversalsAmount.WithLabelValues("EUR"))
+	chargebacks := testutil.ToFloat64(ChargebacksAmount.WithLabelValues("EUR"))
+	chargebackFees := testutil.ToFloat64(ChargebackFeesAmount.WithLabelValues("EUR"))
+
+	otherCurrency := testutil.ToFloat64(OrdersAmount.WithLabelValues("GBP"))
+
+	disbursement := entities.MerchantDisbursement{Currency: "EUR", OrdersSumAmount: 100, FeeAmount: 0.95, FeeAmountCorrection: 5, RefundsAmount: 20, FeeReversalAmount: 0.19,
+		ChargebacksAmount: 30, ChargebackFeeAmount: 15}
+	ObserveDisbursement(disbursement, entities.DailyDisbursementFrequency)
+
+	// Weekly disbursements sum the daily ones, so their amounts are not added again
+	ObserveDisbursement(disbursement, entities.WeeklyDisbursementFrequency)
+
+	require.Equal(t, daily+1, testutil.ToFloat64(DisbursementsCreated.WithLabelValues(string(entities.DailyDisbursementFrequency))))
+	require.Equal(t, weekly+1, testutil.ToFloat64(DisbursementsCreated.WithLabelValues(string(entities.WeeklyDisbursementFrequency))))
+	require.InDelta(t, amount+100, testutil.ToFloat64(OrdersAmount.WithLabelValues("EUR")), 0.001)
+	require.InDelta(t, fees+0.95, testutil.ToFloat64(FeesAmount.WithLabelValues("EUR")), 0.001)
+	require.InDelta(t, corrections+5, testutil.ToFloat64(FeeCorrectionsAmount.WithLabelValues("EUR")), 0.001)
+	require.InDelta(t, refunds+20, testutil.ToFloat64(RefundsAmount.WithLabelValues("EUR")), 0.001)
+	require.InDelta(t, reversals+0.19, testutil.ToFloat64(FeeReversalsAmount.WithLabelValues("EUR")), 0.001)
+	require.InDelta(t, chargebacks+30, testutil.ToFloat64(ChargebacksAmount.WithLabelValues("EUR")), 0.001)
+	require.InDelta(t, chargebackFees+15, testutil.ToFloat64(ChargebackFeesAmount.WithLabelValues("EUR")), 0.001)
+	require.Equal(t, otherCurrency, testutil.ToFloat64(OrdersAmount.WithLabelValues("GBP")))
+}
+
+func TestObserveRun(t *testing.T) {
+	day := time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)
+
+	ObserveRun(day, time.Now(), nil)
+	require.Equal(t, float64(day.Unix()), testutil.ToFloat64(LastProcessedDay))
+
+	// A failed run keeps the last successful day
+	ObserveRun(day.AddDate(0, 0, 1), time.Now(), errors.New("database error"))
+	require.Equal(t, float64(day.Unix()), testutil.ToFloat64(LastProcessedDay))
+}
+
+func TestHandler(t *testing.T) {
+	ObserveFileImport(time.Now(), nil)
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Contains(t, recorder.Body.String(), `disbursement_loader_files_total{result="imported"}`)
+	require.Contains(t, recorder.Body.String(), "disbursement_processor_last_success_day_timestamp_seconds")
+	require.Contains(t, recorder.Body.String(), "go_goroutines")
+}
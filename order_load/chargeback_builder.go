@@ -0,0 +1,108 @@
+package order_load
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+)
+
+// ErrorInvalidChargeback wraps the errors of the chargebacks which cannot be imported as given
+var ErrorInvalidChargeback = errors.New("invalid chargeback")
+
+var csvChargebackHeaderInfo = []string{"id", "order_id", "amount", "created_at", "reason"}
+
+// NewChargeback is a chargeback as received, from a CSV record or the API
+type NewChargeback struct {
+	ID        string
+	OrderID   string
+	Amount    float64 // Zero charges back what is left of the order
+	CreatedAt string  // Day of the chargeback, like 2023-01-31
+	Reason    string
+}
+
+// ChargebackBuilder validates the new chargebacks and charges their fee
+// It is shared by the CSV loader and the API, so both import the same chargebacks
+type ChargebackBuilder struct {
+	querier database.Querier
+	feeCalc *fee_calculator.FeeCalculator
+}
+
+func NewChargebackBuilder(querier database.Querier, feeCalc *fee_calculator.FeeCalculator) *ChargebackBuilder {
+	return &ChargebackBuilder{
+		querier: querier,
+		feeCalc: feeCalc,
+	}
+}
+
+// ParseChargebackRecord reads a new chargeback from a CSV record
+// An empty amount charges back the whole order. Will return an error if the amount is not a valid float
+func ParseChargebackRecord(record []string) (NewChargeback, error) {
+	if len(record) != len(csvChargebackHeaderInfo) {
+		return NewChargeback{}, fmt.Errorf("%w: expected %d fields, got %d", ErrorInvalidChargeback, len(csvChargebackHeaderInfo), len(record))
+	}
+
+	var amount float64
+	if record[2] != "" {
+		var err error
+		amount, err = strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return NewChargeback{}, fmt.Errorf("%w: error converting amount to float: %v", ErrorInvalidChargeback, err)
+		}
+	}
+
+	return NewChargeback{
+		ID:        record[0],
+		OrderID:   record[1],
+		Amount:    amount,
+		CreatedAt: record[3],
+		Reason:    record[4],
+	}, nil
+}
+
+// Build builds a chargeback of an order and charges its fee
+// will return an ErrorInvalidChargeback if the id is empty, the amount is negative, the created_at is not a valid date,
+// the order doesn't exist or is newer than the chargeback, or the chargeback exceeds what is left of the order
+// once refunded and charged back
+func (b *ChargebackBuilder) Build(ctx context.Context, newChargeback NewChargeback) (*entities.Chargeback, error) {
+	if newChargeback.ID == "" {
+		return nil, fmt.Errorf("%w: missing id", ErrorInvalidChargeback)
+	}
+
+	if newChargeback.Amount < 0 || math.IsInf(newChargeback.Amount, 0) || math.IsNaN(newChargeback.Amount) {
+		return nil, fmt.Errorf("%w: amount must be positive, got %v", ErrorInvalidChargeback, newChargeback.Amount)
+	}
+
+	createdAt, err := time.Parse(time.DateOnly, newChargeback.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error parsing created_at: %v", ErrorInvalidChargeback, err)
+	}
+
+	left, err := selectOrderLeft(ctx, b.querier, newChargeback.OrderID, createdAt, ErrorInvalidChargeback)
+	if err != nil {
+		return nil, err
+	}
+	order := left.order
+
+	// The refunds and the previous chargebacks of the order limit the amount left to charge back
+	amount, err := left.take(newChargeback.Amount, "charge back", ErrorInvalidChargeback)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities.Chargeback{
+		ID:         newChargeback.ID,
+		OrderID:    order.ID,
+		MerchantID: order.MerchantID,
+		Amount:     amount,
+		Fee:        b.feeCalc.CalculateChargebackFee(),
+		Reason:     newChargeback.Reason,
+		CreatedAt:  createdAt,
+	}, nil
+}
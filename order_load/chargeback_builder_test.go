@@ -0,0 +1,92 @@
+package order_load
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChargebackRecord(t *testing.T) {
+	newChargeback, err := ParseChargebackRecord([]string{"cb-1", "e653f3e14bc4", "20.50", "2023-02-03", "fraud"})
+	require.NoError(t, err)
+	require.Equal(t, NewChargeback{ID: "cb-1", OrderID: "e653f3e14bc4", Amount: 20.5, CreatedAt: "2023-02-03", Reason: "fraud"}, newChargeback)
+
+	// An empty amount charges back the whole order
+	newChargeback, err = ParseChargebackRecord([]string{"cb-1", "e653f3e14bc4", "", "2023-02-03", ""})
+	require.NoError(t, err)
+	require.Zero(t, newChargeback.Amount)
+
+	_, err = ParseChargebackRecord([]string{"cb-1", "e653f3e14bc4", "20,50", "2023-02-03", ""})
+	require.ErrorIs(t, err, ErrorInvalidChargeback)
+	require.ErrorContains(t, err, "error converting amount to float")
+
+	_, err = ParseChargebackRecord([]string{"cb-1", "e653f3e14bc4", "20.50", "2023-02-03"})
+	require.ErrorIs(t, err, ErrorInvalidChargeback)
+}
+
+func TestChargebackBuilderBuild(t *testing.T) {
+	ctx := context.Background()
+	order := entities.Order{
+		ID:         "e653f3e14bc4",
+		MerchantID: test_helpers.SetupMerchantTemplate().ID,
+		Amount:     100,
+		FeeAmount:  0.95,
+		CreatedAt:  time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectOrder", ctx, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectOrder", ctx, "unknown").Return(nil, nil)
+	mockQuerier.On("SelectOrder", ctx, "failing").Return(nil, errors.New("connection refused"))
+	mockQuerier.On("SelectOrderRefunds", ctx, order.ID).Return([]entities.Refund{{ID: "r-0", OrderID: order.ID, Amount: 40}}, nil)
+	mockQuerier.On("SelectOrderChargebacks", ctx, order.ID).Return([]entities.Chargeback{{ID: "cb-0", OrderID: order.ID, Amount: 20}}, nil)
+
+	fees := system.DefaultConfig().Fees
+	fees.ChargebackFee = 12.5
+	builder := NewChargebackBuilder(mockQuerier, fee_calculator.NewFeeCalculatorWithConfig(ctx, mockQuerier, fees))
+
+	chargeback, err := builder.Build(ctx, NewChargeback{ID: "cb-1", OrderID: order.ID, Amount: 25, CreatedAt: "2023-02-10", Reason: "fraud"})
+	require.NoError(t, err)
+	require.Equal(t, order.MerchantID, chargeback.MerchantID)
+	require.Equal(t, "2023-02-10", chargeback.CreatedAt.Format(time.DateOnly))
+	require.Equal(t, 25.0, chargeback.Amount)
+	require.Equal(t, 12.5, chargeback.Fee)
+	require.Equal(t, "fraud", chargeback.Reason)
+	require.Nil(t, chargeback.DeductedOn)
+
+	// Without an amount, what is left once refunded and charged back is charged back, for the same fee
+	chargeback, err = builder.Build(ctx, NewChargeback{ID: "cb-1", OrderID: order.ID, CreatedAt: "2023-02-10"})
+	require.NoError(t, err)
+	require.Equal(t, 40.0, chargeback.Amount)
+	require.Equal(t, 12.5, chargeback.Fee)
+
+	for name, test := range map[string]struct {
+		newChargeback NewChargeback
+		expected      string
+	}{
+		"MissingID":      {NewChargeback{OrderID: order.ID, Amount: 20, CreatedAt: "2023-02-10"}, "missing id"},
+		"NegativeAmount": {NewChargeback{ID: "cb-1", OrderID: order.ID, Amount: -5, CreatedAt: "2023-02-10"}, "amount must be positive"},
+		"InvalidDate":    {NewChargeback{ID: "cb-1", OrderID: order.ID, Amount: 20, CreatedAt: "10/02/2023"}, "error parsing created_at"},
+		"UnknownOrder":   {NewChargeback{ID: "cb-1", OrderID: "unknown", Amount: 20, CreatedAt: "2023-02-10"}, `unknown order "unknown"`},
+		"BeforeOrder":    {NewChargeback{ID: "cb-1", OrderID: order.ID, Amount: 20, CreatedAt: "2023-01-31"}, "created before its order"},
+		"ExceedsOrder":   {NewChargeback{ID: "cb-1", OrderID: order.ID, Amount: 40.01, CreatedAt: "2023-02-10"}, "exceeds the 40.00 left to charge back"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := builder.Build(ctx, test.newChargeback)
+			require.ErrorIs(t, err, ErrorInvalidChargeback)
+			require.ErrorContains(t, err, test.expected)
+		})
+	}
+
+	// Failing to look up the order does not make the chargeback invalid
+	_, err = builder.Build(ctx, NewChargeback{ID: "cb-1", OrderID: "failing", Amount: 20, CreatedAt: "2023-02-10"})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrorInvalidChargeback)
+}
@@ -0,0 +1,115 @@
+package order_load
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+)
+
+// ErrorInvalidOrder wraps the errors of the orders which cannot be imported as given
+var ErrorInvalidOrder = errors.New("invalid order")
+
+// NewOrder is an order as received, from a CSV record or the API
+type NewOrder struct {
+	ID                string
+	MerchantReference string
+	Amount            float64
+	CreatedAt         string // Day of the order, like 2023-01-31
+	Currency          string // Code of the currency of the amount, in euros when empty
+}
+
+// OrderBuilder validates the new orders and calculates their fees
+// It is shared by the CSV loader and the API, so both import the same orders
+type OrderBuilder struct {
+	querier database.Querier
+	feeCalc *fee_calculator.FeeCalculator
+}
+
+func NewOrderBuilder(querier database.Querier, feeCalc *fee_calculator.FeeCalculator) *OrderBuilder {
+	return &OrderBuilder{
+		querier: querier,
+		feeCalc: feeCalc,
+	}
+}
+
+// ParseRecord reads a new order from a CSV record, with or without the currency field
+// will return an error if the amount is not a valid float
+func ParseRecord(record []string) (NewOrder, error) {
+	if len(record) != len(csvHeaderInfo) && len(record) != len(csvCurrencyHeaderInfo) {
+		return NewOrder{}, fmt.Errorf("%w: expected %d or %d fields, got %d", ErrorInvalidOrder, len(csvHeaderInfo), len(csvCurrencyHeaderInfo), len(record))
+	}
+
+	amount, err := strconv.ParseFloat(record[2], 64)
+	if err != nil {
+		return NewOrder{}, fmt.Errorf("%w: error converting amount to float: %v", ErrorInvalidOrder, err)
+	}
+
+	newOrder := NewOrder{
+		ID:                record[0],
+		MerchantReference: record[1],
+		Amount:            amount,
+		CreatedAt:         record[3],
+	}
+	if len(record) == len(csvCurrencyHeaderInfo) {
+		newOrder.Currency = record[4]
+	}
+	return newOrder, nil
+}
+
+// Build builds an order and calculates its fee
+// will return an ErrorInvalidOrder if the id is empty, the amount is not positive, the created_at is not a valid date,
+// the merchant doesn't exist or the currency is not the settlement currency of the merchant
+func (b *OrderBuilder) Build(ctx context.Context, newOrder NewOrder) (*entities.Order, error) {
+	if newOrder.ID == "" {
+		return nil, fmt.Errorf("%w: missing id", ErrorInvalidOrder)
+	}
+
+	if newOrder.Amount <= 0 || math.IsInf(newOrder.Amount, 0) || math.IsNaN(newOrder.Amount) {
+		return nil, fmt.Errorf("%w: amount must be positive, got %v", ErrorInvalidOrder, newOrder.Amount)
+	}
+
+	createdAt, err := time.Parse(time.DateOnly, newOrder.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error parsing created_at: %v", ErrorInvalidOrder, err)
+	}
+
+	currency := newOrder.Currency
+	if currency == "" {
+		currency = entities.DefaultCurrency
+	}
+	if !entities.ValidCurrency(currency) {
+		return nil, fmt.Errorf("%w: invalid currency %q, expected a code like EUR", ErrorInvalidOrder, currency)
+	}
+
+	merchant, err := b.querier.SelectMerchantByReference(ctx, newOrder.MerchantReference)
+	if err != nil {
+		return nil, fmt.Errorf("error checking if merchant exists: %v", err)
+	}
+	if merchant == nil {
+		return nil, fmt.Errorf("%w: unknown merchant %q", ErrorInvalidOrder, newOrder.MerchantReference)
+	}
+	if currency != merchant.Currency {
+		return nil, fmt.Errorf("%w: currency %s does not match the settlement currency %s of merchant %q",
+			ErrorInvalidOrder, currency, merchant.Currency, newOrder.MerchantReference)
+	}
+
+	order := entities.Order{
+		ID:         newOrder.ID,
+		MerchantID: merchant.ID,
+		Amount:     newOrder.Amount,
+		Currency:   currency,
+		CreatedAt:  createdAt,
+	}
+
+	// calculates the fee amount based on the order amount and fee percentages of its currency.
+	order.FeeAmount = b.feeCalc.CalculateFeeAmount(order.Amount, order.Currency)
+
+	return &order, nil
+}
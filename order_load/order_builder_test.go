@@ -0,0 +1,76 @@
+package order_load
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecord(t *testing.T) {
+	newOrder, err := ParseRecord([]string{"e653f3e14bc4", "padberg_group", "102.29", "2023-02-01"})
+	require.NoError(t, err)
+	require.Equal(t, NewOrder{ID: "e653f3e14bc4", MerchantReference: "padberg_group", Amount: 102.29, CreatedAt: "2023-02-01"}, newOrder)
+
+	newOrder, err = ParseRecord([]string{"e653f3e14bc4", "padberg_group", "102.29", "2023-02-01", "GBP"})
+	require.NoError(t, err)
+	require.Equal(t, "GBP", newOrder.Currency)
+
+	_, err = ParseRecord([]string{"e653f3e14bc4", "padberg_group", "102,29", "2023-02-01"})
+	require.ErrorIs(t, err, ErrorInvalidOrder)
+	require.ErrorContains(t, err, "error converting amount to float")
+
+	_, err = ParseRecord([]string{"e653f3e14bc4", "padberg_group", "102.29"})
+	require.ErrorIs(t, err, ErrorInvalidOrder)
+}
+
+func TestOrderBuilderBuild(t *testing.T) {
+	ctx := context.Background()
+	merchant := test_helpers.SetupMerchantTemplate()
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchantByReference", ctx, merchant.Reference).Return(&merchant, nil)
+	mockQuerier.On("SelectMerchantByReference", ctx, "unknown").Return(nil, nil)
+	mockQuerier.On("SelectMerchantByReference", ctx, "failing").Return(nil, errors.New("connection refused"))
+
+	builder := NewOrderBuilder(mockQuerier, fee_calculator.NewFeeCalculator(ctx, mockQuerier))
+
+	order, err := builder.Build(ctx, NewOrder{ID: "e653f3e14bc4", MerchantReference: merchant.Reference, Amount: 100, CreatedAt: "2023-02-01"})
+	require.NoError(t, err)
+	require.Equal(t, merchant.ID, order.MerchantID)
+	require.Equal(t, "2023-02-01", order.CreatedAt.Format("2006-01-02"))
+	require.Equal(t, 0.95, order.FeeAmount)
+	require.Equal(t, entities.DefaultCurrency, order.Currency)
+
+	order, err = builder.Build(ctx, NewOrder{ID: "e653f3e14bc4", MerchantReference: merchant.Reference, Amount: 100, CreatedAt: "2023-02-01", Currency: "EUR"})
+	require.NoError(t, err)
+	require.Equal(t, "EUR", order.Currency)
+
+	for name, test := range map[string]struct {
+		newOrder NewOrder
+		expected string
+	}{
+		"MissingID":       {NewOrder{MerchantReference: merchant.Reference, Amount: 100, CreatedAt: "2023-02-01"}, "missing id"},
+		"ZeroAmount":      {NewOrder{ID: "1", MerchantReference: merchant.Reference, CreatedAt: "2023-02-01"}, "amount must be positive"},
+		"NegativeAmount":  {NewOrder{ID: "1", MerchantReference: merchant.Reference, Amount: -5, CreatedAt: "2023-02-01"}, "amount must be positive"},
+		"InvalidDate":     {NewOrder{ID: "1", MerchantReference: merchant.Reference, Amount: 100, CreatedAt: "01/02/2023"}, "error parsing created_at"},
+		"UnknownMerchant": {NewOrder{ID: "1", MerchantReference: "unknown", Amount: 100, CreatedAt: "2023-02-01"}, `unknown merchant "unknown"`},
+		"InvalidCurrency": {NewOrder{ID: "1", MerchantReference: merchant.Reference, Amount: 100, CreatedAt: "2023-02-01", Currency: "eur"}, `invalid currency "eur"`},
+		"OtherCurrency":   {NewOrder{ID: "1", MerchantReference: merchant.Reference, Amount: 100, CreatedAt: "2023-02-01", Currency: "GBP"}, "currency GBP does not match the settlement currency EUR"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := builder.Build(ctx, test.newOrder)
+			require.ErrorIs(t, err, ErrorInvalidOrder)
+			require.ErrorContains(t, err, test.expected)
+		})
+	}
+
+	// Failing to look up the merchant does not make the order invalid
+	_, err = builder.Build(ctx, NewOrder{ID: "1", MerchantReference: "failing", Amount: 100, CreatedAt: "2023-02-01"})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrorInvalidOrder)
+}
@@ -0,0 +1,80 @@
+package order_load
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+)
+
+// orderLeft is an order with what its refunds and chargebacks already took of it
+// The refund and chargeback builders share it, so both limit the new amounts the same way
+type orderLeft struct {
+	order       *entities.Order
+	refunded    float64 // Amount of the refunds of the order
+	reversed    float64 // Fee reversal of the refunds of the order
+	chargedBack float64 // Amount of the chargebacks of the order
+}
+
+// selectOrderLeft selects the order refunded or charged back on the day, with its refunds and chargebacks
+// will return an error wrapping invalid if the order doesn't exist or is newer than the day
+func selectOrderLeft(ctx context.Context, querier database.Querier, orderID string, day time.Time, invalid error) (*orderLeft, error) {
+	order, err := querier.SelectOrder(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("error checking if order exists: %v", err)
+	}
+	if order == nil {
+		return nil, fmt.Errorf("%w: unknown order %q", invalid, orderID)
+	}
+	if day.Before(order.CreatedAt) {
+		return nil, fmt.Errorf("%w: created before its order, on %s", invalid, order.CreatedAt.Format(time.DateOnly))
+	}
+
+	left := orderLeft{order: order}
+
+	refunds, err := querier.SelectOrderRefunds(ctx, order.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting the refunds of the order: %v", err)
+	}
+	for _, refund := range refunds {
+		left.refunded += refund.Amount
+		left.reversed += refund.FeeReversal
+	}
+
+	chargebacks, err := querier.SelectOrderChargebacks(ctx, order.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting the chargebacks of the order: %v", err)
+	}
+	for _, chargeback := range chargebacks {
+		left.chargedBack += chargeback.Amount
+	}
+
+	return &left, nil
+}
+
+// amount returns what is left of the order once refunded and charged back
+func (l orderLeft) amount() float64 {
+	return entities.RoundAmount(l.order.Amount - l.refunded - l.chargedBack)
+}
+
+// take returns the amount requested of the order, zero taking all what is left of it
+// will return an error wrapping invalid if nothing is left of the order or the amount exceeds it
+func (l orderLeft) take(requested float64, action string, invalid error) (float64, error) {
+	left := l.amount()
+	amount := entities.RoundAmount(requested)
+	if requested == 0 {
+		amount = left
+	}
+	if left <= 0 {
+		return 0, fmt.Errorf("%w: order %q is already fully refunded or charged back", invalid, l.order.ID)
+	}
+	if amount <= 0 {
+		return 0, fmt.Errorf("%w: amount must be positive, got %v", invalid, requested)
+	}
+	if amount > left {
+		return 0, fmt.Errorf("%w: amount %.2f exceeds the %.2f left to %s of order %q", invalid, amount, left, action, l.order.ID)
+	}
+	return amount, nil
+}
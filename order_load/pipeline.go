@@ -5,55 +5,84 @@ import (
 	"encoding/csv"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/ildomm/cc_sq_disbursement/database"
 	"github.com/ildomm/cc_sq_disbursement/entities"
 	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
-	"log"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"slices"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	// DefaultJobPause is the interval between each job run
-	DefaultJobPause = time.Duration(60) * time.Second
-	WaitingPath     = "../orders/waiting/"
-	ImportedPath    = "../orders/imported/"
-	FailedPath      = "../orders/failed/"
+	DefaultJobPause = system.DefaultJobPause
+	WaitingPath     = system.DefaultOrdersWaitingPath
+	ImportedPath    = system.DefaultOrdersImportedPath
+	FailedPath      = system.DefaultOrdersFailedPath
 )
 
 var csvHeaderInfo = []string{"id", "merchant_reference", "amount", "created_at"}
 
+// csvCurrencyHeaderInfo is the header of the files of orders giving their currency, in euros otherwise
+var csvCurrencyHeaderInfo = []string{"id", "merchant_reference", "amount", "created_at", "currency"}
+
 type pipeline struct {
-	ctx      context.Context
-	querier  database.Querier
-	feeCalc  fee_calculator.FeeCalculator
-	JobPause time.Duration // The amount of time to pause between each job run. This is exported so it can be overridden in tests
+	ctx          context.Context
+	querier      database.Querier
+	builder      *OrderBuilder
+	refunds      *RefundBuilder
+	chargebacks  *ChargebackBuilder
+	JobPause     time.Duration // The amount of time to pause between each job run. This is exported so it can be overridden in tests
+	waitingPath  string
+	importedPath string
+	failedPath   string
+	logger       *slog.Logger
+
+	lastIteration atomic.Int64 // Unix nanoseconds of the last loop iteration, read by the health checks
 }
 
 func NewPipeline(ctx context.Context, querier database.Querier) *pipeline {
+	return NewPipelineWithConfig(ctx, querier, system.DefaultConfig())
+}
+
+// NewPipelineWithConfig creates a pipeline using the loader folders, job pause and fee tiers of the config
+func NewPipelineWithConfig(ctx context.Context, querier database.Querier, cfg system.Config) *pipeline {
+	feeCalc := fee_calculator.NewFeeCalculatorWithConfig(ctx, querier, cfg.Fees)
 	p := &pipeline{
-		ctx:      ctx,
-		querier:  querier,
-		feeCalc:  *fee_calculator.NewFeeCalculator(ctx, querier),
-		JobPause: DefaultJobPause,
+		ctx:          ctx,
+		querier:      querier,
+		builder:      NewOrderBuilder(querier, feeCalc),
+		refunds:      NewRefundBuilder(querier, feeCalc),
+		chargebacks:  NewChargebackBuilder(querier, feeCalc),
+		JobPause:     cfg.Loader.JobPause,
+		waitingPath:  cfg.Loader.WaitingPath,
+		importedPath: cfg.Loader.ImportedPath,
+		failedPath:   cfg.Loader.FailedPath,
+		logger:       system.ComponentLogger("loader"),
 	}
+	// Until the first iteration, count from the creation
+	p.lastIteration.Store(time.Now().UnixNano())
 
 	return p
 }
 
 // Run starts the loading pipeline
 func (pp *pipeline) Run() {
-	log.Print("starting loading orders from CSV`s")
+	pp.logger.Info("starting loading orders from CSV`s", "waiting_path", pp.waitingPath, "job_pause", pp.JobPause.String())
 
 	for {
 		select {
 		case <-pp.ctx.Done():
-			log.Print("stopping loading orders from CSV`s")
+			pp.logger.Info("stopping loading orders from CSV`s")
 			return
 		default:
+			pp.markIteration()
 			pp.importFiles()
 
 			time.Sleep(pp.JobPause)
@@ -61,49 +90,74 @@ func (pp *pipeline) Run() {
 	}
 }
 
+// markIteration records the start of a loop iteration
+func (pp *pipeline) markIteration() {
+	now := time.Now()
+	pp.lastIteration.Store(now.UnixNano())
+	metrics.LoaderLastIteration.Set(float64(now.Unix()))
+}
+
+// LastIteration returns when the last loop iteration started, or when the pipeline was created
+func (pp *pipeline) LastIteration() time.Time {
+	return time.Unix(0, pp.lastIteration.Load())
+}
+
+// PendingFiles counts the files waiting to be imported
+// It fails when the waiting folder cannot be read
+func (pp *pipeline) PendingFiles() (int, error) {
+	files, err := pp.detectFilesWaiting(pp.logger, pp.waitingPath)
+	if err != nil {
+		return 0, err
+	}
+	return len(files), nil
+}
+
 // importFiles imports all the files waiting to be loaded
 // files will be sitting in the folder /orders/waiting
 // the file will be moved to /orders/imported after being loaded
+// each run logs with its own run ID
 func (pp *pipeline) importFiles() {
-	files, err := pp.detectFilesWaiting(WaitingPath)
+	logger := pp.logger.With(system.LogRunIDKey, uuid.NewString())
+
+	files, err := pp.detectFilesWaiting(logger, pp.waitingPath)
 
 	if err != nil {
-		log.Print(err)
+		logger.Error("error detecting files", system.LogErrorKey, err)
 		return
 	}
 
-	log.Print("files to process: ", len(files))
+	logger.Info("files to process", "files", len(files))
 
 	if len(files) > 0 {
 		for _, file := range files {
-			err := pp.importOrdersFromCSV(file)
+			fileLogger := logger.With(system.LogFileKey, file)
+			started := time.Now()
+			err := pp.importFromCSV(fileLogger, file)
+			metrics.ObserveFileImport(started, err)
 
-			targetPath := ""
+			targetFolder := ""
 			if err != nil {
-				log.Print("error importing orders from CSV:", err)
+				fileLogger.Error("error importing from CSV", system.LogErrorKey, err)
 
 				// Error path
-				targetPath = strings.Replace(file, WaitingPath, FailedPath, 1)
+				targetFolder = pp.failedPath
 			} else {
 				// Success path
-				targetPath = strings.Replace(file, WaitingPath, ImportedPath, 1)
+				targetFolder = pp.importedPath
 			}
+			targetPath := pp.targetPath(file, targetFolder)
 
 			err = pp.moveFile(file, targetPath)
 			if err != nil {
-				log.Print("error moving file:", err)
+				fileLogger.Error("error moving file", "target", targetPath, system.LogErrorKey, err)
 			}
 		}
 	}
 }
 
-// importOrdersFromCSV imports orders from a CSV file
-// the file will be ignored if it has an invalid format
-// the file will be ignored if the merchant doesn't exist
-// the file will be ignored if the order already exists
-func (pp *pipeline) importOrdersFromCSV(filePath string) error {
-	log.Printf("importing orders from CSV file: %s", filePath)
-
+// importFromCSV imports the orders, the refunds or the chargebacks of a CSV file
+// the file holds refunds or chargebacks when its header is the refunds or the chargebacks one, orders otherwise
+func (pp *pipeline) importFromCSV(logger *slog.Logger, filePath string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
@@ -118,28 +172,43 @@ func (pp *pipeline) importOrdersFromCSV(filePath string) error {
 		return err
 	}
 
-	// Variable to track if the current line is the first line (header)
-	isFirstLine := true
+	if len(records) > 0 && slices.Equal(records[0], csvRefundHeaderInfo) {
+		return pp.importRefunds(logger, records[1:])
+	}
+	if len(records) > 0 && slices.Equal(records[0], csvChargebackHeaderInfo) {
+		return pp.importChargebacks(logger, records[1:])
+	}
+
+	// Skip the first line (header)
+	if len(records) > 0 {
+		records = records[1:]
+	}
+	return pp.importOrders(logger, records)
+}
+
+// importOrders imports the orders of the records of a CSV file
+// the file will be ignored if it has an invalid format
+// the file will be ignored if the merchant doesn't exist
+// the order will be skipped if it already exists
+func (pp *pipeline) importOrders(logger *slog.Logger, records [][]string) error {
+	logger.Info("importing orders from CSV file")
+
 	counter := 0
 
 	for _, record := range records {
-		// Skip the first line (header)
-		if isFirstLine {
-			isFirstLine = false
-			continue
-		}
-
-		if len(record) != len(csvHeaderInfo) {
+		if len(record) != len(csvHeaderInfo) && len(record) != len(csvCurrencyHeaderInfo) {
+			metrics.RowsImported.WithLabelValues(metrics.ResultRejected).Inc()
 			return errors.New("invalid CSV format")
 		}
 
 		if counter%1000 == 0 {
-			log.Printf("importing order %s. %d/%d", record[0], counter, len(records))
+			logger.Info("importing orders", system.LogOrderIDKey, record[0], "progress", counter, "records", len(records))
 		}
 		counter++
 
 		order, err := pp.buildOrder(record)
 		if err != nil {
+			metrics.RowsImported.WithLabelValues(metrics.ResultRejected).Inc()
 			return err
 		}
 
@@ -150,7 +219,8 @@ func (pp *pipeline) importOrdersFromCSV(filePath string) error {
 
 		// Skip if the order already exists
 		if existingOrder != nil {
-			log.Printf("order already exists: %s", order.ID)
+			logger.Info("order already exists", system.LogOrderIDKey, order.ID, system.LogMerchantIDKey, order.MerchantID)
+			metrics.RowsImported.WithLabelValues(metrics.ResultDuplicate).Inc()
 			continue
 		}
 
@@ -158,9 +228,106 @@ func (pp *pipeline) importOrdersFromCSV(filePath string) error {
 		if err != nil {
 			return fmt.Errorf("error inserting order: %v", err)
 		}
+		metrics.RowsImported.WithLabelValues(metrics.ResultImported).Inc()
 	}
 
-	log.Printf("orders imported successfully from CSV file: %s", filePath)
+	logger.Info("orders imported successfully from CSV file", "orders", counter)
+	return nil
+}
+
+// importRefunds imports the refunds of the records of a CSV file
+// the file will be ignored if it has an invalid format
+// the file will be ignored if the order doesn't exist or the refund exceeds it
+// the refund will be skipped if it already exists
+func (pp *pipeline) importRefunds(logger *slog.Logger, records [][]string) error {
+	logger.Info("importing refunds from CSV file")
+
+	for _, record := range records {
+		newRefund, err := ParseRefundRecord(record)
+		if err != nil {
+			metrics.RefundRowsImported.WithLabelValues(metrics.ResultRejected).Inc()
+			return err
+		}
+
+		existingRefund, err := pp.querier.SelectRefund(pp.ctx, newRefund.ID)
+		if err != nil {
+			return fmt.Errorf("error checking if refund exists: %v", err)
+		}
+
+		// Skip if the refund already exists, before building it as it would exceed its order
+		if existingRefund != nil {
+			logger.Info("refund already exists", system.LogRefundIDKey, newRefund.ID, system.LogOrderIDKey, existingRefund.OrderID)
+			metrics.RefundRowsImported.WithLabelValues(metrics.ResultDuplicate).Inc()
+			continue
+		}
+
+		refund, err := pp.refunds.Build(pp.ctx, newRefund)
+		if err != nil {
+			metrics.RefundRowsImported.WithLabelValues(metrics.ResultRejected).Inc()
+			return err
+		}
+
+		// Another refund or chargeback of the order could have been imported since the refund was built
+		err = pp.querier.InsertRefund(pp.ctx, *refund)
+		if errors.Is(err, database.ErrorOrderAmountExceeded) {
+			metrics.RefundRowsImported.WithLabelValues(metrics.ResultRejected).Inc()
+			return fmt.Errorf("%w: %v", ErrorInvalidRefund, err)
+		}
+		if err != nil {
+			return fmt.Errorf("error inserting refund: %v", err)
+		}
+		metrics.RefundRowsImported.WithLabelValues(metrics.ResultImported).Inc()
+	}
+
+	logger.Info("refunds imported successfully from CSV file", "refunds", len(records))
+	return nil
+}
+
+// importChargebacks imports the chargebacks of the records of a CSV file
+// the file will be ignored if it has an invalid format
+// the file will be ignored if the order doesn't exist or the chargeback exceeds it
+// the chargeback will be skipped if it already exists
+func (pp *pipeline) importChargebacks(logger *slog.Logger, records [][]string) error {
+	logger.Info("importing chargebacks from CSV file")
+
+	for _, record := range records {
+		newChargeback, err := ParseChargebackRecord(record)
+		if err != nil {
+			metrics.ChargebackRowsImported.WithLabelValues(metrics.ResultRejected).Inc()
+			return err
+		}
+
+		existingChargeback, err := pp.querier.SelectChargeback(pp.ctx, newChargeback.ID)
+		if err != nil {
+			return fmt.Errorf("error checking if chargeback exists: %v", err)
+		}
+
+		// Skip if the chargeback already exists, before building it as it would exceed its order
+		if existingChargeback != nil {
+			logger.Info("chargeback already exists", system.LogChargebackIDKey, newChargeback.ID, system.LogOrderIDKey, existingChargeback.OrderID)
+			metrics.ChargebackRowsImported.WithLabelValues(metrics.ResultDuplicate).Inc()
+			continue
+		}
+
+		chargeback, err := pp.chargebacks.Build(pp.ctx, newChargeback)
+		if err != nil {
+			metrics.ChargebackRowsImported.WithLabelValues(metrics.ResultRejected).Inc()
+			return err
+		}
+
+		// Another refund or chargeback of the order could have been imported since the chargeback was built
+		err = pp.querier.InsertChargeback(pp.ctx, *chargeback)
+		if errors.Is(err, database.ErrorOrderAmountExceeded) {
+			metrics.ChargebackRowsImported.WithLabelValues(metrics.ResultRejected).Inc()
+			return fmt.Errorf("%w: %v", ErrorInvalidChargeback, err)
+		}
+		if err != nil {
+			return fmt.Errorf("error inserting chargeback: %v", err)
+		}
+		metrics.ChargebackRowsImported.WithLabelValues(metrics.ResultImported).Inc()
+	}
+
+	logger.Info("chargebacks imported successfully from CSV file", "chargebacks", len(records))
 	return nil
 }
 
@@ -169,38 +336,21 @@ func (pp *pipeline) importOrdersFromCSV(filePath string) error {
 // will return an error if the amount is not a valid float
 // will return an error if the created_at is not a valid date
 func (pp *pipeline) buildOrder(record []string) (*entities.Order, error) {
-
-	orderID := record[0]
-	merchantReference := record[1]
-	amount := record[2]
-	createdAtStr := record[3]
-
-	merchant, err := pp.querier.SelectMerchantByReference(pp.ctx, merchantReference)
+	newOrder, err := ParseRecord(record)
 	if err != nil {
-		return nil, fmt.Errorf("error checking if merchant exists: %v", err)
+		return nil, err
 	}
 
-	amountFloat, err := strconv.ParseFloat(amount, 64)
-	if err != nil {
-		return nil, fmt.Errorf("error converting amount to float: %v", err)
-	}
+	return pp.builder.Build(pp.ctx, newOrder)
+}
 
-	createdAt, err := time.Parse(time.DateOnly, createdAtStr)
+// targetPath returns where a waiting file goes in the target folder, keeping its path relative to the waiting folder
+func (pp *pipeline) targetPath(file, targetFolder string) string {
+	relativePath, err := filepath.Rel(pp.waitingPath, file)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing created_at: %v", err)
-	}
-
-	order := entities.Order{
-		ID:         orderID,
-		MerchantID: merchant.ID,
-		Amount:     amountFloat,
-		CreatedAt:  createdAt,
+		relativePath = filepath.Base(file)
 	}
-
-	// calculates the fee amount based on the order amount and fee percentages.
-	order.FeeAmount = pp.feeCalc.CalculateFeeAmount(order.Amount)
-
-	return &order, nil
+	return filepath.Join(targetFolder, relativePath)
 }
 
 // moveFile moves a file from one path to another
@@ -214,8 +364,8 @@ func (pp *pipeline) moveFile(filePath, targetPath string) error {
 
 // detectFilesWaiting Detects if there are files waiting to be processed
 // files will be sitting in the folder /orders/waiting
-func (pp *pipeline) detectFilesWaiting(folderPath string) ([]string, error) {
-	log.Print("detecting files...")
+func (pp *pipeline) detectFilesWaiting(logger *slog.Logger, folderPath string) ([]string, error) {
+	logger.Debug("detecting files", "path", folderPath)
 
 	var files []string
 
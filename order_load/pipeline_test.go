@@ -8,7 +8,9 @@ import (
 	"github.com/ildomm/cc_sq_disbursement/test_helpers"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
-	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -28,7 +30,7 @@ func TestPipelineHappyPath(t *testing.T) {
 	mockQuerier.On("InsertOrder", mock.Anything, mock.Anything)
 
 	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
+	slog.SetDefault(mockLog.Logger())
 
 	test_helpers.SetupCSVOrder(WaitingPath)
 	//time.Sleep(time.Duration(1) * time.Second)
@@ -41,6 +43,7 @@ func TestPipelineHappyPath(t *testing.T) {
 
 	// Check that the log contains the expected messages
 	mockLog.AssertContains(t, "orders imported successfully from CSV file")
+	mockLog.AssertRecord(t, "importing orders from CSV file", map[string]any{"file": filepath.Join(WaitingPath, "example1.csv")})
 
 	// Check mock querier expectations
 	mockQuerier.AssertExpectations(t)
@@ -74,7 +77,7 @@ func TestPipelineOnWrongMerchant(t *testing.T) {
 		nil, errors.New("merchant not found"))
 
 	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
+	slog.SetDefault(mockLog.Logger())
 
 	test_helpers.SetupCSVOrder(WaitingPath)
 
@@ -86,9 +89,9 @@ func TestPipelineOnWrongMerchant(t *testing.T) {
 
 	// Check that the log contains the expected messages
 	mockLog.AssertContains(t, "starting loading orders")
-	mockLog.AssertContains(t, "files to process: 1")
+	mockLog.AssertRecord(t, "files to process", map[string]any{"component": "loader", "files": 1})
 	mockLog.AssertContains(t, "error checking if merchant exists")
-	mockLog.AssertNotContains(t, "orders imported successfully from CSV file")
+	mockLog.AssertNoRecord(t, "orders imported successfully from CSV file")
 
 	// Check mock querier expectations
 	mockQuerier.AssertExpectations(t)
@@ -118,7 +121,7 @@ func TestPipelineWhenOrderExists(t *testing.T) {
 	mockQuerier.On("InsertOrder", mock.Anything, mock.Anything)
 
 	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
+	slog.SetDefault(mockLog.Logger())
 
 	test_helpers.SetupCSVOrder(WaitingPath)
 
@@ -181,6 +184,12 @@ func TestPipelineBuildOrderHappyPath(t *testing.T) {
 	require.Equal(t, order.ID, builtOrder.ID)
 	require.Equal(t, merchant.ID, builtOrder.MerchantID)
 	require.Equal(t, order.Amount, builtOrder.Amount)
+	require.Equal(t, merchant.Currency, builtOrder.Currency)
+
+	record = append(record, merchant.Currency)
+	builtOrder, err = p.buildOrder(record)
+	require.NoError(t, err)
+	require.Equal(t, merchant.Currency, builtOrder.Currency)
 }
 
 func TestPipelineBuildOrderOnInvalidValues(t *testing.T) {
@@ -216,4 +225,134 @@ func TestPipelineBuildOrderOnInvalidValues(t *testing.T) {
 		_, err := p.buildOrder(record)
 		require.Error(t, err)
 	})
+
+	t.Run("OtherCurrency", func(t *testing.T) {
+		mockQuerier := test_helpers.NewMockQuerier()
+		mockQuerier.On("SelectMerchantByReference", ctx, merchant.Reference).Return(&merchant, nil)
+		p := NewPipeline(ctx, mockQuerier)
+
+		record := []string{"valid_id", merchant.Reference, "100.00", "2021-10-01", "USD"}
+		_, err := p.buildOrder(record)
+		require.ErrorIs(t, err, ErrorInvalidOrder)
+	})
+}
+
+func TestPipelineHealthStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := system.DefaultConfig()
+	cfg.Loader.WaitingPath = t.TempDir()
+	cfg.Loader.JobPause = time.Hour
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	p := NewPipelineWithConfig(ctx, mockQuerier, cfg)
+	created := p.LastIteration()
+
+	// No files waiting yet
+	pending, err := p.PendingFiles()
+	require.NoError(t, err)
+	require.Equal(t, 0, pending)
+
+	test_helpers.SetupCSVOrder(cfg.Loader.WaitingPath)
+	pending, err = p.PendingFiles()
+	require.NoError(t, err)
+	require.Equal(t, 1, pending)
+
+	// The loop records its iterations
+	p.markIteration()
+	require.False(t, p.LastIteration().Before(created))
+
+	// The waiting folder is gone
+	p.waitingPath = filepath.Join(cfg.Loader.WaitingPath, "missing")
+	_, err = p.PendingFiles()
+	require.Error(t, err)
+}
+
+func TestPipelineImportRefunds(t *testing.T) {
+	ctx := context.Background()
+	order := test_helpers.SetupOrderTemplate()
+	order.Amount = 100
+	order.FeeAmount = 0.95
+	order.CreatedAt = time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectOrder", mock.Anything, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectRefund", mock.Anything, mock.Anything)
+	mockQuerier.On("SelectOrderRefunds", mock.Anything, order.ID)
+	mockQuerier.On("SelectOrderChargebacks", mock.Anything, order.ID)
+	mockQuerier.On("InsertRefund", mock.Anything, mock.Anything)
+
+	mockLog := test_helpers.NewLogMocker()
+	p := NewPipeline(ctx, mockQuerier)
+
+	// A refunds file is told apart from an orders file by its header
+	file := filepath.Join(t.TempDir(), "refunds.csv")
+	content := fmt.Sprintf("id;order_id;amount;created_at\nr-1;%s;20.00;2023-02-03\n", order.ID)
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+
+	err := p.importFromCSV(mockLog.Logger(), file)
+	require.NoError(t, err)
+	mockLog.AssertContains(t, "refunds imported successfully from CSV file")
+
+	refund, err := mockQuerier.SelectRefund(ctx, "r-1")
+	require.NoError(t, err)
+	require.NotNil(t, refund)
+	require.Equal(t, order.ID, refund.OrderID)
+	require.Equal(t, order.MerchantID, refund.MerchantID)
+	require.Equal(t, 0.19, refund.FeeReversal)
+
+	// Importing the file again skips the refund instead of exceeding the order
+	err = p.importFromCSV(mockLog.Logger(), file)
+	require.NoError(t, err)
+	mockLog.AssertContains(t, "refund already exists")
+	mockQuerier.AssertNumberOfCalls(t, "InsertRefund", 1)
+
+	// A refund exceeding its order fails the file
+	content = fmt.Sprintf("id;order_id;amount;created_at\nr-2;%s;90.00;2023-02-03\n", order.ID)
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+
+	err = p.importFromCSV(mockLog.Logger(), file)
+	require.ErrorIs(t, err, ErrorInvalidRefund)
+}
+
+func TestPipelineImportChargebacks(t *testing.T) {
+	ctx := context.Background()
+	order := test_helpers.SetupOrderTemplate()
+	order.Amount = 100
+	order.FeeAmount = 0.95
+	order.CreatedAt = time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectOrder", mock.Anything, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectChargeback", mock.Anything, mock.Anything)
+	mockQuerier.On("SelectOrderRefunds", mock.Anything, order.ID)
+	mockQuerier.On("SelectOrderChargebacks", mock.Anything, order.ID)
+	mockQuerier.On("InsertChargeback", mock.Anything, mock.Anything)
+
+	mockLog := test_helpers.NewLogMocker()
+	p := NewPipeline(ctx, mockQuerier)
+
+	// A chargebacks file is told apart from an orders file by its header
+	file := filepath.Join(t.TempDir(), "chargebacks.csv")
+	content := fmt.Sprintf("id;order_id;amount;created_at;reason\ncb-1;%s;;2023-02-10;fraud\n", order.ID)
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+
+	err := p.importFromCSV(mockLog.Logger(), file)
+	require.NoError(t, err)
+	mockLog.AssertContains(t, "chargebacks imported successfully from CSV file")
+
+	chargeback, err := mockQuerier.SelectChargeback(ctx, "cb-1")
+	require.NoError(t, err)
+	require.NotNil(t, chargeback)
+	require.Equal(t, order.MerchantID, chargeback.MerchantID)
+	require.Equal(t, 100.0, chargeback.Amount)
+	require.Equal(t, system.DefaultChargebackFee, chargeback.Fee)
+	require.Equal(t, "fraud", chargeback.Reason)
+
+	// Importing the file again skips the chargeback instead of exceeding the order
+	err = p.importFromCSV(mockLog.Logger(), file)
+	require.NoError(t, err)
+	mockLog.AssertContains(t, "chargeback already exists")
+	mockQuerier.AssertNumberOfCalls(t, "InsertChargeback", 1)
 }
@@ -0,0 +1,109 @@
+package order_load
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+)
+
+// ErrorInvalidRefund wraps the errors of the refunds which cannot be imported as given
+var ErrorInvalidRefund = errors.New("invalid refund")
+
+var csvRefundHeaderInfo = []string{"id", "order_id", "amount", "created_at"}
+
+// NewRefund is a refund as received, from a CSV record or the API
+type NewRefund struct {
+	ID        string
+	OrderID   string
+	Amount    float64 // Zero cancels the order, refunding what is left of it
+	CreatedAt string  // Day of the refund, like 2023-01-31
+}
+
+// RefundBuilder validates the new refunds and calculates their fee reversals
+// It is shared by the CSV loader and the API, so both import the same refunds
+type RefundBuilder struct {
+	querier database.Querier
+	feeCalc *fee_calculator.FeeCalculator
+}
+
+func NewRefundBuilder(querier database.Querier, feeCalc *fee_calculator.FeeCalculator) *RefundBuilder {
+	return &RefundBuilder{
+		querier: querier,
+		feeCalc: feeCalc,
+	}
+}
+
+// ParseRefundRecord reads a new refund from a CSV record
+// An empty amount cancels the order. Will return an error if the amount is not a valid float
+func ParseRefundRecord(record []string) (NewRefund, error) {
+	if len(record) != len(csvRefundHeaderInfo) {
+		return NewRefund{}, fmt.Errorf("%w: expected %d fields, got %d", ErrorInvalidRefund, len(csvRefundHeaderInfo), len(record))
+	}
+
+	var amount float64
+	if record[2] != "" {
+		var err error
+		amount, err = strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return NewRefund{}, fmt.Errorf("%w: error converting amount to float: %v", ErrorInvalidRefund, err)
+		}
+	}
+
+	return NewRefund{
+		ID:        record[0],
+		OrderID:   record[1],
+		Amount:    amount,
+		CreatedAt: record[3],
+	}, nil
+}
+
+// Build builds a refund of an order and calculates its fee reversal
+// will return an ErrorInvalidRefund if the id is empty, the amount is negative, the created_at is not a valid date,
+// the order doesn't exist or is newer than the refund, or the refunds of the order would exceed what is left of it
+// once charged back
+func (b *RefundBuilder) Build(ctx context.Context, newRefund NewRefund) (*entities.Refund, error) {
+	if newRefund.ID == "" {
+		return nil, fmt.Errorf("%w: missing id", ErrorInvalidRefund)
+	}
+
+	if newRefund.Amount < 0 || math.IsInf(newRefund.Amount, 0) || math.IsNaN(newRefund.Amount) {
+		return nil, fmt.Errorf("%w: amount must be positive, got %v", ErrorInvalidRefund, newRefund.Amount)
+	}
+
+	createdAt, err := time.Parse(time.DateOnly, newRefund.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error parsing created_at: %v", ErrorInvalidRefund, err)
+	}
+
+	left, err := selectOrderLeft(ctx, b.querier, newRefund.OrderID, createdAt, ErrorInvalidRefund)
+	if err != nil {
+		return nil, err
+	}
+	order := left.order
+
+	// The previous refunds and the chargebacks of the order limit the amount left to refund
+	amount, err := left.take(newRefund.Amount, "refund", ErrorInvalidRefund)
+	if err != nil {
+		return nil, err
+	}
+
+	refund := entities.Refund{
+		ID:         newRefund.ID,
+		OrderID:    order.ID,
+		MerchantID: order.MerchantID,
+		Amount:     amount,
+		CreatedAt:  createdAt,
+	}
+
+	// calculates the part of the order fee given back following the fee reversal rule
+	refund.FeeReversal = b.feeCalc.CalculateFeeReversal(*order, refund.Amount, left.refunded, left.reversed)
+
+	return &refund, nil
+}
@@ -0,0 +1,148 @@
+package order_load
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRefundRecord(t *testing.T) {
+	newRefund, err := ParseRefundRecord([]string{"r-1", "e653f3e14bc4", "20.50", "2023-02-03"})
+	require.NoError(t, err)
+	require.Equal(t, NewRefund{ID: "r-1", OrderID: "e653f3e14bc4", Amount: 20.5, CreatedAt: "2023-02-03"}, newRefund)
+
+	// An empty amount cancels the order
+	newRefund, err = ParseRefundRecord([]string{"r-1", "e653f3e14bc4", "", "2023-02-03"})
+	require.NoError(t, err)
+	require.Zero(t, newRefund.Amount)
+
+	_, err = ParseRefundRecord([]string{"r-1", "e653f3e14bc4", "20,50", "2023-02-03"})
+	require.ErrorIs(t, err, ErrorInvalidRefund)
+	require.ErrorContains(t, err, "error converting amount to float")
+
+	_, err = ParseRefundRecord([]string{"r-1", "e653f3e14bc4", "20.50"})
+	require.ErrorIs(t, err, ErrorInvalidRefund)
+}
+
+func TestRefundBuilderBuild(t *testing.T) {
+	ctx := context.Background()
+	order := entities.Order{
+		ID:         "e653f3e14bc4",
+		MerchantID: test_helpers.SetupMerchantTemplate().ID,
+		Amount:     100,
+		FeeAmount:  0.95,
+		CreatedAt:  time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectOrder", ctx, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectOrder", ctx, "unknown").Return(nil, nil)
+	mockQuerier.On("SelectOrder", ctx, "failing").Return(nil, errors.New("connection refused"))
+	mockQuerier.On("SelectOrderRefunds", ctx, order.ID).Return([]entities.Refund{
+		{ID: "r-0", OrderID: order.ID, Amount: 60, FeeReversal: 0.57},
+	}, nil)
+	mockQuerier.On("SelectOrderChargebacks", ctx, order.ID)
+
+	builder := NewRefundBuilder(mockQuerier, fee_calculator.NewFeeCalculator(ctx, mockQuerier))
+
+	refund, err := builder.Build(ctx, NewRefund{ID: "r-1", OrderID: order.ID, Amount: 20, CreatedAt: "2023-02-03"})
+	require.NoError(t, err)
+	require.Equal(t, order.MerchantID, refund.MerchantID)
+	require.Equal(t, "2023-02-03", refund.CreatedAt.Format(time.DateOnly))
+	require.Equal(t, 20.0, refund.Amount)
+	require.Equal(t, 0.19, refund.FeeReversal)
+	require.Nil(t, refund.DeductedOn)
+
+	// Cancelling refunds what is left, and reverses what is left of the fee
+	refund, err = builder.Build(ctx, NewRefund{ID: "r-1", OrderID: order.ID, CreatedAt: "2023-02-03"})
+	require.NoError(t, err)
+	require.Equal(t, 40.0, refund.Amount)
+	require.Equal(t, 0.38, refund.FeeReversal)
+
+	for name, test := range map[string]struct {
+		newRefund NewRefund
+		expected  string
+	}{
+		"MissingID":      {NewRefund{OrderID: order.ID, Amount: 20, CreatedAt: "2023-02-03"}, "missing id"},
+		"NegativeAmount": {NewRefund{ID: "r-1", OrderID: order.ID, Amount: -5, CreatedAt: "2023-02-03"}, "amount must be positive"},
+		"TinyAmount":     {NewRefund{ID: "r-1", OrderID: order.ID, Amount: 0.001, CreatedAt: "2023-02-03"}, "amount must be positive"},
+		"InvalidDate":    {NewRefund{ID: "r-1", OrderID: order.ID, Amount: 20, CreatedAt: "03/02/2023"}, "error parsing created_at"},
+		"UnknownOrder":   {NewRefund{ID: "r-1", OrderID: "unknown", Amount: 20, CreatedAt: "2023-02-03"}, `unknown order "unknown"`},
+		"BeforeOrder":    {NewRefund{ID: "r-1", OrderID: order.ID, Amount: 20, CreatedAt: "2023-01-31"}, "created before its order"},
+		"ExceedsOrder":   {NewRefund{ID: "r-1", OrderID: order.ID, Amount: 40.01, CreatedAt: "2023-02-03"}, "exceeds the 40.00 left to refund"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := builder.Build(ctx, test.newRefund)
+			require.ErrorIs(t, err, ErrorInvalidRefund)
+			require.ErrorContains(t, err, test.expected)
+		})
+	}
+
+	// Failing to look up the order does not make the refund invalid
+	_, err = builder.Build(ctx, NewRefund{ID: "r-1", OrderID: "failing", Amount: 20, CreatedAt: "2023-02-03"})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrorInvalidRefund)
+}
+
+func TestRefundBuilderFullyRefunded(t *testing.T) {
+	ctx := context.Background()
+	order := entities.Order{ID: "e653f3e14bc4", Amount: 100, FeeAmount: 0.95, CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectOrder", ctx, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectOrderRefunds", ctx, order.ID).Return([]entities.Refund{{ID: "r-0", OrderID: order.ID, Amount: 100}}, nil)
+	mockQuerier.On("SelectOrderChargebacks", ctx, order.ID)
+
+	builder := NewRefundBuilder(mockQuerier, fee_calculator.NewFeeCalculator(ctx, mockQuerier))
+
+	_, err := builder.Build(ctx, NewRefund{ID: "r-1", OrderID: order.ID, CreatedAt: "2023-02-03"})
+	require.ErrorIs(t, err, ErrorInvalidRefund)
+	require.ErrorContains(t, err, "already fully refunded or charged back")
+}
+
+func TestRefundBuilderWithoutFeeReversal(t *testing.T) {
+	ctx := context.Background()
+	order := entities.Order{ID: "e653f3e14bc4", Amount: 100, FeeAmount: 0.95, CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectOrder", ctx, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectOrderRefunds", ctx, order.ID)
+	mockQuerier.On("SelectOrderChargebacks", ctx, order.ID)
+
+	fees := system.DefaultConfig().Fees
+	fees.RefundFeeReversal = entities.NoFeeReversal
+	builder := NewRefundBuilder(mockQuerier, fee_calculator.NewFeeCalculatorWithConfig(ctx, mockQuerier, fees))
+
+	refund, err := builder.Build(ctx, NewRefund{ID: "r-1", OrderID: order.ID, CreatedAt: "2023-02-01"})
+	require.NoError(t, err)
+	require.Equal(t, 100.0, refund.Amount)
+	require.Zero(t, refund.FeeReversal)
+}
+
+func TestRefundBuilderChargedBack(t *testing.T) {
+	ctx := context.Background()
+	order := entities.Order{ID: "e653f3e14bc4", Amount: 100, FeeAmount: 0.95, CreatedAt: time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectOrder", ctx, order.ID).Return(&order, nil)
+	mockQuerier.On("SelectOrderRefunds", ctx, order.ID)
+	mockQuerier.On("SelectOrderChargebacks", ctx, order.ID).Return([]entities.Chargeback{{ID: "cb-0", OrderID: order.ID, Amount: 70}}, nil)
+
+	builder := NewRefundBuilder(mockQuerier, fee_calculator.NewFeeCalculator(ctx, mockQuerier))
+
+	// Cancelling refunds what is left once charged back
+	refund, err := builder.Build(ctx, NewRefund{ID: "r-1", OrderID: order.ID, CreatedAt: "2023-02-03"})
+	require.NoError(t, err)
+	require.Equal(t, 30.0, refund.Amount)
+
+	_, err = builder.Build(ctx, NewRefund{ID: "r-1", OrderID: order.ID, Amount: 30.01, CreatedAt: "2023-02-03"})
+	require.ErrorIs(t, err, ErrorInvalidRefund)
+	require.ErrorContains(t, err, "exceeds the 30.00 left to refund")
+}
@@ -0,0 +1,299 @@
+package order_process
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/report"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// dryRunQuerier wraps a querier so the pipeline can run without writing to the database
+// Inserted disbursements are kept in memory and included in the following sums,
+// so weekly, monthly and fee correction steps see the same data as in a real run
+type dryRunQuerier struct {
+	database.Querier
+	disbursements       []entities.MerchantDisbursement
+	refundsDeducted     time.Time // Day the pending refunds were deducted by the dry run, zero until then
+	chargebacksDeducted time.Time // Day the pending chargebacks were deducted by the dry run, zero until then
+}
+
+// NewDryRunPipeline creates a pipeline which calculates the disbursements without persisting them
+// It uses the fees of the config, so the preview matches a real run. The calculated disbursements are available through Preview
+func NewDryRunPipeline(ctx context.Context, querier database.Querier, cfg system.Config) *pipeline {
+	p := NewPipelineWithConfig(ctx, &dryRunQuerier{Querier: querier}, cfg)
+	p.dryRun = true
+	p.logger = p.logger.With("dry_run", true)
+	p.feeCalc.SetLogger(p.logger)
+	return p
+}
+
+// Preview returns the disbursements calculated by a dry run pipeline
+func (pp *pipeline) Preview() []entities.MerchantDisbursement {
+	if dryRun, ok := pp.querier.(*dryRunQuerier); ok {
+		return dryRun.disbursements
+	}
+	return nil
+}
+
+// AcquireLock does not lock, a dry run does not write so it can run next to a processor
+func (q *dryRunQuerier) AcquireLock(context.Context, string, bool) error {
+	return nil
+}
+
+func (q *dryRunQuerier) ReleaseLock(context.Context, string) error {
+	return nil
+}
+
+// InsertDisbursement keeps the disbursement in memory
+// A daily disbursement records its day only, the refunds and chargebacks summed up to it are no longer summed by the next days
+func (q *dryRunQuerier) InsertDisbursement(_ context.Context, disbursement entities.MerchantDisbursement) error {
+	if disbursement.ID == uuid.Nil {
+		disbursement.ID = uuid.New()
+	}
+	disbursement.CreatedAt = time.Now()
+
+	if disbursement.DisbursementFrequency == entities.DailyDisbursementFrequency {
+		if len(disbursement.RefundIDs) > 0 {
+			q.refundsDeducted = disbursement.OrdersStartAt
+		}
+		if len(disbursement.ChargebackIDs) > 0 {
+			q.chargebacksDeducted = disbursement.OrdersStartAt
+		}
+	}
+
+	q.disbursements = append(q.disbursements, disbursement)
+	return nil
+}
+
+// SelectMerchantBalance returns the amount carried forward by the last daily disbursement of the merchant in the currency
+// in the dry run, the balance it left, or the persisted balance when the dry run did not disburse the merchant in it yet
+func (q *dryRunQuerier) SelectMerchantBalance(ctx context.Context, merchantID uuid.UUID, currency string) (float64, error) {
+	for i := len(q.disbursements) - 1; i >= 0; i-- {
+		disbursement := q.disbursements[i]
+		if keyOf(disbursement) == (merchantCurrency{merchantID: merchantID, currency: currency}) &&
+			disbursement.DisbursementFrequency == entities.DailyDisbursementFrequency {
+			return -disbursement.CarryForwardAmount, nil
+		}
+	}
+	return q.Querier.SelectMerchantBalance(ctx, merchantID, currency)
+}
+
+// SelectSumRefunds leaves out the refunds deducted on a previous day of the dry run, as they are still pending in the database
+func (q *dryRunQuerier) SelectSumRefunds(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error) {
+	refunds, err := q.Querier.SelectSumRefunds(ctx, day)
+	if err != nil || q.refundsDeducted.IsZero() {
+		return refunds, err
+	}
+
+	deducted, err := q.Querier.SelectSumRefunds(ctx, q.refundsDeducted)
+	if err != nil {
+		return nil, err
+	}
+	byMerchant := make(map[merchantCurrency]entities.MerchantDisbursement, len(deducted))
+	for _, sum := range deducted {
+		byMerchant[keyOf(sum)] = sum
+	}
+
+	var left []entities.MerchantDisbursement
+	for _, sum := range refunds {
+		previous := byMerchant[keyOf(sum)]
+		sum.RefundsAmount -= previous.RefundsAmount
+		sum.RefundsTotalEntries -= previous.RefundsTotalEntries
+		sum.FeeReversalAmount -= previous.FeeReversalAmount
+		sum.RefundIDs = withoutIDs(sum.RefundIDs, previous.RefundIDs)
+		if sum.RefundsTotalEntries > 0 {
+			left = append(left, sum)
+		}
+	}
+	return left, nil
+}
+
+// SelectSumChargebacks leaves out the chargebacks deducted on a previous day of the dry run, as they are still pending in the database
+func (q *dryRunQuerier) SelectSumChargebacks(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error) {
+	chargebacks, err := q.Querier.SelectSumChargebacks(ctx, day)
+	if err != nil || q.chargebacksDeducted.IsZero() {
+		return chargebacks, err
+	}
+
+	deducted, err := q.Querier.SelectSumChargebacks(ctx, q.chargebacksDeducted)
+	if err != nil {
+		return nil, err
+	}
+	byMerchant := make(map[merchantCurrency]entities.MerchantDisbursement, len(deducted))
+	for _, sum := range deducted {
+		byMerchant[keyOf(sum)] = sum
+	}
+
+	var left []entities.MerchantDisbursement
+	for _, sum := range chargebacks {
+		previous := byMerchant[keyOf(sum)]
+		sum.ChargebacksAmount -= previous.ChargebacksAmount
+		sum.ChargebacksTotalEntries -= previous.ChargebacksTotalEntries
+		sum.ChargebackFeeAmount -= previous.ChargebackFeeAmount
+		sum.ChargebackIDs = withoutIDs(sum.ChargebackIDs, previous.ChargebackIDs)
+		if sum.ChargebacksTotalEntries > 0 {
+			left = append(left, sum)
+		}
+	}
+	return left, nil
+}
+
+// withoutIDs returns the IDs not deducted yet by the dry run
+func withoutIDs(ids, deducted []string) []string {
+	var left []string
+	for _, id := range ids {
+		if !slices.Contains(deducted, id) {
+			left = append(left, id)
+		}
+	}
+	return left
+}
+
+// MarkDisbursementsPayable links nothing, the unpayable disbursements reported are the persisted ones
+func (q *dryRunQuerier) MarkDisbursementsPayable(context.Context, time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (q *dryRunQuerier) SelectSumDisbursements(ctx context.Context, from, to time.Time, frequency entities.DisbursementFrequencies) ([]entities.MerchantDisbursement, error) {
+	disbursements, err := q.Querier.SelectSumDisbursements(ctx, from, to, frequency)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index the persisted sums by merchant and currency, keeping their order
+	sums := make(map[merchantCurrency]int)
+	for i, disbursement := range disbursements {
+		sums[keyOf(disbursement)] = i
+	}
+
+	for _, disbursement := range q.inRange(uuid.Nil, "", from, to) {
+		i, exists := sums[keyOf(disbursement)]
+		if !exists {
+			disbursements = append(disbursements, newSum(disbursement.MerchantID, disbursement.Currency, from, to, frequency))
+			i = len(disbursements) - 1
+			sums[keyOf(disbursement)] = i
+		}
+		addToSum(&disbursements[i], disbursement)
+	}
+
+	return disbursements, nil
+}
+
+func (q *dryRunQuerier) SelectSumDisbursementsForMerchant(ctx context.Context, merchantId uuid.UUID, currency string, from, to time.Time, frequency entities.DisbursementFrequencies) (*entities.MerchantDisbursement, error) {
+	sum, err := q.Querier.SelectSumDisbursementsForMerchant(ctx, merchantId, currency, from, to, frequency)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, disbursement := range q.inRange(merchantId, currency, from, to) {
+		if sum == nil {
+			created := newSum(merchantId, currency, from, to, frequency)
+			sum = &created
+		}
+		addToSum(sum, disbursement)
+	}
+
+	return sum, nil
+}
+
+// inRange returns the in memory daily disbursements within the dates, optionally for a single merchant and currency
+// It follows the same filter as the database sums
+func (q *dryRunQuerier) inRange(merchantId uuid.UUID, currency string, from, to time.Time) []entities.MerchantDisbursement {
+	var found []entities.MerchantDisbursement
+	for _, disbursement := range q.disbursements {
+		if disbursement.DisbursementFrequency != entities.DailyDisbursementFrequency {
+			continue
+		}
+		if merchantId != uuid.Nil && disbursement.MerchantID != merchantId {
+			continue
+		}
+		if currency != "" && disbursement.Currency != currency {
+			continue
+		}
+		if disbursement.OrdersStartAt.Before(from) || disbursement.OrdersEndAt.After(to) {
+			continue
+		}
+		found = append(found, disbursement)
+	}
+	return found
+}
+
+func newSum(merchantId uuid.UUID, currency string, from, to time.Time, frequency entities.DisbursementFrequencies) entities.MerchantDisbursement {
+	return entities.MerchantDisbursement{
+		ID:                    uuid.New(),
+		MerchantID:            merchantId,
+		Currency:              currency,
+		DisbursementFrequency: frequency,
+		OrdersStartAt:         from,
+		OrdersEndAt:           to,
+		CreatedAt:             time.Now(),
+	}
+}
+
+func addToSum(sum *entities.MerchantDisbursement, disbursement entities.MerchantDisbursement) {
+	sum.FeeAmount += disbursement.FeeAmount
+	sum.FeeAmountCorrection += disbursement.FeeAmountCorrection
+	sum.OrdersSumAmount += disbursement.OrdersSumAmount
+	sum.OrdersTotalEntries += disbursement.OrdersTotalEntries
+	sum.RefundsAmount += disbursement.RefundsAmount
+	sum.RefundsTotalEntries += disbursement.RefundsTotalEntries
+	sum.FeeReversalAmount += disbursement.FeeReversalAmount
+	sum.ChargebacksAmount += disbursement.ChargebacksAmount
+	sum.ChargebacksTotalEntries += disbursement.ChargebacksTotalEntries
+	sum.ChargebackFeeAmount += disbursement.ChargebackFeeAmount
+	sum.CarriedAmount += disbursement.CarriedAmount
+	sum.CarryForwardAmount += disbursement.CarryForwardAmount
+	sum.NetAmount += disbursement.NetAmount
+}
+
+// PreviewTable builds the report of the disbursements calculated by a dry run
+func PreviewTable(disbursements []entities.MerchantDisbursement) *report.Table {
+	table := report.NewTable(
+		"merchant_id",
+		"currency",
+		"disbursement_frequency",
+		"orders_start_at",
+		"orders_end_at",
+		"orders_total_entries",
+		"orders_sum_amount",
+		"fee_amount",
+		"fee_amount_correction",
+		"refunds_total_entries",
+		"refunds_amount",
+		"fee_reversal_amount",
+		"chargebacks_total_entries",
+		"chargebacks_amount",
+		"chargeback_fee_amount",
+		"carried_amount",
+		"carry_forward_amount",
+		"net_amount")
+
+	for _, disbursement := range disbursements {
+		table.AddRow(
+			disbursement.MerchantID.String(),
+			disbursement.Currency,
+			string(disbursement.DisbursementFrequency),
+			disbursement.OrdersStartAt,
+			disbursement.OrdersEndAt,
+			disbursement.OrdersTotalEntries,
+			disbursement.OrdersSumAmount,
+			disbursement.FeeAmount,
+			disbursement.FeeAmountCorrection,
+			disbursement.RefundsTotalEntries,
+			disbursement.RefundsAmount,
+			disbursement.FeeReversalAmount,
+			disbursement.ChargebacksTotalEntries,
+			disbursement.ChargebacksAmount,
+			disbursement.ChargebackFeeAmount,
+			disbursement.CarriedAmount,
+			disbursement.CarryForwardAmount,
+			disbursement.NetAmount)
+	}
+
+	return table
+}
@@ -0,0 +1,284 @@
+package order_process
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunPipelineDoesNotWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	merchantID := uuid.New()
+	sunday := time.Date(2023, 1, 8, 0, 0, 0, 0, time.UTC)
+	monday := time.Date(2023, 1, 9, 0, 0, 0, 0, time.UTC)
+
+	dailyDisbursement := func(day time.Time) []entities.MerchantDisbursement {
+		return []entities.MerchantDisbursement{{
+			ID:                    uuid.New(),
+			MerchantID:            merchantID,
+			DisbursementFrequency: entities.DailyDisbursementFrequency,
+			OrdersStartAt:         day,
+			OrdersEndAt:           day,
+			FeeAmount:             1.0,
+			OrdersSumAmount:       100.0,
+			OrdersTotalEntries:    2,
+		}}
+	}
+
+	// Set up mock querier, no locks nor writes are expected
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumOrders", ctx, sunday).Return(dailyDisbursement(sunday), nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
+	mockQuerier.On("SelectSumOrders", ctx, monday).Return(dailyDisbursement(monday), nil)
+
+	// The database already holds a daily disbursement of the week
+	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, entities.WeeklyDisbursementFrequency).Return(
+		[]entities.MerchantDisbursement{{
+			MerchantID:            merchantID,
+			DisbursementFrequency: entities.WeeklyDisbursementFrequency,
+			FeeAmount:             0.5,
+			OrdersSumAmount:       50.0,
+			OrdersTotalEntries:    1,
+		}}, nil)
+
+	// The persisted disbursements are reported as unpayable, the dry run links none
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, mock.Anything).Return(
+		[]entities.MerchantDisbursement{{MerchantID: merchantID}}, nil)
+
+	weeklyCreated := testutil.ToFloat64(metrics.DisbursementsCreated.WithLabelValues(string(entities.WeeklyDisbursementFrequency)))
+
+	p := NewDryRunPipeline(ctx, mockQuerier, system.DefaultConfig())
+
+	_, err := p.Run(sunday)
+	require.NoError(t, err)
+	result, err := p.Run(monday)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Disbursements[entities.WeeklyDisbursementFrequency])
+	require.Equal(t, 0, result.Payable)
+	require.Equal(t, 1, result.Unpayable)
+
+	mockQuerier.AssertNotCalled(t, "AcquireLock", mock.Anything, mock.Anything, mock.Anything)
+	mockQuerier.AssertNotCalled(t, "InsertDisbursement", mock.Anything, mock.Anything)
+	mockQuerier.AssertNotCalled(t, "MarkDisbursementsPayable", mock.Anything, mock.Anything)
+	require.Equal(t, weeklyCreated, testutil.ToFloat64(metrics.DisbursementsCreated.WithLabelValues(string(entities.WeeklyDisbursementFrequency))))
+
+	// Sunday daily, Monday daily and the weekly sum of the persisted and Sunday disbursements
+	preview := p.Preview()
+	require.Len(t, preview, 3)
+	require.Equal(t, entities.DailyDisbursementFrequency, preview[0].DisbursementFrequency)
+	require.Equal(t, entities.DailyDisbursementFrequency, preview[1].DisbursementFrequency)
+
+	weekly := preview[2]
+	require.Equal(t, entities.WeeklyDisbursementFrequency, weekly.DisbursementFrequency)
+	require.Equal(t, merchantID, weekly.MerchantID)
+	require.Equal(t, 150.0, weekly.OrdersSumAmount)
+	require.Equal(t, 1.5, weekly.FeeAmount)
+	require.Equal(t, 3, weekly.OrdersTotalEntries)
+}
+
+func TestDryRunPipelineUsesConfig(t *testing.T) {
+	cfg := system.DefaultConfig()
+	cfg.Fees.ChargebackFee = 20
+	cfg.Processor.WaitForLock = true
+
+	// The preview calculates the fees as configured for a real run
+	p := NewDryRunPipeline(context.Background(), test_helpers.NewMockQuerier(), cfg)
+	require.Equal(t, 20.0, p.feeCalc.CalculateChargebackFee())
+	require.True(t, p.WaitForLock)
+}
+
+func TestDryRunQuerierSumsForMerchant(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+	day := time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumDisbursementsForMerchant", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	daily := entities.DailyDisbursementFrequency
+	q := &dryRunQuerier{Querier: mockQuerier}
+	err := q.InsertDisbursement(ctx, entities.MerchantDisbursement{MerchantID: merchantID, Currency: "EUR", DisbursementFrequency: daily, OrdersStartAt: day, OrdersEndAt: day, FeeAmount: 2.0})
+	require.NoError(t, err)
+	err = q.InsertDisbursement(ctx, entities.MerchantDisbursement{MerchantID: merchantID, Currency: "GBP", DisbursementFrequency: daily, OrdersStartAt: day, OrdersEndAt: day, FeeAmount: 3.0})
+	require.NoError(t, err)
+	err = q.InsertDisbursement(ctx, entities.MerchantDisbursement{MerchantID: uuid.New(), Currency: "EUR", DisbursementFrequency: daily, OrdersStartAt: day, OrdersEndAt: day, FeeAmount: 5.0})
+	require.NoError(t, err)
+	// The weekly sums of the daily disbursements are not summed again
+	err = q.InsertDisbursement(ctx, entities.MerchantDisbursement{MerchantID: merchantID, Currency: "EUR", DisbursementFrequency: entities.WeeklyDisbursementFrequency,
+		OrdersStartAt: day.AddDate(0, 0, -6), OrdersEndAt: day, FeeAmount: 2.0})
+	require.NoError(t, err)
+
+	// In range, only the merchant's daily disbursement in the currency is summed
+	sum, err := q.SelectSumDisbursementsForMerchant(ctx, merchantID, "EUR", day.AddDate(0, 0, -30), day, entities.MonthlyDisbursementFrequency)
+	require.NoError(t, err)
+	require.NotNil(t, sum)
+	require.Equal(t, 2.0, sum.FeeAmount)
+	require.Equal(t, "EUR", sum.Currency)
+
+	// Out of range, nothing to sum
+	sum, err = q.SelectSumDisbursementsForMerchant(ctx, merchantID, "EUR", day.AddDate(0, 0, 1), day.AddDate(0, 0, 2), entities.MonthlyDisbursementFrequency)
+	require.NoError(t, err)
+	require.Nil(t, sum)
+}
+
+func TestDryRunFeeAmountCorrectionWithWeeklySums(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+	day := time.Date(2023, 1, 9, 0, 0, 0, 0, time.UTC)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumDisbursementsForMerchant", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectMerchant", mock.Anything, merchantID).
+		Return(&entities.Merchant{ID: merchantID, Currency: "EUR", MinimumMonthlyFee: 10}, nil)
+
+	q := &dryRunQuerier{Querier: mockQuerier}
+	daily := entities.DailyDisbursementFrequency
+	err := q.InsertDisbursement(ctx, entities.MerchantDisbursement{MerchantID: merchantID, Currency: "EUR", DisbursementFrequency: daily, OrdersStartAt: day, OrdersEndAt: day, FeeAmount: 2.0})
+	require.NoError(t, err)
+	err = q.InsertDisbursement(ctx, entities.MerchantDisbursement{MerchantID: merchantID, Currency: "EUR", DisbursementFrequency: daily, OrdersStartAt: day.AddDate(0, 0, 1), OrdersEndAt: day.AddDate(0, 0, 1), FeeAmount: 3.0})
+	require.NoError(t, err)
+	err = q.InsertDisbursement(ctx, entities.MerchantDisbursement{MerchantID: merchantID, Currency: "EUR", DisbursementFrequency: entities.WeeklyDisbursementFrequency,
+		OrdersStartAt: day, OrdersEndAt: day.AddDate(0, 0, 6), FeeAmount: 5.0})
+	require.NoError(t, err)
+
+	// The weekly fees would reach the minimum monthly fee if summed again with the daily ones
+	correction, err := fee_calculator.NewFeeCalculator(ctx, q).
+		CalculateFeeAmountCorrection(time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), entities.MerchantDisbursement{MerchantID: merchantID, Currency: "EUR"})
+	require.NoError(t, err)
+	require.Equal(t, 5.0, correction)
+}
+
+func TestDryRunQuerierDeductsRefundsOnce(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+	monday := time.Date(2023, 1, 9, 0, 0, 0, 0, time.UTC)
+	tuesday := monday.AddDate(0, 0, 1)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumRefunds", ctx, monday).Return([]entities.MerchantDisbursement{
+		{MerchantID: merchantID, RefundsAmount: 20, RefundsTotalEntries: 1, FeeReversalAmount: 0.19, RefundIDs: []string{"r-1"}},
+	}, nil)
+	mockQuerier.On("SelectSumRefunds", ctx, tuesday).Return([]entities.MerchantDisbursement{
+		{MerchantID: merchantID, RefundsAmount: 30, RefundsTotalEntries: 2, FeeReversalAmount: 0.29, RefundIDs: []string{"r-1", "r-2"}},
+	}, nil)
+
+	q := &dryRunQuerier{Querier: mockQuerier}
+	refunds, err := q.SelectSumRefunds(ctx, monday)
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	refunds[0].DisbursementFrequency = entities.DailyDisbursementFrequency
+	refunds[0].OrdersStartAt = monday
+	require.NoError(t, q.InsertDisbursement(ctx, refunds[0]))
+
+	// The refunds deducted on Monday are still pending in the database, only Tuesday's are left
+	refunds, err = q.SelectSumRefunds(ctx, tuesday)
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.Equal(t, 10.0, refunds[0].RefundsAmount)
+	require.Equal(t, 1, refunds[0].RefundsTotalEntries)
+	require.Equal(t, []string{"r-2"}, refunds[0].RefundIDs)
+	mockQuerier.AssertNotCalled(t, "InsertDisbursement", mock.Anything, mock.Anything)
+}
+
+func TestDryRunQuerierDeductsChargebacksOnce(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+	monday := time.Date(2023, 1, 9, 0, 0, 0, 0, time.UTC)
+	tuesday := monday.AddDate(0, 0, 1)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumChargebacks", ctx, monday).Return([]entities.MerchantDisbursement{
+		{MerchantID: merchantID, ChargebacksAmount: 20, ChargebacksTotalEntries: 1, ChargebackFeeAmount: 15, ChargebackIDs: []string{"cb-1"}},
+	}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, tuesday).Return([]entities.MerchantDisbursement{
+		{MerchantID: merchantID, ChargebacksAmount: 20, ChargebacksTotalEntries: 1, ChargebackFeeAmount: 15, ChargebackIDs: []string{"cb-1"}},
+	}, nil)
+
+	q := &dryRunQuerier{Querier: mockQuerier}
+	chargebacks, err := q.SelectSumChargebacks(ctx, monday)
+	require.NoError(t, err)
+	require.Len(t, chargebacks, 1)
+	chargebacks[0].DisbursementFrequency = entities.DailyDisbursementFrequency
+	chargebacks[0].OrdersStartAt = monday
+	require.NoError(t, q.InsertDisbursement(ctx, chargebacks[0]))
+
+	// The chargeback deducted on Monday is still pending in the database, nothing is left on Tuesday
+	chargebacks, err = q.SelectSumChargebacks(ctx, tuesday)
+	require.NoError(t, err)
+	require.Empty(t, chargebacks)
+	mockQuerier.AssertNotCalled(t, "InsertDisbursement", mock.Anything, mock.Anything)
+}
+
+func TestDryRunQuerierCarriesBalance(t *testing.T) {
+	ctx := context.Background()
+	merchantID := uuid.New()
+	day := time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchantBalance", ctx, merchantID, "EUR").Return(-40.0, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, merchantID, "GBP").Return(-10.0, nil)
+
+	q := &dryRunQuerier{Querier: mockQuerier}
+	balance, err := q.SelectMerchantBalance(ctx, merchantID, "EUR")
+	require.NoError(t, err)
+	require.Equal(t, -40.0, balance)
+
+	// Once disbursed by the dry run, the balance is the one the disbursement left
+	err = q.InsertDisbursement(ctx, entities.MerchantDisbursement{
+		MerchantID:            merchantID,
+		Currency:              "EUR",
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day,
+		OrdersEndAt:           day,
+		CarriedAmount:         40,
+		CarryForwardAmount:    15,
+	})
+	require.NoError(t, err)
+
+	balance, err = q.SelectMerchantBalance(ctx, merchantID, "EUR")
+	require.NoError(t, err)
+	require.Equal(t, -15.0, balance)
+	mockQuerier.AssertNumberOfCalls(t, "SelectMerchantBalance", 1)
+
+	// The balance in another currency is not the one the disbursement left
+	balance, err = q.SelectMerchantBalance(ctx, merchantID, "GBP")
+	require.NoError(t, err)
+	require.Equal(t, -10.0, balance)
+}
+
+func TestPreviewTable(t *testing.T) {
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	table := PreviewTable([]entities.MerchantDisbursement{{
+		MerchantID:            uuid.New(),
+		Currency:              "EUR",
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         day,
+		OrdersEndAt:           day,
+		FeeAmount:             1.0,
+		FeeAmountCorrection:   0.5,
+		OrdersSumAmount:       100.0,
+		OrdersTotalEntries:    2,
+		NetAmount:             98.5,
+	}})
+
+	require.Len(t, table.Columns, 18)
+	require.Len(t, table.Rows, 1)
+	require.Equal(t, "EUR", table.Rows[0][1])
+	require.Equal(t, "daily", table.Rows[0][2])
+	require.Equal(t, 0.5, table.Rows[0][8])
+	require.Equal(t, 98.5, table.Rows[0][17])
+}
@@ -2,71 +2,235 @@ package order_process
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/ildomm/cc_sq_disbursement/database"
 	"github.com/ildomm/cc_sq_disbursement/entities"
 	"github.com/ildomm/cc_sq_disbursement/fee_calculator"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
 	"github.com/ildomm/cc_sq_disbursement/system"
-	"log"
+	"log/slog"
 	"time"
 )
 
 type pipeline struct {
-	ctx     context.Context
-	querier database.Querier
-	feeCalc fee_calculator.FeeCalculator
+	ctx         context.Context
+	querier     database.Querier
+	feeCalc     fee_calculator.FeeCalculator
+	WaitForLock bool // Wait for other processors to finish instead of giving up. This is exported so it can be overridden
+	runID       string
+	logger      *slog.Logger
+	dryRun      bool // Dry runs are not recorded in the metrics
 }
 
 func NewPipeline(ctx context.Context, querier database.Querier) *pipeline {
+	return NewPipelineWithConfig(ctx, querier, system.DefaultConfig())
+}
+
+// NewPipelineWithConfig creates a pipeline using the processor options and fee tiers of the config
+func NewPipelineWithConfig(ctx context.Context, querier database.Querier, cfg system.Config) *pipeline {
 	p := &pipeline{
-		ctx:     ctx,
-		querier: querier,
-		feeCalc: *fee_calculator.NewFeeCalculator(ctx, querier),
+		ctx:         ctx,
+		querier:     querier,
+		feeCalc:     *fee_calculator.NewFeeCalculatorWithConfig(ctx, querier, cfg.Fees),
+		WaitForLock: cfg.Processor.WaitForLock,
+		runID:       uuid.NewString(),
 	}
+	p.logger = system.ComponentLogger("processor").With(system.LogRunIDKey, p.runID)
+	p.feeCalc.SetLogger(p.logger)
 
 	return p
 }
 
-// Run starts the processing pipeline
-func (pp *pipeline) Run(day time.Time) {
-	log.Printf("start processing orders from day %s", day)
-	pp.process(day)
-	log.Printf("finish processing orders from day %s", day)
+// RunID identifies the records logged by the pipeline, across all the days it processes
+func (pp *pipeline) RunID() string {
+	return pp.runID
+}
+
+// dayLogger returns the pipeline logger with the day being processed
+func (pp *pipeline) dayLogger(day time.Time) *slog.Logger {
+	return pp.logger.With(system.LogDayKey, day.Format(time.DateOnly))
+}
+
+// Result summarises what a pipeline run produced for a day
+type Result struct {
+	Day                 time.Time
+	Disbursements       map[entities.DisbursementFrequencies]int // Disbursements created per frequency
+	OrdersCovered       int                                      // Orders included in the daily disbursements
+	OrdersSumAmount     float64
+	FeeAmount           float64
+	FeeAmountCorrection float64
+	Corrections         int // Daily disbursements with a fee amount correction applied
+	RefundsDeducted     int // Refunds deducted from the daily disbursements
+	RefundsAmount       float64
+	FeeReversalAmount   float64
+	ChargebacksDeducted int // Chargebacks deducted from the daily disbursements
+	ChargebacksAmount   float64
+	ChargebackFeeAmount float64
+	CarriedAmount       float64 // Debts of the merchants deducted from the daily disbursements
+	CarryForwardAmount  float64 // Negative results carried forward to the next disbursements
+	InDebt              int     // Daily disbursements leaving their merchant in debt
+	NetAmount           float64 // Owed to the merchants by the daily disbursements
+	Payable             int     // Disbursements linked to the verified bank account of their merchant
+	Unpayable           int     // Disbursements not paid yet whose merchant has no verified bank account, after the run
+}
+
+func newResult(day time.Time) *Result {
+	return &Result{
+		Day:           day,
+		Disbursements: make(map[entities.DisbursementFrequencies]int),
+	}
+}
+
+// Add accumulates another result into this one, used to summarise a date range
+func (r *Result) Add(other *Result) {
+	if other == nil {
+		return
+	}
+	if r.Disbursements == nil {
+		r.Disbursements = make(map[entities.DisbursementFrequencies]int)
+	}
+	for frequency, count := range other.Disbursements {
+		r.Disbursements[frequency] += count
+	}
+	r.OrdersCovered += other.OrdersCovered
+	r.OrdersSumAmount += other.OrdersSumAmount
+	r.FeeAmount += other.FeeAmount
+	r.FeeAmountCorrection += other.FeeAmountCorrection
+	r.Corrections += other.Corrections
+	r.RefundsDeducted += other.RefundsDeducted
+	r.RefundsAmount += other.RefundsAmount
+	r.FeeReversalAmount += other.FeeReversalAmount
+	r.ChargebacksDeducted += other.ChargebacksDeducted
+	r.ChargebacksAmount += other.ChargebacksAmount
+	r.ChargebackFeeAmount += other.ChargebackFeeAmount
+	r.CarriedAmount += other.CarriedAmount
+	r.CarryForwardAmount += other.CarryForwardAmount
+	r.InDebt += other.InDebt
+	r.NetAmount += other.NetAmount
+	r.Payable += other.Payable
+	r.Unpayable = other.Unpayable // Not a sum, the unpayable disbursements are counted again on every run
 }
 
-func (pp *pipeline) process(day time.Time) {
+func (r *Result) String() string {
+	return fmt.Sprintf("disbursements: daily %d, weekly %d, monthly %d; orders covered: %d; orders amount: %.2f; fee amount: %.2f; fee corrections: %d (%.2f); refunds: %d (%.2f, fee reversals %.2f); chargebacks: %d (%.2f, fees %.2f); carried: %.2f, carried forward: %.2f (in debt %d); net amount: %.2f; payable: %d, unpayable: %d",
+		r.Disbursements[entities.DailyDisbursementFrequency],
+		r.Disbursements[entities.WeeklyDisbursementFrequency],
+		r.Disbursements[entities.MonthlyDisbursementFrequency],
+		r.OrdersCovered,
+		r.OrdersSumAmount,
+		r.FeeAmount,
+		r.Corrections,
+		r.FeeAmountCorrection,
+		r.RefundsDeducted,
+		r.RefundsAmount,
+		r.FeeReversalAmount,
+		r.ChargebacksDeducted,
+		r.ChargebacksAmount,
+		r.ChargebackFeeAmount,
+		r.CarriedAmount,
+		r.CarryForwardAmount,
+		r.InDebt,
+		r.NetAmount,
+		r.Payable,
+		r.Unpayable)
+}
+
+// Lock takes the processor lock, only one processor can run at a time
+// It fails when the lock is held elsewhere, unless WaitForLock is set. The lock is held until Unlock
+func (pp *pipeline) Lock() error {
+	err := pp.querier.AcquireLock(pp.ctx, database.ProcessorLockName, pp.WaitForLock)
+	if err != nil {
+		return fmt.Errorf("error acquiring processor lock: %w", err)
+	}
+	return nil
+}
+
+// Unlock releases the processor lock taken by Lock
+func (pp *pipeline) Unlock() {
+	if err := pp.querier.ReleaseLock(pp.ctx, database.ProcessorLockName); err != nil {
+		pp.logger.Error("error releasing processor lock", system.LogErrorKey, err)
+	}
+}
+
+// Run starts the processing pipeline for the day
+// The processor lock must be held, taken once with Lock around the runs of all the days
+func (pp *pipeline) Run(day time.Time) (*Result, error) {
+	result := newResult(day)
+	logger := pp.dayLogger(day)
+
+	logger.Info("start processing orders")
+	started := time.Now()
+	err := pp.process(day, result)
+	if !pp.dryRun {
+		metrics.ObserveRun(day, started, err)
+	}
+	if err != nil {
+		logger.Error("error processing orders", system.LogErrorKey, err)
+		return result, err
+	}
+	logger.Info("finish processing orders",
+		"disbursements", result.Disbursements[entities.DailyDisbursementFrequency],
+		"orders_covered", result.OrdersCovered,
+		"refunds_deducted", result.RefundsDeducted,
+		"chargebacks_deducted", result.ChargebacksDeducted,
+		"in_debt", result.InDebt,
+		"fee_corrections", result.Corrections)
+
+	return result, nil
+}
+
+func (pp *pipeline) process(day time.Time, result *Result) error {
 
 	// Create daily disbursements
-	err := pp.dailyDisbursements(day)
+	err := pp.dailyDisbursements(day, result)
 	if err != nil {
-		log.Printf("error creating daily disbursements: %s", err)
-		return
+		return fmt.Errorf("error creating daily disbursements: %w", err)
 	}
 
 	// Create weekly disbursements
-	err = pp.weeklyDisbursements(day)
+	err = pp.weeklyDisbursements(day, result)
 	if err != nil {
-		log.Printf("error creating weekly disbursements: %s", err)
-		return
+		return fmt.Errorf("error creating weekly disbursements: %w", err)
 	}
 
 	// Create monthly disbursements
-	err = pp.monthlyDisbursements(day)
+	err = pp.monthlyDisbursements(day, result)
 	if err != nil {
-		log.Printf("error creating monthly disbursements: %s", err)
-		return
+		return fmt.Errorf("error creating monthly disbursements: %w", err)
+	}
+
+	// Link the disbursements to the bank accounts they are paid to
+	err = pp.payableDisbursements(day, result)
+	if err != nil {
+		return fmt.Errorf("error marking disbursements payable: %w", err)
 	}
+
+	return nil
 }
 
 // dailyDisbursements creates the daily disbursements for the day
-func (pp *pipeline) dailyDisbursements(day time.Time) error {
-	// TODO: Implement in a transaction
-	// Not doing right now because we are running out of time
-	// TODO: Start transaction
-
-	disbursements, err := pp.querier.SelectSumOrders(pp.ctx, day)
+// The refunds and chargebacks not deducted yet are deducted from them, whether their orders were already disbursed or not.
+// The debt of the merchant is deducted too, and a negative result is carried forward instead of being paid.
+// Each disbursement marks the orders, refunds and chargebacks it sums in its own transaction, so a run failing halfway
+// is resumed by running the day again, the merchants already disbursed having nothing left to sum.
+func (pp *pipeline) dailyDisbursements(day time.Time, result *Result) error {
+	orderSums, err := pp.querier.SelectSumOrders(pp.ctx, day)
 	if err != nil {
 		return err
 	}
+	refundSums, err := pp.querier.SelectSumRefunds(pp.ctx, day)
+	if err != nil {
+		return err
+	}
+	chargebackSums, err := pp.querier.SelectSumChargebacks(pp.ctx, day)
+	if err != nil {
+		return err
+	}
+
+	disbursements := mergeDeductions(day, orderSums, refundSums)
+	disbursements = mergeDeductions(day, disbursements, chargebackSums)
 	for _, disbursement := range disbursements {
 
 		// Check if it is necessary to correct the fee amount
@@ -76,29 +240,112 @@ func (pp *pipeline) dailyDisbursements(day time.Time) error {
 		}
 		disbursement.FeeAmountCorrection = feeAmountCorrection
 
-		err = pp.querier.InsertDisbursement(pp.ctx, disbursement)
+		// Carry the balance of the merchant in the currency, so the disbursement never pays a negative amount
+		balance, err := pp.querier.SelectMerchantBalance(pp.ctx, disbursement.MerchantID, disbursement.Currency)
 		if err != nil {
 			return err
 		}
-	}
+		disbursement.CarryBalance(balance)
 
-	if len(disbursements) > 0 {
-		// Mark orders as disbursed
-		err = pp.querier.MarkOrdersAsDisbursed(pp.ctx, day)
+		err = pp.querier.InsertDisbursement(pp.ctx, disbursement)
 		if err != nil {
 			return err
 		}
-	}
+		pp.observeDisbursement(disbursement, entities.DailyDisbursementFrequency)
+		pp.dayLogger(day).Debug("created disbursement",
+			system.LogMerchantIDKey, disbursement.MerchantID,
+			"frequency", entities.DailyDisbursementFrequency,
+			"orders", disbursement.OrdersTotalEntries,
+			"refunds", disbursement.RefundsTotalEntries,
+			"chargebacks", disbursement.ChargebacksTotalEntries,
+			"fee_amount", disbursement.FeeAmount,
+			"fee_amount_correction", disbursement.FeeAmountCorrection,
+			"carried_amount", disbursement.CarriedAmount,
+			"carry_forward_amount", disbursement.CarryForwardAmount,
+			"net_amount", disbursement.NetAmount)
 
-	// TODO: END transaction
+		result.Disbursements[entities.DailyDisbursementFrequency]++
+		result.OrdersCovered += disbursement.OrdersTotalEntries
+		result.OrdersSumAmount += disbursement.OrdersSumAmount
+		result.FeeAmount += disbursement.FeeAmount
+		result.RefundsDeducted += disbursement.RefundsTotalEntries
+		result.RefundsAmount += disbursement.RefundsAmount
+		result.FeeReversalAmount += disbursement.FeeReversalAmount
+		result.ChargebacksDeducted += disbursement.ChargebacksTotalEntries
+		result.ChargebacksAmount += disbursement.ChargebacksAmount
+		result.ChargebackFeeAmount += disbursement.ChargebackFeeAmount
+		result.CarriedAmount += disbursement.CarriedAmount
+		result.CarryForwardAmount += disbursement.CarryForwardAmount
+		if disbursement.CarryForwardAmount > 0 {
+			result.InDebt++
+		}
+		result.NetAmount += disbursement.NetAmount
+		if disbursement.FeeAmountCorrection > 0 {
+			result.FeeAmountCorrection += disbursement.FeeAmountCorrection
+			result.Corrections++
+		}
+	}
 
 	return nil
 }
 
+// merchantCurrency identifies the sums of a merchant in a currency, the disbursements being grouped by both
+type merchantCurrency struct {
+	merchantID uuid.UUID
+	currency   string
+}
+
+func keyOf(disbursement entities.MerchantDisbursement) merchantCurrency {
+	return merchantCurrency{merchantID: disbursement.MerchantID, currency: disbursement.Currency}
+}
+
+// mergeDeductions adds the sums of the refunds, or of the chargebacks, of each merchant to its daily disbursement of the day
+// in the same currency
+// A merchant with deductions but no orders gets a disbursement of the deductions alone
+func mergeDeductions(day time.Time, disbursements, deductions []entities.MerchantDisbursement) []entities.MerchantDisbursement {
+	merchants := make(map[merchantCurrency]int, len(disbursements))
+	for i, disbursement := range disbursements {
+		merchants[keyOf(disbursement)] = i
+	}
+
+	for _, deduction := range deductions {
+		i, exists := merchants[keyOf(deduction)]
+		if !exists {
+			disbursements = append(disbursements, entities.MerchantDisbursement{
+				ID:                    deduction.ID,
+				MerchantID:            deduction.MerchantID,
+				Currency:              deduction.Currency,
+				DisbursementFrequency: entities.DailyDisbursementFrequency,
+				OrdersStartAt:         day,
+				OrdersEndAt:           day,
+			})
+			i = len(disbursements) - 1
+			merchants[keyOf(deduction)] = i
+		}
+		disbursements[i].RefundsAmount += deduction.RefundsAmount
+		disbursements[i].RefundsTotalEntries += deduction.RefundsTotalEntries
+		disbursements[i].FeeReversalAmount += deduction.FeeReversalAmount
+		disbursements[i].ChargebacksAmount += deduction.ChargebacksAmount
+		disbursements[i].ChargebacksTotalEntries += deduction.ChargebacksTotalEntries
+		disbursements[i].ChargebackFeeAmount += deduction.ChargebackFeeAmount
+		disbursements[i].RefundIDs = append(disbursements[i].RefundIDs, deduction.RefundIDs...)
+		disbursements[i].ChargebackIDs = append(disbursements[i].ChargebackIDs, deduction.ChargebackIDs...)
+	}
+
+	return disbursements
+}
+
+// observeDisbursement records a created disbursement in the metrics
+func (pp *pipeline) observeDisbursement(disbursement entities.MerchantDisbursement, frequency entities.DisbursementFrequencies) {
+	if !pp.dryRun {
+		metrics.ObserveDisbursement(disbursement, frequency)
+	}
+}
+
 // weeklyDisbursements creates the weekly disbursements for the week
 // It is created on Mondays
 // It is calculated by summing the orders for the last week
-func (pp *pipeline) weeklyDisbursements(day time.Time) error {
+func (pp *pipeline) weeklyDisbursements(day time.Time, result *Result) error {
 	if day.Weekday() != time.Monday {
 		return nil
 	}
@@ -117,10 +364,24 @@ func (pp *pipeline) weeklyDisbursements(day time.Time) error {
 	}
 
 	for _, disbursement := range disbursements {
+		disbursement.CalculateNetAmount()
+
 		err = pp.querier.InsertDisbursement(pp.ctx, disbursement)
+		if errors.Is(err, database.ErrorDisbursementExists) {
+			// Created by a previous run of the day
+			pp.dayLogger(day).Warn("disbursement already exists",
+				system.LogMerchantIDKey, disbursement.MerchantID,
+				"frequency", entities.WeeklyDisbursementFrequency)
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		pp.observeDisbursement(disbursement, entities.WeeklyDisbursementFrequency)
+		pp.dayLogger(day).Debug("created disbursement",
+			system.LogMerchantIDKey, disbursement.MerchantID,
+			"frequency", entities.WeeklyDisbursementFrequency)
+		result.Disbursements[entities.WeeklyDisbursementFrequency]++
 	}
 
 	return nil
@@ -129,7 +390,7 @@ func (pp *pipeline) weeklyDisbursements(day time.Time) error {
 // monthlyDisbursements creates the monthly disbursements for the month
 // It is created on the first day of the month
 // It is calculated by summing the orders for the last month
-func (pp *pipeline) monthlyDisbursements(day time.Time) error {
+func (pp *pipeline) monthlyDisbursements(day time.Time, result *Result) error {
 	if day.Day() != 1 {
 		return nil
 	}
@@ -144,11 +405,48 @@ func (pp *pipeline) monthlyDisbursements(day time.Time) error {
 	}
 
 	for _, disbursement := range disbursements {
+		disbursement.CalculateNetAmount()
+
 		err = pp.querier.InsertDisbursement(pp.ctx, disbursement)
+		if errors.Is(err, database.ErrorDisbursementExists) {
+			// Created by a previous run of the day
+			pp.dayLogger(day).Warn("disbursement already exists",
+				system.LogMerchantIDKey, disbursement.MerchantID,
+				"frequency", entities.MonthlyDisbursementFrequency)
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		pp.observeDisbursement(disbursement, entities.MonthlyDisbursementFrequency)
+		pp.dayLogger(day).Debug("created disbursement",
+			system.LogMerchantIDKey, disbursement.MerchantID,
+			"frequency", entities.MonthlyDisbursementFrequency)
+		result.Disbursements[entities.MonthlyDisbursementFrequency]++
+	}
+
+	return nil
+}
+
+// payableDisbursements makes the disbursements up to the day payable, linking them to the verified bank account of their merchant
+// The disbursements of merchants without a verified account are not payable, they are linked once an account is verified
+func (pp *pipeline) payableDisbursements(day time.Time, result *Result) error {
+	payable, err := pp.querier.MarkDisbursementsPayable(pp.ctx, day)
+	if err != nil {
+		return err
+	}
+	result.Payable = int(payable)
+
+	unpayable, err := pp.querier.SelectUnpayableDisbursements(pp.ctx, day)
+	if err != nil {
+		return err
+	}
+	for _, disbursement := range unpayable {
+		pp.dayLogger(day).Warn("disbursement not payable, the merchant has no verified bank account",
+			system.LogMerchantIDKey, disbursement.MerchantID,
+			"disbursement", disbursement.Reference)
 	}
+	result.Unpayable = len(unpayable)
 
 	return nil
 }
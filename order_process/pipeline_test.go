@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
 	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
 	"github.com/ildomm/cc_sq_disbursement/system"
 	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
-	"log"
+	"log/slog"
+	"slices"
 	"testing"
 	"time"
 )
@@ -54,12 +58,16 @@ func TestPipelineHappyPath(t *testing.T) {
 
 	// Return mocked data for daily disbursements
 	mockQuerier.On("SelectSumOrders", ctx, mock.Anything).Return(dailyDisbursements, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
 
 	// Return mocked data for weekly disbursements
 	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, entities.WeeklyDisbursementFrequency).Return(weeklyDisbursements, nil)
 
 	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
-	mockQuerier.On("MarkOrdersAsDisbursed", ctx, mock.Anything).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, mock.Anything).Return(int64(1), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, mock.Anything).Return(nil, nil)
 
 	// Initialize the pipeline
 	p := NewPipeline(ctx, mockQuerier)
@@ -68,7 +76,12 @@ func TestPipelineHappyPath(t *testing.T) {
 	testDay := time.Now()
 
 	// Run the pipeline for the test day
-	p.Run(testDay)
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Disbursements[entities.DailyDisbursementFrequency])
+	require.Equal(t, 1, result.OrdersCovered)
+	require.Equal(t, 100.0, result.OrdersSumAmount)
+	require.Equal(t, 10.0, result.FeeAmount)
 
 	// Assert that the expected methods were called on the mock querier
 	mockQuerier.AssertExpectations(t)
@@ -87,21 +100,29 @@ func TestPipelineOnDatabaseError(t *testing.T) {
 	// Simulate an error during SelectSumOrders
 	mockQuerier.On("SelectSumOrders", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, dbError)
 
+	// Mock logger to capture log output, the pipeline logger is set up on creation
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
+
 	// Initialize the pipeline
 	p := NewPipeline(ctx, mockQuerier)
 
 	// Define a test day
 	testDay := time.Now()
 
-	// Mock logger to capture log output
-	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
-
 	// Run the pipeline for the test day
-	p.Run(testDay)
-
-	// Assert that the error was logged
-	mockLog.AssertContains(t, "error creating daily disbursements: database error")
+	_, err := p.Run(testDay)
+
+	// Assert that the error was returned and logged
+	require.Error(t, err)
+	require.ErrorIs(t, err, dbError)
+	require.Equal(t, "error creating daily disbursements: database error", err.Error())
+	mockLog.AssertRecord(t, "error processing orders", map[string]any{
+		"component": "processor",
+		"run_id":    p.RunID(),
+		"day":       testDay.Format(time.DateOnly),
+		"error":     "error creating daily disbursements: database error",
+	})
 
 	// Assert that the expected method was called on the mock querier
 	mockQuerier.AssertExpectations(t)
@@ -126,6 +147,7 @@ func TestPipelineSingleDailyDisbursement(t *testing.T) {
 			FeeAmountCorrection:   0.0,
 			OrdersSumAmount:       100.0,
 			OrdersTotalEntries:    1,
+			OrderIDs:              []string{"o-1"},
 			CreatedAt:             testDay,
 		},
 	}
@@ -133,31 +155,42 @@ func TestPipelineSingleDailyDisbursement(t *testing.T) {
 	// Set up mock querier
 	mockQuerier := test_helpers.NewMockQuerier()
 	mockQuerier.On("SelectSumOrders", ctx, testDay).Return(dailyDisbursement, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
 
 	// Set up expectations for SelectSumDisbursements
 	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
 
 	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
-	mockQuerier.On("MarkOrdersAsDisbursed", ctx, testDay).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(1), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	// Mock logger to capture log output, the pipeline logger is set up on creation
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
 
 	// Initialize the pipeline
 	p := NewPipeline(ctx, mockQuerier)
 
-	// Mock logger to capture log output
-	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
-
 	// Run the pipeline for the test day
-	p.Run(testDay)
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Disbursements[entities.DailyDisbursementFrequency])
+	require.Equal(t, 0, result.Corrections)
 
 	// Assert that the expected methods were called on the mock querier
 	mockQuerier.AssertCalled(t, "SelectSumOrders", ctx, testDay)
 	mockQuerier.AssertNumberOfCalls(t, "InsertDisbursement", len(dailyDisbursement))
-	mockQuerier.AssertCalled(t, "MarkOrdersAsDisbursed", ctx, testDay)
+
+	// The disbursement marks the orders it sums, in its transaction
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return slices.Equal(d.OrderIDs, []string{"o-1"})
+	}))
 
 	// Assert that the log contains expected messages
-	mockLog.AssertContains(t, "start processing orders from day")
-	mockLog.AssertContains(t, "finish processing orders from day")
+	mockLog.AssertRecord(t, "start processing orders", map[string]any{"run_id": p.RunID(), "day": testDay.Format(time.DateOnly)})
+	mockLog.AssertRecord(t, "finish processing orders", map[string]any{"run_id": p.RunID(), "disbursements": 1})
 }
 
 func TestPipelineSingleDailyDisbursementWithFeeAmountCorrection(t *testing.T) {
@@ -186,31 +219,41 @@ func TestPipelineSingleDailyDisbursementWithFeeAmountCorrection(t *testing.T) {
 	// Set up mock querier
 	mockQuerier := test_helpers.NewMockQuerier()
 	mockQuerier.On("SelectSumOrders", ctx, testDay).Return(dailyDisbursement, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
 
 	// Set up expectations for SelectSumDisbursements
 	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
 
 	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
-	mockQuerier.On("MarkOrdersAsDisbursed", ctx, testDay).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(1), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	// Mock logger to capture log output, the pipeline logger is set up on creation
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
 
 	// Initialize the pipeline
 	p := NewPipeline(ctx, mockQuerier)
 
-	// Mock logger to capture log output
-	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
-
 	// Run the pipeline for the test day
-	p.Run(testDay)
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Disbursements[entities.DailyDisbursementFrequency])
 
 	// Assert that the expected methods were called on the mock querier
 	mockQuerier.AssertCalled(t, "SelectSumOrders", ctx, testDay)
 	mockQuerier.AssertNumberOfCalls(t, "InsertDisbursement", len(dailyDisbursement))
-	mockQuerier.AssertCalled(t, "MarkOrdersAsDisbursed", ctx, testDay)
 
 	// Assert that the log contains expected messages
-	mockLog.AssertContains(t, "start processing orders from day")
-	mockLog.AssertContains(t, "finish processing orders from day")
+	mockLog.AssertRecord(t, "start processing orders", map[string]any{"run_id": p.RunID(), "day": testDay.Format(time.DateOnly)})
+	mockLog.AssertRecord(t, "finish processing orders", map[string]any{"run_id": p.RunID(), "disbursements": 1})
+	mockLog.AssertRecord(t, "created disbursement", map[string]any{
+		"run_id":      p.RunID(),
+		"merchant_id": dailyDisbursement[0].MerchantID,
+		"frequency":   entities.DailyDisbursementFrequency,
+	})
 }
 
 func TestPipelineWeeklyDailyDisbursement(t *testing.T) {
@@ -255,22 +298,27 @@ func TestPipelineWeeklyDailyDisbursement(t *testing.T) {
 	// Set up mock querier
 	mockQuerier := test_helpers.NewMockQuerier()
 	mockQuerier.On("SelectSumOrders", ctx, testDay).Return(dailyDisbursement, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
 
 	// Set up expectations for SelectSumDisbursements
 	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, mock.Anything).Return(weeklyDisbursement, nil)
 
 	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
-	mockQuerier.On("MarkOrdersAsDisbursed", ctx, testDay).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(1), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	// Mock logger to capture log output, the pipeline logger is set up on creation
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
 
 	// Initialize the pipeline
 	p := NewPipeline(ctx, mockQuerier)
 
-	// Mock logger to capture log output
-	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
-
 	// Run the pipeline for the test day
-	p.Run(testDay)
+	_, err := p.Run(testDay)
+	require.NoError(t, err)
 
 	// Assert that the expected methods were called on the mock querier
 	mockQuerier.AssertCalled(t, "SelectSumOrders", ctx, testDay)
@@ -317,22 +365,27 @@ func TestPipelineSingleMonthlyDisbursement(t *testing.T) {
 	// Set up mock querier
 	mockQuerier := test_helpers.NewMockQuerier()
 	mockQuerier.On("SelectSumOrders", ctx, testDay).Return(dailyDisbursement, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
 
 	// Set up expectations for SelectSumDisbursements
 	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, mock.Anything).Return(monthlyDisbursement, nil)
 
 	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
-	mockQuerier.On("MarkOrdersAsDisbursed", ctx, testDay).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(1), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	// Mock logger to capture log output, the pipeline logger is set up on creation
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
 
 	// Initialize the pipeline
 	p := NewPipeline(ctx, mockQuerier)
 
-	// Mock logger to capture log output
-	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
-
 	// Run the pipeline for the test day
-	p.Run(testDay)
+	_, err := p.Run(testDay)
+	require.NoError(t, err)
 
 	// Assert that the expected methods were called on the mock querier
 	mockQuerier.AssertCalled(t, "SelectSumOrders", ctx, testDay)
@@ -367,22 +420,27 @@ func TestPipelineFeeAmountCorrectionWithoutLastMonth(t *testing.T) {
 	// Set up mock querier
 	mockQuerier := test_helpers.NewMockQuerier()
 	mockQuerier.On("SelectSumOrders", ctx, testDay).Return(dailyDisbursement, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
 
 	// Set up expectations for SelectSumDisbursements
 	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, mock.Anything).Return(monthlyDisbursement, nil)
 
 	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
-	mockQuerier.On("MarkOrdersAsDisbursed", ctx, testDay).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(1), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	// Mock logger to capture log output, the pipeline logger is set up on creation
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
 
 	// Initialize the pipeline
 	p := NewPipeline(ctx, mockQuerier)
 
-	// Mock logger to capture log output
-	mockLog := test_helpers.NewLogMocker()
-	log.SetOutput(mockLog)
-
 	// Run the pipeline for the test day
-	p.Run(testDay)
+	_, err := p.Run(testDay)
+	require.NoError(t, err)
 
 	// Assert that the expected methods were called on the mock querier
 	mockQuerier.AssertCalled(t, "SelectSumOrders", ctx, testDay)
@@ -418,13 +476,450 @@ func TestPipelineMonthlyDisbursements(t *testing.T) {
 	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, entities.MonthlyDisbursementFrequency).Return(monthlyDisbursement, nil)
 	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
 
-	err := p.monthlyDisbursements(firstDayOfMonth)
+	err := p.monthlyDisbursements(firstDayOfMonth, newResult(firstDayOfMonth))
 	require.NoError(t, err)
 	mockQuerier.AssertNumberOfCalls(t, "InsertDisbursement", len(monthlyDisbursement))
 
 	// Test 2: Run on a day other than the first of the month
 	nonFirstDayOfMonth := time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)
-	err = p.monthlyDisbursements(nonFirstDayOfMonth)
+	err = p.monthlyDisbursements(nonFirstDayOfMonth, newResult(nonFirstDayOfMonth))
 	require.NoError(t, err)
 	mockQuerier.AssertNumberOfCalls(t, "InsertDisbursement", len(monthlyDisbursement)) // Assert that no new calls were made
 }
+
+func TestPipelineWhenLockIsHeld(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Set up mock querier, another processor holds the lock
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("AcquireLock", ctx, database.ProcessorLockName, false).Return(database.ErrorLockHeld)
+
+	// Initialize the pipeline
+	p := NewPipeline(ctx, mockQuerier)
+
+	// Take the lock
+	err := p.Lock()
+	require.ErrorIs(t, err, database.ErrorLockHeld)
+	require.Equal(t, "error acquiring processor lock: lock is held by another process", err.Error())
+}
+
+func TestPipelineWaitsForLock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Set up mock querier
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("AcquireLock", ctx, database.ProcessorLockName, true).Return(nil)
+	mockQuerier.On("ReleaseLock", ctx, database.ProcessorLockName).Return(nil)
+
+	// Initialize the pipeline, waiting for the lock
+	p := NewPipeline(ctx, mockQuerier)
+	p.WaitForLock = true
+
+	// Take and release the lock
+	err := p.Lock()
+	require.NoError(t, err)
+	p.Unlock()
+
+	// Assert that the lock was acquired waiting, and released
+	mockQuerier.AssertCalled(t, "AcquireLock", ctx, database.ProcessorLockName, true)
+	mockQuerier.AssertCalled(t, "ReleaseLock", ctx, database.ProcessorLockName)
+}
+
+func TestPipelineRunAssumesLockIsHeld(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Set up mock querier
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("AcquireLock", ctx, database.ProcessorLockName, false).Return(nil)
+	mockQuerier.On("ReleaseLock", ctx, database.ProcessorLockName).Return(nil)
+	mockQuerier.On("SelectSumOrders", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
+	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, mock.Anything).Return(int64(0), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, mock.Anything).Return(nil, nil)
+
+	// Initialize the pipeline, locked once for several days
+	p := NewPipeline(ctx, mockQuerier)
+	err := p.Lock()
+	require.NoError(t, err)
+
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, d := range []time.Time{day, day.AddDate(0, 0, 1)} {
+		_, err = p.Run(d)
+		require.NoError(t, err)
+	}
+	p.Unlock()
+
+	// Assert that the lock was taken once around both days
+	mockQuerier.AssertNumberOfCalls(t, "AcquireLock", 1)
+	mockQuerier.AssertNumberOfCalls(t, "SelectSumOrders", 2)
+	mockQuerier.AssertNumberOfCalls(t, "ReleaseLock", 1)
+}
+
+func TestPipelineResultOnMonday(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A Monday which is also the first day of the month
+	testDay := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	disbursement := entities.MerchantDisbursement{
+		ID:                  uuid.New(),
+		MerchantID:          uuid.New(),
+		FeeAmount:           1.0,
+		FeeAmountCorrection: 0.0,
+		OrdersSumAmount:     100.0,
+		OrdersTotalEntries:  2,
+	}
+
+	// Set up mock querier
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumOrders", ctx, testDay).Return([]entities.MerchantDisbursement{disbursement}, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
+	mockQuerier.On("SelectSumDisbursementsForMerchant", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		&entities.MerchantDisbursement{FeeAmount: 4.0}, nil)
+	mockQuerier.On("SelectMerchant", ctx, disbursement.MerchantID).Return(&entities.Merchant{MinimumMonthlyFee: 10.0}, nil)
+	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, mock.Anything).Return(
+		[]entities.MerchantDisbursement{disbursement, disbursement}, nil)
+	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(1), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	monthly := testutil.ToFloat64(metrics.DisbursementsCreated.WithLabelValues(string(entities.MonthlyDisbursementFrequency)))
+	corrections := testutil.ToFloat64(metrics.FeeCorrectionsAmount)
+
+	p := NewPipeline(ctx, mockQuerier)
+
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.Equal(t, testDay, result.Day)
+	require.Equal(t, 1, result.Disbursements[entities.DailyDisbursementFrequency])
+	require.Equal(t, 2, result.Disbursements[entities.WeeklyDisbursementFrequency])
+	require.Equal(t, 2, result.Disbursements[entities.MonthlyDisbursementFrequency])
+	require.Equal(t, 2, result.OrdersCovered)
+	require.Equal(t, 1, result.Corrections)
+	require.Equal(t, 6.0, result.FeeAmountCorrection)
+	require.Equal(t, 93.0, result.NetAmount)
+
+	// The net amount is calculated for every frequency
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.FeeAmountCorrection == 6.0 && d.NetAmount == 93.0
+	}))
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.FeeAmountCorrection == 0 && d.NetAmount == 99.0
+	}))
+
+	// The run is recorded in the metrics
+	require.Equal(t, monthly+2, testutil.ToFloat64(metrics.DisbursementsCreated.WithLabelValues(string(entities.MonthlyDisbursementFrequency))))
+	require.Equal(t, corrections+6, testutil.ToFloat64(metrics.FeeCorrectionsAmount))
+	require.Equal(t, float64(testDay.Unix()), testutil.ToFloat64(metrics.LastProcessedDay))
+
+	// Accumulate into a range summary
+	var total Result
+	total.Add(result)
+	total.Add(result)
+	total.Add(nil)
+	require.Equal(t, 2, total.Disbursements[entities.DailyDisbursementFrequency])
+	require.Equal(t, 4, total.OrdersCovered)
+	require.Equal(t, 200.0, total.OrdersSumAmount)
+}
+
+func TestPipelineSkipsExistingDisbursements(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A Monday, rerun after a run which created the weekly disbursement of one merchant and failed
+	testDay := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+	created := entities.MerchantDisbursement{MerchantID: uuid.New(), DisbursementFrequency: entities.WeeklyDisbursementFrequency}
+	pending := entities.MerchantDisbursement{MerchantID: uuid.New(), DisbursementFrequency: entities.WeeklyDisbursementFrequency}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumOrders", ctx, testDay).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumRefunds", ctx, testDay).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, testDay)
+	mockQuerier.On("SelectSumDisbursements", ctx, mock.Anything, mock.Anything, entities.WeeklyDisbursementFrequency).Return(
+		[]entities.MerchantDisbursement{created, pending}, nil)
+	mockQuerier.On("InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == created.MerchantID
+	})).Return(database.ErrorDisbursementExists)
+	mockQuerier.On("InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == pending.MerchantID
+	})).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(1), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
+
+	p := NewPipeline(ctx, mockQuerier)
+
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Disbursements[entities.WeeklyDisbursementFrequency])
+	mockLog.AssertRecord(t, "disbursement already exists", map[string]any{"merchant_id": created.MerchantID.String()})
+
+	// A daily disbursement is not skipped, the orders it sums were disbursed by another one
+	mockQuerier = test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumOrders", ctx, testDay).Return([]entities.MerchantDisbursement{
+		{MerchantID: created.MerchantID, DisbursementFrequency: entities.DailyDisbursementFrequency, OrdersStartAt: testDay, OrdersTotalEntries: 1},
+	}, nil)
+	mockQuerier.On("SelectSumRefunds", ctx, testDay).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, testDay)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(database.ErrorDisbursementExists)
+
+	_, err = NewPipeline(ctx, mockQuerier).Run(testDay)
+	require.ErrorIs(t, err, database.ErrorDisbursementExists)
+}
+
+func TestPipelineUnpayableDisbursements(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A Tuesday, only daily disbursements are created
+	testDay := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	unpayable := entities.MerchantDisbursement{
+		ID:         uuid.New(),
+		Reference:  "D-UNPAYABLE",
+		MerchantID: uuid.New(),
+	}
+
+	// Set up mock querier
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumOrders", ctx, testDay).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, mock.Anything).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, mock.Anything)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(3), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return([]entities.MerchantDisbursement{unpayable}, nil)
+
+	// Mock logger to capture log output, the pipeline logger is set up on creation
+	mockLog := test_helpers.NewLogMocker()
+	slog.SetDefault(mockLog.Logger())
+
+	p := NewPipeline(ctx, mockQuerier)
+
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.Equal(t, 3, result.Payable)
+	require.Equal(t, 1, result.Unpayable)
+
+	// Each unpayable disbursement is reported
+	mockLog.AssertRecord(t, "disbursement not payable, the merchant has no verified bank account", map[string]any{
+		"merchant_id":  unpayable.MerchantID,
+		"disbursement": unpayable.Reference,
+	})
+
+	// The unpayable disbursements are counted again on every run, not summed
+	var total Result
+	total.Add(result)
+	total.Add(result)
+	require.Equal(t, 6, total.Payable)
+	require.Equal(t, 1, total.Unpayable)
+}
+
+func TestPipelineDeductsRefunds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A Tuesday, only daily disbursements are created
+	testDay := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	withOrders := entities.MerchantDisbursement{
+		ID:                    uuid.New(),
+		MerchantID:            uuid.New(),
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         testDay,
+		OrdersEndAt:           testDay,
+		FeeAmount:             1.0,
+		OrdersSumAmount:       100.0,
+		OrdersTotalEntries:    2,
+	}
+
+	// The refunds of one merchant with orders on the day, and of one without, whose orders were already disbursed
+	refunds := []entities.MerchantDisbursement{
+		{ID: uuid.New(), MerchantID: withOrders.MerchantID, RefundsAmount: 20, RefundsTotalEntries: 1, FeeReversalAmount: 0.19, RefundIDs: []string{"r-1"}},
+		{ID: uuid.New(), MerchantID: uuid.New(), RefundsAmount: 50, RefundsTotalEntries: 2, FeeReversalAmount: 0.48, RefundIDs: []string{"r-2", "r-3"}},
+	}
+
+	// Set up mock querier
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumOrders", ctx, testDay).Return([]entities.MerchantDisbursement{withOrders}, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, testDay).Return(refunds, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, testDay)
+	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(0), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	p := NewPipeline(ctx, mockQuerier)
+
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.Equal(t, 2, result.Disbursements[entities.DailyDisbursementFrequency])
+	require.Equal(t, 3, result.RefundsDeducted)
+	require.Equal(t, 70.0, result.RefundsAmount)
+	require.InDelta(t, 0.67, result.FeeReversalAmount, 0.001)
+	require.InDelta(t, 79.19, result.NetAmount, 0.001)
+	require.InDelta(t, 49.52, result.CarryForwardAmount, 0.001)
+	require.Equal(t, 1, result.InDebt)
+
+	// The refunds are deducted from the disbursement of the orders of the day
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == withOrders.MerchantID && d.RefundsAmount == 20 && d.NetAmount == 79.19 &&
+			slices.Equal(d.RefundIDs, []string{"r-1"})
+	}))
+
+	// Without orders, the refunds alone are owed by the merchant, carried forward to its next disbursement
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == refunds[1].MerchantID && d.OrdersTotalEntries == 0 && d.RefundsTotalEntries == 2 &&
+			d.OrdersStartAt.Equal(testDay) && d.OrdersEndAt.Equal(testDay) && d.NetAmount == 0 && d.CarryForwardAmount == 49.52 &&
+			slices.Equal(d.RefundIDs, []string{"r-2", "r-3"})
+	}))
+	mockQuerier.AssertExpectations(t)
+}
+
+func TestPipelineDeductsChargebacks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A Tuesday, only daily disbursements are created
+	testDay := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	withOrders := entities.MerchantDisbursement{
+		ID:                    uuid.New(),
+		MerchantID:            uuid.New(),
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         testDay,
+		OrdersEndAt:           testDay,
+		FeeAmount:             1.0,
+		OrdersSumAmount:       100.0,
+		OrdersTotalEntries:    2,
+	}
+
+	// One merchant without orders on the day has both a refund and a chargeback, deducted by the same disbursement
+	withoutOrders := uuid.New()
+	refunds := []entities.MerchantDisbursement{
+		{ID: uuid.New(), MerchantID: withoutOrders, RefundsAmount: 20, RefundsTotalEntries: 1, FeeReversalAmount: 0.19, RefundIDs: []string{"r-1"}},
+	}
+	chargebacks := []entities.MerchantDisbursement{
+		{ID: uuid.New(), MerchantID: withOrders.MerchantID, ChargebacksAmount: 30, ChargebacksTotalEntries: 1, ChargebackFeeAmount: 15, ChargebackIDs: []string{"cb-1"}},
+		{ID: uuid.New(), MerchantID: withoutOrders, ChargebacksAmount: 10, ChargebacksTotalEntries: 1, ChargebackFeeAmount: 15, ChargebackIDs: []string{"cb-2"}},
+	}
+
+	// Set up mock querier
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumOrders", ctx, testDay).Return([]entities.MerchantDisbursement{withOrders}, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, mock.Anything, mock.Anything)
+	mockQuerier.On("SelectSumRefunds", ctx, testDay).Return(refunds, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, testDay).Return(chargebacks, nil)
+	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(0), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	p := NewPipeline(ctx, mockQuerier)
+
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.Equal(t, 2, result.Disbursements[entities.DailyDisbursementFrequency])
+	require.Equal(t, 2, result.ChargebacksDeducted)
+	require.Equal(t, 40.0, result.ChargebacksAmount)
+	require.Equal(t, 30.0, result.ChargebackFeeAmount)
+	require.InDelta(t, 54.0, result.NetAmount, 0.001)
+	require.InDelta(t, 44.81, result.CarryForwardAmount, 0.001)
+	require.Equal(t, 1, result.InDebt)
+
+	// The chargeback and its fee are deducted from the disbursement of the orders of the day
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == withOrders.MerchantID && d.ChargebacksAmount == 30 && d.ChargebackFeeAmount == 15 && d.NetAmount == 54 &&
+			slices.Equal(d.ChargebackIDs, []string{"cb-1"})
+	}))
+
+	// The refund and the chargeback of the merchant without orders are merged, and carried forward
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == withoutOrders && d.RefundsTotalEntries == 1 && d.ChargebacksTotalEntries == 1 &&
+			d.NetAmount == 0 && d.CarryForwardAmount == 44.81 &&
+			slices.Equal(d.RefundIDs, []string{"r-1"}) && slices.Equal(d.ChargebackIDs, []string{"cb-2"})
+	}))
+	mockQuerier.AssertExpectations(t)
+}
+
+func TestPipelineCarriesBalance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A Tuesday, only daily disbursements are created
+	testDay := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	inDebt := entities.MerchantDisbursement{
+		ID:                    uuid.New(),
+		MerchantID:            uuid.New(),
+		DisbursementFrequency: entities.DailyDisbursementFrequency,
+		OrdersStartAt:         testDay,
+		OrdersEndAt:           testDay,
+		FeeAmount:             1.0,
+		OrdersSumAmount:       100.0,
+		OrdersTotalEntries:    2,
+	}
+	inDebt.Currency = "EUR"
+	stillInDebt := inDebt
+	stillInDebt.ID = uuid.New()
+	stillInDebt.MerchantID = uuid.New()
+
+	// The same merchant in pounds carries its balance in pounds
+	inPounds := inDebt
+	inPounds.ID = uuid.New()
+	inPounds.Currency = "GBP"
+
+	// Set up mock querier
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectSumOrders", ctx, testDay).Return([]entities.MerchantDisbursement{inDebt, stillInDebt, inPounds}, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, inDebt.MerchantID, "EUR").Return(-30.5, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, inDebt.MerchantID, "GBP").Return(0.0, nil)
+	mockQuerier.On("SelectMerchantBalance", ctx, stillInDebt.MerchantID, "EUR").Return(-150.0, nil)
+	mockQuerier.On("SelectSumRefunds", ctx, testDay).Return([]entities.MerchantDisbursement{}, nil)
+	mockQuerier.On("SelectSumChargebacks", ctx, testDay)
+	mockQuerier.On("InsertDisbursement", ctx, mock.Anything).Return(nil)
+	mockQuerier.On("MarkDisbursementsPayable", ctx, testDay).Return(int64(0), nil)
+	mockQuerier.On("SelectUnpayableDisbursements", ctx, testDay).Return(nil, nil)
+
+	p := NewPipeline(ctx, mockQuerier)
+
+	result, err := p.Run(testDay)
+	require.NoError(t, err)
+	require.InDelta(t, 180.5, result.CarriedAmount, 0.001)
+	require.InDelta(t, 51.0, result.CarryForwardAmount, 0.001)
+	require.InDelta(t, 167.5, result.NetAmount, 0.001)
+	require.Equal(t, 1, result.InDebt)
+
+	// The debt is deducted from the next disbursement
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == inDebt.MerchantID && d.Currency == "EUR" && d.CarriedAmount == 30.5 && d.CarryForwardAmount == 0 && d.NetAmount == 68.5
+	}))
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == inDebt.MerchantID && d.Currency == "GBP" && d.CarriedAmount == 0 && d.NetAmount == 99
+	}))
+
+	// What the disbursement cannot cover is carried forward again, nothing is paid
+	mockQuerier.AssertCalled(t, "InsertDisbursement", ctx, mock.MatchedBy(func(d entities.MerchantDisbursement) bool {
+		return d.MerchantID == stillInDebt.MerchantID && d.CarriedAmount == 150 && d.CarryForwardAmount == 51 && d.NetAmount == 0
+	}))
+	mockQuerier.AssertExpectations(t)
+}
+
+func TestPipelineResultString(t *testing.T) {
+	result := newResult(time.Now())
+	result.Disbursements[entities.DailyDisbursementFrequency] = 3
+	result.OrdersCovered = 7
+	result.OrdersSumAmount = 350.5
+	result.FeeAmount = 3.25
+	result.NetAmount = 347.25
+
+	require.Equal(t,
+		"disbursements: daily 3, weekly 0, monthly 0; orders covered: 7; orders amount: 350.50; fee amount: 3.25; fee corrections: 0 (0.00); refunds: 0 (0.00, fee reversals 0.00); chargebacks: 0 (0.00, fees 0.00); carried: 0.00, carried forward: 0.00 (in debt 0); net amount: 347.25; payable: 0, unpayable: 0",
+		result.String())
+}
@@ -0,0 +1,116 @@
+package payout
+
+import "encoding/xml"
+
+// Namespace is the namespace of the customer credit transfer initiation messages, version 3 as accepted by SEPA banks
+const Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.001.001.03"
+
+// Layouts of the dates and times of the messages
+const (
+	dateTimeLayout = "2006-01-02T15:04:05"
+	dateLayout     = "2006-01-02"
+)
+
+// Document is an ISO 20022 pain.001 customer credit transfer initiation
+// Only the elements used for SEPA credit transfers are modelled, in the order required by the schema
+type Document struct {
+	XMLName            xml.Name                         `xml:"Document"`
+	Namespace          string                           `xml:"xmlns,attr"`
+	CreditTransferInit CustomerCreditTransferInitiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type CustomerCreditTransferInitiation struct {
+	GroupHeader        GroupHeader          `xml:"GrpHdr"`
+	PaymentInformation []PaymentInformation `xml:"PmtInf"`
+}
+
+type GroupHeader struct {
+	MessageID            string    `xml:"MsgId"`
+	CreationDateTime     string    `xml:"CreDtTm"`
+	NumberOfTransactions string    `xml:"NbOfTxs"`
+	ControlSum           string    `xml:"CtrlSum"`
+	InitiatingParty      PartyName `xml:"InitgPty"`
+}
+
+type PaymentInformation struct {
+	PaymentInformationID   string                      `xml:"PmtInfId"`
+	PaymentMethod          string                      `xml:"PmtMtd"`
+	BatchBooking           bool                        `xml:"BtchBookg"`
+	NumberOfTransactions   string                      `xml:"NbOfTxs"`
+	ControlSum             string                      `xml:"CtrlSum"`
+	PaymentTypeInformation PaymentTypeInformation      `xml:"PmtTpInf"`
+	RequestedExecutionDate string                      `xml:"ReqdExctnDt"`
+	Debtor                 PartyName                   `xml:"Dbtr"`
+	DebtorAccount          Account                     `xml:"DbtrAcct"`
+	DebtorAgent            Agent                       `xml:"DbtrAgt"`
+	ChargeBearer           string                      `xml:"ChrgBr"`
+	Transactions           []CreditTransferTransaction `xml:"CdtTrfTxInf"`
+}
+
+type PaymentTypeInformation struct {
+	ServiceLevel Code `xml:"SvcLvl"`
+}
+
+type Code struct {
+	Code string `xml:"Cd"`
+}
+
+type PartyName struct {
+	Name string `xml:"Nm"`
+}
+
+type Account struct {
+	ID AccountID `xml:"Id"`
+}
+
+type AccountID struct {
+	IBAN string `xml:"IBAN"`
+}
+
+// Agent is the bank of a party, identified by its BIC or, when not known, as not provided
+type Agent struct {
+	FinancialInstitution FinancialInstitution `xml:"FinInstnId"`
+}
+
+type FinancialInstitution struct {
+	BIC   string `xml:"BIC,omitempty"`
+	Other *Other `xml:"Othr,omitempty"`
+}
+
+type Other struct {
+	ID string `xml:"Id"`
+}
+
+type CreditTransferTransaction struct {
+	PaymentID             PaymentID             `xml:"PmtId"`
+	Amount                Amount                `xml:"Amt"`
+	CreditorAgent         *Agent                `xml:"CdtrAgt,omitempty"`
+	Creditor              PartyName             `xml:"Cdtr"`
+	CreditorAccount       Account               `xml:"CdtrAcct"`
+	RemittanceInformation RemittanceInformation `xml:"RmtInf"`
+}
+
+type PaymentID struct {
+	EndToEndID string `xml:"EndToEndId"`
+}
+
+type Amount struct {
+	InstructedAmount InstructedAmount `xml:"InstdAmt"`
+}
+
+type InstructedAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type RemittanceInformation struct {
+	Unstructured string `xml:"Ustrd"`
+}
+
+// agent returns the agent of a BIC, the BIC is optional for SEPA transfers
+func agent(bic string) Agent {
+	if bic == "" {
+		return Agent{FinancialInstitution: FinancialInstitution{Other: &Other{ID: "NOTPROVIDED"}}}
+	}
+	return Agent{FinancialInstitution: FinancialInstitution{BIC: bic}}
+}
@@ -0,0 +1,240 @@
+package payout
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/bank_account"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// ErrorNothingToPay is returned when no disbursement can be paid
+var ErrorNothingToPay = errors.New("no disbursements to pay")
+
+// SkippedNoAmount is the reason for not paying a disbursement without a positive net amount, it stays payable
+const SkippedNoAmount = "net amount is not positive"
+
+// SkippedCurrency is the reason for not paying a disbursement in another currency than euros, the only one
+// of the SEPA credit transfers, it stays payable
+const SkippedCurrency = "currency is not paid by SEPA credit transfers"
+
+// Batch is a payout file, with the records linking each disbursement to its credit transfer
+type Batch struct {
+	Record       entities.PayoutBatch
+	Instructions []entities.PayoutInstruction
+	Document     *Document
+	Skipped      []Skipped
+}
+
+// Skipped is a payable disbursement left out of a batch
+type Skipped struct {
+	Disbursement entities.PayableDisbursement
+	Reason       string
+}
+
+// Exporter builds the payout files of the disbursements, paid from the debtor account of the config
+type Exporter struct {
+	querier database.Querier
+	debtor  system.PayoutConfig
+	logger  *slog.Logger
+	now     func() time.Time
+}
+
+// NewExporter creates an exporter, failing when the debtor account is not configured
+func NewExporter(querier database.Querier, debtor system.PayoutConfig) (*Exporter, error) {
+	err := ValidateDebtor(debtor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exporter{
+		querier: querier,
+		debtor:  debtor,
+		logger:  system.ComponentLogger("payout"),
+		now:     time.Now,
+	}, nil
+}
+
+// ValidateDebtor checks the account the payouts are sent from is configured
+func ValidateDebtor(debtor system.PayoutConfig) error {
+	var errs []error
+	if debtor.DebtorName == "" {
+		errs = append(errs, errors.New("payout debtor_name is required"))
+	}
+	if err := bank_account.ValidateIBAN(debtor.DebtorIBAN); err != nil {
+		errs = append(errs, fmt.Errorf("payout debtor_iban: %w", err))
+	}
+	if debtor.DebtorBIC != "" {
+		if err := bank_account.ValidateBIC(debtor.DebtorBIC); err != nil {
+			errs = append(errs, fmt.Errorf("payout debtor_bic: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Prepare builds the batch paying the payable disbursements with orders until the day, included, that are not paid yet
+// Disbursements are payable once the processor links them to a verified bank account of their merchant, and approved.
+// The disbursements without an amount to pay, or not in euros, are skipped.
+// It returns ErrorNothingToPay, with the skipped disbursements, when no disbursement can be paid.
+func (e *Exporter) Prepare(ctx context.Context, until, executionDate time.Time) (*Batch, error) {
+	disbursements, err := e.querier.SelectPayableDisbursements(ctx, until)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting payable disbursements: %w", err)
+	}
+
+	batch := &Batch{
+		Record: entities.PayoutBatch{
+			MessageID:     entities.NewPayoutMessageID(executionDate),
+			ExecutionDate: executionDate,
+		},
+	}
+
+	var transactions []CreditTransferTransaction
+	var controlSum int64
+	for _, disbursement := range disbursements {
+		amount := int64(math.Round(disbursement.NetAmount * 100))
+
+		reason := ""
+		switch {
+		case amount <= 0:
+			reason = SkippedNoAmount
+		case disbursement.Currency != sepaCurrency:
+			reason = SkippedCurrency
+		}
+		if reason != "" {
+			e.logger.Warn("disbursement not paid",
+				system.LogMerchantIDKey, disbursement.MerchantID,
+				"disbursement", disbursement.Reference,
+				"currency", disbursement.Currency,
+				"reason", reason)
+			batch.Skipped = append(batch.Skipped, Skipped{Disbursement: disbursement, Reason: reason})
+			continue
+		}
+
+		batch.Instructions = append(batch.Instructions, entities.PayoutInstruction{
+			DisbursementID: disbursement.ID,
+			EndToEndID:     disbursement.Reference,
+			Amount:         float64(amount) / 100,
+			IBAN:           disbursement.IBAN,
+			BIC:            disbursement.BIC,
+		})
+		transactions = append(transactions, e.transaction(disbursement, amount))
+		controlSum += amount
+	}
+
+	if len(batch.Instructions) == 0 {
+		return batch, ErrorNothingToPay
+	}
+
+	batch.Record.PaymentsCount = len(batch.Instructions)
+	batch.Record.ControlSum = float64(controlSum) / 100
+	batch.Document = e.document(batch.Record, transactions, controlSum)
+
+	err = Validate(batch.Document)
+	if err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// Record stores the batch and marks its disbursements as sent, so they are not paid again
+func (e *Exporter) Record(ctx context.Context, batch *Batch) error {
+	err := e.querier.InsertPayoutBatch(ctx, &batch.Record, batch.Instructions)
+	if err != nil {
+		return fmt.Errorf("error storing payout batch: %w", err)
+	}
+	metrics.StatusChanges.WithLabelValues(string(entities.SentDisbursementStatus)).Add(float64(len(batch.Instructions)))
+
+	e.logger.Info("payout batch created",
+		"message_id", batch.Record.MessageID,
+		"execution_date", batch.Record.ExecutionDate.Format(time.DateOnly),
+		"payments", batch.Record.PaymentsCount,
+		"control_sum", batch.Record.ControlSum,
+		"skipped", len(batch.Skipped))
+	return nil
+}
+
+// Write writes the pain.001 XML of the batch
+func (b *Batch) Write(w io.Writer) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(b.Document)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// document builds the message, with a single payment from the debtor account
+func (e *Exporter) document(record entities.PayoutBatch, transactions []CreditTransferTransaction, controlSum int64) *Document {
+	count := strconv.Itoa(len(transactions))
+	sum := formatCents(controlSum)
+	debtorName := sepaText(e.debtor.DebtorName, maxNameLength)
+
+	return &Document{
+		Namespace: Namespace,
+		CreditTransferInit: CustomerCreditTransferInitiation{
+			GroupHeader: GroupHeader{
+				MessageID:            record.MessageID,
+				CreationDateTime:     e.now().UTC().Format(dateTimeLayout),
+				NumberOfTransactions: count,
+				ControlSum:           sum,
+				InitiatingParty:      PartyName{Name: debtorName},
+			},
+			PaymentInformation: []PaymentInformation{{
+				PaymentInformationID:   record.MessageID,
+				PaymentMethod:          "TRF",
+				BatchBooking:           true,
+				NumberOfTransactions:   count,
+				ControlSum:             sum,
+				PaymentTypeInformation: PaymentTypeInformation{ServiceLevel: Code{Code: "SEPA"}},
+				RequestedExecutionDate: record.ExecutionDate.Format(dateLayout),
+				Debtor:                 PartyName{Name: debtorName},
+				DebtorAccount:          Account{ID: AccountID{IBAN: e.debtor.DebtorIBAN}},
+				DebtorAgent:            agent(e.debtor.DebtorBIC),
+				ChargeBearer:           "SLEV",
+				Transactions:           transactions,
+			}},
+		},
+	}
+}
+
+// transaction builds the credit transfer of a disbursement, identified end to end by the disbursement reference
+func (e *Exporter) transaction(disbursement entities.PayableDisbursement, amount int64) CreditTransferTransaction {
+	transaction := CreditTransferTransaction{
+		PaymentID: PaymentID{EndToEndID: disbursement.Reference},
+		Amount: Amount{InstructedAmount: InstructedAmount{
+			Currency: sepaCurrency,
+			Value:    formatCents(amount),
+		}},
+		Creditor:        PartyName{Name: sepaText(disbursement.HolderName, maxNameLength)},
+		CreditorAccount: Account{ID: AccountID{IBAN: disbursement.IBAN}},
+		RemittanceInformation: RemittanceInformation{Unstructured: sepaText(fmt.Sprintf("Disbursement %s orders %s to %s",
+			disbursement.Reference,
+			disbursement.OrdersStartAt.Format(time.DateOnly),
+			disbursement.OrdersEndAt.Format(time.DateOnly)), maxRemittanceLength)},
+	}
+	if disbursement.BIC != "" {
+		creditorAgent := agent(disbursement.BIC)
+		transaction.CreditorAgent = &creditorAgent
+	}
+	return transaction
+}
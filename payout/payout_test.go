@@ -0,0 +1,199 @@
+package payout
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testDebtor = system.PayoutConfig{
+	DebtorName: "Sequra Payouts",
+	DebtorIBAN: "ES9121000418450200051332",
+	DebtorBIC:  "CAIXESBBXXX",
+}
+
+func setupPayable(reference, iban, bic string, netAmount float64) entities.PayableDisbursement {
+	return entities.PayableDisbursement{
+		MerchantDisbursement: entities.MerchantDisbursement{
+			ID:                    uuid.New(),
+			Reference:             reference,
+			MerchantID:            uuid.New(),
+			Currency:              entities.DefaultCurrency,
+			DisbursementFrequency: entities.DailyDisbursementFrequency,
+			OrdersStartAt:         time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC),
+			OrdersEndAt:           time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC),
+			NetAmount:             netAmount,
+		},
+		MerchantReference: "padberg_group",
+		IBAN:              iban,
+		BIC:               bic,
+		HolderName:        "Padberg_Group GmbH",
+	}
+}
+
+func TestNewExporter(t *testing.T) {
+	_, err := NewExporter(test_helpers.NewMockQuerier(), testDebtor)
+	require.NoError(t, err)
+
+	_, err = NewExporter(test_helpers.NewMockQuerier(), system.PayoutConfig{DebtorIBAN: "ES91 2100", DebtorBIC: "CAIX"})
+	require.ErrorContains(t, err, "debtor_name is required")
+	require.ErrorContains(t, err, `invalid IBAN "ES91 2100"`)
+	require.ErrorContains(t, err, `invalid BIC "CAIX"`)
+}
+
+func TestPrepare(t *testing.T) {
+	ctx := context.Background()
+	until := time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)
+	executionDate := time.Date(2023, 1, 16, 0, 0, 0, 0, time.UTC)
+
+	paid := setupPayable("DSB-20230115-00000001", "DE89370400440532013000", "COBADEFFXXX", 99.1)
+	withoutBIC := setupPayable("DSB-20230115-00000002", "NL91ABNA0417164300", "", 0.9)
+	negative := setupPayable("DSB-20230115-00000004", "DE89370400440532013000", "", -10)
+	otherCurrency := setupPayable("DSB-20230115-00000005", "DE89370400440532013000", "", 50)
+	otherCurrency.Currency = "GBP"
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectPayableDisbursements", ctx, until).Return([]entities.PayableDisbursement{paid, withoutBIC, negative, otherCurrency}, nil)
+
+	exporter, err := NewExporter(mockQuerier, testDebtor)
+	require.NoError(t, err)
+	exporter.now = func() time.Time { return time.Date(2023, 1, 16, 8, 30, 0, 0, time.UTC) }
+
+	batch, err := exporter.Prepare(ctx, until, executionDate)
+	require.NoError(t, err)
+
+	require.Regexp(t, `^PAY-20230116-[0-9A-F]{8}$`, batch.Record.MessageID)
+	require.Equal(t, 2, batch.Record.PaymentsCount)
+	require.Equal(t, 100.0, batch.Record.ControlSum)
+	require.Equal(t, []entities.PayoutInstruction{
+		{DisbursementID: paid.ID, EndToEndID: paid.Reference, Amount: 99.1, IBAN: paid.IBAN, BIC: paid.BIC},
+		{DisbursementID: withoutBIC.ID, EndToEndID: withoutBIC.Reference, Amount: 0.9, IBAN: withoutBIC.IBAN},
+	}, batch.Instructions)
+	require.Equal(t, []Skipped{
+		{Disbursement: negative, Reason: SkippedNoAmount},
+		{Disbursement: otherCurrency, Reason: SkippedCurrency},
+	}, batch.Skipped)
+
+	var buf bytes.Buffer
+	require.NoError(t, batch.Write(&buf))
+	output := buf.String()
+	require.Contains(t, output, `<?xml version="1.0" encoding="UTF-8"?>`)
+	require.Contains(t, output, `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.001.001.03">`)
+	require.Contains(t, output, `<CreDtTm>2023-01-16T08:30:00</CreDtTm>`)
+	require.Contains(t, output, `<ReqdExctnDt>2023-01-16</ReqdExctnDt>`)
+	require.Contains(t, output, `<CtrlSum>100.00</CtrlSum>`)
+	require.Contains(t, output, `<InstdAmt Ccy="EUR">99.10</InstdAmt>`)
+	require.Contains(t, output, `<EndToEndId>DSB-20230115-00000001</EndToEndId>`)
+	require.Contains(t, output, `<Nm>Padberg Group GmbH</Nm>`)
+	require.Contains(t, output, `<Ustrd>Disbursement DSB-20230115-00000001 orders 2023-01-15 to 2023-01-15</Ustrd>`)
+	require.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("<CdtrAgt>")), "the creditor agent is left out without a BIC")
+
+	// The file written is the document validated
+	var parsed Document
+	require.NoError(t, xml.Unmarshal(buf.Bytes(), &parsed))
+	require.NoError(t, Validate(&parsed))
+
+	batches := mockQuerier.On("InsertPayoutBatch", ctx, &batch.Record, batch.Instructions).Return(nil)
+	require.NoError(t, exporter.Record(ctx, batch))
+	mockQuerier.AssertExpectations(t)
+
+	batches.Unset()
+	mockQuerier.On("InsertPayoutBatch", ctx, &batch.Record, batch.Instructions).Return(errors.New("duplicate key"))
+	require.ErrorContains(t, exporter.Record(ctx, batch), "error storing payout batch: duplicate key")
+}
+
+func TestPrepareNothingToPay(t *testing.T) {
+	ctx := context.Background()
+	until := time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectPayableDisbursements", ctx, until).Return([]entities.PayableDisbursement{
+		setupPayable("DSB-20230115-00000003", "DE89370400440532013000", "", 0),
+	}, nil).Once()
+	mockQuerier.On("SelectPayableDisbursements", ctx, until).Return(nil, errors.New("connection refused")).Once()
+
+	exporter, err := NewExporter(mockQuerier, testDebtor)
+	require.NoError(t, err)
+
+	batch, err := exporter.Prepare(ctx, until, until)
+	require.ErrorIs(t, err, ErrorNothingToPay)
+	require.Len(t, batch.Skipped, 1)
+
+	_, err = exporter.Prepare(ctx, until, until)
+	require.ErrorContains(t, err, "error selecting payable disbursements: connection refused")
+	mockQuerier.AssertNotCalled(t, "InsertPayoutBatch", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func validDocument() *Document {
+	exporter := &Exporter{debtor: testDebtor, now: time.Now}
+	record := entities.PayoutBatch{MessageID: "PAY-20230116-1A2B3C4D", ExecutionDate: time.Date(2023, 1, 16, 0, 0, 0, 0, time.UTC)}
+	transaction := exporter.transaction(setupPayable("DSB-20230115-00000001", "DE89370400440532013000", "COBADEFFXXX", 10), 1000)
+	return exporter.document(record, []CreditTransferTransaction{transaction}, 1000)
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate(validDocument()))
+
+	tests := []struct {
+		description string
+		change      func(*Document)
+		expected    string
+	}{
+		{"Namespace", func(d *Document) { d.Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.001.001.09" }, "namespace"},
+		{"LongMessageID", func(d *Document) {
+			d.CreditTransferInit.GroupHeader.MessageID = "PAY-20230116-1A2B3C4D-0123456789ABCDEF"
+		}, "GrpHdr/MsgId"},
+		{"SlashMessageID", func(d *Document) { d.CreditTransferInit.GroupHeader.MessageID = "/PAY" }, "cannot start with /"},
+		{"CreationDateTime", func(d *Document) { d.CreditTransferInit.GroupHeader.CreationDateTime = "2023-01-16" }, "GrpHdr/CreDtTm"},
+		{"NumberOfTransactions", func(d *Document) { d.CreditTransferInit.GroupHeader.NumberOfTransactions = "2" }, `GrpHdr/NbOfTxs "2", expected 1`},
+		{"ControlSum", func(d *Document) { d.CreditTransferInit.GroupHeader.ControlSum = "10.01" }, `GrpHdr/CtrlSum "10.01", expected 10.00`},
+		{"NoPayment", func(d *Document) { d.CreditTransferInit.PaymentInformation = nil }, "no PmtInf"},
+		{"ExecutionDate", func(d *Document) { d.CreditTransferInit.PaymentInformation[0].RequestedExecutionDate = "16/01/2023" }, "ReqdExctnDt"},
+		{"DebtorIBAN", func(d *Document) { d.CreditTransferInit.PaymentInformation[0].DebtorAccount.ID.IBAN = "es91" }, `DbtrAcct: invalid IBAN "es91"`},
+		{"DebtorAgent", func(d *Document) { d.CreditTransferInit.PaymentInformation[0].DebtorAgent = Agent{} }, "DbtrAgt has no BIC"},
+		{"ServiceLevel", func(d *Document) {
+			d.CreditTransferInit.PaymentInformation[0].PaymentTypeInformation.ServiceLevel.Code = "URGP"
+		}, "SvcLvl/Cd"},
+		{"Currency", func(d *Document) { transaction(d).Amount.InstructedAmount.Currency = "USD" }, `@Ccy "USD"`},
+		{"AmountDecimals", func(d *Document) { transaction(d).Amount.InstructedAmount.Value = "10.001" }, "is not an amount"},
+		{"ZeroAmount", func(d *Document) { transaction(d).Amount.InstructedAmount.Value = "0.00" }, "is not an amount"},
+		{"CreditorBIC", func(d *Document) { transaction(d).CreditorAgent = &Agent{FinancialInstitution{BIC: "COBADE"}} }, `CdtrAgt: invalid BIC "COBADE"`},
+		{"CreditorName", func(d *Document) { transaction(d).Creditor.Name = "padberg_group" }, "outside the SEPA character set"},
+		{"EmptyRemittance", func(d *Document) { transaction(d).RemittanceInformation.Unstructured = "" }, "RmtInf/Ustrd is empty"},
+		{"RepeatedEndToEndID", func(d *Document) {
+			payment := &d.CreditTransferInit.PaymentInformation[0]
+			payment.Transactions = append(payment.Transactions, payment.Transactions[0])
+		}, "is repeated"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			document := validDocument()
+			test.change(document)
+
+			err := Validate(document)
+			require.ErrorIs(t, err, ErrorInvalidDocument)
+			require.ErrorContains(t, err, test.expected)
+		})
+	}
+}
+
+func transaction(document *Document) *CreditTransferTransaction {
+	return &document.CreditTransferInit.PaymentInformation[0].Transactions[0]
+}
+
+func TestSepaText(t *testing.T) {
+	require.Equal(t, "padberg group", sepaText("padberg_group", maxNameLength))
+	require.Equal(t, "Muller Sohne", sepaText("Muller & Sohne", maxNameLength))
+	require.Equal(t, "abc", sepaText("abcdef", 3))
+}
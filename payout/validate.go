@@ -0,0 +1,205 @@
+package payout
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorInvalidDocument is returned when a payout file does not follow the pain.001 schema and the SEPA rules
+var ErrorInvalidDocument = errors.New("invalid pain.001 document")
+
+// Restrictions of the pain.001.001.03 schema, and of the SEPA implementation guidelines
+const (
+	maxIdentifierLength = 35
+	maxNameLength       = 70
+	maxRemittanceLength = 140
+	sepaCurrency        = "EUR"
+	notProvided         = "NOTPROVIDED"
+	maxAmountCents      = 99999999999 // 999999999.99, the largest SEPA credit transfer
+)
+
+var (
+	ibanPattern   = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[a-zA-Z0-9]{1,30}$`)
+	bicPattern    = regexp.MustCompile(`^[A-Z]{6}[A-Z2-9][A-NP-Z0-9]([A-Z0-9]{3})?$`)
+	amountPattern = regexp.MustCompile(`^[0-9]{1,16}\.[0-9]{2}$`)
+	countPattern  = regexp.MustCompile(`^[0-9]{1,15}$`)
+
+	// sepaTextPattern is the Latin character set of the SEPA messages
+	sepaTextPattern = regexp.MustCompile(`^[A-Za-z0-9/\-?:().,'+ ]*$`)
+	sepaTextInvalid = regexp.MustCompile(`[^A-Za-z0-9/\-?:().,'+ ]`)
+)
+
+// Validate checks the document against the restrictions of the schema and the SEPA rules
+// All the problems found are reported
+func Validate(document *Document) error {
+	var v validator
+
+	if document.Namespace != Namespace {
+		v.addf("namespace %q, expected %q", document.Namespace, Namespace)
+	}
+
+	header := document.CreditTransferInit.GroupHeader
+	v.identifier("GrpHdr/MsgId", header.MessageID)
+	if _, err := time.Parse(dateTimeLayout, header.CreationDateTime); err != nil {
+		v.addf("GrpHdr/CreDtTm %q is not a date and time", header.CreationDateTime)
+	}
+	v.text("GrpHdr/InitgPty/Nm", header.InitiatingParty.Name, maxNameLength)
+
+	payments := document.CreditTransferInit.PaymentInformation
+	if len(payments) == 0 {
+		v.addf("no PmtInf")
+	}
+
+	var transactions int
+	var controlSum int64
+	endToEndIDs := make(map[string]bool)
+	for i, payment := range payments {
+		path := fmt.Sprintf("PmtInf[%d]", i+1)
+		v.identifier(path+"/PmtInfId", payment.PaymentInformationID)
+		v.equal(path+"/PmtMtd", payment.PaymentMethod, "TRF")
+		v.equal(path+"/PmtTpInf/SvcLvl/Cd", payment.PaymentTypeInformation.ServiceLevel.Code, "SEPA")
+		v.equal(path+"/ChrgBr", payment.ChargeBearer, "SLEV")
+		if _, err := time.Parse(dateLayout, payment.RequestedExecutionDate); err != nil {
+			v.addf("%s/ReqdExctnDt %q is not a date", path, payment.RequestedExecutionDate)
+		}
+		v.text(path+"/Dbtr/Nm", payment.Debtor.Name, maxNameLength)
+		v.iban(path+"/DbtrAcct", payment.DebtorAccount.ID.IBAN)
+		v.agent(path+"/DbtrAgt", payment.DebtorAgent)
+
+		if len(payment.Transactions) == 0 {
+			v.addf("%s has no CdtTrfTxInf", path)
+		}
+
+		var paymentSum int64
+		for j, transaction := range payment.Transactions {
+			transactionPath := fmt.Sprintf("%s/CdtTrfTxInf[%d]", path, j+1)
+
+			endToEndID := transaction.PaymentID.EndToEndID
+			v.identifier(transactionPath+"/PmtId/EndToEndId", endToEndID)
+			if endToEndIDs[endToEndID] {
+				v.addf("%s/PmtId/EndToEndId %q is repeated", transactionPath, endToEndID)
+			}
+			endToEndIDs[endToEndID] = true
+
+			amount := transaction.Amount.InstructedAmount
+			v.equal(transactionPath+"/Amt/InstdAmt/@Ccy", amount.Currency, sepaCurrency)
+			value, ok := cents(amount.Value)
+			if !ok || value <= 0 || value > maxAmountCents {
+				v.addf("%s/Amt/InstdAmt %q is not an amount from 0.01 to %s with 2 decimals", transactionPath, amount.Value, formatCents(maxAmountCents))
+			}
+			paymentSum += value
+
+			if transaction.CreditorAgent != nil {
+				v.agent(transactionPath+"/CdtrAgt", *transaction.CreditorAgent)
+			}
+			v.text(transactionPath+"/Cdtr/Nm", transaction.Creditor.Name, maxNameLength)
+			v.iban(transactionPath+"/CdtrAcct", transaction.CreditorAccount.ID.IBAN)
+			v.text(transactionPath+"/RmtInf/Ustrd", transaction.RemittanceInformation.Unstructured, maxRemittanceLength)
+		}
+
+		v.count(path+"/NbOfTxs", payment.NumberOfTransactions, len(payment.Transactions))
+		v.sum(path+"/CtrlSum", payment.ControlSum, paymentSum)
+		transactions += len(payment.Transactions)
+		controlSum += paymentSum
+	}
+
+	v.count("GrpHdr/NbOfTxs", header.NumberOfTransactions, transactions)
+	v.sum("GrpHdr/CtrlSum", header.ControlSum, controlSum)
+
+	if len(v.errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrorInvalidDocument, errors.Join(v.errs...))
+	}
+	return nil
+}
+
+// validator collects the problems of a document
+type validator struct {
+	errs []error
+}
+
+func (v *validator) addf(format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+func (v *validator) equal(path, value, expected string) {
+	if value != expected {
+		v.addf("%s %q, expected %q", path, value, expected)
+	}
+}
+
+// identifier checks the identifiers, which cannot start with a slash or contain a double slash
+func (v *validator) identifier(path, value string) {
+	v.text(path, value, maxIdentifierLength)
+	if strings.HasPrefix(value, "/") || strings.Contains(value, "//") {
+		v.addf("%s %q cannot start with / or contain //", path, value)
+	}
+}
+
+func (v *validator) text(path, value string, maxLength int) {
+	switch {
+	case value == "":
+		v.addf("%s is empty", path)
+	case len(value) > maxLength:
+		v.addf("%s %q is longer than %d characters", path, value, maxLength)
+	case !sepaTextPattern.MatchString(value):
+		v.addf("%s %q has characters outside the SEPA character set", path, value)
+	}
+}
+
+// iban checks the format of the schema, the bank accounts are checked in full when they are added
+func (v *validator) iban(path, iban string) {
+	if !ibanPattern.MatchString(iban) {
+		v.addf("%s: invalid IBAN %q", path, iban)
+	}
+}
+
+func (v *validator) agent(path string, agent Agent) {
+	institution := agent.FinancialInstitution
+	switch {
+	case institution.BIC != "":
+		if !bicPattern.MatchString(institution.BIC) {
+			v.addf("%s: invalid BIC %q", path, institution.BIC)
+		}
+	case institution.Other == nil || institution.Other.ID != notProvided:
+		v.addf("%s has no BIC, expected Othr/Id %s", path, notProvided)
+	}
+}
+
+func (v *validator) count(path, value string, expected int) {
+	if !countPattern.MatchString(value) || value != strconv.Itoa(expected) {
+		v.addf("%s %q, expected %d", path, value, expected)
+	}
+}
+
+func (v *validator) sum(path, value string, expected int64) {
+	if sum, ok := cents(value); !ok || sum != expected {
+		v.addf("%s %q, expected %s", path, value, formatCents(expected))
+	}
+}
+
+// cents parses an amount with 2 decimals into cents, so sums are exact
+func cents(amount string) (int64, bool) {
+	if !amountPattern.MatchString(amount) {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(strings.Replace(amount, ".", "", 1), 10, 64)
+	return value, err == nil
+}
+
+// formatCents formats an amount in cents with 2 decimals
+func formatCents(value int64) string {
+	return fmt.Sprintf("%d.%02d", value/100, value%100)
+}
+
+// sepaText replaces the characters outside the SEPA character set, and shortens the text to the maximum length
+func sepaText(text string, maxLength int) string {
+	text = strings.Join(strings.Fields(sepaTextInvalid.ReplaceAllString(text, " ")), " ")
+	if len(text) > maxLength {
+		text = strings.TrimSpace(text[:maxLength])
+	}
+	return text
+}
@@ -0,0 +1,193 @@
+package reconciliation
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+)
+
+// camtDocument is an ISO 20022 camt.053 bank to customer statement
+// Only the elements used for the reconciliation are modelled. Elements are matched whatever their namespace,
+// so the versions 001.02 to 001.08 are read.
+type camtDocument struct {
+	XMLName    xml.Name        `xml:"Document"`
+	Statements []camtStatement `xml:"BkToCstmrStmt>Stmt"`
+}
+
+type camtStatement struct {
+	ID      string      `xml:"Id"`
+	IBAN    string      `xml:"Acct>Id>IBAN"`
+	Entries []camtEntry `xml:"Ntry"`
+}
+
+type camtEntry struct {
+	Amount             camtAmount        `xml:"Amt"`
+	CreditDebit        string            `xml:"CdtDbtInd"`
+	Status             camtStatus        `xml:"Sts"`
+	BookingDate        camtDate          `xml:"BookgDt"`
+	AccountServicerRef string            `xml:"AcctSvcrRef"`
+	Transactions       []camtTransaction `xml:"NtryDtls>TxDtls"`
+	AdditionalInfo     string            `xml:"AddtlNtryInf"`
+}
+
+// camtStatus is the status of an entry, a code since version 001.08
+type camtStatus struct {
+	Value string `xml:",chardata"`
+	Code  string `xml:"Cd"`
+}
+
+type camtDate struct {
+	Date     string `xml:"Dt"`
+	DateTime string `xml:"DtTm"`
+}
+
+type camtAmount struct {
+	Value    string `xml:",chardata"`
+	Currency string `xml:"Ccy,attr"`
+}
+
+type camtTransaction struct {
+	EndToEndID         string      `xml:"Refs>EndToEndId"`
+	InstructionID      string      `xml:"Refs>InstrId"`
+	AccountServicerRef string      `xml:"Refs>AcctSvcrRef"`
+	Amount             *camtAmount `xml:"Amt"`               // Since version 001.04
+	TransactionAmount  *camtAmount `xml:"AmtDtls>TxAmt>Amt"` // Version 001.02
+	InstructedAmount   *camtAmount `xml:"AmtDtls>InstdAmt>Amt"`
+	Remittance         []string    `xml:"RmtInf>Ustrd"`
+	AdditionalInfo     string      `xml:"AddtlTxInf"`
+}
+
+// parseCamt053 reads the booked entries of the statements of a camt.053 file
+func parseCamt053(content []byte) (*Statement, error) {
+	var document camtDocument
+	err := xml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+	if len(document.Statements) == 0 {
+		return nil, errors.New("no statement in the camt.053 file")
+	}
+
+	statement := &Statement{
+		Format: entities.Camt053StatementFormat,
+		ID:     strings.TrimSpace(document.Statements[0].ID),
+		IBAN:   strings.TrimSpace(document.Statements[0].IBAN),
+	}
+	for _, stmt := range document.Statements {
+		for i, camt := range stmt.Entries {
+			if camt.status() != "BOOK" {
+				continue
+			}
+
+			entries, err := camt.entries()
+			if err != nil {
+				return nil, fmt.Errorf("statement %s entry %d: %w", stmt.ID, i+1, err)
+			}
+			statement.Entries = append(statement.Entries, entries...)
+		}
+	}
+	return statement, nil
+}
+
+func (e *camtEntry) status() string {
+	if e.Status.Code != "" {
+		return strings.TrimSpace(e.Status.Code)
+	}
+	return strings.TrimSpace(e.Status.Value)
+}
+
+// entries returns the entry, or an entry per transaction when a batch booking gives the amount of each one
+func (e *camtEntry) entries() ([]Entry, error) {
+	var debit bool
+	switch strings.TrimSpace(e.CreditDebit) {
+	case "DBIT":
+		debit = true
+	case "CRDT":
+		debit = false
+	default:
+		return nil, fmt.Errorf("invalid credit debit indicator %q", e.CreditDebit)
+	}
+
+	bookingDate, err := e.BookingDate.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := parseCents(e.Amount.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := Entry{
+		BookingDate:   bookingDate,
+		Amount:        amount,
+		Currency:      e.Amount.Currency,
+		Debit:         debit,
+		BankReference: strings.TrimSpace(e.AccountServicerRef),
+		Texts:         []string{e.AdditionalInfo},
+	}
+
+	split := len(e.Transactions) > 1
+	for _, transaction := range e.Transactions {
+		split = split && transaction.amount() != nil
+	}
+	if !split {
+		for _, transaction := range e.Transactions {
+			entry.Texts = append(entry.Texts, transaction.texts()...)
+		}
+		return []Entry{entry}, nil
+	}
+
+	var entries []Entry
+	var total int64
+	for _, transaction := range e.Transactions {
+		amount, err := parseCents(transaction.amount().Value)
+		if err != nil {
+			return nil, err
+		}
+		total += amount
+
+		transactionEntry := entry
+		transactionEntry.Amount = amount
+		if transaction.amount().Currency != "" {
+			transactionEntry.Currency = transaction.amount().Currency
+		}
+		if ref := strings.TrimSpace(transaction.AccountServicerRef); ref != "" {
+			transactionEntry.BankReference = ref
+		}
+		transactionEntry.Texts = transaction.texts()
+		entries = append(entries, transactionEntry)
+	}
+	if total != entry.Amount {
+		return nil, fmt.Errorf("the transactions sum %s, the entry amount is %s", formatCents(total), formatCents(entry.Amount))
+	}
+	return entries, nil
+}
+
+func (d camtDate) parse() (time.Time, error) {
+	if value := strings.TrimSpace(d.Date); value != "" {
+		return time.Parse(time.DateOnly, value)
+	}
+	if value := strings.TrimSpace(d.DateTime); len(value) >= len(time.DateOnly) {
+		return time.Parse(time.DateOnly, value[:len(time.DateOnly)])
+	}
+	return time.Time{}, errors.New("missing booking date")
+}
+
+// amount is the amount of the transaction, nil when the statement does not give it
+func (t *camtTransaction) amount() *camtAmount {
+	for _, amount := range []*camtAmount{t.Amount, t.TransactionAmount, t.InstructedAmount} {
+		if amount != nil {
+			return amount
+		}
+	}
+	return nil
+}
+
+func (t *camtTransaction) texts() []string {
+	return append([]string{t.EndToEndID, t.InstructionID, t.AdditionalInfo}, t.Remittance...)
+}
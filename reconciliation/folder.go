@@ -0,0 +1,126 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// FolderResult is the outcome of importing the statement files waiting in the folder
+type FolderResult struct {
+	Imports []*Import
+	Failed  []string // Files moved to the failed folder
+}
+
+// ImportFolder reconciles the statement files waiting in the folder of the config, in the order of their names
+// Each file is moved to the imported folder, or to the failed folder when it cannot be read or stored.
+// A file already imported is moved to the imported folder again.
+func (r *Reconciler) ImportFolder(ctx context.Context, cfg system.StatementsConfig) (*FolderResult, error) {
+	logger := r.logger.With(system.LogRunIDKey, uuid.NewString())
+
+	var files []string
+	err := filepath.Walk(cfg.WaitingPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &FolderResult{}
+	for _, file := range files {
+		fileLogger := logger.With(system.LogFileKey, file)
+
+		imported, err := r.importFile(ctx, cfg.WaitingPath, file)
+		targetFolder := cfg.ImportedPath
+		switch {
+		case errors.Is(err, ErrorAlreadyImported):
+			fileLogger.Warn("bank statement already imported", system.LogErrorKey, err)
+		case err != nil:
+			fileLogger.Error("error importing bank statement", system.LogErrorKey, err)
+			result.Failed = append(result.Failed, file)
+			targetFolder = cfg.FailedPath
+		default:
+			result.Imports = append(result.Imports, imported)
+		}
+
+		err = moveFile(cfg.WaitingPath, file, targetFolder)
+		if err != nil {
+			fileLogger.Error("error moving file", "target", targetFolder, system.LogErrorKey, err)
+		}
+
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+	}
+
+	return result, nil
+}
+
+// CreateFolders creates the waiting, imported and failed folders of the config when missing
+// A placeholder file would be imported as a statement, so the folders are not committed
+func CreateFolders(cfg system.StatementsConfig) error {
+	for _, folder := range []string{cfg.WaitingPath, cfg.ImportedPath, cfg.FailedPath} {
+		err := os.MkdirAll(folder, 0o755)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch imports the statement files waiting in the folder until the context is done, pausing between each import
+func (r *Reconciler) Watch(ctx context.Context, cfg system.StatementsConfig) {
+	r.logger.Info("watching bank statements", "waiting_path", cfg.WaitingPath, "job_pause", cfg.JobPause.String())
+
+	for {
+		_, err := r.ImportFolder(ctx, cfg)
+		if err != nil && ctx.Err() == nil {
+			r.logger.Error("error importing bank statements", system.LogErrorKey, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			r.logger.Info("stopping watching bank statements")
+			return
+		case <-time.After(cfg.JobPause):
+		}
+	}
+}
+
+// importFile reconciles a file, named in the statement by its path relative to the waiting folder
+func (r *Reconciler) importFile(ctx context.Context, waitingPath, file string) (*Import, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return r.Import(ctx, relativePath(waitingPath, file), content)
+}
+
+// moveFile moves a waiting file to the target folder, keeping its path relative to the waiting folder
+func moveFile(waitingPath, file, targetFolder string) error {
+	target := filepath.Join(targetFolder, relativePath(waitingPath, file))
+	err := os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file, target)
+}
+
+func relativePath(folder, file string) string {
+	relative, err := filepath.Rel(folder, file)
+	if err != nil {
+		return filepath.Base(file)
+	}
+	return relative
+}
@@ -0,0 +1,167 @@
+package reconciliation
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+)
+
+// mt940Field is a field of an MT940 message, like :61:, with its continuation lines
+type mt940Field struct {
+	tag   string
+	lines []string
+}
+
+var (
+	// mt940Tag starts a field, like :61: or :60F:
+	mt940Tag = regexp.MustCompile(`^:(\d{2}[A-Z]?):`)
+	// mt940StatementLine is the first line of the :61: field: value date, entry date, debit or credit mark,
+	// third letter of the currency, amount, transaction type, and the references of the customer and the bank
+	mt940StatementLine = regexp.MustCompile(`^(\d{6})(\d{4})?(RC|RD|C|D)([A-Z])?(\d+,\d{0,2})([NSF][A-Z0-9]{3})(.*)$`)
+	// mt940StructuredField separates the subfields of a structured :86: field, like ?20
+	mt940StructuredField = regexp.MustCompile(`\?\d{2}`)
+)
+
+// parseMT940 reads the entries of the statements of an MT940 file
+// The SWIFT blocks around the messages are ignored. Statements of several messages are read as one.
+func parseMT940(content []byte) (*Statement, error) {
+	fields, err := mt940Fields(content)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &Statement{Format: entities.MT940StatementFormat}
+	currency := ""
+	var last *Entry
+	for _, field := range fields {
+		value := strings.Join(field.lines, "\n")
+		switch field.tag {
+		case "20":
+			if statement.ID == "" {
+				statement.ID = strings.TrimSpace(value)
+			}
+		case "25":
+			if statement.IBAN == "" {
+				statement.IBAN = strings.TrimSpace(value)
+			}
+		case "60F", "60M":
+			// Opening balance: mark, date, currency and amount, like C230115EUR1234,56
+			if len(value) < 10 {
+				return nil, fmt.Errorf("invalid opening balance %q", value)
+			}
+			currency = value[7:10]
+		case "61":
+			if currency == "" {
+				return nil, errors.New("statement line before the opening balance")
+			}
+			entry, err := parseMT940StatementLine(field.lines, currency)
+			if err != nil {
+				return nil, err
+			}
+			statement.Entries = append(statement.Entries, *entry)
+			last = &statement.Entries[len(statement.Entries)-1]
+		case "86":
+			// Information to the account owner of the previous statement line
+			if last != nil {
+				last.Texts = append(last.Texts, mt940StructuredField.ReplaceAllString(strings.Join(field.lines, ""), ""))
+			}
+		case "62F", "62M":
+			last = nil
+		}
+	}
+
+	if statement.ID == "" {
+		return nil, errors.New("missing transaction reference :20:")
+	}
+	return statement, nil
+}
+
+// mt940Fields splits the messages of the file into their fields
+func mt940Fields(content []byte) ([]mt940Field, error) {
+	var fields []mt940Field
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		// SWIFT blocks: {1:...}{2:...}{4: before the text of the message, and -} after it
+		if strings.HasPrefix(line, "{") {
+			_, text, found := strings.Cut(line, "{4:")
+			if !found {
+				continue
+			}
+			line = text
+		}
+		if line == "" || line == "-" || line == "-}" {
+			continue
+		}
+
+		if match := mt940Tag.FindStringSubmatch(line); match != nil {
+			fields = append(fields, mt940Field{tag: match[1], lines: []string{line[len(match[0]):]}})
+			continue
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("unexpected line %q before the first field", line)
+		}
+		fields[len(fields)-1].lines = append(fields[len(fields)-1].lines, line)
+	}
+
+	return fields, scanner.Err()
+}
+
+// parseMT940StatementLine reads a :61: field, like 2301200120D99,10NTRFDSB-20230115-1A2B//BANKREF
+func parseMT940StatementLine(lines []string, currency string) (*Entry, error) {
+	match := mt940StatementLine.FindStringSubmatch(lines[0])
+	if match == nil {
+		return nil, fmt.Errorf("invalid statement line %q", lines[0])
+	}
+
+	valueDate, err := time.Parse("060102", match[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid statement line %q: %w", lines[0], err)
+	}
+	bookingDate := valueDate
+	if match[2] != "" {
+		bookingDate, err = time.Parse("0102", match[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid statement line %q: %w", lines[0], err)
+		}
+		bookingDate = entryYear(bookingDate, valueDate)
+	}
+
+	amount, err := parseCents(match[5])
+	if err != nil {
+		return nil, err
+	}
+
+	customerReference, bankReference, _ := strings.Cut(match[7], "//")
+	entry := &Entry{
+		BookingDate:   bookingDate,
+		Amount:        amount,
+		Currency:      currency,
+		Debit:         match[3] == "D" || match[3] == "RC",
+		BankReference: strings.TrimSpace(bankReference),
+		Texts:         []string{customerReference},
+	}
+	// Supplementary details on the second line
+	entry.Texts = append(entry.Texts, lines[1:]...)
+	return entry, nil
+}
+
+// entryYear gives the entry date, given without a year, the year of the value date closest to it
+func entryYear(entryDate, valueDate time.Time) time.Time {
+	date := time.Date(valueDate.Year(), entryDate.Month(), entryDate.Day(), 0, 0, 0, 0, time.UTC)
+	switch {
+	case date.Sub(valueDate) > 180*24*time.Hour:
+		return date.AddDate(-1, 0, 0)
+	case valueDate.Sub(date) > 180*24*time.Hour:
+		return date.AddDate(1, 0, 0)
+	}
+	return date
+}
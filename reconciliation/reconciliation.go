@@ -0,0 +1,226 @@
+package reconciliation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/disbursement_status"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// ErrorAlreadyImported is returned when a statement file with the same content was already imported
+var ErrorAlreadyImported = errors.New("bank statement already imported")
+
+// Import is a statement file reconciled with the disbursements
+type Import struct {
+	Statement entities.BankStatement
+	Entries   []entities.BankStatementEntry // The debits, with the result of matching them
+	Credits   int                           // Credits of the statement, not reconciled
+}
+
+// Count counts the entries with a result
+func (i *Import) Count(result entities.ReconciliationResults) int {
+	count := 0
+	for _, entry := range i.Entries {
+		if entry.Result == result {
+			count++
+		}
+	}
+	return count
+}
+
+// String summarises the results of the import
+func (i *Import) String() string {
+	counts := make([]string, 0, len(entities.ReconciliationResultsList))
+	for _, result := range entities.ReconciliationResultsList {
+		counts = append(counts, fmt.Sprintf("%s: %d", result, i.Count(result)))
+	}
+	return fmt.Sprintf("statement %s (%s) of %s: %d debit(s), %s, %d credit(s) ignored",
+		i.Statement.FileName,
+		i.Statement.Format,
+		i.Statement.IBAN,
+		len(i.Entries),
+		strings.Join(counts, ", "),
+		i.Credits)
+}
+
+// Reconciler matches the debits of the bank statements to the disbursements they pay
+type Reconciler struct {
+	querier  database.Querier
+	statuses *disbursement_status.Service
+	logger   *slog.Logger
+}
+
+// NewReconciler creates a reconciler, settling the matched disbursements
+func NewReconciler(querier database.Querier) *Reconciler {
+	return &Reconciler{
+		querier:  querier,
+		statuses: disbursement_status.NewService(querier),
+		logger:   system.ComponentLogger("reconciliation"),
+	}
+}
+
+// settlement is a matched disbursement, settled once the statement is stored
+type settlement struct {
+	disbursement *entities.MerchantDisbursement
+	change       *entities.DisbursementStatusChange
+}
+
+// Import reconciles a statement file, once
+// Each debit is matched to the disbursement with the reference it carries, expecting its net amount in euros.
+// The statement is stored with the result of every debit, the unmatched and mismatched ones being left for the
+// reconciliation report, and the matched sent disbursements are settled in the same transaction.
+// If one of them changed status meanwhile, nothing is stored and the statement can be imported again.
+func (r *Reconciler) Import(ctx context.Context, fileName string, content []byte) (*Import, error) {
+	hash := sha256.Sum256(content)
+	fileHash := hex.EncodeToString(hash[:])
+
+	existing, err := r.querier.SelectBankStatementByHash(ctx, fileHash)
+	if err != nil {
+		return nil, fmt.Errorf("error checking if the statement was imported: %w", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("%w: same content as %s, imported at %s",
+			ErrorAlreadyImported, existing.FileName, existing.ImportedAt.Format(time.RFC3339))
+	}
+
+	statement, err := ParseStatement(content)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Import{
+		Statement: entities.BankStatement{
+			FileName:    fileName,
+			FileHash:    fileHash,
+			Format:      statement.Format,
+			StatementID: statement.ID,
+			IBAN:        statement.IBAN,
+		},
+	}
+
+	reason := "bank statement " + fileName
+	var settlements []settlement
+	for _, entry := range statement.Entries {
+		if !entry.Debit {
+			result.Credits++
+			continue
+		}
+
+		reconciled, settled, err := r.match(ctx, entry, reason)
+		if err != nil {
+			return nil, err
+		}
+		if settled != nil {
+			settlements = append(settlements, *settled)
+		}
+		metrics.ObserveReconciliation(reconciled.Result)
+		if reconciled.Result == entities.UnmatchedReconciliationResult || reconciled.Result == entities.MismatchedReconciliationResult {
+			r.logger.Warn("bank statement entry not reconciled",
+				"statement", fileName,
+				"bank_reference", reconciled.BankReference,
+				"disbursement", reconciled.DisbursementReference,
+				"result", string(reconciled.Result),
+				"detail", reconciled.Detail)
+		}
+		result.Entries = append(result.Entries, reconciled)
+	}
+
+	changes := make([]*entities.DisbursementStatusChange, 0, len(settlements))
+	for _, settled := range settlements {
+		changes = append(changes, settled.change)
+	}
+	err = r.querier.InsertBankStatement(ctx, &result.Statement, result.Entries, changes)
+	if err != nil {
+		return nil, fmt.Errorf("error storing bank statement: %w", err)
+	}
+	for _, settled := range settlements {
+		r.statuses.Changed(settled.disbursement, settled.change)
+	}
+
+	r.logger.Info("bank statement reconciled",
+		"statement", fileName,
+		"format", result.Statement.Format,
+		"debits", len(result.Entries),
+		"matched", result.Count(entities.MatchedReconciliationResult),
+		"unmatched", result.Count(entities.UnmatchedReconciliationResult),
+		"mismatched", result.Count(entities.MismatchedReconciliationResult))
+	return result, nil
+}
+
+// match finds the disbursement paid by a debit, and the settlement of it when it was sent with the same amount
+func (r *Reconciler) match(ctx context.Context, entry Entry, reason string) (entities.BankStatementEntry, *settlement, error) {
+	reconciled := entities.BankStatementEntry{
+		BookingDate:   entry.BookingDate,
+		Amount:        float64(entry.Amount) / 100,
+		Currency:      entry.Currency,
+		BankReference: entry.BankReference,
+	}
+
+	references := entry.DisbursementReferences()
+	switch {
+	case len(references) == 0:
+		return unmatched(reconciled, "no disbursement reference"), nil, nil
+	case len(references) > 1:
+		return unmatched(reconciled, "several disbursement references: "+strings.Join(references, ", ")), nil, nil
+	}
+	reconciled.DisbursementReference = references[0]
+
+	disbursement, err := r.querier.SelectDisbursementByReference(ctx, reconciled.DisbursementReference)
+	if err != nil {
+		return reconciled, nil, fmt.Errorf("error selecting disbursement %s: %w", reconciled.DisbursementReference, err)
+	}
+	if disbursement == nil {
+		return unmatched(reconciled, "unknown disbursement"), nil, nil
+	}
+	reconciled.DisbursementID = uuid.NullUUID{UUID: disbursement.ID, Valid: true}
+
+	if entry.Currency != disbursement.Currency {
+		return mismatched(reconciled, fmt.Sprintf("paid in %s, the disbursement is in %s", entry.Currency, disbursement.Currency)), nil, nil
+	}
+	netAmount := int64(math.Round(disbursement.NetAmount * 100))
+	if entry.Amount != netAmount {
+		return mismatched(reconciled, fmt.Sprintf("amount %s differs from the net amount %s",
+			formatCents(entry.Amount), formatCents(netAmount))), nil, nil
+	}
+
+	switch disbursement.Status {
+	case entities.SettledDisbursementStatus:
+		reconciled.Result = entities.AlreadySettledReconciliationResult
+		return reconciled, nil, nil
+	case entities.SentDisbursementStatus:
+	default:
+		return mismatched(reconciled, fmt.Sprintf("the disbursement is %s, not sent", disbursement.Status)), nil, nil
+	}
+
+	change, err := r.statuses.Change(disbursement, entities.SettledDisbursementStatus, reason)
+	if err != nil {
+		return reconciled, nil, err
+	}
+
+	reconciled.Result = entities.MatchedReconciliationResult
+	return reconciled, &settlement{disbursement: disbursement, change: change}, nil
+}
+
+func unmatched(entry entities.BankStatementEntry, detail string) entities.BankStatementEntry {
+	entry.Result = entities.UnmatchedReconciliationResult
+	entry.Detail = detail
+	return entry
+}
+
+func mismatched(entry entities.BankStatementEntry, detail string) entities.BankStatementEntry {
+	entry.Result = entities.MismatchedReconciliationResult
+	entry.Detail = detail
+	return entry
+}
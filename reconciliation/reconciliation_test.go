@@ -0,0 +1,203 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupDisbursement(reference string, status entities.DisbursementStatuses, netAmount float64) *entities.MerchantDisbursement {
+	return &entities.MerchantDisbursement{
+		ID:            uuid.New(),
+		Reference:     reference,
+		MerchantID:    uuid.New(),
+		Currency:      entities.DefaultCurrency,
+		NetAmount:     netAmount,
+		Status:        status,
+		BankAccountID: uuid.NullUUID{UUID: uuid.New(), Valid: true},
+	}
+}
+
+// statementWithDebits is a camt.053 statement with a debit per disbursement reference and amount
+func statementWithDebits(debits ...string) string {
+	content := `<Document><BkToCstmrStmt><Stmt><Id>STMT-1</Id><Acct><Id><IBAN>ES9121000418450200051332</IBAN></Id></Acct>`
+	for i := 0; i < len(debits); i += 2 {
+		content += `<Ntry><Amt Ccy="EUR">` + debits[i+1] + `</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts>BOOK</Sts>` +
+			`<BookgDt><Dt>2023-01-20</Dt></BookgDt><AcctSvcrRef>BANK-` + debits[i] + `</AcctSvcrRef>` +
+			`<NtryDtls><TxDtls><Refs><EndToEndId>` + debits[i] + `</EndToEndId></Refs></TxDtls></NtryDtls></Ntry>`
+	}
+	content += `<Ntry><Amt Ccy="EUR">1000.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Sts>BOOK</Sts><BookgDt><Dt>2023-01-20</Dt></BookgDt></Ntry>`
+	return content + `</Stmt></BkToCstmrStmt></Document>`
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	sent := setupDisbursement("DSB-20230115-00000001", entities.SentDisbursementStatus, 99.1)
+	settled := setupDisbursement("DSB-20230115-00000002", entities.SettledDisbursementStatus, 10)
+	wrongAmount := setupDisbursement("DSB-20230115-00000003", entities.SentDisbursementStatus, 20)
+	approved := setupDisbursement("DSB-20230115-00000004", entities.ApprovedDisbursementStatus, 30)
+	otherCurrency := setupDisbursement("DSB-20230115-00000005", entities.SentDisbursementStatus, 60)
+	otherCurrency.Currency = "GBP"
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectBankStatementByHash", ctx, mock.Anything).Return(nil, nil)
+	for _, disbursement := range []*entities.MerchantDisbursement{sent, settled, wrongAmount, approved, otherCurrency} {
+		mockQuerier.On("SelectDisbursementByReference", ctx, disbursement.Reference).Return(disbursement, nil)
+	}
+	mockQuerier.On("SelectDisbursementByReference", ctx, "DSB-20230115-00000009").Return(nil, nil)
+	mockQuerier.On("InsertBankStatement", ctx, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	content := statementWithDebits(
+		sent.Reference, "99.10",
+		settled.Reference, "10.00",
+		wrongAmount.Reference, "25.00",
+		approved.Reference, "30.00",
+		"DSB-20230115-00000009", "40.00",
+		"PAY-20230120-AB12CD34", "50.00",
+		otherCurrency.Reference, "60.00")
+
+	imported, err := NewReconciler(mockQuerier).Import(ctx, "camt053_20230120.xml", []byte(content))
+	require.NoError(t, err)
+	require.Equal(t, "camt053_20230120.xml", imported.Statement.FileName)
+	require.Equal(t, entities.Camt053StatementFormat, imported.Statement.Format)
+	require.Equal(t, "STMT-1", imported.Statement.StatementID)
+	require.Len(t, imported.Statement.FileHash, 64)
+	require.Equal(t, 1, imported.Credits)
+
+	expected := []struct {
+		result entities.ReconciliationResults
+		detail string
+	}{
+		{entities.MatchedReconciliationResult, ""},
+		{entities.AlreadySettledReconciliationResult, ""},
+		{entities.MismatchedReconciliationResult, "amount 25.00 differs from the net amount 20.00"},
+		{entities.MismatchedReconciliationResult, "the disbursement is approved, not sent"},
+		{entities.UnmatchedReconciliationResult, "unknown disbursement"},
+		{entities.UnmatchedReconciliationResult, "no disbursement reference"},
+		{entities.MismatchedReconciliationResult, "paid in EUR, the disbursement is in GBP"},
+	}
+	require.Len(t, imported.Entries, len(expected))
+	for i, entry := range imported.Entries {
+		require.Equal(t, expected[i].result, entry.Result, "entry %d", i)
+		require.Equal(t, expected[i].detail, entry.Detail, "entry %d", i)
+	}
+	require.Equal(t, sent.ID, imported.Entries[0].DisbursementID.UUID)
+	require.Equal(t, 99.1, imported.Entries[0].Amount)
+	require.Equal(t, "BANK-"+sent.Reference, imported.Entries[0].BankReference)
+	require.False(t, imported.Entries[4].DisbursementID.Valid)
+	require.Equal(t, "DSB-20230115-00000009", imported.Entries[4].DisbursementReference)
+
+	// Only the sent disbursement with the same amount is settled, along with the statement
+	mockQuerier.AssertCalled(t, "InsertBankStatement", ctx, &imported.Statement, imported.Entries,
+		mock.MatchedBy(func(changes []*entities.DisbursementStatusChange) bool {
+			return len(changes) == 1 &&
+				changes[0].DisbursementID == sent.ID &&
+				changes[0].FromStatus == entities.SentDisbursementStatus &&
+				changes[0].ToStatus == entities.SettledDisbursementStatus &&
+				changes[0].Reason == "bank statement camt053_20230120.xml"
+		}))
+	require.Equal(t, entities.SettledDisbursementStatus, sent.Status)
+
+	require.Equal(t, "statement camt053_20230120.xml (camt.053) of ES9121000418450200051332: 7 debit(s), "+
+		"matched: 1, already_settled: 1, unmatched: 2, mismatched: 3, 1 credit(s) ignored", imported.String())
+}
+
+func TestImportInvalid(t *testing.T) {
+	ctx := context.Background()
+	previous := &entities.BankStatement{FileName: "camt053_20230120.xml", ImportedAt: time.Date(2023, 1, 20, 19, 0, 0, 0, time.UTC)}
+	dbError := errors.New("database error")
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectBankStatementByHash", ctx, mock.Anything).Return(previous, nil).Once()
+	mockQuerier.On("SelectBankStatementByHash", ctx, mock.Anything).Return(nil, nil)
+	mockQuerier.On("InsertBankStatement", ctx, mock.Anything, mock.Anything, mock.Anything).Return(dbError)
+
+	reconciler := NewReconciler(mockQuerier)
+
+	_, err := reconciler.Import(ctx, "copy.xml", []byte(statementWithDebits()))
+	require.ErrorIs(t, err, ErrorAlreadyImported)
+	require.ErrorContains(t, err, "same content as camt053_20230120.xml, imported at 2023-01-20T19:00:00Z")
+
+	_, err = reconciler.Import(ctx, "orders.csv", []byte("id;amount\n"))
+	require.ErrorIs(t, err, ErrorInvalidStatement)
+
+	_, err = reconciler.Import(ctx, "camt053_20230121.xml", []byte(statementWithDebits()))
+	require.ErrorIs(t, err, dbError)
+}
+
+func TestImportStatusChanged(t *testing.T) {
+	ctx := context.Background()
+	sent := setupDisbursement("DSB-20230115-00000001", entities.SentDisbursementStatus, 99.1)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectBankStatementByHash", ctx, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectDisbursementByReference", ctx, sent.Reference).Return(sent, nil)
+	mockQuerier.On("InsertBankStatement", ctx, mock.Anything, mock.Anything, mock.Anything).Return(database.ErrorStatusChanged)
+
+	// Nothing is stored, so the statement can be imported again
+	_, err := NewReconciler(mockQuerier).Import(ctx, "camt053_20230120.xml", []byte(statementWithDebits(sent.Reference, "99.10")))
+	require.ErrorIs(t, err, database.ErrorStatusChanged)
+	require.Equal(t, entities.SentDisbursementStatus, sent.Status)
+}
+
+func TestImportFolder(t *testing.T) {
+	ctx := context.Background()
+	folder := t.TempDir()
+	cfg := system.StatementsConfig{
+		JobPause:     time.Second,
+		WaitingPath:  filepath.Join(folder, "waiting"),
+		ImportedPath: filepath.Join(folder, "imported"),
+		FailedPath:   filepath.Join(folder, "failed"),
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.WaitingPath, "2023"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.WaitingPath, "2023", "camt053_20230120.xml"), []byte(statementWithDebits()), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.WaitingPath, "notes.txt"), []byte("not a statement"), 0o600))
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectBankStatementByHash", ctx, mock.Anything).Return(nil, nil)
+	mockQuerier.On("InsertBankStatement", ctx, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	result, err := NewReconciler(mockQuerier).ImportFolder(ctx, cfg)
+	require.NoError(t, err)
+	require.Len(t, result.Imports, 1)
+	require.Equal(t, filepath.Join("2023", "camt053_20230120.xml"), result.Imports[0].Statement.FileName)
+	require.Equal(t, []string{filepath.Join(cfg.WaitingPath, "notes.txt")}, result.Failed)
+
+	// The files are moved out of the waiting folder, keeping their path
+	require.FileExists(t, filepath.Join(cfg.ImportedPath, "2023", "camt053_20230120.xml"))
+	require.FileExists(t, filepath.Join(cfg.FailedPath, "notes.txt"))
+	require.NoFileExists(t, filepath.Join(cfg.WaitingPath, "2023", "camt053_20230120.xml"))
+
+	_, err = NewReconciler(mockQuerier).ImportFolder(ctx, system.StatementsConfig{WaitingPath: filepath.Join(folder, "missing")})
+	require.Error(t, err)
+}
+
+func TestCreateFolders(t *testing.T) {
+	folder := t.TempDir()
+	cfg := system.StatementsConfig{
+		WaitingPath:  filepath.Join(folder, "statements", "waiting"),
+		ImportedPath: filepath.Join(folder, "statements", "imported"),
+		FailedPath:   filepath.Join(folder, "statements", "failed"),
+	}
+
+	require.NoError(t, CreateFolders(cfg))
+	require.DirExists(t, cfg.WaitingPath)
+	require.DirExists(t, cfg.ImportedPath)
+	require.DirExists(t, cfg.FailedPath)
+
+	// Existing folders are kept
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.WaitingPath, "camt053_20230120.xml"), []byte(statementWithDebits()), 0o600))
+	require.NoError(t, CreateFolders(cfg))
+	require.FileExists(t, filepath.Join(cfg.WaitingPath, "camt053_20230120.xml"))
+}
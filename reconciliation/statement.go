@@ -0,0 +1,110 @@
+package reconciliation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorInvalidStatement is returned when a file is not a camt.053 or MT940 statement that can be read
+var ErrorInvalidStatement = errors.New("invalid bank statement")
+
+// referencePattern finds the disbursement references, like DSB-20230115-1A2B3C4D, in the texts of an entry
+var referencePattern = regexp.MustCompile(`DSB-\d{8}-[0-9A-F]{8}`)
+
+// Statement is a bank statement of the account the payouts are sent from, whatever the format of its file
+type Statement struct {
+	Format  string
+	ID      string
+	IBAN    string
+	Entries []Entry
+}
+
+// Entry is a movement booked on the account
+// A batch booked in a camt.053 statement with the details of its transactions gives an entry per transaction.
+type Entry struct {
+	BookingDate   time.Time
+	Amount        int64 // In cents, always positive
+	Currency      string
+	Debit         bool
+	BankReference string   // Given by the bank to the movement
+	Texts         []string // End to end identifier, references and remittance information, carrying the disbursement reference
+}
+
+// DisbursementReferences returns the distinct disbursement references found in the texts of the entry
+func (e *Entry) DisbursementReferences() []string {
+	var references []string
+	for _, text := range e.Texts {
+		for _, reference := range referencePattern.FindAllString(text, -1) {
+			found := false
+			for _, existing := range references {
+				found = found || existing == reference
+			}
+			if !found {
+				references = append(references, reference)
+			}
+		}
+	}
+	return references
+}
+
+// ParseStatement reads a camt.053 or MT940 statement, detecting its format from the content
+func ParseStatement(content []byte) (*Statement, error) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf")))
+
+	var statement *Statement
+	var err error
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		statement, err = parseCamt053(trimmed)
+	case bytes.Contains(trimmed, []byte(":20:")):
+		statement, err = parseMT940(trimmed)
+	default:
+		return nil, fmt.Errorf("%w: unknown format, expected a camt.053 or MT940 file", ErrorInvalidStatement)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorInvalidStatement, err)
+	}
+	return statement, nil
+}
+
+// Debits returns the entries paid from the account
+func (s *Statement) Debits() []Entry {
+	var debits []Entry
+	for _, entry := range s.Entries {
+		if entry.Debit {
+			debits = append(debits, entry)
+		}
+	}
+	return debits
+}
+
+// parseCents parses a positive amount with up to two decimals, given with a decimal point or comma
+func parseCents(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	units, decimals, _ := strings.Cut(strings.Replace(value, ",", ".", 1), ".")
+	if units == "" || len(decimals) > 2 || strings.ContainsAny(units+decimals, "+-") {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	decimals += strings.Repeat("0", 2-len(decimals))
+
+	cents, err := strconv.ParseInt(units+decimals, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	return cents, nil
+}
+
+// formatCents formats an amount in cents, like 1234.56
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
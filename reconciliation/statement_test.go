@@ -0,0 +1,188 @@
+package reconciliation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/stretchr/testify/require"
+)
+
+const camt053Batch = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02">
+  <BkToCstmrStmt>
+    <GrpHdr><MsgId>STMT-20230120</MsgId><CreDtTm>2023-01-20T18:00:00</CreDtTm></GrpHdr>
+    <Stmt>
+      <Id>STMT-20230120-1</Id>
+      <Acct><Id><IBAN>ES9121000418450200051332</IBAN></Id></Acct>
+      <Ntry>
+        <Amt Ccy="EUR">150.35</Amt>
+        <CdtDbtInd>DBIT</CdtDbtInd>
+        <Sts>BOOK</Sts>
+        <BookgDt><Dt>2023-01-20</Dt></BookgDt>
+        <AcctSvcrRef>BANK-0001</AcctSvcrRef>
+        <NtryDtls>
+          <Btch><MsgId>PAY-20230120-AB12CD34</MsgId></Btch>
+          <TxDtls>
+            <Refs><EndToEndId>DSB-20230115-1A2B3C4D</EndToEndId></Refs>
+            <AmtDtls><TxAmt><Amt Ccy="EUR">99.10</Amt></TxAmt></AmtDtls>
+          </TxDtls>
+          <TxDtls>
+            <Refs><EndToEndId>NOTPROVIDED</EndToEndId><AcctSvcrRef>BANK-0001-2</AcctSvcrRef></Refs>
+            <AmtDtls><TxAmt><Amt Ccy="EUR">51.25</Amt></TxAmt></AmtDtls>
+            <RmtInf><Ustrd>Disbursement DSB-20230115-5E6F7A8B orders 2023-01-15 to 2023-01-15</Ustrd></RmtInf>
+          </TxDtls>
+        </NtryDtls>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="EUR">1000</Amt>
+        <CdtDbtInd>CRDT</CdtDbtInd>
+        <Sts>BOOK</Sts>
+        <BookgDt><Dt>2023-01-20</Dt></BookgDt>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="EUR">20.00</Amt>
+        <CdtDbtInd>DBIT</CdtDbtInd>
+        <Sts>PDNG</Sts>
+        <BookgDt><Dt>2023-01-20</Dt></BookgDt>
+      </Ntry>
+    </Stmt>
+  </BkToCstmrStmt>
+</Document>
+`
+
+const camt053Single = `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.08">
+  <BkToCstmrStmt>
+    <Stmt>
+      <Id>STMT-20230121-1</Id>
+      <Acct><Id><IBAN>ES9121000418450200051332</IBAN></Id></Acct>
+      <Ntry>
+        <Amt Ccy="EUR">99.1</Amt>
+        <CdtDbtInd>DBIT</CdtDbtInd>
+        <Sts><Cd>BOOK</Cd></Sts>
+        <BookgDt><DtTm>2023-01-21T09:30:00</DtTm></BookgDt>
+        <AcctSvcrRef>BANK-0002</AcctSvcrRef>
+        <NtryDtls>
+          <TxDtls>
+            <Refs><EndToEndId>DSB-20230115-1A2B3C4D</EndToEndId></Refs>
+            <Amt Ccy="EUR">99.1</Amt>
+          </TxDtls>
+        </NtryDtls>
+      </Ntry>
+    </Stmt>
+  </BkToCstmrStmt>
+</Document>
+`
+
+const mt940Statement = `{1:F01CAIXESBBAXXX0000000000}{2:O9401800230120CAIXESBBXXXX00000000002301201800N}{4:
+:20:STMT20230120
+:25:ES9121000418450200051332
+:28C:00020/001
+:60F:C230119EUR10000,00
+:61:2301200120D99,10NTRFNONREF//BANK-0001
+Payout disbursement
+:86:?00SEPA CREDIT TRANSFER?20DSB-20230115-1A2B?213C4D?32Padberg Group GmbH
+:61:2301200120C1000,NTRFNONREF//BANK-0002
+:86:Incoming transfer
+:61:2301200120D51,25NTRFDSB-20230115-5E6F7A8B
+:62F:C230120EUR10849,65
+-}
+`
+
+func TestParseCamt053Batch(t *testing.T) {
+	statement, err := ParseStatement([]byte(camt053Batch))
+	require.NoError(t, err)
+	require.Equal(t, entities.Camt053StatementFormat, statement.Format)
+	require.Equal(t, "STMT-20230120-1", statement.ID)
+	require.Equal(t, "ES9121000418450200051332", statement.IBAN)
+
+	// The batch is split in its transactions, the pending entry is left out
+	require.Len(t, statement.Entries, 3)
+	debits := statement.Debits()
+	require.Len(t, debits, 2)
+
+	require.Equal(t, time.Date(2023, 1, 20, 0, 0, 0, 0, time.UTC), debits[0].BookingDate)
+	require.Equal(t, int64(9910), debits[0].Amount)
+	require.Equal(t, "EUR", debits[0].Currency)
+	require.Equal(t, "BANK-0001", debits[0].BankReference)
+	require.Equal(t, []string{"DSB-20230115-1A2B3C4D"}, debits[0].DisbursementReferences())
+
+	require.Equal(t, int64(5125), debits[1].Amount)
+	require.Equal(t, "BANK-0001-2", debits[1].BankReference)
+	require.Equal(t, []string{"DSB-20230115-5E6F7A8B"}, debits[1].DisbursementReferences())
+
+	require.False(t, statement.Entries[2].Debit)
+	require.Equal(t, int64(100000), statement.Entries[2].Amount)
+}
+
+func TestParseCamt053Single(t *testing.T) {
+	statement, err := ParseStatement([]byte(camt053Single))
+	require.NoError(t, err)
+	require.Len(t, statement.Entries, 1)
+
+	entry := statement.Entries[0]
+	require.True(t, entry.Debit)
+	require.Equal(t, int64(9910), entry.Amount)
+	require.Equal(t, time.Date(2023, 1, 21, 0, 0, 0, 0, time.UTC), entry.BookingDate)
+	require.Equal(t, []string{"DSB-20230115-1A2B3C4D"}, entry.DisbursementReferences())
+}
+
+func TestParseMT940(t *testing.T) {
+	statement, err := ParseStatement([]byte(mt940Statement))
+	require.NoError(t, err)
+	require.Equal(t, entities.MT940StatementFormat, statement.Format)
+	require.Equal(t, "STMT20230120", statement.ID)
+	require.Equal(t, "ES9121000418450200051332", statement.IBAN)
+	require.Len(t, statement.Entries, 3)
+
+	// The reference is split over the subfields of the information to the account owner
+	first := statement.Entries[0]
+	require.True(t, first.Debit)
+	require.Equal(t, int64(9910), first.Amount)
+	require.Equal(t, "EUR", first.Currency)
+	require.Equal(t, time.Date(2023, 1, 20, 0, 0, 0, 0, time.UTC), first.BookingDate)
+	require.Equal(t, "BANK-0001", first.BankReference)
+	require.Equal(t, []string{"DSB-20230115-1A2B3C4D"}, first.DisbursementReferences())
+
+	require.False(t, statement.Entries[1].Debit)
+	require.Equal(t, int64(100000), statement.Entries[1].Amount)
+
+	// The reference of the customer carries the disbursement reference
+	third := statement.Entries[2]
+	require.Equal(t, int64(5125), third.Amount)
+	require.Equal(t, "", third.BankReference)
+	require.Equal(t, []string{"DSB-20230115-5E6F7A8B"}, third.DisbursementReferences())
+}
+
+func TestParseMT940EntryDateOverYearEnd(t *testing.T) {
+	statement, err := ParseStatement([]byte(":20:STMT\n:25:ES9121000418450200051332\n:60F:C221231EUR0,\n:61:2301011231D10,NTRFNONREF\n:62F:D230101EUR10,\n"))
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2022, 12, 31, 0, 0, 0, 0, time.UTC), statement.Entries[0].BookingDate)
+}
+
+func TestParseStatementInvalid(t *testing.T) {
+	for content, expected := range map[string]string{
+		"id;amount\n1;10":                       "unknown format",
+		"<Document><BkToCstmrStmt/></Document>": "no statement in the camt.053 file",
+		"<Document><BkToCstmrStmt><Stmt><Ntry><Amt Ccy=\"EUR\">1.234</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts>BOOK</Sts><BookgDt><Dt>2023-01-20</Dt></BookgDt></Ntry></Stmt></BkToCstmrStmt></Document>": `invalid amount "1.234"`,
+		"<Document><BkToCstmrStmt><Stmt><Ntry><Amt Ccy=\"EUR\">1</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts>BOOK</Sts></Ntry></Stmt></BkToCstmrStmt></Document>":                                           "missing booking date",
+		":20:STMT\n:61:2301200120D99,10NTRFNONREF\n":          "statement line before the opening balance",
+		":20:STMT\n:60F:C230119EUR0,\n:61:230120D99.10NTRF\n": "invalid statement line",
+	} {
+		_, err := ParseStatement([]byte(content))
+		require.ErrorIs(t, err, ErrorInvalidStatement, content)
+		require.ErrorContains(t, err, expected, content)
+	}
+}
+
+func TestParseCents(t *testing.T) {
+	for value, expected := range map[string]int64{"99.10": 9910, "99,1": 9910, "1000": 100000, "1000,": 100000, "0.05": 5} {
+		cents, err := parseCents(value)
+		require.NoError(t, err, value)
+		require.Equal(t, expected, cents, value)
+	}
+	for _, value := range []string{"", "-1.00", "1.234", "1,2,3", "abc"} {
+		_, err := parseCents(value)
+		require.Error(t, err, value)
+	}
+}
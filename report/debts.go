@@ -0,0 +1,24 @@
+package report
+
+import "github.com/ildomm/cc_sq_disbursement/entities"
+
+// DebtsTable builds the report of the merchants in debt, owing the amount deducted from their next disbursements
+func DebtsTable(debts []entities.MerchantDebt) *Table {
+	table := NewTable(
+		"merchant",
+		"currency",
+		"amount",
+		"since",
+		"last_entry_at")
+
+	for _, debt := range debts {
+		table.AddRow(
+			debt.Reference,
+			debt.Currency,
+			debt.Amount,
+			debt.Since,
+			debt.LastEntryAt)
+	}
+
+	return table
+}
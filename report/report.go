@@ -0,0 +1,167 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Format is the output format of a report.
+type Format string
+
+const (
+	TableFormat Format = "table"
+	CSVFormat   Format = "csv"
+	JSONFormat  Format = "json"
+)
+
+// ParseFormat parses the format name given in the command line
+func ParseFormat(format string) (Format, error) {
+	switch Format(strings.ToLower(format)) {
+	case TableFormat, "text":
+		return TableFormat, nil
+	case CSVFormat:
+		return CSVFormat, nil
+	case JSONFormat:
+		return JSONFormat, nil
+	}
+	return "", fmt.Errorf("unknown report format %q, expected one of table, csv or json", format)
+}
+
+// Table is a report made of named columns and rows of values.
+// Values are kept typed so each format can render them properly:
+// float64 amounts are rendered with two decimals and time.Time as dates.
+type Table struct {
+	Columns []string
+	Rows    [][]any
+}
+
+func NewTable(columns ...string) *Table {
+	return &Table{Columns: columns}
+}
+
+// AddRow appends a row, it must have one value per column
+func (t *Table) AddRow(values ...any) {
+	t.Rows = append(t.Rows, values)
+}
+
+// Write renders the table in the given format
+func Write(w io.Writer, format Format, table *Table) error {
+	for _, row := range table.Rows {
+		if len(row) != len(table.Columns) {
+			return fmt.Errorf("row has %d values, expected %d", len(row), len(table.Columns))
+		}
+	}
+
+	switch format {
+	case TableFormat:
+		return writeTable(w, table)
+	case CSVFormat:
+		return writeCSV(w, table)
+	case JSONFormat:
+		return writeJSON(w, table)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+func writeTable(w io.Writer, table *Table) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(table.Columns, "\t")))
+	for _, row := range table.Rows {
+		fmt.Fprintln(tw, strings.Join(formatRow(row), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, table *Table) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(table.Columns)
+	if err != nil {
+		return err
+	}
+	for _, row := range table.Rows {
+		err = cw.Write(formatRow(row))
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes an array of objects keeping the column order
+func writeJSON(w io.Writer, table *Table) error {
+	var buf bytes.Buffer
+
+	buf.WriteString("[")
+	for i, row := range table.Rows {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  {")
+		for j, value := range row {
+			if j > 0 {
+				buf.WriteString(", ")
+			}
+			key, err := json.Marshal(table.Columns[j])
+			if err != nil {
+				return err
+			}
+			encoded, err := jsonValue(value)
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteString(": ")
+			buf.Write(encoded)
+		}
+		buf.WriteString("}")
+	}
+	if len(table.Rows) > 0 {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("]\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func jsonValue(value any) ([]byte, error) {
+	switch v := value.(type) {
+	case float64:
+		// Amounts are money, keep them with two decimals
+		return []byte(fmt.Sprintf("%.2f", v)), nil
+	case time.Time:
+		return json.Marshal(v.Format(time.DateOnly))
+	}
+	return json.Marshal(value)
+}
+
+func formatRow(row []any) []string {
+	values := make([]string, len(row))
+	for i, value := range row {
+		values[i] = formatValue(value)
+	}
+	return values
+}
+
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return fmt.Sprintf("%.2f", v)
+	case time.Time:
+		return v.Format(time.DateOnly)
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,120 @@
+package report
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTable() *Table {
+	table := NewTable("merchant", "day", "amount", "entries")
+	table.AddRow("padberg_group", time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), 100.5, 3)
+	table.AddRow("deckow_gibson", time.Date(2023, 1, 3, 0, 0, 0, 0, time.UTC), 0.1+0.2, 1)
+	return table
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Format
+	}{
+		{"table", TableFormat},
+		{"text", TableFormat},
+		{"CSV", CSVFormat},
+		{"json", JSONFormat},
+	}
+
+	for _, test := range tests {
+		format, err := ParseFormat(test.input)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, format)
+	}
+
+	_, err := ParseFormat("xml")
+	require.Error(t, err)
+}
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, TableFormat, setupTable())
+	require.NoError(t, err)
+
+	expected := "" +
+		"MERCHANT       DAY         AMOUNT  ENTRIES\n" +
+		"padberg_group  2023-01-02  100.50  3\n" +
+		"deckow_gibson  2023-01-03  0.30    1\n"
+	require.Equal(t, expected, buf.String())
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, CSVFormat, setupTable())
+	require.NoError(t, err)
+
+	expected := "" +
+		"merchant,day,amount,entries\n" +
+		"padberg_group,2023-01-02,100.50,3\n" +
+		"deckow_gibson,2023-01-03,0.30,1\n"
+	require.Equal(t, expected, buf.String())
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, JSONFormat, setupTable())
+	require.NoError(t, err)
+
+	expected := "[\n" +
+		`  {"merchant": "padberg_group", "day": "2023-01-02", "amount": 100.50, "entries": 3},` + "\n" +
+		`  {"merchant": "deckow_gibson", "day": "2023-01-03", "amount": 0.30, "entries": 1}` + "\n" +
+		"]\n"
+	require.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	err = Write(&buf, JSONFormat, NewTable("empty"))
+	require.NoError(t, err)
+	require.Equal(t, "[]\n", buf.String())
+}
+
+func TestWriteInvalidRow(t *testing.T) {
+	table := NewTable("one", "two")
+	table.AddRow("only one")
+
+	var buf bytes.Buffer
+	err := Write(&buf, CSVFormat, table)
+	require.Error(t, err)
+}
+
+func TestYearlyTable(t *testing.T) {
+	years := []entities.YearlyReport{
+		{Year: 2022, Currency: "EUR", Disbursements: 1547, AmountDisbursed: 37000000.456, OrderFees: 359000.5, MonthlyFees: 22, MonthlyFeesAmount: 330},
+		{Year: 2023, Currency: "EUR", Disbursements: 10363, AmountDisbursed: 188000000, OrderFees: 1700000.1, MonthlyFees: 92, MonthlyFeesAmount: 1400.25},
+	}
+
+	var buf bytes.Buffer
+	err := Write(&buf, CSVFormat, YearlyTable(years))
+	require.NoError(t, err)
+
+	expected := "" +
+		"year,currency,disbursements,amount_disbursed,order_fees,monthly_fees,monthly_fees_amount\n" +
+		"2022,EUR,1547,37000000.46,359000.50,22,330.00\n" +
+		"2023,EUR,10363,188000000.00,1700000.10,92,1400.25\n"
+	require.Equal(t, expected, buf.String())
+}
+
+func TestDebtsTable(t *testing.T) {
+	debts := []entities.MerchantDebt{
+		{Reference: "padberg_group", Currency: "EUR", Amount: 40.104, Since: time.Date(2023, 1, 2, 10, 0, 0, 0, time.UTC), LastEntryAt: time.Date(2023, 1, 5, 10, 0, 0, 0, time.UTC)},
+	}
+
+	var buf bytes.Buffer
+	err := Write(&buf, CSVFormat, DebtsTable(debts))
+	require.NoError(t, err)
+
+	expected := "" +
+		"merchant,currency,amount,since,last_entry_at\n" +
+		"padberg_group,EUR,40.10,2023-01-02,2023-01-05\n"
+	require.Equal(t, expected, buf.String())
+}
@@ -0,0 +1,28 @@
+package report
+
+import "github.com/ildomm/cc_sq_disbursement/entities"
+
+// YearlyTable builds the report of the disbursements and fees of each year and currency
+func YearlyTable(years []entities.YearlyReport) *Table {
+	table := NewTable(
+		"year",
+		"currency",
+		"disbursements",
+		"amount_disbursed",
+		"order_fees",
+		"monthly_fees",
+		"monthly_fees_amount")
+
+	for _, year := range years {
+		table.AddRow(
+			year.Year,
+			year.Currency,
+			year.Disbursements,
+			year.AmountDisbursed,
+			year.OrderFees,
+			year.MonthlyFees,
+			year.MonthlyFeesAmount)
+	}
+
+	return table
+}
@@ -0,0 +1,150 @@
+package statement
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Write exports the statement in the given format
+func Write(w io.Writer, format Format, statement *Statement) error {
+	switch format {
+	case CSVFormat:
+		return writeCSV(w, statement)
+	case PDFFormat:
+		return writePDF(w, textLines(statement))
+	}
+	return fmt.Errorf("unknown statement format %q", format)
+}
+
+// writeCSV writes the orders, the refunds and chargebacks if any, then the totals, with the carried balances if any, with the columns order_id, date, amount and fee
+// The header rows identify the merchant and the period
+func writeCSV(w io.Writer, statement *Statement) error {
+	cw := csv.NewWriter(w)
+
+	rows := [][]string{
+		{"merchant", statement.Merchant.Reference, "", ""},
+		{"reference", statement.Reference, "", ""},
+		{"currency", statement.Currency, "", ""},
+		{"period", statement.PeriodStart.Format(time.DateOnly), statement.PeriodEnd.Format(time.DateOnly), ""},
+		{"order_id", "date", "amount", "fee"},
+	}
+	for _, order := range statement.Orders {
+		rows = append(rows, []string{order.ID, order.CreatedAt.Format(time.DateOnly), amount(order.Amount), amount(order.FeeAmount)})
+	}
+	if len(statement.Refunds) > 0 {
+		rows = append(rows, []string{"refund_id", "date", "amount", "fee_reversal"})
+		for _, refund := range statement.Refunds {
+			rows = append(rows, []string{refund.ID, refund.CreatedAt.Format(time.DateOnly), amount(refund.Amount), amount(refund.FeeReversal)})
+		}
+	}
+	if len(statement.Chargebacks) > 0 {
+		rows = append(rows, []string{"chargeback_id", "date", "amount", "chargeback_fee"})
+		for _, chargeback := range statement.Chargebacks {
+			rows = append(rows, []string{chargeback.ID, chargeback.CreatedAt.Format(time.DateOnly), amount(chargeback.Amount), amount(chargeback.Fee)})
+		}
+	}
+	rows = append(rows,
+		[]string{"subtotal", "", amount(statement.Subtotal), ""},
+		[]string{"fee_total", "", "", amount(statement.FeeTotal)},
+		[]string{"monthly_fee_adjustment", "", "", amount(statement.MonthlyAdjustment)},
+	)
+	if len(statement.Refunds) > 0 {
+		rows = append(rows,
+			[]string{"refunds_total", "", amount(statement.RefundsTotal), ""},
+			[]string{"fee_reversal_total", "", "", amount(statement.FeeReversalTotal)},
+		)
+	}
+	if len(statement.Chargebacks) > 0 {
+		rows = append(rows,
+			[]string{"chargebacks_total", "", amount(statement.ChargebacksTotal), ""},
+			[]string{"chargeback_fee_total", "", "", amount(statement.ChargebackFeeTotal)},
+		)
+	}
+	if statement.HasCarriedBalance() {
+		rows = append(rows,
+			[]string{"carried_total", "", amount(statement.CarriedTotal), ""},
+			[]string{"carry_forward_total", "", amount(statement.CarryForwardTotal), ""},
+		)
+	}
+	rows = append(rows, []string{"net_payout", "", amount(statement.NetPayout), ""})
+
+	err := cw.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// textLines lays out the statement as text, for the PDF
+func textLines(statement *Statement) []string {
+	merchant := statement.Merchant.Reference
+	if statement.Merchant.Email != "" {
+		merchant = fmt.Sprintf("%s <%s>", merchant, statement.Merchant.Email)
+	}
+
+	lines := []string{
+		"Merchant statement " + statement.Reference,
+		"",
+		"Merchant: " + merchant,
+		"Currency: " + statement.Currency,
+		fmt.Sprintf("Period:   %s to %s", statement.PeriodStart.Format(time.DateOnly), statement.PeriodEnd.Format(time.DateOnly)),
+		"",
+		fmt.Sprintf("%-32s %-10s %12s %10s", "Order ID", "Date", "Amount", "Fee"),
+	}
+	for _, order := range statement.Orders {
+		lines = append(lines, fmt.Sprintf("%-32s %-10s %12s %10s",
+			order.ID, order.CreatedAt.Format(time.DateOnly), amount(order.Amount), amount(order.FeeAmount)))
+	}
+	if len(statement.Refunds) > 0 {
+		lines = append(lines,
+			"",
+			fmt.Sprintf("%-32s %-10s %12s %10s", "Refund ID", "Date", "Amount", "Fee back"),
+		)
+		for _, refund := range statement.Refunds {
+			lines = append(lines, fmt.Sprintf("%-32s %-10s %12s %10s",
+				refund.ID, refund.CreatedAt.Format(time.DateOnly), amount(refund.Amount), amount(refund.FeeReversal)))
+		}
+	}
+	if len(statement.Chargebacks) > 0 {
+		lines = append(lines,
+			"",
+			fmt.Sprintf("%-32s %-10s %12s %10s", "Chargeback ID", "Date", "Amount", "Fee"),
+		)
+		for _, chargeback := range statement.Chargebacks {
+			lines = append(lines, fmt.Sprintf("%-32s %-10s %12s %10s",
+				chargeback.ID, chargeback.CreatedAt.Format(time.DateOnly), amount(chargeback.Amount), amount(chargeback.Fee)))
+		}
+	}
+	lines = append(lines,
+		"",
+		fmt.Sprintf("%-44s %12s", "Subtotal", amount(statement.Subtotal)),
+		fmt.Sprintf("%-44s %12s", "Fee total", "-"+amount(statement.FeeTotal)),
+		fmt.Sprintf("%-44s %12s", "Monthly minimum fee adjustment", "-"+amount(statement.MonthlyAdjustment)),
+	)
+	if len(statement.Refunds) > 0 {
+		lines = append(lines,
+			fmt.Sprintf("%-44s %12s", "Refunds", "-"+amount(statement.RefundsTotal)),
+			fmt.Sprintf("%-44s %12s", "Fees reversed on refunds", amount(statement.FeeReversalTotal)),
+		)
+	}
+	if len(statement.Chargebacks) > 0 {
+		lines = append(lines,
+			fmt.Sprintf("%-44s %12s", "Chargebacks", "-"+amount(statement.ChargebacksTotal)),
+			fmt.Sprintf("%-44s %12s", "Chargeback fees", "-"+amount(statement.ChargebackFeeTotal)),
+		)
+	}
+	if statement.HasCarriedBalance() {
+		lines = append(lines,
+			fmt.Sprintf("%-44s %12s", "Balance carried from earlier disbursements", "-"+amount(statement.CarriedTotal)),
+			fmt.Sprintf("%-44s %12s", "Balance carried forward", amount(statement.CarryForwardTotal)),
+		)
+	}
+	lines = append(lines, fmt.Sprintf("%-44s %12s", "Net payout ("+statement.Currency+")", amount(statement.NetPayout)))
+	return lines
+}
+
+func amount(value float64) string {
+	return fmt.Sprintf("%.2f", value)
+}
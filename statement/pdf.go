@@ -0,0 +1,91 @@
+package statement
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Layout of the PDF pages: A4, in points, with a monospace font so the columns align
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	pageMargin   = 50
+	fontSize     = 10
+	lineHeight   = 14
+	linesPerPage = (pageHeight - 2*pageMargin) / lineHeight
+)
+
+// writePDF writes lines of text as a PDF document
+// It only needs the standard Courier font, so no font is embedded
+func writePDF(w io.Writer, lines []string) error {
+	var pages [][]string
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	var buf bytes.Buffer
+	var offsets []int
+
+	// addObject writes the next object, objects are numbered from 1 in the order they are written
+	addObject := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1 to 3 are the catalog, the page tree and the font, then a page and its content for each page
+	pageObject := func(page int) int { return 4 + 2*page }
+
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", pageObject(i))
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	addObject("<< /Type /Catalog /Pages 2 0 R >>")
+	addObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	addObject("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range pages {
+		addObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, pageObject(i)+1))
+
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", fontSize, lineHeight, pageMargin, pageHeight-pageMargin)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", escapePDFText(line))
+		}
+		content.WriteString("ET")
+		addObject(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// escapePDFText escapes a line for a PDF string, replacing the characters the font cannot show
+func escapePDFText(line string) string {
+	var b strings.Builder
+	for _, r := range line {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
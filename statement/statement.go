@@ -0,0 +1,183 @@
+package statement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+)
+
+// Format is the export format of a statement.
+type Format string
+
+const (
+	CSVFormat Format = "csv"
+	PDFFormat Format = "pdf"
+)
+
+// ParseFormat parses the format name given in the command line or the API
+func ParseFormat(format string) (Format, error) {
+	switch Format(strings.ToLower(format)) {
+	case CSVFormat:
+		return CSVFormat, nil
+	case PDFFormat:
+		return PDFFormat, nil
+	}
+	return "", fmt.Errorf("unknown statement format %q, expected csv or pdf", format)
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	if f == PDFFormat {
+		return "application/pdf"
+	}
+	return "text/csv"
+}
+
+var (
+	ErrorDisbursementNotFound = errors.New("disbursement not found")
+	ErrorMerchantNotFound     = errors.New("merchant not found")
+)
+
+// Statement lists the orders paid to a merchant in a period, with the fees charged and the refunds and chargebacks deducted
+type Statement struct {
+	Merchant    entities.Merchant
+	Reference   string // Disbursement reference, or the month, like 2023-01
+	Currency    string // Of the disbursement, or the settlement currency of the merchant for a month
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Orders      []entities.Order
+	Refunds     []entities.Refund     // Deducted in the period, the orders refunded can be of an earlier one
+	Chargebacks []entities.Chargeback // Deducted in the period, like the refunds
+
+	Subtotal           float64 // Amount of the orders
+	FeeTotal           float64 // Fees of the orders
+	MonthlyAdjustment  float64 // Minimum monthly fee corrections charged in the period
+	RefundsTotal       float64 // Amount of the refunds
+	FeeReversalTotal   float64 // Fees of the refunded orders given back
+	ChargebacksTotal   float64 // Amount of the chargebacks
+	ChargebackFeeTotal float64 // Fees of the chargebacks
+	CarriedTotal       float64 // Debts brought in from the earlier disbursements of the merchant
+	CarryForwardTotal  float64 // Negative results carried forward, owed by the merchant
+	NetPayout          float64 // Subtotal minus the fees, the adjustment, the refunds, the chargebacks and the debts, plus the fee reversals and the amounts carried forward
+}
+
+// HasCarriedBalance tells if a debt of the merchant was carried in or forward in the period
+func (s *Statement) HasCarriedBalance() bool {
+	return s.CarriedTotal > 0 || s.CarryForwardTotal > 0
+}
+
+// ForDisbursement builds the statement of a disbursement
+// It covers the disbursed orders and deducted refunds and chargebacks of the merchant in the period of the disbursement
+func ForDisbursement(ctx context.Context, querier database.Querier, reference string) (*Statement, error) {
+	disbursement, err := querier.SelectDisbursementByReference(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	if disbursement == nil {
+		return nil, fmt.Errorf("%w: %q", ErrorDisbursementNotFound, reference)
+	}
+
+	merchant, err := querier.SelectMerchant(ctx, disbursement.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	if merchant == nil {
+		return nil, fmt.Errorf("%w: %s", ErrorMerchantNotFound, disbursement.MerchantID)
+	}
+
+	return build(ctx, querier, *merchant, reference, disbursement.Currency, disbursement.OrdersStartAt, disbursement.OrdersEndAt)
+}
+
+// ForMonth builds the statement of a merchant for a month
+// It covers the disbursed orders of the merchant created in the month, and its refunds and chargebacks deducted in the month
+func ForMonth(ctx context.Context, querier database.Querier, merchantReference string, month time.Time) (*Statement, error) {
+	merchant, err := querier.SelectMerchantByReference(ctx, merchantReference)
+	if err != nil {
+		return nil, err
+	}
+	if merchant == nil {
+		return nil, fmt.Errorf("%w: %q", ErrorMerchantNotFound, merchantReference)
+	}
+
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, -1)
+
+	return build(ctx, querier, *merchant, start.Format(MonthLayout), merchant.Currency, start, end)
+}
+
+// MonthLayout is the layout of the months of the statements
+const MonthLayout = "2006-01"
+
+func build(ctx context.Context, querier database.Querier, merchant entities.Merchant, reference, currency string, start, end time.Time) (*Statement, error) {
+	orders, err := querier.SelectDisbursedOrders(ctx, merchant.ID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting orders: %w", err)
+	}
+
+	refunds, err := querier.SelectDeductedRefunds(ctx, merchant.ID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting refunds: %w", err)
+	}
+
+	chargebacks, err := querier.SelectDeductedChargebacks(ctx, merchant.ID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting chargebacks: %w", err)
+	}
+
+	// The monthly fee corrections are charged, and the balances carried, on the daily disbursements, whatever the merchant frequency
+	dailyDisbursements, err := querier.SelectDisbursements(ctx, entities.DisbursementFilter{
+		MerchantID: merchant.ID,
+		Frequency:  entities.DailyDisbursementFrequency,
+		From:       start,
+		To:         end,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error selecting disbursements: %w", err)
+	}
+
+	statement := &Statement{
+		Merchant:    merchant,
+		Reference:   reference,
+		Currency:    currency,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Orders:      orders,
+		Refunds:     refunds,
+		Chargebacks: chargebacks,
+	}
+	for _, order := range orders {
+		statement.Subtotal += order.Amount
+		statement.FeeTotal += order.FeeAmount
+	}
+	for _, disbursement := range dailyDisbursements {
+		statement.MonthlyAdjustment += disbursement.FeeAmountCorrection
+		statement.CarriedTotal += disbursement.CarriedAmount
+		statement.CarryForwardTotal += disbursement.CarryForwardAmount
+	}
+	for _, refund := range refunds {
+		statement.RefundsTotal += refund.Amount
+		statement.FeeReversalTotal += refund.FeeReversal
+	}
+	for _, chargeback := range chargebacks {
+		statement.ChargebacksTotal += chargeback.Amount
+		statement.ChargebackFeeTotal += chargeback.Fee
+	}
+	statement.NetPayout = statement.Subtotal - statement.FeeTotal - statement.MonthlyAdjustment -
+		statement.RefundsTotal + statement.FeeReversalTotal - statement.ChargebacksTotal - statement.ChargebackFeeTotal -
+		statement.CarriedTotal + statement.CarryForwardTotal
+
+	return statement, nil
+}
+
+// Filename returns the name of the file of the statement, like statement-padberg_group-2023-01.pdf
+func (s *Statement) Filename(format Format) string {
+	if strings.HasPrefix(s.Reference, "DSB-") {
+		return fmt.Sprintf("statement-%s.%s", s.Reference, format)
+	}
+	return fmt.Sprintf("statement-%s-%s.%s", s.Merchant.Reference, s.Reference, format)
+}
@@ -0,0 +1,253 @@
+package statement
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupStatement(orders int) *Statement {
+	statement := &Statement{
+		Merchant:          entities.Merchant{ID: uuid.New(), Reference: "padberg_group", Email: "info@padberg-group.com"},
+		Reference:         "DSB-20230102-1A2B3C4D",
+		Currency:          "EUR",
+		PeriodStart:       time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+		PeriodEnd:         time.Date(2023, 1, 8, 0, 0, 0, 0, time.UTC),
+		Subtotal:          150.5,
+		FeeTotal:          1.45,
+		MonthlyAdjustment: 5,
+		NetPayout:         144.05,
+	}
+	for i := 0; i < orders; i++ {
+		statement.Orders = append(statement.Orders, entities.Order{
+			ID:        fmt.Sprintf("order-%d", i),
+			Amount:    100.5,
+			FeeAmount: 0.96,
+			CreatedAt: statement.PeriodStart,
+		})
+	}
+	return statement
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("PDF")
+	require.NoError(t, err)
+	require.Equal(t, PDFFormat, format)
+	require.Equal(t, "application/pdf", format.ContentType())
+
+	format, err = ParseFormat("csv")
+	require.NoError(t, err)
+	require.Equal(t, "text/csv", format.ContentType())
+
+	_, err = ParseFormat("xlsx")
+	require.ErrorContains(t, err, `unknown statement format "xlsx"`)
+}
+
+func TestForDisbursement(t *testing.T) {
+	ctx := context.Background()
+	merchant := test_helpers.SetupMerchantTemplate()
+	start := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2023, 1, 8, 0, 0, 0, 0, time.UTC)
+	disbursement := entities.MerchantDisbursement{
+		Reference:             "DSB-20230102-1A2B3C4D",
+		MerchantID:            merchant.ID,
+		Currency:              "GBP",
+		DisbursementFrequency: entities.WeeklyDisbursementFrequency,
+		OrdersStartAt:         start,
+		OrdersEndAt:           end,
+	}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDisbursementByReference", ctx, disbursement.Reference).Return(&disbursement, nil)
+	mockQuerier.On("SelectDisbursementByReference", ctx, "DSB-MISSING").Return(nil, nil)
+	mockQuerier.On("SelectMerchant", ctx, merchant.ID).Return(&merchant, nil)
+	mockQuerier.On("SelectDisbursedOrders", ctx, merchant.ID, start, end).Return([]entities.Order{
+		{ID: "1", Amount: 100, FeeAmount: 0.95, CreatedAt: start},
+		{ID: "2", Amount: 40, FeeAmount: 0.4, CreatedAt: end},
+	}, nil)
+	mockQuerier.On("SelectDisbursements", ctx, entities.DisbursementFilter{
+		MerchantID: merchant.ID,
+		Frequency:  entities.DailyDisbursementFrequency,
+		From:       start,
+		To:         end,
+	}).Return([]entities.MerchantDisbursement{{FeeAmountCorrection: 5}, {}}, nil)
+	mockQuerier.On("SelectDeductedRefunds", ctx, merchant.ID, start, end).Return([]entities.Refund{
+		{ID: "r-1", OrderID: "0", Amount: 20, FeeReversal: 0.19, CreatedAt: start},
+	}, nil)
+	mockQuerier.On("SelectDeductedChargebacks", ctx, merchant.ID, start, end).Return([]entities.Chargeback{
+		{ID: "cb-1", OrderID: "2", Amount: 40, Fee: 15, CreatedAt: end},
+	}, nil)
+
+	statement, err := ForDisbursement(ctx, mockQuerier, disbursement.Reference)
+	require.NoError(t, err)
+	require.Equal(t, merchant, statement.Merchant)
+	require.Equal(t, disbursement.Reference, statement.Reference)
+	require.Equal(t, "GBP", statement.Currency)
+	require.Len(t, statement.Orders, 2)
+	require.InDelta(t, 140, statement.Subtotal, 0.001)
+	require.InDelta(t, 1.35, statement.FeeTotal, 0.001)
+	require.InDelta(t, 5, statement.MonthlyAdjustment, 0.001)
+	require.Len(t, statement.Refunds, 1)
+	require.InDelta(t, 20, statement.RefundsTotal, 0.001)
+	require.InDelta(t, 0.19, statement.FeeReversalTotal, 0.001)
+	require.Len(t, statement.Chargebacks, 1)
+	require.InDelta(t, 40, statement.ChargebacksTotal, 0.001)
+	require.InDelta(t, 15, statement.ChargebackFeeTotal, 0.001)
+	require.InDelta(t, 58.84, statement.NetPayout, 0.001)
+	require.Equal(t, "statement-DSB-20230102-1A2B3C4D.pdf", statement.Filename(PDFFormat))
+
+	_, err = ForDisbursement(ctx, mockQuerier, "DSB-MISSING")
+	require.ErrorIs(t, err, ErrorDisbursementNotFound)
+}
+
+func TestForMonth(t *testing.T) {
+	ctx := context.Background()
+	merchant := test_helpers.SetupMerchantTemplate()
+	start := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2023, 2, 28, 0, 0, 0, 0, time.UTC)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchantByReference", ctx, merchant.Reference).Return(&merchant, nil)
+	mockQuerier.On("SelectMerchantByReference", ctx, "unknown").Return(nil, nil)
+	mockQuerier.On("SelectDisbursedOrders", ctx, merchant.ID, start, end).Return(nil, nil)
+	mockQuerier.On("SelectDisbursements", ctx, mock.Anything).Return(nil, nil)
+	mockQuerier.On("SelectDeductedRefunds", ctx, merchant.ID, start, end).Return(nil, nil)
+	mockQuerier.On("SelectDeductedChargebacks", ctx, merchant.ID, start, end).Return(nil, nil)
+
+	statement, err := ForMonth(ctx, mockQuerier, merchant.Reference, time.Date(2023, 2, 15, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, "2023-02", statement.Reference)
+	require.Equal(t, merchant.Currency, statement.Currency)
+	require.Equal(t, start, statement.PeriodStart)
+	require.Equal(t, end, statement.PeriodEnd)
+	require.Empty(t, statement.Orders)
+	require.Zero(t, statement.NetPayout)
+	require.Equal(t, "statement-"+merchant.Reference+"-2023-02.csv", statement.Filename(CSVFormat))
+
+	_, err = ForMonth(ctx, mockQuerier, "unknown", start)
+	require.ErrorIs(t, err, ErrorMerchantNotFound)
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, CSVFormat, setupStatement(2))
+	require.NoError(t, err)
+
+	expected := "" +
+		"merchant,padberg_group,,\n" +
+		"reference,DSB-20230102-1A2B3C4D,,\n" +
+		"currency,EUR,,\n" +
+		"period,2023-01-02,2023-01-08,\n" +
+		"order_id,date,amount,fee\n" +
+		"order-0,2023-01-02,100.50,0.96\n" +
+		"order-1,2023-01-02,100.50,0.96\n" +
+		"subtotal,,150.50,\n" +
+		"fee_total,,,1.45\n" +
+		"monthly_fee_adjustment,,,5.00\n" +
+		"net_payout,,144.05,\n"
+	require.Equal(t, expected, buf.String())
+
+	// The refunds are listed, and totalled, only when some were deducted
+	statement := setupStatement(1)
+	statement.Refunds = []entities.Refund{{ID: "refund-0", OrderID: "order-9", Amount: 20, FeeReversal: 0.19, CreatedAt: statement.PeriodEnd}}
+	statement.RefundsTotal = 20
+	statement.FeeReversalTotal = 0.19
+	statement.NetPayout = 124.24
+
+	buf.Reset()
+	err = Write(&buf, CSVFormat, statement)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "order-0,2023-01-02,100.50,0.96\n"+
+		"refund_id,date,amount,fee_reversal\n"+
+		"refund-0,2023-01-08,20.00,0.19\n"+
+		"subtotal,,150.50,\n")
+	require.Contains(t, buf.String(), "monthly_fee_adjustment,,,5.00\n"+
+		"refunds_total,,20.00,\n"+
+		"fee_reversal_total,,,0.19\n"+
+		"net_payout,,124.24,\n")
+
+	// The chargebacks are listed, and totalled with their fees, only when some were deducted
+	statement = setupStatement(1)
+	statement.Chargebacks = []entities.Chargeback{{ID: "cb-0", OrderID: "order-9", Amount: 40, Fee: 15, CreatedAt: statement.PeriodEnd}}
+	statement.ChargebacksTotal = 40
+	statement.ChargebackFeeTotal = 15
+	statement.NetPayout = 89.05
+
+	buf.Reset()
+	err = Write(&buf, CSVFormat, statement)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "order-0,2023-01-02,100.50,0.96\n"+
+		"chargeback_id,date,amount,chargeback_fee\n"+
+		"cb-0,2023-01-08,40.00,15.00\n"+
+		"subtotal,,150.50,\n")
+	require.Contains(t, buf.String(), "monthly_fee_adjustment,,,5.00\n"+
+		"chargebacks_total,,40.00,\n"+
+		"chargeback_fee_total,,,15.00\n"+
+		"net_payout,,89.05,\n")
+
+	// The balances carried are totalled only when the merchant was in debt
+	statement = setupStatement(1)
+	statement.CarriedTotal = 30
+	statement.NetPayout = 114.05
+
+	buf.Reset()
+	err = Write(&buf, CSVFormat, statement)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "monthly_fee_adjustment,,,5.00\n"+
+		"carried_total,,30.00,\n"+
+		"carry_forward_total,,0.00,\n"+
+		"net_payout,,114.05,\n")
+}
+
+func TestWritePDF(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, PDFFormat, setupStatement(2))
+	require.NoError(t, err)
+
+	pdf := buf.String()
+	require.True(t, strings.HasPrefix(pdf, "%PDF-1.4\n"))
+	require.True(t, strings.HasSuffix(pdf, "%%EOF\n"))
+	require.Contains(t, pdf, "/Count 1")
+	require.Contains(t, pdf, "(Merchant: padberg_group <info@padberg-group.com>) '")
+	require.Contains(t, pdf, "(Net payout \\(EUR\\)")
+	assertXref(t, pdf)
+
+	// Long statements take several pages
+	buf.Reset()
+	err = Write(&buf, PDFFormat, setupStatement(2*linesPerPage))
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "/Count 3")
+	assertXref(t, buf.String())
+}
+
+// assertXref checks the cross-reference table points to the objects, so readers can open the document
+func assertXref(t *testing.T, pdf string) {
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(pdf)
+	require.NotNil(t, startxref)
+	xref, err := strconv.Atoi(startxref[1])
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(pdf[xref:], "xref\n"))
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(pdf[xref:], -1)
+	require.NotEmpty(t, entries)
+	for i, entry := range entries {
+		offset, err := strconv.Atoi(entry[1])
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(pdf[offset:], fmt.Sprintf("%d 0 obj\n", i+1)), "object %d", i+1)
+	}
+}
+
+func TestEscapePDFText(t *testing.T) {
+	require.Equal(t, `a \(b\) \\ ? c`, escapePDFText(`a (b) \ € c`))
+}
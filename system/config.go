@@ -0,0 +1,407 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultJobPause           = time.Duration(60) * time.Second
+	DefaultLoaderStallTimeout = time.Duration(15) * time.Minute
+	DefaultOrdersWaitingPath  = "../orders/waiting/"
+	DefaultOrdersImportedPath = "../orders/imported/"
+	DefaultOrdersFailedPath   = "../orders/failed/"
+
+	DefaultStatementsWaitingPath  = "../statements/waiting/"
+	DefaultStatementsImportedPath = "../statements/imported/"
+	DefaultStatementsFailedPath   = "../statements/failed/"
+
+	DefaultWebhooksJobPause       = time.Duration(10) * time.Second
+	DefaultWebhooksTimeout        = time.Duration(10) * time.Second
+	DefaultWebhooksMaxAttempts    = 10
+	DefaultWebhooksInitialBackoff = time.Duration(30) * time.Second
+	DefaultWebhooksMaxBackoff     = time.Duration(6) * time.Hour
+
+	DefaultChargebackFee = 15.0
+)
+
+// Config is the configuration of the loader and the processor
+// It is resolved by LoadConfig, in order of precedence, from:
+// flags, environment variables, the config file and the defaults.
+type Config struct {
+	Database   DatabaseConfig   `yaml:"database"`
+	Loader     LoaderConfig     `yaml:"loader"`
+	Processor  ProcessorConfig  `yaml:"processor"`
+	Fees       FeesConfig       `yaml:"fees"`
+	Log        LogConfig        `yaml:"log"`
+	HTTP       HTTPConfig       `yaml:"http"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Payout     PayoutConfig     `yaml:"payout"`
+	Statements StatementsConfig `yaml:"statements"`
+	Webhooks   WebhooksConfig   `yaml:"webhooks"`
+}
+
+type DatabaseConfig struct {
+	URL         string `yaml:"url"`          // DATABASE_URL
+	AutoMigrate bool   `yaml:"auto_migrate"` // AUTO_MIGRATE
+}
+
+type LoaderConfig struct {
+	JobPause     time.Duration `yaml:"job_pause"`     // LOADER_JOB_PAUSE
+	WaitingPath  string        `yaml:"waiting_path"`  // ORDERS_WAITING_PATH
+	ImportedPath string        `yaml:"imported_path"` // ORDERS_IMPORTED_PATH
+	FailedPath   string        `yaml:"failed_path"`   // ORDERS_FAILED_PATH
+	StallTimeout time.Duration `yaml:"stall_timeout"` // LOADER_STALL_TIMEOUT, time over the job pause after which /healthz reports the loader as stuck
+}
+
+type ProcessorConfig struct {
+	WaitForLock bool `yaml:"wait_for_lock"` // PROCESSOR_WAIT_FOR_LOCK
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"` // LOG_LEVEL
+}
+
+// HTTPConfig holds the address of the HTTP server with the operational endpoints, disabled when empty
+type HTTPConfig struct {
+	Addr string `yaml:"addr"` // HTTP_ADDR
+}
+
+// MetricsConfig holds the Prometheus Pushgateway the processor pushes its metrics to when it finishes
+// Used for scheduled runs, which exit before they can be scraped
+type MetricsConfig struct {
+	PushURL string `yaml:"push_url"` // METRICS_PUSH_URL
+}
+
+// PayoutConfig holds the account the payouts are sent from, required by the payout command
+type PayoutConfig struct {
+	DebtorName string `yaml:"debtor_name"` // PAYOUT_DEBTOR_NAME
+	DebtorIBAN string `yaml:"debtor_iban"` // PAYOUT_DEBTOR_IBAN
+	DebtorBIC  string `yaml:"debtor_bic"`  // PAYOUT_DEBTOR_BIC, optional
+}
+
+// StatementsConfig holds the folders of the bank statement files reconciled by the reconcile command
+type StatementsConfig struct {
+	JobPause     time.Duration `yaml:"job_pause"`     // STATEMENTS_JOB_PAUSE, between each import when watching the folder
+	WaitingPath  string        `yaml:"waiting_path"`  // STATEMENTS_WAITING_PATH
+	ImportedPath string        `yaml:"imported_path"` // STATEMENTS_IMPORTED_PATH
+	FailedPath   string        `yaml:"failed_path"`   // STATEMENTS_FAILED_PATH
+}
+
+// WebhooksConfig holds the delivery of the disbursement events to the webhooks of the merchants
+// A failed delivery is retried after the initial backoff, doubled after each failure up to the maximum backoff,
+// until the maximum attempts are reached and the event is dead.
+type WebhooksConfig struct {
+	JobPause       time.Duration `yaml:"job_pause"`       // WEBHOOKS_JOB_PAUSE, between each dispatch when watching the outbox
+	Timeout        time.Duration `yaml:"timeout"`         // WEBHOOKS_TIMEOUT, of each delivery
+	MaxAttempts    int           `yaml:"max_attempts"`    // WEBHOOKS_MAX_ATTEMPTS
+	InitialBackoff time.Duration `yaml:"initial_backoff"` // WEBHOOKS_INITIAL_BACKOFF
+	MaxBackoff     time.Duration `yaml:"max_backoff"`     // WEBHOOKS_MAX_BACKOFF
+}
+
+// FeesConfig holds the pricing of the orders
+// When no tiers are configured the built-in pricing is used.
+// The orders in a currency with its own tiers are priced with them, with amounts in that currency.
+type FeesConfig struct {
+	Tiers             []FeeTier             `yaml:"tiers"`
+	CurrencyTiers     map[string][]FeeTier  `yaml:"currency_tiers"`      // By currency code, like GBP
+	RefundFeeReversal entities.FeeReversals `yaml:"refund_fee_reversal"` // FEES_REFUND_FEE_REVERSAL, proportional or none
+	ChargebackFee     float64               `yaml:"chargeback_fee"`      // FEES_CHARGEBACK_FEE, charged to the merchant for each chargeback
+}
+
+// FeeTier applies its percentage to the orders with an amount of MinAmount or more
+type FeeTier struct {
+	MinAmount  float64 `yaml:"min_amount"`
+	Percentage float64 `yaml:"percentage"`
+}
+
+// DefaultConfig returns the configuration used when nothing else is set
+func DefaultConfig() Config {
+	return Config{
+		Database: DatabaseConfig{
+			AutoMigrate: true,
+		},
+		Loader: LoaderConfig{
+			JobPause:     DefaultJobPause,
+			WaitingPath:  DefaultOrdersWaitingPath,
+			ImportedPath: DefaultOrdersImportedPath,
+			FailedPath:   DefaultOrdersFailedPath,
+			StallTimeout: DefaultLoaderStallTimeout,
+		},
+		Statements: StatementsConfig{
+			JobPause:     DefaultJobPause,
+			WaitingPath:  DefaultStatementsWaitingPath,
+			ImportedPath: DefaultStatementsImportedPath,
+			FailedPath:   DefaultStatementsFailedPath,
+		},
+		Webhooks: WebhooksConfig{
+			JobPause:       DefaultWebhooksJobPause,
+			Timeout:        DefaultWebhooksTimeout,
+			MaxAttempts:    DefaultWebhooksMaxAttempts,
+			InitialBackoff: DefaultWebhooksInitialBackoff,
+			MaxBackoff:     DefaultWebhooksMaxBackoff,
+		},
+		Fees: FeesConfig{
+			RefundFeeReversal: entities.ProportionalFeeReversal,
+			ChargebackFee:     DefaultChargebackFee,
+		},
+		Log: LogConfig{
+			Level: DefaultLogLevel,
+		},
+	}
+}
+
+// LoadConfig merges the defaults, the config file, if any, and the environment variables
+// Flags are applied by the caller on the returned config, before validating it
+func LoadConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		err := cfg.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := cfg.loadEnv(lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// loadFile overrides the config with the values present in a YAML file
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// loadEnv overrides the config with the environment variables that are set
+func (c *Config) loadEnv(lookupEnv func(string) (string, bool)) error {
+	if value, ok := lookupEnv("DATABASE_URL"); ok {
+		c.Database.URL = value
+	}
+	if value, ok := lookupEnv("ORDERS_WAITING_PATH"); ok {
+		c.Loader.WaitingPath = value
+	}
+	if value, ok := lookupEnv("ORDERS_IMPORTED_PATH"); ok {
+		c.Loader.ImportedPath = value
+	}
+	if value, ok := lookupEnv("ORDERS_FAILED_PATH"); ok {
+		c.Loader.FailedPath = value
+	}
+	if value, ok := lookupEnv("LOG_LEVEL"); ok {
+		c.Log.Level = value
+	}
+	if value, ok := lookupEnv("HTTP_ADDR"); ok {
+		c.HTTP.Addr = value
+	}
+	if value, ok := lookupEnv("METRICS_PUSH_URL"); ok {
+		c.Metrics.PushURL = value
+	}
+	if value, ok := lookupEnv("PAYOUT_DEBTOR_NAME"); ok {
+		c.Payout.DebtorName = value
+	}
+	if value, ok := lookupEnv("PAYOUT_DEBTOR_IBAN"); ok {
+		c.Payout.DebtorIBAN = value
+	}
+	if value, ok := lookupEnv("PAYOUT_DEBTOR_BIC"); ok {
+		c.Payout.DebtorBIC = value
+	}
+	if value, ok := lookupEnv("STATEMENTS_WAITING_PATH"); ok {
+		c.Statements.WaitingPath = value
+	}
+	if value, ok := lookupEnv("STATEMENTS_IMPORTED_PATH"); ok {
+		c.Statements.ImportedPath = value
+	}
+	if value, ok := lookupEnv("STATEMENTS_FAILED_PATH"); ok {
+		c.Statements.FailedPath = value
+	}
+	if value, ok := lookupEnv("FEES_REFUND_FEE_REVERSAL"); ok {
+		c.Fees.RefundFeeReversal = entities.FeeReversals(value)
+	}
+
+	var err error
+	if value, ok := lookupEnv("AUTO_MIGRATE"); ok {
+		c.Database.AutoMigrate, err = strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("error parsing AUTO_MIGRATE: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("LOADER_JOB_PAUSE"); ok {
+		c.Loader.JobPause, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("error parsing LOADER_JOB_PAUSE: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("LOADER_STALL_TIMEOUT"); ok {
+		c.Loader.StallTimeout, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("error parsing LOADER_STALL_TIMEOUT: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("STATEMENTS_JOB_PAUSE"); ok {
+		c.Statements.JobPause, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("error parsing STATEMENTS_JOB_PAUSE: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("WEBHOOKS_JOB_PAUSE"); ok {
+		c.Webhooks.JobPause, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("error parsing WEBHOOKS_JOB_PAUSE: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("WEBHOOKS_TIMEOUT"); ok {
+		c.Webhooks.Timeout, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("error parsing WEBHOOKS_TIMEOUT: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("WEBHOOKS_INITIAL_BACKOFF"); ok {
+		c.Webhooks.InitialBackoff, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("error parsing WEBHOOKS_INITIAL_BACKOFF: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("WEBHOOKS_MAX_BACKOFF"); ok {
+		c.Webhooks.MaxBackoff, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("error parsing WEBHOOKS_MAX_BACKOFF: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("WEBHOOKS_MAX_ATTEMPTS"); ok {
+		c.Webhooks.MaxAttempts, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("error parsing WEBHOOKS_MAX_ATTEMPTS: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("PROCESSOR_WAIT_FOR_LOCK"); ok {
+		c.Processor.WaitForLock, err = strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("error parsing PROCESSOR_WAIT_FOR_LOCK: %v", err)
+		}
+	}
+	if value, ok := lookupEnv("FEES_CHARGEBACK_FEE"); ok {
+		c.Fees.ChargebackFee, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing FEES_CHARGEBACK_FEE: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the resolved configuration
+// The database URL is checked when connecting, as not every command needs it
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Loader.JobPause <= 0 {
+		errs = append(errs, fmt.Errorf("loader job_pause must be positive, got %s", c.Loader.JobPause))
+	}
+	if c.Loader.StallTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("loader stall_timeout must be positive, got %s", c.Loader.StallTimeout))
+	}
+	if c.Loader.WaitingPath == "" || c.Loader.ImportedPath == "" || c.Loader.FailedPath == "" {
+		errs = append(errs, errors.New("loader waiting_path, imported_path and failed_path are required"))
+	}
+	if c.Statements.JobPause <= 0 {
+		errs = append(errs, fmt.Errorf("statements job_pause must be positive, got %s", c.Statements.JobPause))
+	}
+	if c.Statements.WaitingPath == "" || c.Statements.ImportedPath == "" || c.Statements.FailedPath == "" {
+		errs = append(errs, errors.New("statements waiting_path, imported_path and failed_path are required"))
+	}
+
+	if c.Webhooks.JobPause <= 0 || c.Webhooks.Timeout <= 0 || c.Webhooks.InitialBackoff <= 0 {
+		errs = append(errs, errors.New("webhooks job_pause, timeout and initial_backoff must be positive"))
+	}
+	if c.Webhooks.MaxBackoff < c.Webhooks.InitialBackoff {
+		errs = append(errs, fmt.Errorf("webhooks max_backoff must be at least the initial_backoff, got %s", c.Webhooks.MaxBackoff))
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhooks max_attempts must be at least 1, got %d", c.Webhooks.MaxAttempts))
+	}
+
+	_, err := ParseLogLevel(c.Log.Level)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.HTTP.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid http addr %q, expected host:port", c.HTTP.Addr))
+		}
+	}
+	if c.Metrics.PushURL != "" {
+		if u, err := url.Parse(c.Metrics.PushURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid metrics push_url %q", c.Metrics.PushURL))
+		}
+	}
+
+	errs = append(errs, validateFeeTiers("", c.Fees.Tiers)...)
+	currencies := make([]string, 0, len(c.Fees.CurrencyTiers))
+	for currency := range c.Fees.CurrencyTiers {
+		currencies = append(currencies, currency)
+	}
+	slices.Sort(currencies)
+	for _, currency := range currencies {
+		tiers := c.Fees.CurrencyTiers[currency]
+		if !entities.ValidCurrency(currency) {
+			errs = append(errs, fmt.Errorf("invalid fees currency_tiers currency %q, expected a code like GBP", currency))
+		}
+		if len(tiers) == 0 {
+			errs = append(errs, fmt.Errorf("fees currency_tiers %s has no tiers", currency))
+		}
+		errs = append(errs, validateFeeTiers(currency+" ", tiers)...)
+	}
+	if !slices.Contains(entities.FeeReversalsList, c.Fees.RefundFeeReversal) {
+		errs = append(errs, fmt.Errorf("unknown fees refund_fee_reversal %q, expected proportional or none", c.Fees.RefundFeeReversal))
+	}
+	if c.Fees.ChargebackFee < 0 {
+		errs = append(errs, fmt.Errorf("fees chargeback_fee must not be negative, got %v", c.Fees.ChargebackFee))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateFeeTiers checks the tiers are sorted and start at 0, the prefix names the currency of the tiers, if any
+func validateFeeTiers(prefix string, tiers []FeeTier) []error {
+	var errs []error
+	for i, tier := range tiers {
+		if tier.Percentage < 0 || tier.Percentage >= 1 {
+			errs = append(errs, fmt.Errorf("%sfee tier %d percentage must be between 0 and 1, got %v", prefix, i+1, tier.Percentage))
+		}
+		if i == 0 && tier.MinAmount != 0 {
+			errs = append(errs, fmt.Errorf("the first %sfee tier must start at min_amount 0, got %v", prefix, tier.MinAmount))
+		}
+		if i > 0 && tier.MinAmount <= tiers[i-1].MinAmount {
+			errs = append(errs, fmt.Errorf("%sfee tier %d min_amount must be greater than the previous tier", prefix, i+1))
+		}
+	}
+	return errs
+}
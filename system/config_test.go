@@ -0,0 +1,179 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/stretchr/testify/require"
+)
+
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	require.NoError(t, err)
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig("", envLookup(nil))
+	require.NoError(t, err)
+	require.Equal(t, DefaultConfig(), *cfg)
+	require.True(t, cfg.Database.AutoMigrate)
+	require.Equal(t, DefaultJobPause, cfg.Loader.JobPause)
+	require.NoError(t, cfg.Validate())
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+database:
+  url: postgres://file
+  auto_migrate: false
+loader:
+  job_pause: 30s
+  waiting_path: /orders/waiting/
+processor:
+  wait_for_lock: true
+fees:
+  tiers:
+    - min_amount: 0
+      percentage: 0.02
+    - min_amount: 100
+      percentage: 0.01
+  currency_tiers:
+    GBP:
+      - min_amount: 0
+        percentage: 0.015
+  refund_fee_reversal: none
+  chargeback_fee: 20
+`)
+
+	t.Run("FileOverridesDefaults", func(t *testing.T) {
+		cfg, err := LoadConfig(path, envLookup(nil))
+		require.NoError(t, err)
+		require.Equal(t, "postgres://file", cfg.Database.URL)
+		require.False(t, cfg.Database.AutoMigrate)
+		require.Equal(t, 30*time.Second, cfg.Loader.JobPause)
+		require.Equal(t, "/orders/waiting/", cfg.Loader.WaitingPath)
+		require.Equal(t, DefaultOrdersImportedPath, cfg.Loader.ImportedPath)
+		require.True(t, cfg.Processor.WaitForLock)
+		require.Equal(t, []FeeTier{{0, 0.02}, {100, 0.01}}, cfg.Fees.Tiers)
+		require.Equal(t, map[string][]FeeTier{"GBP": {{0, 0.015}}}, cfg.Fees.CurrencyTiers)
+		require.Equal(t, entities.NoFeeReversal, cfg.Fees.RefundFeeReversal)
+		require.Equal(t, 20.0, cfg.Fees.ChargebackFee)
+		require.NoError(t, cfg.Validate())
+	})
+
+	t.Run("EnvironmentOverridesFile", func(t *testing.T) {
+		cfg, err := LoadConfig(path, envLookup(map[string]string{
+			"DATABASE_URL":             "postgres://env",
+			"AUTO_MIGRATE":             "true",
+			"LOADER_JOB_PAUSE":         "5m",
+			"ORDERS_FAILED_PATH":       "/orders/failed/",
+			"PROCESSOR_WAIT_FOR_LOCK":  "false",
+			"LOG_LEVEL":                "debug",
+			"HTTP_ADDR":                ":9090",
+			"PAYOUT_DEBTOR_NAME":       "Sequra Payouts",
+			"PAYOUT_DEBTOR_IBAN":       "ES9121000418450200051332",
+			"STATEMENTS_JOB_PAUSE":     "10m",
+			"STATEMENTS_WAITING_PATH":  "/statements/waiting/",
+			"WEBHOOKS_MAX_ATTEMPTS":    "3",
+			"WEBHOOKS_MAX_BACKOFF":     "1h",
+			"FEES_REFUND_FEE_REVERSAL": "proportional",
+			"FEES_CHARGEBACK_FEE":      "12.5",
+		}))
+		require.NoError(t, err)
+		require.Equal(t, "postgres://env", cfg.Database.URL)
+		require.True(t, cfg.Database.AutoMigrate)
+		require.Equal(t, 5*time.Minute, cfg.Loader.JobPause)
+		require.Equal(t, "/orders/waiting/", cfg.Loader.WaitingPath)
+		require.Equal(t, "/orders/failed/", cfg.Loader.FailedPath)
+		require.False(t, cfg.Processor.WaitForLock)
+		require.Equal(t, "debug", cfg.Log.Level)
+		require.Equal(t, ":9090", cfg.HTTP.Addr)
+		require.Equal(t, PayoutConfig{DebtorName: "Sequra Payouts", DebtorIBAN: "ES9121000418450200051332"}, cfg.Payout)
+		require.Equal(t, 10*time.Minute, cfg.Statements.JobPause)
+		require.Equal(t, "/statements/waiting/", cfg.Statements.WaitingPath)
+		require.Equal(t, DefaultStatementsImportedPath, cfg.Statements.ImportedPath)
+		require.Equal(t, 3, cfg.Webhooks.MaxAttempts)
+		require.Equal(t, time.Hour, cfg.Webhooks.MaxBackoff)
+		require.Equal(t, DefaultWebhooksInitialBackoff, cfg.Webhooks.InitialBackoff)
+		require.Equal(t, entities.ProportionalFeeReversal, cfg.Fees.RefundFeeReversal)
+		require.Equal(t, 12.5, cfg.Fees.ChargebackFee)
+	})
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"), envLookup(nil))
+		require.ErrorContains(t, err, "error reading config file")
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		path := writeConfigFile(t, "loader:\n  pause: 30s\n")
+		_, err := LoadConfig(path, envLookup(nil))
+		require.ErrorContains(t, err, "field pause not found")
+	})
+
+	t.Run("EmptyFile", func(t *testing.T) {
+		path := writeConfigFile(t, "")
+		cfg, err := LoadConfig(path, envLookup(nil))
+		require.NoError(t, err)
+		require.Equal(t, DefaultConfig(), *cfg)
+	})
+
+	t.Run("InvalidEnvironmentValue", func(t *testing.T) {
+		_, err := LoadConfig("", envLookup(map[string]string{"LOADER_JOB_PAUSE": "soon"}))
+		require.ErrorContains(t, err, "error parsing LOADER_JOB_PAUSE")
+
+		_, err = LoadConfig("", envLookup(map[string]string{"WEBHOOKS_TIMEOUT": "later"}))
+		require.ErrorContains(t, err, "error parsing WEBHOOKS_TIMEOUT")
+
+		_, err = LoadConfig("", envLookup(map[string]string{"AUTO_MIGRATE": "maybe"}))
+		require.ErrorContains(t, err, "error parsing AUTO_MIGRATE")
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		description string
+		change      func(*Config)
+		expected    string
+	}{
+		{"NonPositiveJobPause", func(c *Config) { c.Loader.JobPause = 0 }, "job_pause must be positive"},
+		{"NonPositiveStallTimeout", func(c *Config) { c.Loader.StallTimeout = -time.Minute }, "stall_timeout must be positive"},
+		{"MissingPath", func(c *Config) { c.Loader.FailedPath = "" }, "failed_path are required"},
+		{"NonPositiveWebhooksTimeout", func(c *Config) { c.Webhooks.Timeout = 0 }, "webhooks job_pause, timeout and initial_backoff must be positive"},
+		{"WebhooksMaxBackoffBelowInitial", func(c *Config) { c.Webhooks.MaxBackoff = time.Second }, "max_backoff must be at least the initial_backoff"},
+		{"NoWebhooksAttempts", func(c *Config) { c.Webhooks.MaxAttempts = 0 }, "max_attempts must be at least 1"},
+		{"MissingStatementsPath", func(c *Config) { c.Statements.WaitingPath = "" }, "statements waiting_path"},
+		{"FirstTierNotAtZero", func(c *Config) { c.Fees.Tiers = []FeeTier{{10, 0.01}} }, "must start at min_amount 0"},
+		{"PercentageOutOfRange", func(c *Config) { c.Fees.Tiers = []FeeTier{{0, 1.5}} }, "percentage must be between 0 and 1"},
+		{"InvalidHTTPAddr", func(c *Config) { c.HTTP.Addr = "8080" }, "invalid http addr"},
+		{"InvalidPushURL", func(c *Config) { c.Metrics.PushURL = "pushgateway" }, "invalid metrics push_url"},
+		{"InvalidLogLevel", func(c *Config) { c.Log.Level = "verbose" }, "invalid log level"},
+		{"UnknownFeeReversal", func(c *Config) { c.Fees.RefundFeeReversal = "half" }, `unknown fees refund_fee_reversal "half"`},
+		{"NegativeChargebackFee", func(c *Config) { c.Fees.ChargebackFee = -1 }, "chargeback_fee must not be negative"},
+		{"UnsortedTiers", func(c *Config) { c.Fees.Tiers = []FeeTier{{0, 0.01}, {300, 0.0085}, {50, 0.0095}} }, "greater than the previous tier"},
+		{"InvalidTiersCurrency", func(c *Config) { c.Fees.CurrencyTiers = map[string][]FeeTier{"gbp": {{0, 0.01}}} }, `currency "gbp"`},
+		{"NoCurrencyTiers", func(c *Config) { c.Fees.CurrencyTiers = map[string][]FeeTier{"GBP": {}} }, "GBP has no tiers"},
+		{"CurrencyFirstTierNotAtZero", func(c *Config) { c.Fees.CurrencyTiers = map[string][]FeeTier{"GBP": {{10, 0.01}}} }, "the first GBP fee tier must start at min_amount 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cfg := DefaultConfig()
+			test.change(&cfg)
+			require.ErrorContains(t, cfg.Validate(), test.expected)
+		})
+	}
+}
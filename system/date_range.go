@@ -0,0 +1,132 @@
+package system
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// MonthOnly is the layout of a whole month expression, eg: 2023-01
+	MonthOnly = "2006-01"
+)
+
+// DateRange is a range of days, both From and To are included
+type DateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// Days returns every day of the range, from the first to the last one
+func (r DateRange) Days() []time.Time {
+	var days []time.Time
+	for current := r.From; !current.After(r.To); current = current.AddDate(0, 0, 1) {
+		days = append(days, current)
+	}
+	return days
+}
+
+func (r DateRange) String() string {
+	if r.From.Equal(r.To) {
+		return r.From.Format(time.DateOnly)
+	}
+	return fmt.Sprintf("%s..%s", r.From.Format(time.DateOnly), r.To.Format(time.DateOnly))
+}
+
+// ParseDateRange builds the range of days to process from the -from, -to and -day options
+// Each option accepts a date expression, see ParseDateExpression.
+// -from uses the first day of its expression and -to the last one, so -from 2023-01 -to 2023-03
+// covers the whole first quarter. Without any option the range is yesterday.
+// It fails when only one of -from and -to is set, when -day is combined with them,
+// when -to is before -from or when the range ends in the future.
+func ParseDateRange(from, to, day string, today time.Time) (*DateRange, error) {
+	today = StartOfDay(today)
+
+	var dateRange DateRange
+	switch {
+	case day != "" && (from != "" || to != ""):
+		return nil, fmt.Errorf("use either -day or -from and -to")
+
+	case day != "":
+		expression, err := ParseDateExpression(day, today)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ORDERS_DAY: %v", err)
+		}
+		dateRange = expression
+
+	case from != "" && to != "":
+		fromExpression, err := ParseDateExpression(from, today)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ORDERS_FROM: %v", err)
+		}
+		toExpression, err := ParseDateExpression(to, today)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ORDERS_TO: %v", err)
+		}
+		dateRange = DateRange{From: fromExpression.From, To: toExpression.To}
+
+	case from != "":
+		return nil, fmt.Errorf("missing -to, both -from and -to are required")
+
+	case to != "":
+		return nil, fmt.Errorf("missing -from, both -from and -to are required")
+
+	default:
+		yesterday := today.AddDate(0, 0, -1)
+		dateRange = DateRange{From: yesterday, To: yesterday}
+	}
+
+	if dateRange.To.Before(dateRange.From) {
+		return nil, fmt.Errorf("the range end %s is before its start %s",
+			dateRange.To.Format(time.DateOnly), dateRange.From.Format(time.DateOnly))
+	}
+
+	if dateRange.To.After(today) {
+		return nil, fmt.Errorf("the range end %s is in the future", dateRange.To.Format(time.DateOnly))
+	}
+
+	return &dateRange, nil
+}
+
+// ParseDateExpression parses a date expression into the range of days it covers
+// Supported expressions:
+//   - 2023-01-15: a single day
+//   - 2023-01: the whole month
+//   - today, yesterday: a single day relative to today
+//   - last-week: Monday to Sunday of the previous week
+//   - last-month: the whole previous month
+func ParseDateExpression(expression string, today time.Time) (DateRange, error) {
+	today = StartOfDay(today)
+	expression = strings.TrimSpace(expression)
+
+	switch strings.ToLower(expression) {
+	case "today":
+		return DateRange{From: today, To: today}, nil
+	case "yesterday":
+		yesterday := today.AddDate(0, 0, -1)
+		return DateRange{From: yesterday, To: yesterday}, nil
+	case "last-week":
+		// Weeks start on Monday
+		daysSinceMonday := (int(today.Weekday()) + 6) % 7
+		firstDay := today.AddDate(0, 0, -daysSinceMonday-7)
+		return DateRange{From: firstDay, To: firstDay.AddDate(0, 0, 6)}, nil
+	case "last-month":
+		return DateRange{From: FirstDayOfLastMonth(today), To: LastDayOfLastMonth(today)}, nil
+	}
+
+	if day, err := time.Parse(time.DateOnly, expression); err == nil {
+		return DateRange{From: day, To: day}, nil
+	}
+
+	if month, err := time.Parse(MonthOnly, expression); err == nil {
+		return DateRange{From: month, To: month.AddDate(0, 1, -1)}, nil
+	}
+
+	return DateRange{}, fmt.Errorf("invalid date %q, expected yyyy-mm-dd, yyyy-mm, today, yesterday, last-week or last-month", expression)
+}
+
+// StartOfDay truncates the time to the beginning of its day, in UTC
+func StartOfDay(day time.Time) time.Time {
+	day = day.UTC()
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,136 @@
+package system
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParseDateExpression(t *testing.T) {
+	// A Wednesday
+	today := time.Date(2023, 3, 15, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		expression string
+		expected   DateRange
+	}{
+		{"2023-01-15", DateRange{date(2023, 1, 15), date(2023, 1, 15)}},
+		{" 2023-01-05", DateRange{date(2023, 1, 5), date(2023, 1, 5)}},
+		{"2023-02", DateRange{date(2023, 2, 1), date(2023, 2, 28)}},
+		{"2023-02 ", DateRange{date(2023, 2, 1), date(2023, 2, 28)}},
+		{"2024-02", DateRange{date(2024, 2, 1), date(2024, 2, 29)}},
+		{"today", DateRange{date(2023, 3, 15), date(2023, 3, 15)}},
+		{"yesterday", DateRange{date(2023, 3, 14), date(2023, 3, 14)}},
+		{"Yesterday", DateRange{date(2023, 3, 14), date(2023, 3, 14)}},
+		{"last-week", DateRange{date(2023, 3, 6), date(2023, 3, 12)}},
+		{"last-month", DateRange{date(2023, 2, 1), date(2023, 2, 28)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			result, err := ParseDateExpression(test.expression, today)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, result)
+		})
+	}
+}
+
+func TestParseDateExpressionLastWeekEdges(t *testing.T) {
+	// On a Monday and on a Sunday, last week is the one before the current week
+	result, err := ParseDateExpression("last-week", date(2023, 3, 13))
+	require.NoError(t, err)
+	require.Equal(t, DateRange{date(2023, 3, 6), date(2023, 3, 12)}, result)
+
+	result, err = ParseDateExpression("last-week", date(2023, 3, 19))
+	require.NoError(t, err)
+	require.Equal(t, DateRange{date(2023, 3, 6), date(2023, 3, 12)}, result)
+}
+
+func TestParseDateExpressionInvalid(t *testing.T) {
+	for _, expression := range []string{"", "tomorrow", "2023-13", "2023-02-30", "15/01/2023"} {
+		_, err := ParseDateExpression(expression, date(2023, 3, 15))
+		require.Error(t, err, expression)
+	}
+}
+
+func TestParseDateRange(t *testing.T) {
+	today := date(2023, 3, 15)
+
+	tests := []struct {
+		description string
+		from        string
+		to          string
+		day         string
+		expected    DateRange
+	}{
+		{"Defaults to yesterday", "", "", "", DateRange{date(2023, 3, 14), date(2023, 3, 14)}},
+		{"Single day", "", "", "2023-01-10", DateRange{date(2023, 1, 10), date(2023, 1, 10)}},
+		{"Single relative day", "", "", "last-week", DateRange{date(2023, 3, 6), date(2023, 3, 12)}},
+		{"Inclusive range", "2023-01-01", "2023-01-31", "", DateRange{date(2023, 1, 1), date(2023, 1, 31)}},
+		{"Same day range", "2023-01-01", "2023-01-01", "", DateRange{date(2023, 1, 1), date(2023, 1, 1)}},
+		{"Months range", "2023-01", "2023-02", "", DateRange{date(2023, 1, 1), date(2023, 2, 28)}},
+		{"Relative range", "last-month", "yesterday", "", DateRange{date(2023, 2, 1), date(2023, 3, 14)}},
+		{"Up to today", "2023-03-01", "today", "", DateRange{date(2023, 3, 1), date(2023, 3, 15)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			result, err := ParseDateRange(test.from, test.to, test.day, today)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, *result)
+		})
+	}
+}
+
+func TestParseDateRangeValidation(t *testing.T) {
+	today := date(2023, 3, 15)
+
+	tests := []struct {
+		description string
+		from        string
+		to          string
+		day         string
+		expectedErr string
+	}{
+		{"Only from", "2023-01-01", "", "", "missing -to, both -from and -to are required"},
+		{"Only to", "", "2023-01-01", "", "missing -from, both -from and -to are required"},
+		{"Day and range", "2023-01-01", "2023-01-02", "2023-01-01", "use either -day or -from and -to"},
+		{"Inverted range", "2023-01-31", "2023-01-01", "", "the range end 2023-01-01 is before its start 2023-01-31"},
+		{"Future range", "2023-03-01", "2023-03-16", "", "the range end 2023-03-16 is in the future"},
+		{"Future month", "", "", "2023-03", "the range end 2023-03-31 is in the future"},
+		{"Invalid from", "not-a-date", "2023-01-01", "", "error parsing ORDERS_FROM"},
+		{"Invalid to", "2023-01-01", "not-a-date", "", "error parsing ORDERS_TO"},
+		{"Invalid day", "", "", "not-a-date", "error parsing ORDERS_DAY"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			result, err := ParseDateRange(test.from, test.to, test.day, today)
+			require.Error(t, err)
+			require.Nil(t, result)
+			require.Contains(t, err.Error(), test.expectedErr)
+		})
+	}
+}
+
+func TestDateRangeDays(t *testing.T) {
+	days := DateRange{From: date(2023, 2, 27), To: date(2023, 3, 2)}.Days()
+	require.Equal(t, []time.Time{date(2023, 2, 27), date(2023, 2, 28), date(2023, 3, 1), date(2023, 3, 2)}, days)
+
+	days = DateRange{From: date(2023, 2, 27), To: date(2023, 2, 27)}.Days()
+	require.Equal(t, []time.Time{date(2023, 2, 27)}, days)
+}
+
+func TestDateRangeString(t *testing.T) {
+	require.Equal(t, "2023-02-27", DateRange{From: date(2023, 2, 27), To: date(2023, 2, 27)}.String())
+	require.Equal(t, "2023-02-27..2023-03-02", DateRange{From: date(2023, 2, 27), To: date(2023, 3, 2)}.String())
+}
+
+func TestStartOfDay(t *testing.T) {
+	require.Equal(t, date(2023, 3, 15), StartOfDay(time.Date(2023, 3, 15, 23, 59, 59, 0, time.UTC)))
+}
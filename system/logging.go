@@ -0,0 +1,47 @@
+package system
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const DefaultLogLevel = "info"
+
+// Keys of the log fields shared by the packages, so records can be correlated
+const (
+	LogComponentKey    = "component"
+	LogRunIDKey        = "run_id"
+	LogFileKey         = "file"
+	LogOrderIDKey      = "order_id"
+	LogRefundIDKey     = "refund_id"
+	LogChargebackIDKey = "chargeback_id"
+	LogMerchantIDKey   = "merchant_id"
+	LogDayKey          = "day"
+	LogErrorKey        = "error"
+)
+
+// ParseLogLevel parses a log level name: debug, info, warn or error
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.TrimSpace(name)))
+	if err != nil {
+		return level, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// NewLogger creates a logger writing JSON records of the level or above
+// The source file of each record is only added at debug level
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:     level,
+		AddSource: level <= slog.LevelDebug,
+	}))
+}
+
+// ComponentLogger returns the default logger tagged with the component name
+func ComponentLogger(component string) *slog.Logger {
+	return slog.Default().With(LogComponentKey, component)
+}
@@ -0,0 +1,49 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"info", slog.LevelInfo},
+		{"WARN", slog.LevelWarn},
+		{" error ", slog.LevelError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			level, err := ParseLogLevel(test.name)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, level)
+		})
+	}
+
+	_, err := ParseLogLevel("verbose")
+	require.ErrorContains(t, err, `invalid log level "verbose"`)
+}
+
+func TestNewLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, slog.LevelInfo).With(LogRunIDKey, "run")
+
+	logger.Debug("hidden")
+	logger.Info("shown", LogDayKey, "2023-01-01")
+
+	var record map[string]any
+	err := json.Unmarshal(buffer.Bytes(), &record)
+	require.NoError(t, err, "a single JSON record is expected")
+	require.Equal(t, "shown", record[slog.MessageKey])
+	require.Equal(t, "run", record[LogRunIDKey])
+	require.Equal(t, "2023-01-01", record[LogDayKey])
+	require.NotContains(t, record, slog.SourceKey)
+}
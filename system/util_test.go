@@ -48,8 +48,12 @@ func TestInvalidDbURL(t *testing.T) {
 }
 
 func TestMissingDisbursementDateRange(t *testing.T) {
-	_, _, err := ParseDisbursementDateRange([]string{})
+	dateRange, err := ParseDisbursementDateRange([]string{})
 	require.NoError(t, err)
+
+	// Defaults to yesterday
+	yesterday := StartOfDay(time.Now()).AddDate(0, 0, -1)
+	require.Equal(t, &DateRange{From: yesterday, To: yesterday}, dateRange)
 }
 
 func TestParseDisbursementDateRangeInvalidParameters(t *testing.T) {
@@ -59,7 +63,7 @@ func TestParseDisbursementDateRangeInvalidParameters(t *testing.T) {
 		args := []string{"-ORDERS_FROM", from, "-ORDERS_TO", to}
 
 		// Call the ParseDisbursementDateRange method with invalid parameters
-		_, _, err := ParseDisbursementDateRange(args)
+		_, err := ParseDisbursementDateRange(args)
 
 		// Check if error is expected for invalid parameters
 		return err != nil
@@ -124,10 +128,9 @@ func TestParseDisbursementDateRangeInvalidFrom(t *testing.T) {
 	invalidFromDate := "invalid-date"
 	args := []string{"-from", invalidFromDate, "-to", "2021-10-01"}
 
-	from, to, err := ParseDisbursementDateRange(args)
+	dateRange, err := ParseDisbursementDateRange(args)
 	require.Error(t, err)
-	require.Nil(t, from)
-	require.Nil(t, to)
+	require.Nil(t, dateRange)
 	require.Contains(t, err.Error(), "error parsing ORDERS_FROM")
 }
 
@@ -135,9 +138,8 @@ func TestParseDisbursementDateRangeInvalidTo(t *testing.T) {
 	invalidToDate := "invalid-date"
 	args := []string{"-from", "2021-10-01", "-to", invalidToDate}
 
-	from, to, err := ParseDisbursementDateRange(args)
+	dateRange, err := ParseDisbursementDateRange(args)
 	require.Error(t, err)
-	require.Nil(t, from)
-	require.Nil(t, to)
+	require.Nil(t, dateRange)
 	require.Contains(t, err.Error(), "error parsing ORDERS_TO")
 }
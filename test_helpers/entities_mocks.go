@@ -11,6 +11,7 @@ func SetupOrderTemplate() entities.Order {
 		ID:         "an_order_id",
 		MerchantID: uuid.New(),
 		Amount:     1.01,
+		Currency:   entities.DefaultCurrency,
 		CreatedAt:  time.Now(),
 	}
 }
@@ -22,6 +23,7 @@ func SetupMerchantTemplate() entities.Merchant {
 		LiveAt:                time.Now(),
 		DisbursementFrequency: "weekly",
 		MinimumMonthlyFee:     1.01,
+		Currency:              entities.DefaultCurrency,
 		CreatedAt:             time.Now(),
 		UpdatedAt:             time.Now(),
 	}
@@ -1,31 +1,62 @@
 package test_helpers
 
 import (
-	"github.com/stretchr/testify/assert"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"strings"
+	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 // captureLogs is a type that implements the io.Writer interface
-// to capture log output.
+// to capture log output. Used as the output of a JSON logger it
+// also gives access to the structured records.
 type captureLogs struct {
+	mu   sync.Mutex
 	logs *[]string
 }
 
 func NewLogMocker() *captureLogs {
 	var logs []string
-	return &captureLogs{&logs}
+	return &captureLogs{logs: &logs}
+}
+
+// Logger returns a JSON logger writing every level to the capture
+// Tests install it with slog.SetDefault before creating the pipelines
+func (c *captureLogs) Logger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(c, &slog.HandlerOptions{Level: slog.LevelDebug}))
 }
 
 func (c *captureLogs) Write(p []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	*c.logs = append(*c.logs, string(p))
 	return len(p), nil
 }
 
 func (c *captureLogs) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	return strings.Join(*c.logs, "")
 }
 
+// Records returns the captured JSON records, lines which are not JSON are skipped
+func (c *captureLogs) Records() []map[string]any {
+	var records []map[string]any
+	for _, line := range strings.Split(c.String(), "\n") {
+		var record map[string]any
+		if json.Unmarshal([]byte(line), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
 func (c *captureLogs) AssertContains(t *testing.T, match string) {
 	assert.Contains(t, c.String(), match)
 }
@@ -33,3 +64,34 @@ func (c *captureLogs) AssertContains(t *testing.T, match string) {
 func (c *captureLogs) AssertNotContains(t *testing.T, match string) {
 	assert.NotContains(t, c.String(), match)
 }
+
+// AssertRecord checks that a record has the message and, at least, the given fields
+// Field values are compared by their text, so numbers and IDs can be given with their Go types
+func (c *captureLogs) AssertRecord(t *testing.T, msg string, fields map[string]any) {
+	for _, record := range c.Records() {
+		if record[slog.MessageKey] == msg && hasFields(record, fields) {
+			return
+		}
+	}
+	assert.Fail(t, "log record not found", "message %q with fields %v in:\n%s", msg, fields, c.String())
+}
+
+// AssertNoRecord checks that no record has the message
+func (c *captureLogs) AssertNoRecord(t *testing.T, msg string) {
+	for _, record := range c.Records() {
+		if record[slog.MessageKey] == msg {
+			assert.Fail(t, "unexpected log record", "message %q in:\n%s", msg, c.String())
+			return
+		}
+	}
+}
+
+func hasFields(record map[string]any, fields map[string]any) bool {
+	for key, expected := range fields {
+		value, exists := record[key]
+		if !exists || fmt.Sprint(value) != fmt.Sprint(expected) {
+			return false
+		}
+	}
+	return true
+}
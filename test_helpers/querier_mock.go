@@ -21,6 +21,8 @@ func NewMockQuerier() *mockQuerier {
 
 	mocked.keys["orders"] = make(map[string]interface{})
 	mocked.keys["disbursement"] = make(map[string]interface{})
+	mocked.keys["refunds"] = make(map[string]interface{})
+	mocked.keys["chargebacks"] = make(map[string]interface{})
 
 	return mocked
 }
@@ -29,6 +31,36 @@ func (m *mockQuerier) Close() {
 	m.Called()
 }
 
+func (m *mockQuerier) Ping(ctx context.Context) error {
+	args := m.Called(ctx)
+
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) AcquireLock(ctx context.Context, name string, wait bool) error {
+	args := m.Called(ctx, name, wait)
+
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) ReleaseLock(ctx context.Context, name string) error {
+	args := m.Called(ctx, name)
+
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
 func (m *mockQuerier) CountMerchants(ctx context.Context) (int64, error) {
 	args := m.Called(ctx)
 	if len(args) > 0 && args.Get(1) != nil {
@@ -38,6 +70,24 @@ func (m *mockQuerier) CountMerchants(ctx context.Context) (int64, error) {
 	return 1, nil
 }
 
+func (m *mockQuerier) SelectMerchants(ctx context.Context) ([]entities.Merchant, error) {
+	args := m.Called(ctx)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.Merchant), nil
+	}
+
+	var merchants []entities.Merchant
+	for _, merchant := range m.keys["merchant"] {
+		merchants = append(merchants, merchant.(entities.Merchant))
+	}
+
+	return merchants, nil
+}
+
 func (m *mockQuerier) SelectMerchantByReference(ctx context.Context, reference string) (*entities.Merchant, error) {
 	args := m.Called(ctx, reference)
 
@@ -156,25 +206,580 @@ func (m *mockQuerier) SelectSumDisbursements(ctx context.Context, from, to time.
 	return []entities.MerchantDisbursement{}, nil
 }
 
-func (m *mockQuerier) MarkOrdersAsDisbursed(ctx context.Context, day time.Time) error {
+func (m *mockQuerier) SelectSumDisbursementsForMerchant(ctx context.Context, merchantId uuid.UUID, currency string, from, to time.Time, frequency entities.DisbursementFrequencies) (*entities.MerchantDisbursement, error) {
+	args := m.Called(ctx, merchantId, currency, from, to, frequency)
+
+	if len(args) > 0 && args.Get(1) != nil {
+		return &entities.MerchantDisbursement{}, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(*entities.MerchantDisbursement), nil
+	}
+
+	return nil, nil
+}
+
+func (m *mockQuerier) SelectDisbursements(ctx context.Context, filter entities.DisbursementFilter) ([]entities.MerchantDisbursement, error) {
+	args := m.Called(ctx, filter)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.MerchantDisbursement), nil
+	}
+
+	return []entities.MerchantDisbursement{}, nil
+}
+
+func (m *mockQuerier) CountDisbursements(ctx context.Context, filter entities.DisbursementFilter) (int64, error) {
+	args := m.Called(ctx, filter)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return 0, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(int64), nil
+	}
+
+	return 0, nil
+}
+
+func (m *mockQuerier) SelectDisbursementByReference(ctx context.Context, reference string) (*entities.MerchantDisbursement, error) {
+	args := m.Called(ctx, reference)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(*entities.MerchantDisbursement), nil
+	}
+
+	return nil, nil
+}
+
+func (m *mockQuerier) SelectDisbursedOrders(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Order, error) {
+	args := m.Called(ctx, merchantID, from, to)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.Order), nil
+	}
+
+	return []entities.Order{}, nil
+}
+
+func (m *mockQuerier) InsertRefund(ctx context.Context, refund entities.Refund) error {
+	args := m.Called(ctx, refund)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	m.keys["refunds"][refund.ID] = refund
+
+	return nil
+}
+
+func (m *mockQuerier) SelectRefund(ctx context.Context, id string) (*entities.Refund, error) {
+	args := m.Called(ctx, id)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(*entities.Refund), nil
+	}
+
+	if refund, found := m.keys["refunds"][id]; found {
+		_refund := refund.(entities.Refund)
+		return &_refund, nil
+	}
+
+	return nil, nil
+}
+
+func (m *mockQuerier) SelectOrderRefunds(ctx context.Context, orderID string) ([]entities.Refund, error) {
+	args := m.Called(ctx, orderID)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.Refund), nil
+	}
+
+	refunds := []entities.Refund{}
+	for _, refund := range m.keys["refunds"] {
+		if refund.(entities.Refund).OrderID == orderID {
+			refunds = append(refunds, refund.(entities.Refund))
+		}
+	}
+
+	return refunds, nil
+}
+
+func (m *mockQuerier) SelectSumRefunds(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error) {
 	args := m.Called(ctx, day)
 
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.MerchantDisbursement), nil
+	}
+
+	return []entities.MerchantDisbursement{}, nil
+}
+
+func (m *mockQuerier) SelectDeductedRefunds(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Refund, error) {
+	args := m.Called(ctx, merchantID, from, to)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.Refund), nil
+	}
+
+	return []entities.Refund{}, nil
+}
+
+func (m *mockQuerier) InsertChargeback(ctx context.Context, chargeback entities.Chargeback) error {
+	args := m.Called(ctx, chargeback)
 	if len(args) > 0 && args.Get(0) != nil {
 		return args.Error(0)
 	}
 
+	m.keys["chargebacks"][chargeback.ID] = chargeback
+
 	return nil
 }
 
-func (m *mockQuerier) SelectSumDisbursementsForMerchant(ctx context.Context, merchantId uuid.UUID, from, to time.Time, frequency entities.DisbursementFrequencies) (*entities.MerchantDisbursement, error) {
-	args := m.Called(ctx, merchantId, merchantId, from, to, frequency)
+func (m *mockQuerier) SelectChargeback(ctx context.Context, id string) (*entities.Chargeback, error) {
+	args := m.Called(ctx, id)
 
-	if len(args) > 0 && args.Get(1) != nil {
-		return &entities.MerchantDisbursement{}, args.Error(1)
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
 	}
 	if len(args) > 0 && args.Get(0) != nil {
-		return args.Get(0).(*entities.MerchantDisbursement), nil
+		return args.Get(0).(*entities.Chargeback), nil
+	}
+
+	if chargeback, found := m.keys["chargebacks"][id]; found {
+		_chargeback := chargeback.(entities.Chargeback)
+		return &_chargeback, nil
 	}
 
 	return nil, nil
 }
+
+func (m *mockQuerier) SelectOrderChargebacks(ctx context.Context, orderID string) ([]entities.Chargeback, error) {
+	args := m.Called(ctx, orderID)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.Chargeback), nil
+	}
+
+	chargebacks := []entities.Chargeback{}
+	for _, chargeback := range m.keys["chargebacks"] {
+		if chargeback.(entities.Chargeback).OrderID == orderID {
+			chargebacks = append(chargebacks, chargeback.(entities.Chargeback))
+		}
+	}
+
+	return chargebacks, nil
+}
+
+func (m *mockQuerier) SelectSumChargebacks(ctx context.Context, day time.Time) ([]entities.MerchantDisbursement, error) {
+	args := m.Called(ctx, day)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.MerchantDisbursement), nil
+	}
+
+	return []entities.MerchantDisbursement{}, nil
+}
+
+func (m *mockQuerier) SelectDeductedChargebacks(ctx context.Context, merchantID uuid.UUID, from, to time.Time) ([]entities.Chargeback, error) {
+	args := m.Called(ctx, merchantID, from, to)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.Chargeback), nil
+	}
+
+	return []entities.Chargeback{}, nil
+}
+
+func (m *mockQuerier) SelectMerchantBalance(ctx context.Context, merchantID uuid.UUID, currency string) (float64, error) {
+	args := m.Called(ctx, merchantID, currency)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return 0, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(float64), nil
+	}
+
+	return 0, nil
+}
+
+func (m *mockQuerier) SelectBalanceEntries(ctx context.Context, merchantID uuid.UUID) ([]entities.MerchantBalanceEntry, error) {
+	args := m.Called(ctx, merchantID)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.MerchantBalanceEntry), nil
+	}
+
+	return []entities.MerchantBalanceEntry{}, nil
+}
+
+func (m *mockQuerier) SelectMerchantDebts(ctx context.Context) ([]entities.MerchantDebt, error) {
+	args := m.Called(ctx)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.MerchantDebt), nil
+	}
+
+	return []entities.MerchantDebt{}, nil
+}
+
+func (m *mockQuerier) SelectLedgerBalances(ctx context.Context) ([]entities.LedgerBalance, error) {
+	args := m.Called(ctx)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.LedgerBalance), nil
+	}
+
+	return []entities.LedgerBalance{}, nil
+}
+
+func (m *mockQuerier) SelectLedgerTotals(ctx context.Context) ([]entities.LedgerTotals, error) {
+	args := m.Called(ctx)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.LedgerTotals), nil
+	}
+
+	return []entities.LedgerTotals{}, nil
+}
+
+func (m *mockQuerier) SelectMerchantPayables(ctx context.Context) ([]entities.MerchantPayable, error) {
+	args := m.Called(ctx)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.MerchantPayable), nil
+	}
+
+	return []entities.MerchantPayable{}, nil
+}
+
+func (m *mockQuerier) SelectIdempotencyKey(ctx context.Context, key string) (*entities.IdempotencyKey, error) {
+	args := m.Called(ctx, key)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(*entities.IdempotencyKey), nil
+	}
+
+	return nil, nil
+}
+
+func (m *mockQuerier) ReserveIdempotencyKey(ctx context.Context, key, requestHash string) (bool, error) {
+	args := m.Called(ctx, key, requestHash)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return false, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Bool(0), nil
+	}
+
+	return true, nil
+}
+
+func (m *mockQuerier) CompleteIdempotencyKey(ctx context.Context, idempotencyKey entities.IdempotencyKey) error {
+	args := m.Called(ctx, idempotencyKey)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	args := m.Called(ctx, key)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) SelectYearlyReport(ctx context.Context, year int) ([]entities.YearlyReport, error) {
+	args := m.Called(ctx, year)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.YearlyReport), nil
+	}
+
+	return []entities.YearlyReport{}, nil
+}
+
+func (m *mockQuerier) InsertBankAccount(ctx context.Context, account *entities.MerchantBankAccount) error {
+	args := m.Called(ctx, account)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) SelectBankAccount(ctx context.Context, id uuid.UUID) (*entities.MerchantBankAccount, error) {
+	args := m.Called(ctx, id)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(*entities.MerchantBankAccount), nil
+	}
+
+	return nil, nil
+}
+
+func (m *mockQuerier) SelectBankAccounts(ctx context.Context, merchantID uuid.UUID) ([]entities.MerchantBankAccount, error) {
+	args := m.Called(ctx, merchantID)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.MerchantBankAccount), nil
+	}
+
+	return []entities.MerchantBankAccount{}, nil
+}
+
+func (m *mockQuerier) UpdateBankAccount(ctx context.Context, account *entities.MerchantBankAccount, change string) error {
+	args := m.Called(ctx, account, change)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) SelectBankAccountChanges(ctx context.Context, merchantID uuid.UUID) ([]entities.BankAccountChange, error) {
+	args := m.Called(ctx, merchantID)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.BankAccountChange), nil
+	}
+
+	return []entities.BankAccountChange{}, nil
+}
+
+func (m *mockQuerier) MarkDisbursementsPayable(ctx context.Context, until time.Time) (int64, error) {
+	args := m.Called(ctx, until)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return 0, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(int64), nil
+	}
+
+	return 0, nil
+}
+
+func (m *mockQuerier) SelectUnpayableDisbursements(ctx context.Context, until time.Time) ([]entities.MerchantDisbursement, error) {
+	args := m.Called(ctx, until)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.MerchantDisbursement), nil
+	}
+
+	return []entities.MerchantDisbursement{}, nil
+}
+
+func (m *mockQuerier) SelectPayableDisbursements(ctx context.Context, until time.Time) ([]entities.PayableDisbursement, error) {
+	args := m.Called(ctx, until)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.PayableDisbursement), nil
+	}
+
+	return []entities.PayableDisbursement{}, nil
+}
+
+func (m *mockQuerier) InsertPayoutBatch(ctx context.Context, batch *entities.PayoutBatch, instructions []entities.PayoutInstruction) error {
+	args := m.Called(ctx, batch, instructions)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) TransitionDisbursement(ctx context.Context, change *entities.DisbursementStatusChange) error {
+	args := m.Called(ctx, change)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) SelectDisbursementStatusChanges(ctx context.Context, disbursementID uuid.UUID) ([]entities.DisbursementStatusChange, error) {
+	args := m.Called(ctx, disbursementID)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.DisbursementStatusChange), nil
+	}
+
+	return []entities.DisbursementStatusChange{}, nil
+}
+
+func (m *mockQuerier) SelectBankStatementByHash(ctx context.Context, hash string) (*entities.BankStatement, error) {
+	args := m.Called(ctx, hash)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(*entities.BankStatement), nil
+	}
+
+	return nil, nil
+}
+
+func (m *mockQuerier) InsertBankStatement(ctx context.Context, statement *entities.BankStatement, entries []entities.BankStatementEntry, changes []*entities.DisbursementStatusChange) error {
+	args := m.Called(ctx, statement, entries, changes)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) SelectReconciliationEntries(ctx context.Context, filter entities.ReconciliationFilter) ([]entities.ReconciliationEntry, error) {
+	args := m.Called(ctx, filter)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.ReconciliationEntry), nil
+	}
+
+	return []entities.ReconciliationEntry{}, nil
+}
+
+func (m *mockQuerier) UpdateMerchantWebhook(ctx context.Context, merchantID uuid.UUID, url, secret string) error {
+	args := m.Called(ctx, merchantID, url, secret)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) UpdateMerchantCurrency(ctx context.Context, merchantID uuid.UUID, currency string) error {
+	args := m.Called(ctx, merchantID, currency)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
+
+func (m *mockQuerier) SelectDueOutboxEvents(ctx context.Context, now time.Time, limit int) ([]entities.OutboxEvent, error) {
+	args := m.Called(ctx, now, limit)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.OutboxEvent), nil
+	}
+
+	return []entities.OutboxEvent{}, nil
+}
+
+func (m *mockQuerier) SelectOutboxEvent(ctx context.Context, id uuid.UUID) (*entities.OutboxEvent, error) {
+	args := m.Called(ctx, id)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).(*entities.OutboxEvent), nil
+	}
+
+	return nil, nil
+}
+
+func (m *mockQuerier) SelectOutboxEvents(ctx context.Context, filter entities.OutboxFilter) ([]entities.OutboxEvent, error) {
+	args := m.Called(ctx, filter)
+
+	if len(args) > 1 && args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Get(0).([]entities.OutboxEvent), nil
+	}
+
+	return []entities.OutboxEvent{}, nil
+}
+
+func (m *mockQuerier) UpdateOutboxEvent(ctx context.Context, event *entities.OutboxEvent) error {
+	args := m.Called(ctx, event)
+	if len(args) > 0 && args.Get(0) != nil {
+		return args.Error(0)
+	}
+
+	return nil
+}
@@ -0,0 +1,264 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/metrics"
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+var (
+	ErrorEventNotFound  = errors.New("outbox event not found")
+	ErrorNotRetryable   = errors.New("outbox event cannot be retried")
+	ErrorDeliveryFailed = errors.New("webhook delivery failed")
+)
+
+// Results of the events processed by the dispatcher, as counted in the metrics
+const (
+	ResultDelivered = "delivered"
+	ResultRetried   = "retried"
+	ResultDead      = "dead"
+	ResultSkipped   = "skipped"
+)
+
+// batchSize is the number of due events selected at a time
+const batchSize = 100
+
+// Delivery is the body posted to the webhook of the merchant
+type Delivery struct {
+	ID        uuid.UUID       `json:"id"` // Same for every attempt, so the merchant can ignore the duplicates
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Merchant  string          `json:"merchant"`
+	Data      json.RawMessage `json:"data"` // The entities.DisbursementEventData
+}
+
+// DispatchResult counts the events processed by a dispatch
+type DispatchResult struct {
+	Delivered int
+	Retried   int
+	Dead      int
+	Skipped   int
+}
+
+func (r DispatchResult) String() string {
+	return fmt.Sprintf("delivered: %d, retried: %d, dead: %d, skipped: %d", r.Delivered, r.Retried, r.Dead, r.Skipped)
+}
+
+// Dispatcher delivers the outbox events to the webhooks of the merchants, retrying the failed deliveries
+type Dispatcher struct {
+	querier database.Querier
+	client  *http.Client
+	cfg     system.WebhooksConfig
+	logger  *slog.Logger
+	now     func() time.Time
+}
+
+// NewDispatcher creates a dispatcher with the timeout, attempts and backoff of the config
+func NewDispatcher(querier database.Querier, cfg system.WebhooksConfig) *Dispatcher {
+	return &Dispatcher{
+		querier: querier,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		cfg:     cfg,
+		logger:  system.ComponentLogger("webhooks"),
+		now:     time.Now,
+	}
+}
+
+// Dispatch delivers the events due, until none is left
+// A failed delivery is retried after a backoff doubling on each failure. After the maximum attempts the event is dead,
+// and only delivered again when retried by hand. The events of merchants without a webhook are skipped.
+func (d *Dispatcher) Dispatch(ctx context.Context) (DispatchResult, error) {
+	var result DispatchResult
+	merchants := make(map[uuid.UUID]*entities.Merchant)
+
+	for {
+		events, err := d.querier.SelectDueOutboxEvents(ctx, d.now(), batchSize)
+		if err != nil {
+			return result, fmt.Errorf("error selecting outbox events: %w", err)
+		}
+
+		for i := range events {
+			event := &events[i]
+
+			merchant, found := merchants[event.MerchantID]
+			if !found {
+				merchant, err = d.querier.SelectMerchant(ctx, event.MerchantID)
+				if err != nil {
+					return result, fmt.Errorf("error selecting merchant: %w", err)
+				}
+				merchants[event.MerchantID] = merchant
+			}
+
+			outcome := d.deliver(ctx, event, merchant)
+			err = d.querier.UpdateOutboxEvent(ctx, event)
+			if err != nil {
+				return result, fmt.Errorf("error updating outbox event %s: %w", event.ID, err)
+			}
+			metrics.ObserveWebhookDelivery(outcome)
+
+			switch outcome {
+			case ResultDelivered:
+				result.Delivered++
+			case ResultRetried:
+				result.Retried++
+			case ResultDead:
+				result.Dead++
+			case ResultSkipped:
+				result.Skipped++
+			}
+		}
+
+		if len(events) < batchSize || ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+	}
+}
+
+// Watch dispatches the due events until the context is done, pausing between each dispatch
+// Only one dispatcher delivers at a time, the others wait for the lock and take over when it is released.
+func (d *Dispatcher) Watch(ctx context.Context) {
+	err := d.querier.AcquireLock(ctx, database.WebhooksLockName, true)
+	if err != nil {
+		if ctx.Err() == nil {
+			d.logger.Error("error acquiring the webhooks lock", system.LogErrorKey, err)
+		}
+		return
+	}
+	defer d.querier.ReleaseLock(context.Background(), database.WebhooksLockName) //nolint:errcheck
+
+	d.logger.Info("watching outbox events", "job_pause", d.cfg.JobPause.String())
+	for {
+		result, err := d.Dispatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			d.logger.Error("error dispatching outbox events", system.LogErrorKey, err)
+		}
+		if result != (DispatchResult{}) {
+			d.logger.Info("outbox events dispatched", "result", result.String())
+		}
+
+		select {
+		case <-ctx.Done():
+			d.logger.Info("stopping watching outbox events")
+			return
+		case <-time.After(d.cfg.JobPause):
+		}
+	}
+}
+
+// Retry makes a dead or skipped event pending again, delivered on the next dispatch with its attempts reset
+func (d *Dispatcher) Retry(ctx context.Context, id uuid.UUID) (*entities.OutboxEvent, error) {
+	event, err := d.querier.SelectOutboxEvent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if event == nil {
+		return nil, fmt.Errorf("%w: %s", ErrorEventNotFound, id)
+	}
+	if event.Status != entities.DeadOutboxStatus && event.Status != entities.SkippedOutboxStatus {
+		return nil, fmt.Errorf("%w: the event is %s", ErrorNotRetryable, event.Status)
+	}
+
+	event.Status = entities.PendingOutboxStatus
+	event.Attempts = 0
+	event.NextAttemptAt = d.now()
+	err = d.querier.UpdateOutboxEvent(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// deliver posts an event to the webhook of its merchant, and updates its delivery status
+func (d *Dispatcher) deliver(ctx context.Context, event *entities.OutboxEvent, merchant *entities.Merchant) string {
+	now := d.now()
+	logger := d.logger.With("event_id", event.ID, "event_type", event.EventType, system.LogMerchantIDKey, event.MerchantID)
+
+	if merchant == nil || merchant.WebhookURL == "" {
+		event.Status = entities.SkippedOutboxStatus
+		event.LastError = "the merchant has no webhook"
+		return ResultSkipped
+	}
+
+	event.Attempts++
+	err := d.post(ctx, event, merchant, now)
+	if err == nil {
+		event.Status = entities.DeliveredOutboxStatus
+		event.DeliveredAt = &now
+		event.LastError = ""
+		return ResultDelivered
+	}
+
+	event.LastError = err.Error()
+	if event.Attempts >= d.cfg.MaxAttempts {
+		event.Status = entities.DeadOutboxStatus
+		logger.Error("webhook delivery failed, giving up", "attempts", event.Attempts, system.LogErrorKey, err)
+		return ResultDead
+	}
+
+	event.NextAttemptAt = now.Add(d.backoff(event.Attempts))
+	logger.Warn("webhook delivery failed, retrying",
+		"attempts", event.Attempts,
+		"next_attempt_at", event.NextAttemptAt.Format(time.RFC3339),
+		system.LogErrorKey, err)
+	return ResultRetried
+}
+
+// post sends the signed delivery, the webhook must respond with a 2xx status
+func (d *Dispatcher) post(ctx context.Context, event *entities.OutboxEvent, merchant *entities.Merchant, now time.Time) error {
+	body, err := json.Marshal(Delivery{
+		ID:        event.ID,
+		Type:      event.EventType,
+		CreatedAt: event.CreatedAt.UTC(),
+		Merchant:  merchant.Reference,
+		Data:      event.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, merchant.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := now.Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "disbursement-webhooks")
+	request.Header.Set(EventHeader, event.EventType)
+	request.Header.Set(DeliveryHeader, event.ID.String())
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, Sign(merchant.WebhookSecret, timestamp, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorDeliveryFailed, err)
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%w: the webhook responded %s", ErrorDeliveryFailed, response.Status)
+	}
+	return nil
+}
+
+// backoff is the pause after a failed attempt: the initial backoff, doubled on each failure up to the maximum
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.cfg.InitialBackoff
+	for i := 1; i < attempts && backoff < d.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.cfg.MaxBackoff)
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ildomm/cc_sq_disbursement/database"
+	"github.com/ildomm/cc_sq_disbursement/entities"
+	"github.com/ildomm/cc_sq_disbursement/system"
+	"github.com/ildomm/cc_sq_disbursement/test_helpers"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testConfig = system.WebhooksConfig{
+	JobPause:       time.Second,
+	Timeout:        time.Second,
+	MaxAttempts:    3,
+	InitialBackoff: 30 * time.Second,
+	MaxBackoff:     time.Minute,
+}
+
+func setupEvent(t *testing.T, merchantID uuid.UUID, eventType string) entities.OutboxEvent {
+	disbursement := entities.MerchantDisbursement{
+		ID:         uuid.New(),
+		Reference:  "DSB-20230115-00000001",
+		MerchantID: merchantID,
+		NetAmount:  99.1,
+		Status:     entities.SentDisbursementStatus,
+	}
+	event, err := entities.NewDisbursementEvent(eventType, disbursement, entities.ApprovedDisbursementStatus)
+	require.NoError(t, err)
+	event.ID = uuid.New()
+	event.CreatedAt = time.Date(2023, 1, 16, 8, 0, 0, 0, time.UTC)
+	return event
+}
+
+// recordUpdates records a copy of each outbox event updated
+func recordUpdates(updated *[]entities.OutboxEvent) func(mock.Arguments) {
+	return func(args mock.Arguments) {
+		*updated = append(*updated, *args.Get(1).(*entities.OutboxEvent))
+	}
+}
+
+// setupDispatcher returns a dispatcher at a fixed time
+func setupDispatcher(querier database.Querier, now time.Time) *Dispatcher {
+	dispatcher := NewDispatcher(querier, testConfig)
+	dispatcher.now = func() time.Time { return now }
+	return dispatcher
+}
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	receiver := NewReceiver("whsec_test")
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	merchant := &entities.Merchant{ID: uuid.New(), Reference: "merchant_a", WebhookURL: server.URL, WebhookSecret: "whsec_test"}
+	withoutWebhook := &entities.Merchant{ID: uuid.New(), Reference: "merchant_b"}
+	sent := setupEvent(t, merchant.ID, entities.DisbursementSentEvent)
+	skipped := setupEvent(t, withoutWebhook.ID, entities.DisbursementCreatedEvent)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDueOutboxEvents", ctx, now, batchSize).Return([]entities.OutboxEvent{sent, skipped}, nil)
+	mockQuerier.On("SelectMerchant", ctx, merchant.ID).Return(merchant, nil)
+	mockQuerier.On("SelectMerchant", ctx, withoutWebhook.ID).Return(withoutWebhook, nil)
+
+	var updated []entities.OutboxEvent
+	mockQuerier.On("UpdateOutboxEvent", ctx, mock.Anything).Run(recordUpdates(&updated)).Return(nil)
+
+	result, err := setupDispatcher(mockQuerier, now).Dispatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, DispatchResult{Delivered: 1, Skipped: 1}, result)
+
+	require.Len(t, updated, 2)
+	require.Equal(t, entities.DeliveredOutboxStatus, updated[0].Status)
+	require.Equal(t, 1, updated[0].Attempts)
+	require.Equal(t, now, *updated[0].DeliveredAt)
+	require.Equal(t, entities.SkippedOutboxStatus, updated[1].Status)
+	require.Equal(t, 0, updated[1].Attempts)
+
+	deliveries := receiver.Deliveries()
+	require.Len(t, deliveries, 1)
+	require.Equal(t, sent.ID, deliveries[0].ID)
+	require.Equal(t, entities.DisbursementSentEvent, deliveries[0].Type)
+	require.Equal(t, "merchant_a", deliveries[0].Merchant)
+
+	var data entities.DisbursementEventData
+	require.NoError(t, json.Unmarshal(deliveries[0].Data, &data))
+	require.Equal(t, "DSB-20230115-00000001", data.Reference)
+	require.Equal(t, 99.1, data.NetAmount)
+	require.Equal(t, "sent", data.Status)
+	require.Equal(t, "approved", data.PreviousStatus)
+}
+
+func TestDispatchRetriesWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	receiver := NewReceiver("whsec_test")
+	receiver.FailNext(testConfig.MaxAttempts)
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	merchant := &entities.Merchant{ID: uuid.New(), Reference: "merchant_a", WebhookURL: server.URL, WebhookSecret: "whsec_test"}
+	event := setupEvent(t, merchant.ID, entities.DisbursementSettledEvent)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchant", ctx, merchant.ID).Return(merchant, nil)
+	var updated []entities.OutboxEvent
+	mockQuerier.On("UpdateOutboxEvent", ctx, mock.Anything).Run(recordUpdates(&updated)).Return(nil)
+	dispatcher := setupDispatcher(mockQuerier, now)
+
+	// Each failed attempt delays the next one, doubling the backoff up to the maximum
+	expectedBackoffs := []time.Duration{30 * time.Second, time.Minute}
+	for attempt, backoff := range expectedBackoffs {
+		mockQuerier.On("SelectDueOutboxEvents", ctx, now, batchSize).Return([]entities.OutboxEvent{event}, nil).Once()
+
+		result, err := dispatcher.Dispatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, DispatchResult{Retried: 1}, result)
+
+		event = updated[attempt]
+		require.Equal(t, entities.PendingOutboxStatus, event.Status)
+		require.Equal(t, attempt+1, event.Attempts)
+		require.Equal(t, now.Add(backoff), event.NextAttemptAt)
+		require.Contains(t, event.LastError, "503")
+	}
+
+	// The last attempt gives up
+	mockQuerier.On("SelectDueOutboxEvents", ctx, now, batchSize).Return([]entities.OutboxEvent{event}, nil).Once()
+	result, err := dispatcher.Dispatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, DispatchResult{Dead: 1}, result)
+	event = updated[2]
+	require.Equal(t, entities.DeadOutboxStatus, event.Status)
+	require.Equal(t, 3, event.Attempts)
+	require.Empty(t, receiver.Deliveries())
+
+	// Retried by hand, it is delivered on the next dispatch
+	mockQuerier.On("SelectOutboxEvent", ctx, event.ID).Return(&event, nil).Once()
+	retried, err := dispatcher.Retry(ctx, event.ID)
+	require.NoError(t, err)
+	require.Equal(t, entities.PendingOutboxStatus, retried.Status)
+	require.Equal(t, 0, retried.Attempts)
+
+	mockQuerier.On("SelectDueOutboxEvents", ctx, now, batchSize).Return([]entities.OutboxEvent{*retried}, nil).Once()
+	result, err = dispatcher.Dispatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, DispatchResult{Delivered: 1}, result)
+	require.Len(t, receiver.Deliveries(), 1)
+}
+
+func TestDispatchRejectedSignature(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	server := httptest.NewServer(NewReceiver("whsec_rotated"))
+	defer server.Close()
+
+	merchant := &entities.Merchant{ID: uuid.New(), Reference: "merchant_a", WebhookURL: server.URL, WebhookSecret: "whsec_test"}
+	event := setupEvent(t, merchant.ID, entities.DisbursementFailedEvent)
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectDueOutboxEvents", ctx, now, batchSize).Return([]entities.OutboxEvent{event}, nil)
+	mockQuerier.On("SelectMerchant", ctx, merchant.ID).Return(merchant, nil)
+
+	var updated []entities.OutboxEvent
+	mockQuerier.On("UpdateOutboxEvent", ctx, mock.Anything).Run(recordUpdates(&updated)).Return(nil)
+
+	result, err := setupDispatcher(mockQuerier, now).Dispatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, DispatchResult{Retried: 1}, result)
+	require.Contains(t, updated[0].LastError, "401")
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	mockQuerier := test_helpers.NewMockQuerier()
+	dispatcher := NewDispatcher(mockQuerier, testConfig)
+
+	missing := uuid.New()
+	mockQuerier.On("SelectOutboxEvent", ctx, missing).Return(nil, nil)
+	_, err := dispatcher.Retry(ctx, missing)
+	require.True(t, errors.Is(err, ErrorEventNotFound))
+
+	delivered := setupEvent(t, uuid.New(), entities.DisbursementSentEvent)
+	delivered.Status = entities.DeliveredOutboxStatus
+	mockQuerier.On("SelectOutboxEvent", ctx, delivered.ID).Return(&delivered, nil)
+	_, err = dispatcher.Retry(ctx, delivered.ID)
+	require.True(t, errors.Is(err, ErrorNotRetryable))
+}
+
+func TestSetMerchantWebhook(t *testing.T) {
+	ctx := context.Background()
+	merchant := &entities.Merchant{ID: uuid.New(), Reference: "merchant_a"}
+
+	mockQuerier := test_helpers.NewMockQuerier()
+	mockQuerier.On("SelectMerchantByReference", ctx, "merchant_a").Return(merchant, nil)
+	mockQuerier.On("SelectMerchantByReference", ctx, "unknown").Return(nil, nil)
+	mockQuerier.On("UpdateMerchantWebhook", ctx, merchant.ID, "https://merchant.example/hooks", mock.Anything).Return(nil)
+
+	secret, err := SetMerchantWebhook(ctx, mockQuerier, "merchant_a", "https://merchant.example/hooks")
+	require.NoError(t, err)
+	require.NotEmpty(t, secret)
+	mockQuerier.AssertCalled(t, "UpdateMerchantWebhook", ctx, merchant.ID, "https://merchant.example/hooks", secret)
+
+	_, err = SetMerchantWebhook(ctx, mockQuerier, "unknown", "https://merchant.example/hooks")
+	require.True(t, errors.Is(err, ErrorMerchantNotFound))
+
+	_, err = SetMerchantWebhook(ctx, mockQuerier, "merchant_a", "merchant.example/hooks")
+	require.True(t, errors.Is(err, ErrorInvalidURL))
+}
@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/ildomm/cc_sq_disbursement/database"
+)
+
+var (
+	ErrorMerchantNotFound = errors.New("merchant not found")
+	ErrorInvalidURL       = errors.New("invalid webhook url")
+)
+
+// ValidateURL checks the webhook is an absolute http or https URL
+func ValidateURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrorInvalidURL, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%w: %q, expected an absolute http or https url", ErrorInvalidURL, value)
+	}
+	return nil
+}
+
+// SetMerchantWebhook sets the webhook of a merchant with a new secret, returned to be shared with the merchant
+// Setting the webhook again rotates the secret.
+func SetMerchantWebhook(ctx context.Context, querier database.Querier, reference, webhookURL string) (string, error) {
+	err := ValidateURL(webhookURL)
+	if err != nil {
+		return "", err
+	}
+
+	merchant, err := querier.SelectMerchantByReference(ctx, reference)
+	if err != nil {
+		return "", err
+	}
+	if merchant == nil {
+		return "", fmt.Errorf("%w: %q", ErrorMerchantNotFound, reference)
+	}
+
+	secret, err := NewSecret()
+	if err != nil {
+		return "", err
+	}
+	err = querier.UpdateMerchantWebhook(ctx, merchant.ID, webhookURL, secret)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// RemoveMerchantWebhook stops notifying a merchant, its next events are skipped
+func RemoveMerchantWebhook(ctx context.Context, querier database.Querier, reference string) error {
+	merchant, err := querier.SelectMerchantByReference(ctx, reference)
+	if err != nil {
+		return err
+	}
+	if merchant == nil {
+		return fmt.Errorf("%w: %q", ErrorMerchantNotFound, reference)
+	}
+	return querier.UpdateMerchantWebhook(ctx, merchant.ID, "", "")
+}
@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ildomm/cc_sq_disbursement/system"
+)
+
+// DefaultTolerance is how old a delivery the receiver accepts
+const DefaultTolerance = 5 * time.Minute
+
+// Receiver is a stand-in for the webhook of a merchant, verifying and recording the deliveries
+// It is used to test the deliveries locally, it is not meant to be exposed.
+type Receiver struct {
+	secret    string
+	tolerance time.Duration
+	logger    *slog.Logger
+	now       func() time.Time
+
+	mu         sync.Mutex
+	deliveries []Delivery
+	failNext   int
+	onDelivery func(Delivery)
+}
+
+// NewReceiver creates a receiver verifying the deliveries with the secret of the merchant
+func NewReceiver(secret string) *Receiver {
+	return &Receiver{
+		secret:    secret,
+		tolerance: DefaultTolerance,
+		logger:    system.ComponentLogger("webhook_receiver"),
+		now:       time.Now,
+	}
+}
+
+// OnDelivery sets a function called with each delivery accepted
+func (r *Receiver) OnDelivery(onDelivery func(Delivery)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onDelivery = onDelivery
+}
+
+// FailNext makes the receiver respond with an error to the next deliveries, to simulate a merchant being down
+func (r *Receiver) FailNext(count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failNext = count
+}
+
+// Deliveries returns the deliveries accepted, in the order received
+func (r *Receiver) Deliveries() []Delivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Delivery(nil), r.deliveries...)
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = Verify(r.secret, req.Header, body, r.now(), r.tolerance)
+	if err != nil {
+		r.logger.Warn("delivery rejected", system.LogErrorKey, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var delivery Delivery
+	err = json.Unmarshal(body, &delivery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	if r.failNext > 0 {
+		r.failNext--
+		r.mu.Unlock()
+		http.Error(w, "failing on purpose", http.StatusServiceUnavailable)
+		return
+	}
+	r.deliveries = append(r.deliveries, delivery)
+	onDelivery := r.onDelivery
+	r.mu.Unlock()
+
+	if onDelivery != nil {
+		onDelivery(delivery)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers of the deliveries
+const (
+	EventHeader     = "X-Disbursement-Event"
+	DeliveryHeader  = "X-Disbursement-Delivery"
+	TimestampHeader = "X-Disbursement-Timestamp"
+	SignatureHeader = "X-Disbursement-Signature"
+)
+
+// ErrorInvalidSignature is returned when a delivery is not signed with the secret of the merchant, or is too old
+var ErrorInvalidSignature = errors.New("invalid webhook signature")
+
+// signaturePrefix names the algorithm of the signature
+const signaturePrefix = "sha256="
+
+// Sign returns the signature of a delivery: the HMAC-SHA256, with the secret of the merchant,
+// of the Unix timestamp of the delivery, a dot and the body
+// The timestamp is signed so a delivery cannot be replayed later.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery, and that it was sent within the tolerance of now
+func Verify(secret string, header http.Header, body []byte, now time.Time, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: missing or invalid %s", ErrorInvalidSignature, TimestampHeader)
+	}
+
+	expected := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(header.Get(SignatureHeader))) {
+		return fmt.Errorf("%w: the signature does not match", ErrorInvalidSignature)
+	}
+
+	sentAt := time.Unix(timestamp, 0)
+	if sentAt.Before(now.Add(-tolerance)) || sentAt.After(now.Add(tolerance)) {
+		return fmt.Errorf("%w: sent at %s, outside the tolerance of %s", ErrorInvalidSignature, sentAt.UTC().Format(time.RFC3339), tolerance)
+	}
+	return nil
+}
+
+// NewSecret generates the secret a merchant verifies the deliveries with
+func NewSecret() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(key), nil
+}
@@ -0,0 +1,68 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Date(2023, 1, 20, 10, 0, 0, 0, time.UTC)
+	body := []byte(`{"type":"disbursement.sent"}`)
+
+	signature := Sign("whsec_test", now.Unix(), body)
+	require.True(t, strings.HasPrefix(signature, "sha256="))
+	require.Len(t, signature, len("sha256=")+64)
+	require.Equal(t, signature, Sign("whsec_test", now.Unix(), body))
+
+	header := http.Header{}
+	header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	header.Set(SignatureHeader, signature)
+
+	require.NoError(t, Verify("whsec_test", header, body, now.Add(time.Minute), DefaultTolerance))
+
+	cases := map[string]struct {
+		secret string
+		body   []byte
+		now    time.Time
+	}{
+		"wrong secret":  {"whsec_other", body, now},
+		"changed body":  {"whsec_test", []byte(`{"type":"disbursement.settled"}`), now},
+		"too old":       {"whsec_test", body, now.Add(DefaultTolerance + time.Second)},
+		"in the future": {"whsec_test", body, now.Add(-DefaultTolerance - time.Second)},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := Verify(c.secret, header, c.body, c.now, DefaultTolerance)
+			require.True(t, errors.Is(err, ErrorInvalidSignature), err)
+		})
+	}
+
+	err := Verify("whsec_test", http.Header{}, body, now, DefaultTolerance)
+	require.True(t, errors.Is(err, ErrorInvalidSignature))
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(secret, "whsec_"))
+	require.Len(t, secret, len("whsec_")+64)
+
+	other, err := NewSecret()
+	require.NoError(t, err)
+	require.NotEqual(t, secret, other)
+}
+
+func TestValidateURL(t *testing.T) {
+	for _, valid := range []string{"https://merchant.example/webhooks", "http://localhost:8090/"} {
+		require.NoError(t, ValidateURL(valid), valid)
+	}
+	for _, invalid := range []string{"", "merchant.example/webhooks", "ftp://merchant.example", "https://", "://bad"} {
+		require.True(t, errors.Is(ValidateURL(invalid), ErrorInvalidURL), invalid)
+	}
+}